@@ -0,0 +1,305 @@
+// Package client is a Go client for the movies API. It covers the movie
+// endpoints with typed methods, retries requests the API didn't process
+// with backoff, and pages through listings with an iterator:
+//
+//	c := client.New("https://api.example.com", client.WithToken(os.Getenv("API_TOKEN")))
+//	it := c.Movies(client.ListMoviesOptions{Genre: "Drama"})
+//	for it.Next(ctx) {
+//		fmt.Println(it.Movie().Title)
+//	}
+//	if err := it.Err(); err != nil { ... }
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client talks to one API instance. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	http       *http.Client
+	tenant     string
+	userAgent  string
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu    sync.RWMutex
+	token string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests through hc instead of a client with a 30s
+// timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithToken authenticates requests with a bearer token: a personal access
+// token, a session token from Login, or a JWT the API accepts.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithTenant sends X-Tenant-ID, for anonymous requests to a tenant other
+// than the default one. Authenticated requests use the user's tenant.
+func WithTenant(slug string) Option {
+	return func(c *Client) { c.tenant = slug }
+}
+
+// WithRetries sets how many times a failed request is retried (default 3;
+// 0 disables retries) and the backoff between attempts, which doubles from
+// min up to max with jitter (default 200ms to 5s).
+func WithRetries(n int, min, max time.Duration) Option {
+	return func(c *Client) { c.retries, c.minBackoff, c.maxBackoff = n, min, max }
+}
+
+// WithUserAgent names the calling service in the User-Agent header, which
+// shows up in the API's access log.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// New returns a client for the API at baseURL, e.g. http://localhost:8080.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		http:       &http.Client{Timeout: 30 * time.Second},
+		userAgent:  "practice4-client",
+		retries:    3,
+		minBackoff: 200 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetToken replaces the bearer token, e.g. after signing in again.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+func (c *Client) bearer() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+// Error is a response with a 4xx or 5xx status.
+type Error struct {
+	StatusCode int
+	// Message is the API's "error" field, or the status text.
+	Message string
+	// RequestID is the X-Request-ID of the response, for bug reports.
+	RequestID string
+	// Body is the raw response, for fields specific to the endpoint.
+	Body []byte
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("api: %d %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+}
+
+// StatusCode returns the status of an *Error in err's chain, or 0.
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// IsNotFound says whether err is a 404 from the API.
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// ErrTwoFactorRequired is returned by Login when the account has two-factor
+// authentication and no (or a wrong) code was given.
+var ErrTwoFactorRequired = errors.New("api: two-factor code required")
+
+// Token is a session token issued by Login.
+type Token struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Login signs in with a password (and the current two-factor code, if the
+// account has one) and makes the client use the session token it gets.
+func (c *Client) Login(ctx context.Context, email, password, otp string) (Token, error) {
+	var tok Token
+	in := map[string]string{"email": email, "password": password}
+	if otp != "" {
+		in["otp"] = otp
+	}
+	err := c.do(ctx, http.MethodPost, "/tokens/authentication", in, &tok)
+	var e *Error
+	if errors.As(err, &e) && e.StatusCode == http.StatusUnauthorized {
+		var body struct {
+			TwoFactorRequired bool `json:"two_factor_required"`
+		}
+		if json.Unmarshal(e.Body, &body) == nil && body.TwoFactorRequired {
+			return Token{}, fmt.Errorf("%w: %s", ErrTwoFactorRequired, e.Message)
+		}
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	c.SetToken(tok.Token)
+	return tok, nil
+}
+
+// do sends a request with in as the JSON body (when not nil) and decodes the
+// response into out (when not nil).
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	_, err := c.request(ctx, method, path, in, out)
+	return err
+}
+
+// request is do for callers that need the status of a successful response.
+func (c *Client) request(ctx context.Context, method, path string, in, out any) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, body)
+		wait, retry := c.shouldRetry(method, resp, err, attempt)
+		if !retry {
+			if err != nil {
+				return 0, err
+			}
+			return resp.StatusCode, decodeResponse(resp, out)
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	return c.sendStream(ctx, method, path, rd)
+}
+
+// sendStream sends one request with body (JSON, or nil) as is, without
+// retries, for bodies too large to buffer.
+func (c *Client) sendStream(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if tok := c.bearer(); tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.tenant)
+	}
+	return c.http.Do(req)
+}
+
+// shouldRetry decides whether to try again and after how long. Requests
+// that may change something (POST) are only retried when the API says it
+// didn't process them, i.e. it answered 429 or 503 with Retry-After; the
+// others also on network errors and 502/503/504. A Retry-After longer than
+// the maximum backoff, such as an exhausted monthly quota, isn't waited out.
+func (c *Client) shouldRetry(method string, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= c.retries {
+		return 0, false
+	}
+	idempotent := method != http.MethodPost && method != http.MethodPatch
+	if err != nil {
+		return c.backoff(attempt), idempotent && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if hasRetryAfter {
+			return retryAfter, retryAfter <= c.maxBackoff
+		}
+		return c.backoff(attempt), idempotent && resp.StatusCode == http.StatusServiceUnavailable
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return c.backoff(attempt), idempotent
+	}
+	return 0, false
+}
+
+// backoff is the wait before retry attempt+1: exponential with full jitter.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.minBackoff << attempt
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	return time.Duration(rand.Int64N(int64(d)) + 1)
+}
+
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+func decodeResponse(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		e := &Error{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID"), Body: raw}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(raw, &body) == nil && body.Error != "" {
+			e.Message = body.Error
+		} else {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+		return e
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,293 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Movie is a movie as the API returns it.
+type Movie struct {
+	ID            int64           `json:"id"`
+	UUID          string          `json:"uuid"`
+	Slug          string          `json:"slug"`
+	Title         string          `json:"title"`
+	Year          int             `json:"year,omitempty"`
+	Rating        *float64        `json:"rating,omitempty"`
+	Genres        []string        `json:"genres"`
+	Certification string          `json:"certification,omitempty"`
+	ExternalIDs   *ExternalIDs    `json:"external_ids,omitempty"`
+	Metadata      json.RawMessage `json:"metadata"`
+	Views         int64           `json:"views"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// ExternalIDs link a movie to IMDb and TMDb.
+type ExternalIDs struct {
+	IMDbID string `json:"imdb_id,omitempty"`
+	TMDbID int64  `json:"tmdb_id,omitempty"`
+}
+
+// MovieInput is what CreateMovie, UpdateMovie and ImportMovies send. An
+// update replaces every field, metadata included. External IDs can only be
+// given on create and import; UpdateMovie leaves them out.
+type MovieInput struct {
+	Title         string          `json:"title"`
+	Year          int             `json:"year,omitempty"`
+	Rating        *float64        `json:"rating,omitempty"`
+	Genres        []string        `json:"genres,omitempty"`
+	Certification string          `json:"certification,omitempty"`
+	Metadata      json.RawMessage `json:"metadata,omitempty"`
+	ExternalIDs   *ExternalIDs    `json:"external_ids,omitempty"`
+}
+
+// ListMoviesOptions filter and page a movie listing. Zero values are left
+// out.
+type ListMoviesOptions struct {
+	Genre string
+	// Genres matches movies with any of them, or all with GenresMatchAll.
+	Genres         []string
+	GenresMatchAll bool
+	Tag            string
+	Certification  string
+	YearMin        int
+	YearMax        int
+	RatingMin      *float64
+	RatingMax      *float64
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	// Limit is the page size, 1 to 500; 0 means the API's default of 50.
+	Limit  int
+	Cursor string
+}
+
+// query is filters plus the page.
+func (o ListMoviesOptions) query() url.Values {
+	q := o.filters()
+	// Always page: without limit or cursor the API returns every movie.
+	limit := o.Limit
+	if limit == 0 {
+		limit = 50
+	}
+	q.Set("limit", strconv.Itoa(limit))
+	if o.Cursor != "" {
+		q.Set("cursor", o.Cursor)
+	}
+	return q
+}
+
+func (o ListMoviesOptions) filters() url.Values {
+	q := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	set("genre", o.Genre)
+	set("genres", strings.Join(o.Genres, ","))
+	if o.GenresMatchAll {
+		q.Set("genres_match", "all")
+	}
+	set("tag", o.Tag)
+	set("certification", o.Certification)
+	if o.YearMin > 0 {
+		q.Set("year_min", strconv.Itoa(o.YearMin))
+	}
+	if o.YearMax > 0 {
+		q.Set("year_max", strconv.Itoa(o.YearMax))
+	}
+	if o.RatingMin != nil {
+		q.Set("rating_min", strconv.FormatFloat(*o.RatingMin, 'f', -1, 64))
+	}
+	if o.RatingMax != nil {
+		q.Set("rating_max", strconv.FormatFloat(*o.RatingMax, 'f', -1, 64))
+	}
+	if !o.CreatedAfter.IsZero() {
+		q.Set("created_after", o.CreatedAfter.Format(time.RFC3339))
+	}
+	if !o.CreatedBefore.IsZero() {
+		q.Set("created_before", o.CreatedBefore.Format(time.RFC3339))
+	}
+	return q
+}
+
+// MoviePage is one page of a listing. NextCursor is empty on the last page.
+type MoviePage struct {
+	Movies     []Movie
+	NextCursor string
+	PrevCursor string
+}
+
+// ListMovies fetches one page of movies.
+func (c *Client) ListMovies(ctx context.Context, opts ListMoviesOptions) (*MoviePage, error) {
+	var out struct {
+		Movies   []Movie `json:"movies"`
+		Metadata struct {
+			NextCursor string `json:"next_cursor"`
+			PrevCursor string `json:"prev_cursor"`
+		} `json:"metadata"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/movies?"+opts.query().Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+	return &MoviePage{Movies: out.Movies, NextCursor: out.Metadata.NextCursor, PrevCursor: out.Metadata.PrevCursor}, nil
+}
+
+// MovieIterator walks a listing page by page; see Movies.
+type MovieIterator struct {
+	c    *Client
+	opts ListMoviesOptions
+	page []Movie
+	cur  Movie
+	done bool
+	err  error
+}
+
+// Movies returns an iterator over every movie matching opts, starting at
+// opts.Cursor. Pages are fetched as the iterator reaches them.
+func (c *Client) Movies(opts ListMoviesOptions) *MovieIterator {
+	return &MovieIterator{c: c, opts: opts}
+}
+
+// Next advances to the next movie, fetching the next page if needed. It
+// returns false at the end or on an error; check Err.
+func (it *MovieIterator) Next(ctx context.Context) bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		p, err := it.c.ListMovies(ctx, it.opts)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page, it.opts.Cursor = p.Movies, p.NextCursor
+		it.done = p.NextCursor == ""
+	}
+	it.cur, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Movie is the current movie.
+func (it *MovieIterator) Movie() Movie {
+	return it.cur
+}
+
+// Err is the error that stopped Next, if any.
+func (it *MovieIterator) Err() error {
+	return it.err
+}
+
+// GetMovie fetches a movie by ID.
+func (c *Client) GetMovie(ctx context.Context, id int64) (*Movie, error) {
+	var m Movie
+	if err := c.do(ctx, http.MethodGet, "/movies/"+strconv.FormatInt(id, 10), nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetMovieByIMDbID fetches a movie by its IMDb ID, e.g. tt0816692.
+func (c *Client) GetMovieByIMDbID(ctx context.Context, imdbID string) (*Movie, error) {
+	var m Movie
+	if err := c.do(ctx, http.MethodGet, "/movies/by-external/imdb/"+url.PathEscape(imdbID), nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// CreateMovie adds a movie. If its external ID is taken, the error is a 409
+// *Error whose Body holds the existing movie under "movie".
+func (c *Client) CreateMovie(ctx context.Context, in MovieInput) (*Movie, error) {
+	var m Movie
+	if err := c.do(ctx, http.MethodPost, "/movies", in, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// UpdateMovie replaces the fields of a movie.
+func (c *Client) UpdateMovie(ctx context.Context, id int64, in MovieInput) (*Movie, error) {
+	in.ExternalIDs = nil
+	var m Movie
+	if err := c.do(ctx, http.MethodPut, "/movies/"+strconv.FormatInt(id, 10), in, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// UpsertMovieByIMDbID creates or replaces the movie with this IMDb ID and
+// says whether it was created.
+func (c *Client) UpsertMovieByIMDbID(ctx context.Context, imdbID string, in MovieInput) (*Movie, bool, error) {
+	in.ExternalIDs = nil
+	var m Movie
+	code, err := c.request(ctx, http.MethodPut, "/movies/by-external/imdb/"+url.PathEscape(imdbID), in, &m)
+	if err != nil {
+		return nil, false, err
+	}
+	return &m, code == http.StatusCreated, nil
+}
+
+// DeleteMovie soft-deletes a movie.
+func (c *Client) DeleteMovie(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/movies/"+strconv.FormatInt(id, 10), nil, nil)
+}
+
+// ImportSummary is the result of ImportMovies.
+type ImportSummary struct {
+	Received          int64   `json:"received"`
+	Imported          int64   `json:"imported"`
+	SkippedDuplicates int64   `json:"skipped_duplicates"`
+	Batches           int     `json:"batches"`
+	Seconds           float64 `json:"seconds"`
+}
+
+// ImportMovies bulk-loads movies in one request. Movies whose external ID
+// already exists are skipped; one invalid movie rejects the whole import.
+func (c *Client) ImportMovies(ctx context.Context, movies []MovieInput) (*ImportSummary, error) {
+	var sum ImportSummary
+	if err := c.do(ctx, http.MethodPost, "/movies/import", movies, &sum); err != nil {
+		return nil, err
+	}
+	return &sum, nil
+}
+
+// ImportMoviesFrom bulk-loads a JSON array of movies read from r, such as
+// a file written by ExportMovies, without holding it in memory. Since the
+// body can't be sent twice, it isn't retried.
+func (c *Client) ImportMoviesFrom(ctx context.Context, r io.Reader) (*ImportSummary, error) {
+	resp, err := c.sendStream(ctx, http.MethodPost, "/movies/import", r)
+	if err != nil {
+		return nil, err
+	}
+	var sum ImportSummary
+	if err := decodeResponse(resp, &sum); err != nil {
+		return nil, err
+	}
+	return &sum, nil
+}
+
+// ExportMovies writes every movie matching the filters of opts (its Limit
+// and Cursor are ignored) to w as a JSON array, as the API streams it.
+func (c *Client) ExportMovies(ctx context.Context, opts ListMoviesOptions, w io.Writer) error {
+	path := "/movies/export"
+	if q := opts.filters().Encode(); q != "" {
+		path += "?" + q
+	}
+	resp, err := c.sendStream(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return decodeResponse(resp, nil)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Access modes pick what anonymous requests may do, whatever the
+// authorization policy says. open leaves it to the policy; read-only lets
+// them read (GET and HEAD) but not write; private turns them away from
+// everything but signing in and the operational endpoints.
+const (
+	accessOpen     = "open"
+	accessReadOnly = "read-only"
+	accessPrivate  = "private"
+)
+
+// anonymousAllowed reports whether an anonymous request may go on under
+// mode. Signing in stays possible in every mode; registering only while
+// reads are public.
+func anonymousAllowed(mode string, r *http.Request) bool {
+	if mode == accessOpen || r.Method == http.MethodOptions {
+		return true
+	}
+	switch path := r.URL.Path; {
+	case path == "/health", path == "/metrics", path == "/version",
+		path == "/tokens/authentication", path == "/unsubscribe/digest", isSignedDownload(path),
+		strings.HasPrefix(path, "/auth/"), strings.HasPrefix(path, "/admin/ui"):
+		return true
+	case path == "/users" && r.Method == http.MethodPost:
+		return mode == accessReadOnly
+	}
+	return mode == accessReadOnly && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
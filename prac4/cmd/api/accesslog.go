@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogger writes one line per request in Combined Log Format or JSON.
+// Successful (2xx) requests are sampled at sampleRate; everything else is
+// always logged, since that's what someone debugging will look for.
+type accessLogger struct {
+	mu   sync.Mutex
+	out  io.Writer
+	json bool
+	// sampleRate holds the float64 bits, so CONFIG_FILE can change it.
+	sampleRate atomic.Uint64
+}
+
+func (l *accessLogger) rate() float64 {
+	return math.Float64frombits(l.sampleRate.Load())
+}
+
+// setRate changes the sample rate and returns the previous one.
+func (l *accessLogger) setRate(rate float64) float64 {
+	return math.Float64frombits(l.sampleRate.Swap(math.Float64bits(rate)))
+}
+
+// newAccessLogger opens the destination: "stdout", "stderr" or a file path,
+// appended to. It returns nil when format is "off".
+func newAccessLogger(format, output string, sampleRate float64) (*accessLogger, error) {
+	l := &accessLogger{}
+	l.setRate(sampleRate)
+	switch format {
+	case "off":
+		return nil, nil
+	case "combined":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("ACCESS_LOG_FORMAT must be combined, json or off")
+	}
+	switch output {
+	case "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		l.out = f
+	}
+	return l, nil
+}
+
+// accessRecord collects what the log line needs while the request runs.
+// authenticate fills in the user once it knows it.
+type accessRecord struct {
+	status int
+	bytes  int64
+	user   string
+}
+
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	rec, _ := ctx.Value(ctxAccessRecord).(*accessRecord)
+	return rec
+}
+
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecord{}
+		aw := &accessWriter{ResponseWriter: w, rec: rec}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), ctxAccessRecord, rec)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rate := l.rate(); rec.status < 300 && rec.status >= 200 && rate < 1 && rand.Float64() >= rate {
+			return
+		}
+		l.write(r, rec, start)
+	})
+}
+
+func (l *accessLogger) write(r *http.Request, rec *accessRecord, start time.Time) {
+	host := clientIPFrom(r)
+	var line []byte
+	if l.json {
+		line, _ = json.Marshal(map[string]any{
+			"time":        start.UTC().Format(time.RFC3339Nano),
+			"remote_ip":   host,
+			"user":        rec.user,
+			"method":      r.Method,
+			"uri":         r.RequestURI,
+			"proto":       r.Proto,
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"referer":     r.Referer(),
+			"user_agent":  r.UserAgent(),
+			"request_id":  requestIDFrom(r.Context()),
+		})
+		line = append(line, '\n')
+	} else {
+		user := rec.user
+		if user == "" {
+			user = "-"
+		}
+		size := "-"
+		if rec.bytes > 0 {
+			size = strconv.FormatInt(rec.bytes, 10)
+		}
+		line = fmt.Appendf(nil, "%s - %s [%s] %q %d %s %q %q\n",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, rec.status, size, r.Referer(), r.UserAgent())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		log.Printf("access log: %v", err)
+	}
+}
+
+type accessWriter struct {
+	http.ResponseWriter
+	rec *accessRecord
+}
+
+func (a *accessWriter) WriteHeader(code int) {
+	if a.rec.status == 0 {
+		a.rec.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessWriter) Write(b []byte) (int, error) {
+	if a.rec.status == 0 {
+		a.rec.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.rec.bytes += int64(n)
+	return n, err
+}
+
+func (a *accessWriter) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
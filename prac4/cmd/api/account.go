@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth event types of account deletion.
+const (
+	authDeletionRequested = "deletion_requested"
+	authDeletionCancelled = "deletion_cancelled"
+)
+
+// AccountExport is everything GET /me/export hands back: the account and
+// what it has done. Token secrets are never stored, so they aren't in it.
+type AccountExport struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	Profile    Profile          `json:"profile"`
+	Identities []exportIdentity `json:"identities"`
+	Tokens     []exportToken    `json:"tokens"`
+	Activity   []AuthEvent      `json:"activity"`
+	Audit      []AuditEntry     `json:"audit"`
+}
+
+type exportIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportToken struct {
+	ID         int64         `json:"id"`
+	Kind       string        `json:"kind"`
+	Name       string        `json:"name"`
+	Scopes     []string      `json:"scopes"`
+	ExpiresAt  *time.Time    `json:"expires_at"`
+	LastUsedAt *time.Time    `json:"last_used_at"`
+	RevokedAt  *time.Time    `json:"revoked_at"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Usage      []hourlyUsage `json:"usage,omitempty"`
+}
+
+// GET /me/export returns the caller's data as a JSON download: profile and
+// preferences, linked identities, tokens with their usage, account activity
+// and the audit entries they made or that are about them.
+func exportAccount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		u := userFrom(ctx)
+		out := AccountExport{ExportedAt: time.Now().UTC(), Identities: []exportIdentity{}, Tokens: []exportToken{}}
+
+		p, err := scanProfile(db.QueryRowContext(ctx, selectProfile, u.ID))
+		if err == nil {
+			out.Profile = p
+			out.Identities, err = exportIdentities(ctx, db, u.ID)
+		}
+		if err == nil {
+			out.Tokens, err = exportTokens(ctx, db, u.ID)
+		}
+		if err == nil {
+			out.Activity, err = queryAuthEvents(r, db, []string{"user_id = $1"}, []any{u.ID}, 100000)
+		}
+		if err == nil {
+			out.Audit, err = queryAudit(ctx, db, `
+				SELECT `+auditColumns+` FROM audit_log
+				WHERE tenant_id=$1 AND (actor=$2 OR (entity='user' AND entity_id=$3))
+				ORDER BY id`, tenantFrom(ctx), "user:"+strconv.FormatInt(u.ID, 10), u.ID)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="account-`+strconv.FormatInt(u.ID, 10)+`.json"`)
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+func exportIdentities(ctx context.Context, db *sql.DB, userID int64) ([]exportIdentity, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT provider, subject, email, created_at FROM user_identities WHERE user_id=$1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []exportIdentity{}
+	for rows.Next() {
+		var i exportIdentity
+		if err := rows.Scan(&i.Provider, &i.Subject, &i.Email, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, i)
+	}
+	return out, rows.Err()
+}
+
+func exportTokens(ctx context.Context, db *sql.DB, userID int64) ([]exportToken, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, t.kind, t.name, t.scopes, t.expires_at, t.last_used_at, t.revoked_at, t.created_at,
+			g.hour, g.requests, g.bytes_in, g.bytes_out
+		FROM tokens t LEFT JOIN token_usage g ON g.token_id = t.id
+		WHERE t.user_id=$1
+		ORDER BY t.id, g.hour`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []exportToken{}
+	for rows.Next() {
+		var (
+			t    exportToken
+			hour sql.NullTime
+			c    struct{ requests, in, out sql.NullInt64 }
+		)
+		if err := rows.Scan(&t.ID, &t.Kind, &t.Name, pq.Array(&t.Scopes), &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt, &t.CreatedAt,
+			&hour, &c.requests, &c.in, &c.out); err != nil {
+			return nil, err
+		}
+		if len(out) == 0 || out[len(out)-1].ID != t.ID {
+			out = append(out, t)
+		}
+		if hour.Valid {
+			last := &out[len(out)-1]
+			last.Usage = append(last.Usage, hourlyUsage{hour.Time, usageCount{c.requests.Int64, c.in.Int64, c.out.Int64}})
+		}
+	}
+	return out, rows.Err()
+}
+
+// DELETE /me
+//
+// Deactivates the caller's account and signs it out everywhere. The
+// personal data is erased once the grace period is over; signing in with
+// the password before then cancels the deletion. Accounts with a password
+// must confirm it.
+func deleteAccount(db *sql.DB, grace time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Password string `json:"password"`
+		}
+		if err := readJSON(r, &in); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		u := userFrom(r.Context())
+		if u.tokenScopes != nil {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "personal access tokens cannot delete the account"})
+			return
+		}
+		if u.isOperator() {
+			var others bool
+			err := db.QueryRowContext(r.Context(), `
+				SELECT EXISTS (SELECT 1 FROM users WHERE tenant_id=$1 AND role=$2 AND active AND id<>$3)`,
+				defaultTenantID, roleAdmin, u.ID).Scan(&others)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if !others {
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "the last operator cannot delete their account"})
+				return
+			}
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		var hash []byte
+		if err := tx.QueryRow(`SELECT password_hash FROM users WHERE id=$1 FOR UPDATE`, u.ID).Scan(&hash); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if len(hash) > 0 && bcrypt.CompareHashAndPassword(hash, []byte(in.Password)) != nil {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "password is incorrect"})
+			return
+		}
+
+		var requested time.Time
+		err = tx.QueryRow(`
+			UPDATE users SET active=FALSE, deletion_requested_at=now() WHERE id=$1
+			RETURNING deletion_requested_at`, u.ID).Scan(&requested)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM tokens WHERE user_id=$1`, u.ID)
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "user", u.ID, "update",
+				map[string]any{"active": true}, map[string]any{"active": false, "deletion_requested_at": requested})
+		}
+		if err == nil {
+			err = recordAuthEvent(r, tx, u.ID, authDeletionRequested, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]any{"deletion_requested_at": requested, "erase_after": requested.Add(grace)})
+	}
+}
+
+// runAccountEraser erases the accounts whose grace period is over.
+func runAccountEraser(db *sql.DB, grace, interval time.Duration) {
+	for range time.Tick(interval) {
+		rows, err := db.Query(`
+			SELECT id, tenant_id FROM users
+			WHERE NOT active AND erased_at IS NULL AND deletion_requested_at < now() - make_interval(secs => $1)
+			ORDER BY id`, grace.Seconds())
+		if err != nil {
+			log.Printf("account eraser: %v", err)
+			continue
+		}
+		type due struct{ id, tenant int64 }
+		var accounts []due
+		for rows.Next() {
+			var a due
+			if err := rows.Scan(&a.id, &a.tenant); err != nil {
+				log.Printf("account eraser: %v", err)
+				break
+			}
+			accounts = append(accounts, a)
+		}
+		rows.Close()
+
+		for _, a := range accounts {
+			ctx := context.WithValue(context.Background(), ctxTenant, tenantScope{id: a.tenant})
+			if err := eraseAccount(ctx, db, a.id); err != nil {
+				log.Printf("erase account %d: %v", a.id, err)
+				continue
+			}
+			log.Printf("Erased account %d", a.id)
+		}
+	}
+}
+
+// eraseAccount removes the user's personal data in one transaction. The
+// users row stays, anonymised, so movies, audit entries and the like that
+// point at it stay valid; what only describes the person is deleted. ctx
+// carries the user's tenant so the audit log of the right schema is used.
+func eraseAccount(ctx context.Context, db *sql.DB, id int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRowContext(ctx, `SELECT email FROM users WHERE id=$1 AND erased_at IS NULL FOR UPDATE`, id).Scan(&email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE users SET email=$2, name='Erased user', password_hash='', active=FALSE, require_2fa=FALSE, erased_at=now()
+			WHERE id=$1`, id, "erased-"+strconv.FormatInt(id, 10)+"@invalid")
+	}
+	for _, table := range []string{"tokens", "user_preferences", "user_identities", "user_totp", "user_recovery_codes", "user_permissions", "notifications", "email_outbox"} {
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id=$1`, id)
+		}
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE auth_events SET ip='', user_agent='', details='{}' WHERE user_id=$1`, id)
+	}
+	if err == nil {
+		// Events stay for the aggregates, detached from the account.
+		_, err = tx.ExecContext(ctx, `UPDATE analytics_events SET user_id=NULL WHERE user_id=$1`, id)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM login_failures WHERE key=$1`, "account:"+email)
+	}
+	if err == nil {
+		// Replies from others stay in place under the blanked comment.
+		_, err = tx.ExecContext(ctx, `UPDATE comments SET body='[erased]' WHERE tenant_id=$1 AND user_id=$2`, tenantFrom(ctx), id)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE audit_log SET changes='{}' WHERE tenant_id=$1 AND entity='user' AND entity_id=$2`,
+			tenantFrom(ctx), id)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO audit_log (tenant_id, entity, entity_id, action, actor, request_id, changes)
+			VALUES ($1, 'user', $2, 'delete', 'system', '', '{}')`, tenantFrom(ctx), id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// cancelAccountDeletion reactivates an account that is within its grace
+// period, on a successful password sign-in. The sign-in request isn't bound
+// to the user's tenant yet, so the audit entry names it explicitly.
+func cancelAccountDeletion(r *http.Request, db *sql.DB, id, tenant int64) error {
+	ctx := context.WithValue(r.Context(), ctxTenant, tenantScope{id: tenant})
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var requested time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT deletion_requested_at FROM users
+		WHERE id=$1 AND deletion_requested_at IS NOT NULL AND erased_at IS NULL FOR UPDATE`, id).Scan(&requested)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE users SET active=TRUE, deletion_requested_at=NULL WHERE id=$1`, id)
+	}
+	var changes map[string]fieldChange
+	if err == nil {
+		changes, err = diffFields(map[string]any{"active": false, "deletion_requested_at": requested},
+			map[string]any{"active": true, "deletion_requested_at": nil})
+	}
+	if err == nil {
+		raw, _ := json.Marshal(changes)
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO audit_log (tenant_id, entity, entity_id, action, actor, request_id, changes)
+			VALUES ($1, 'user', $2, 'update', $3, $4, $5)`,
+			tenant, id, "user:"+strconv.FormatInt(id, 10), requestIDFrom(ctx), raw)
+	}
+	if err == nil {
+		err = recordAuthEvent(r, tx, id, authDeletionCancelled, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return err
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// adminMux is the /admin route group, mounted behind requireUser. Everything
+// in it is the "admin" action, which the default policy only grants to the
+// admin role; keep public handlers out of here so the boundary stays obvious.
+// Admins manage their own tenant; the routes wrapped in requireOperator
+// change what every tenant sees. schemas reports schema-per-tenant isolation.
+func adminMux(db *sql.DB, refs *refData, maint *maintenance, flags *featureFlags, limits *rateLimits, views []matView, archive *archiver, recordings *recorder, faults *faultInjector, schemas bool) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/users", adminListUsers(db))
+	mux.HandleFunc("POST /admin/users/{id}/deactivate", adminSetUserActive(db, false))
+	mux.HandleFunc("POST /admin/users/{id}/activate", adminSetUserActive(db, true))
+	mux.HandleFunc("PUT /admin/users/{id}/role", adminSetUserRole(db))
+	mux.HandleFunc("POST /admin/users/{id}/permissions", adminGrantPermission(db))
+	mux.HandleFunc("DELETE /admin/users/{id}/permissions/{permission}", adminRevokePermission(db))
+	mux.HandleFunc("POST /admin/users/{id}/tokens/revoke", adminRevokeUserTokens(db))
+	mux.HandleFunc("PUT /admin/users/{id}/require-2fa", adminRequireTwoFactor(db))
+	mux.HandleFunc("DELETE /admin/users/{id}/2fa", adminResetTwoFactor(db))
+
+	mux.HandleFunc("DELETE /admin/movies/{id}", adminPurgeMovie(db))
+	mux.HandleFunc("POST /admin/search/reindex", adminReindexSearch(db))
+
+	mux.HandleFunc("GET /admin/comments", adminListComments(db))
+	mux.HandleFunc("POST /admin/comments/{id}/approve", adminModerateComment(db, commentApproved))
+	mux.HandleFunc("POST /admin/comments/{id}/reject", adminModerateComment(db, commentRejected))
+
+	mux.HandleFunc("POST /admin/genres", requireOperator(createGenre(db)))
+	mux.HandleFunc("DELETE /admin/genres/{name}", requireOperator(deleteGenre(db, schemas)))
+	mux.HandleFunc("POST /admin/genres/rename", requireOperator(renameGenre(db, schemas)))
+
+	mux.HandleFunc("GET /admin/audit", adminAudit(db))
+	mux.HandleFunc("GET /admin/auth-events", adminAuthEvents(db))
+	mux.HandleFunc("POST /admin/cache/flush", requireOperator(adminFlushCache(refs)))
+	mux.HandleFunc("GET /admin/jobs", adminJobs(db))
+	mux.HandleFunc("GET /admin/summary", adminSummary(db))
+	mux.HandleFunc("GET /admin/matviews", adminListMatViews(db, views))
+	mux.HandleFunc("POST /admin/matviews/{name}/refresh", requireOperator(adminRefreshMatView(db, views)))
+	mux.HandleFunc("GET /admin/migrations", requireOperator(adminMigrations(db, schemas)))
+	mux.HandleFunc("POST /admin/migrations/apply", requireOperator(adminApplyMigrations(db, maint, schemas)))
+	mux.HandleFunc("GET /admin/maintenance", requireOperator(adminGetMaintenance(maint)))
+	mux.HandleFunc("PUT /admin/maintenance", requireOperator(adminSetMaintenance(db, maint)))
+
+	mux.HandleFunc("GET /admin/flags", requireOperator(adminListFlags(flags)))
+	mux.HandleFunc("PUT /admin/flags/{name}", requireOperator(adminPutFlag(db, flags)))
+	mux.HandleFunc("DELETE /admin/flags/{name}", requireOperator(adminDeleteFlag(db, flags)))
+
+	mux.HandleFunc("GET /admin/rate-limits", requireOperator(adminListRateLimits(limits)))
+	mux.HandleFunc("PUT /admin/rate-limits/{kind}/{id}", requireOperator(adminPutRateLimit(db, limits)))
+	mux.HandleFunc("DELETE /admin/rate-limits/{kind}/{id}", requireOperator(adminDeleteRateLimit(db, limits)))
+
+	mux.HandleFunc("GET /admin/archive/runs", requireOperator(adminListArchiveRuns(db)))
+	mux.HandleFunc("GET /admin/archive/runs/{id}", requireOperator(adminGetArchiveRun(db)))
+	mux.HandleFunc("POST /admin/archive/runs", requireOperator(adminStartArchiveRun(db, archive)))
+
+	mux.HandleFunc("GET /admin/recordings", requireOperator(adminListRecordings(recordings)))
+	mux.HandleFunc("DELETE /admin/recordings", requireOperator(adminClearRecordings(recordings)))
+
+	mux.HandleFunc("GET /admin/faults", requireOperator(adminListFaults(faults)))
+	mux.HandleFunc("POST /admin/faults", requireOperator(adminAddFault(db, faults)))
+	mux.HandleFunc("DELETE /admin/faults/{id}", requireOperator(adminRemoveFault(db, faults)))
+	mux.HandleFunc("DELETE /admin/faults", requireOperator(adminClearFaults(faults)))
+
+	mux.HandleFunc("GET /admin/tenants", requireOperator(adminListTenants(db)))
+	mux.HandleFunc("POST /admin/tenants", requireOperator(adminCreateTenant(db, schemas)))
+
+	return mux
+}
+
+// permissionRe keeps permission names in the resource:action form, e.g.
+// "movies:write".
+var permissionRe = regexp.MustCompile(`^[a-z_]+:[a-z_]+$`)
+
+// GET /admin/users?active=false
+func adminListUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := `SELECT ` + userColumns + ` FROM users u WHERE u.tenant_id = $1`
+		args := []any{tenantFrom(r.Context())}
+		switch r.URL.Query().Get("active") {
+		case "":
+		case "true", "false":
+			query += ` AND u.active = $2`
+			args = append(args, r.URL.Query().Get("active") == "true")
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "active must be true or false"})
+			return
+		}
+
+		rows, err := db.QueryContext(r.Context(), query+` ORDER BY u.id`, args...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []User{}
+		for rows.Next() {
+			u, err := scanUser(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			out = append(out, u)
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// updateUser runs change against the user inside a transaction, records the
+// before/after state in the audit log and responds with the updated user.
+func updateUser(w http.ResponseWriter, r *http.Request, db *sql.DB, change func(tx *sql.Tx, id int64) error) {
+	id, ok := pathID(r)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	tenant := tenantFrom(r.Context())
+	selectUser := `SELECT ` + userColumns + ` FROM users u WHERE u.id=$1 AND u.tenant_id=$2`
+	before, err := scanUser(tx.QueryRow(selectUser+` FOR UPDATE`, id, tenant))
+	if err == sql.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := change(tx, id); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	after, err := scanUser(tx.QueryRow(selectUser, id, tenant))
+	if err == nil {
+		err = recordAudit(r, tx, "user", id, "update", before, after)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, after)
+}
+
+// POST /admin/users/{id}/deactivate and /activate. Deactivating also revokes
+// the user's tokens; activating cancels a pending account deletion. Admins
+// can't deactivate themselves.
+func adminSetUserActive(db *sql.DB, active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := pathID(r); !active && id == userFrom(r.Context()).ID {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "you cannot deactivate yourself"})
+			return
+		}
+		updateUser(w, r, db, func(tx *sql.Tx, id int64) error {
+			if _, err := tx.Exec(`
+				UPDATE users SET active=$1, deletion_requested_at=CASE WHEN $1 THEN NULL ELSE deletion_requested_at END
+				WHERE id=$2`, active, id); err != nil {
+				return err
+			}
+			if !active {
+				_, err := tx.Exec(`DELETE FROM tokens WHERE user_id=$1`, id)
+				return err
+			}
+			return nil
+		})
+	}
+}
+
+// PUT /admin/users/{id}/role
+func adminSetUserRole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Role string `json:"role"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if in.Role != roleUser && in.Role != roleAdmin {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "role must be user or admin"})
+			return
+		}
+		if id, _ := pathID(r); in.Role != roleAdmin && id == userFrom(r.Context()).ID {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "you cannot remove your own admin role"})
+			return
+		}
+		updateUser(w, r, db, func(tx *sql.Tx, id int64) error {
+			if _, err := tx.Exec(`UPDATE users SET role=$1 WHERE id=$2`, in.Role, id); err != nil {
+				return err
+			}
+			return recordAuthEvent(r, tx, id, authRoleChanged, map[string]any{"role": in.Role, "by": userFrom(r.Context()).ID})
+		})
+	}
+}
+
+// POST /admin/users/{id}/permissions grants one permission; granting it again
+// is a no-op.
+func adminGrantPermission(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Permission string `json:"permission"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if !permissionRe.MatchString(in.Permission) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "permission must look like movies:write"})
+			return
+		}
+		updateUser(w, r, db, func(tx *sql.Tx, id int64) error {
+			res, err := tx.Exec(`
+				INSERT INTO user_permissions (user_id, permission) VALUES ($1, $2)
+				ON CONFLICT DO NOTHING`, id, in.Permission)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return nil
+			}
+			return recordAuthEvent(r, tx, id, authPermissionGranted, map[string]any{"permission": in.Permission, "by": userFrom(r.Context()).ID})
+		})
+	}
+}
+
+// DELETE /admin/users/{id}/permissions/{permission}
+func adminRevokePermission(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permission := r.PathValue("permission")
+		updateUser(w, r, db, func(tx *sql.Tx, id int64) error {
+			res, err := tx.Exec(`DELETE FROM user_permissions WHERE user_id=$1 AND permission=$2`, id, permission)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return nil
+			}
+			return recordAuthEvent(r, tx, id, authPermissionRevoked, map[string]any{"permission": permission, "by": userFrom(r.Context()).ID})
+		})
+	}
+}
+
+// DELETE /admin/movies/{id} removes a movie for good, whether or not it was
+// soft-deleted before. Its audit history is kept.
+func adminPurgeMovie(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := scanMovie(tx.QueryRow(`
+			DELETE FROM movies WHERE id=$1 AND tenant_id=$2 RETURNING `+movieColumns, id, tenantFrom(r.Context())))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "movie", id, "delete", before, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		countEvent(eventMoviePurged)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST /admin/cache/flush reloads the in-memory reference data right away.
+func adminFlushCache(refs *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := refs.reload(r.Context()); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": "flushed", "genres": len(refs.genreList())})
+	}
+}
+
+type job struct {
+	Kind      string     `json:"kind"`
+	ID        int64      `json:"id"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Target    string     `json:"target"`
+}
+
+// GET /admin/jobs lists background work that is queued or has failed:
+// webhook verification and outgoing emails.
+func adminJobs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT id, status, verify_attempts, next_verify_at, last_error, url
+			FROM webhooks WHERE tenant_id=$1 AND status IN ('pending', 'failed')
+			ORDER BY next_verify_at`, tenantFrom(r.Context()))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []job{}
+		for rows.Next() {
+			j := job{Kind: "webhook_verification"}
+			var next time.Time
+			if err := rows.Scan(&j.ID, &j.Status, &j.Attempts, &next, &j.LastError, &j.Target); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if j.Status == webhookPending {
+				j.NextRunAt = &next
+			}
+			out = append(out, j)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		rows, err = db.QueryContext(r.Context(), `
+			SELECT id, status, attempts, next_attempt_at, last_error, template
+			FROM email_outbox WHERE tenant_id=$1 AND status IN ('pending', 'failed')
+			ORDER BY next_attempt_at LIMIT 100`, tenantFrom(r.Context()))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			j := job{Kind: "email"}
+			var next time.Time
+			if err := rows.Scan(&j.ID, &j.Status, &j.Attempts, &next, &j.LastError, &j.Target); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if j.Status == "pending" {
+				j.NextRunAt = &next
+			}
+			out = append(out, j)
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
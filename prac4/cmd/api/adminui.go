@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"golang.org/x/sync/errgroup"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// adminUI serves the embedded single-page admin UI. The static files are
+// public: they contain no data, and the page signs in and talks to the
+// admin-only API with a bearer token like any other client.
+func adminUI() http.Handler {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/admin/ui/", http.FileServer(http.FS(sub)))
+}
+
+// GET /admin/summary backs the UI's status page: health, catalog counts,
+// connection pool state and a few key metrics.
+func adminSummary(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		counts := map[string]int{}
+		var g errgroup.Group
+		queries := map[string]string{
+			"movies":          `SELECT count(*) FROM movies WHERE tenant_id = $1 AND deleted_at IS NULL`,
+			"deleted movies":  `SELECT count(*) FROM movies WHERE tenant_id = $1 AND deleted_at IS NOT NULL`,
+			"users":           `SELECT count(*) FROM users WHERE tenant_id = $1`,
+			"active webhooks": `SELECT count(*) FROM webhooks WHERE tenant_id = $1 AND status = 'active'`,
+		}
+		tenant := tenantFrom(r.Context())
+		results := make(map[string]*int, len(queries))
+		for name, q := range queries {
+			n := new(int)
+			results[name] = n
+			g.Go(func() error { return db.QueryRowContext(r.Context(), q, tenant).Scan(n) })
+		}
+		health := "ok"
+		if err := g.Wait(); err != nil {
+			health = "database error: " + err.Error()
+		}
+		for name, n := range results {
+			counts[name] = *n
+		}
+
+		st := db.Stats()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"health": health,
+			"counts": counts,
+			"db_pool": map[string]any{
+				"open":           st.OpenConnections,
+				"in_use":         st.InUse,
+				"idle":           st.Idle,
+				"max_open":       st.MaxOpenConnections,
+				"wait_count":     st.WaitCount,
+				"wait_duration":  st.WaitDuration.String(),
+				"max_idle_close": st.MaxIdleClosed,
+			},
+			"metrics": map[string]float64{
+				"db_pool_saturated":        metrics.Value("db_pool_saturated"),
+				"db_pool_wait_seconds_avg": metrics.Value("db_pool_wait_seconds_avg"),
+				"db_pool_limited":          metrics.Value("db_pool_limited"),
+				"db_round_trip_seconds":    metrics.Value("db_round_trip_seconds"),
+			},
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errArchiveBusy means another archive run hasn't finished yet.
+var errArchiveBusy = errors.New("an archive run is already in progress")
+
+// archiveStore is the cold storage archived records are copied to, as
+// gzipped NDJSON objects under slash-separated keys.
+type archiveStore interface {
+	put(ctx context.Context, key string, f *os.File) error
+}
+
+// newArchiveStore returns the store ARCHIVE_URL names, or nil if archiving
+// is off: a directory for file:// URLs, otherwise a bucket that takes
+// objects by HTTP PUT under the URL.
+func newArchiveStore(cfg config) archiveStore {
+	if cfg.ArchiveURL == "" {
+		return nil
+	}
+	u, _ := url.Parse(cfg.ArchiveURL)
+	if u.Scheme == "file" {
+		return fileArchive{dir: u.Path}
+	}
+	return httpArchive{
+		url:    strings.TrimSuffix(cfg.ArchiveURL, "/"),
+		token:  cfg.ArchiveToken,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+type fileArchive struct {
+	dir string
+}
+
+func (s fileArchive) put(ctx context.Context, key string, f *os.File) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, f)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+type httpArchive struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s httpArchive) put(ctx context.Context, key string, f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url+"/"+key, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/gzip")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("archive: PUT %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+type archiveObject struct {
+	Key  string `json:"key"`
+	Rows int64  `json:"rows"`
+}
+
+type archiveRun struct {
+	ID         int64           `json:"id"`
+	Trigger    string          `json:"trigger"`
+	Status     string          `json:"status"`
+	Movies     int64           `json:"movies"`
+	AuditRows  int64           `json:"audit_rows"`
+	Objects    []archiveObject `json:"objects"`
+	Error      string          `json:"error,omitempty"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at"`
+}
+
+const archiveRunColumns = `id, trigger, status, movies, audit_rows, objects, error, started_at, finished_at`
+
+func scanArchiveRun(row interface{ Scan(...any) error }) (archiveRun, error) {
+	var (
+		run     archiveRun
+		objects []byte
+	)
+	err := row.Scan(&run.ID, &run.Trigger, &run.Status, &run.Movies, &run.AuditRows, &objects, &run.Error, &run.StartedAt, &run.FinishedAt)
+	if err == nil {
+		err = json.Unmarshal(objects, &run.Objects)
+	}
+	return run, err
+}
+
+// archiver copies soft-deleted movies past RETAIN_DELETED_MOVIES and the
+// audit partitions of months past RETAIN_AUDIT_LOG to the store, in every
+// tenant, and purges them once the copy is stored. A failed upload leaves
+// the records in place for the next run.
+type archiver struct {
+	db      *sql.DB
+	store   archiveStore
+	schemas bool
+
+	keepMovies time.Duration
+	keepAudit  time.Duration
+}
+
+func newArchiver(db *sql.DB, cfg config, schemas bool) *archiver {
+	return &archiver{
+		db:         db,
+		store:      newArchiveStore(cfg),
+		schemas:    schemas,
+		keepMovies: cfg.RetainDeletedMovies,
+		keepAudit:  cfg.RetainAuditLog,
+	}
+}
+
+// run starts an archive run every interval.
+func (a *archiver) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		id, err := a.start(context.Background(), "schedule")
+		if err == errArchiveBusy {
+			continue
+		}
+		if err != nil {
+			log.Printf("archive: %v", err)
+			continue
+		}
+		a.process(id)
+	}
+}
+
+// start records a new run, or returns errArchiveBusy while one is going.
+// A run still marked running after a day belonged to an instance that
+// died and is given up.
+func (a *archiver) start(ctx context.Context, trigger string) (int64, error) {
+	_, err := a.db.ExecContext(ctx, `
+		UPDATE archive_runs SET status='failed', error='abandoned', finished_at=now()
+		WHERE status='running' AND started_at < now() - interval '1 day'`)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = a.db.QueryRowContext(ctx, `INSERT INTO archive_runs (trigger) VALUES ($1) RETURNING id`, trigger).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, errArchiveBusy
+	}
+	return id, err
+}
+
+// process archives every tenant and records the outcome of run id.
+func (a *archiver) process(id int64) {
+	ctx := context.Background()
+	var (
+		movies, auditRows int64
+		objects           = []archiveObject{}
+	)
+	err := forEachTenant(ctx, a.db, a.schemas, func(ctx context.Context) error {
+		var schema string
+		if err := a.db.QueryRowContext(ctx, `SELECT current_schema()`).Scan(&schema); err != nil {
+			return err
+		}
+		if a.keepMovies > 0 {
+			obj, err := a.archiveMovies(ctx, schema, id)
+			if obj.Rows > 0 {
+				movies += obj.Rows
+				objects = append(objects, obj)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if a.keepAudit > 0 {
+			objs, err := a.archiveAudit(ctx, schema)
+			for _, obj := range objs {
+				auditRows += obj.Rows
+				objects = append(objects, obj)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	status, msg := "succeeded", ""
+	if err != nil {
+		status, msg = "failed", err.Error()
+		log.Printf("archive run %d: %v", id, err)
+	}
+	list, _ := json.Marshal(objects)
+	_, uerr := a.db.ExecContext(ctx, `
+		UPDATE archive_runs SET status=$2, movies=$3, audit_rows=$4, objects=$5, error=$6, finished_at=now()
+		WHERE id=$1`, id, status, movies, auditRows, list, msg)
+	if uerr != nil {
+		log.Printf("archive run %d: %v", id, uerr)
+	}
+	metrics.Add("api_archived_rows_total", "Rows copied to cold storage and purged.", float64(movies), "kind", "movies")
+	metrics.Add("api_archived_rows_total", "Rows copied to cold storage and purged.", float64(auditRows), "kind", "audit_log")
+}
+
+// archiveMovies stores the movies of ctx's tenant deleted before the cutoff,
+// with their translations, and purges them.
+func (a *archiver) archiveMovies(ctx context.Context, schema string, run int64) (archiveObject, error) {
+	cutoff := time.Now().Add(-a.keepMovies)
+	obj := archiveObject{Key: schema + "/movies/run-" + strconv.FormatInt(run, 10) + ".ndjson.gz"}
+	n, err := a.export(ctx, obj.Key, `
+		SELECT jsonb_build_object('movie', to_jsonb(m), 'translations',
+			(SELECT coalesce(jsonb_agg(to_jsonb(t) ORDER BY t.language), '[]') FROM movie_translations t WHERE t.movie_id = m.id))::text
+		FROM movies m WHERE m.deleted_at < $1 ORDER BY m.id`, cutoff)
+	if err != nil || n == 0 {
+		return obj, err
+	}
+	// The same cutoff, so only what was stored goes.
+	p := retentionPolicy{name: "deleted_movies", table: "movies", where: `deleted_at < $1`}
+	obj.Rows, err = p.purge(ctx, a.db, cutoff)
+	return obj, err
+}
+
+// archiveAudit stores each audit partition of ctx's tenant whose month
+// ended before the cutoff, then drops it.
+func (a *archiver) archiveAudit(ctx context.Context, schema string) ([]archiveObject, error) {
+	rows, err := a.db.QueryContext(ctx, `
+		SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'audit_log'::regclass AND c.relname ~ '_\d{4}_\d{2}$'
+		  AND (to_date(right(c.relname, 7), 'YYYY_MM') + interval '1 month') AT TIME ZONE 'UTC' <= $1
+		ORDER BY c.relname`, time.Now().Add(-a.keepAudit))
+	if err != nil {
+		return nil, err
+	}
+	var parts []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		parts = append(parts, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var out []archiveObject
+	for _, part := range parts {
+		// part comes from the catalog, matching the pattern above.
+		table := schema + "." + part
+		obj := archiveObject{Key: schema + "/audit_log/" + part + ".ndjson.gz"}
+		obj.Rows, err = a.export(ctx, obj.Key, `SELECT to_jsonb(a)::text FROM `+table+` a ORDER BY id`)
+		if err == nil {
+			_, err = a.db.ExecContext(ctx, `DROP TABLE `+table)
+		}
+		if err != nil {
+			return out, err
+		}
+		if obj.Rows > 0 {
+			out = append(out, obj)
+		}
+	}
+	return out, nil
+}
+
+// export writes the documents query returns, one per line, to a gzipped
+// temporary file and stores it under key. Nothing is stored for no rows.
+func (a *archiver) export(ctx context.Context, key, query string, args ...any) (int64, error) {
+	f, err := os.CreateTemp("", "archive-*.ndjson.gz")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	rows, err := a.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	zw := gzip.NewWriter(f)
+	var n int64
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return 0, err
+		}
+		if _, err := zw.Write(append(doc, '\n')); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return n, a.store.put(ctx, key, f)
+}
+
+// GET /admin/archive/runs
+//
+// The last 50 archive runs, newest first.
+func adminListArchiveRuns(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT `+archiveRunColumns+` FROM archive_runs ORDER BY started_at DESC, id DESC LIMIT 50`)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+		out := []archiveRun{}
+		for rows.Next() {
+			run, err := scanArchiveRun(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			out = append(out, run)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// GET /admin/archive/runs/{id}
+func adminGetArchiveRun(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		run, err := scanArchiveRun(db.QueryRowContext(r.Context(), `
+			SELECT `+archiveRunColumns+` FROM archive_runs WHERE id=$1`, id))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "archive run not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+	}
+}
+
+// POST /admin/archive/runs
+//
+// Starts an archive run now rather than at the next ARCHIVE_INTERVAL. It
+// runs in the background; poll GET /admin/archive/runs/{id} for the result.
+// 409 while another run is going.
+func adminStartArchiveRun(db *sql.DB, a *archiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.store == nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "archiving is not configured"})
+			return
+		}
+		id, err := a.start(r.Context(), "manual")
+		if err == errArchiveBusy {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		go a.process(id)
+
+		run, err := scanArchiveRun(db.QueryRowContext(r.Context(), `
+			SELECT `+archiveRunColumns+` FROM archive_runs WHERE id=$1`, id))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Location", "/admin/archive/runs/"+strconv.FormatInt(id, 10))
+		writeJSON(w, http.StatusAccepted, run)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AuditEntry struct {
+	ID        int64                  `json:"id"`
+	Entity    string                 `json:"entity"`
+	EntityID  int64                  `json:"entity_id"`
+	Action    string                 `json:"action"`
+	Actor     string                 `json:"actor"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Changes   map[string]fieldChange `json:"changes"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// fieldChange is one entry of the JSON diff stored with each audit row.
+type fieldChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// execer is satisfied by *sql.Tx so audit rows are written in the same
+// transaction as the change they describe.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// actorFrom identifies who made a request: the user its credentials
+// authenticated, or "anonymous". Nothing the client says about itself
+// counts, so the log can't be made to blame someone else.
+func actorFrom(r *http.Request) string {
+	if u := userFrom(r.Context()); u != nil {
+		return "user:" + strconv.FormatInt(u.ID, 10)
+	}
+	return "anonymous"
+}
+
+// diffIgnored lists bookkeeping fields that change on every write and would
+// only add noise to the diff.
+var diffIgnored = map[string]bool{"updated_at": true}
+
+// diffFields compares the JSON representations of before and after and
+// returns the fields that differ. A nil side means the entity didn't exist
+// (create) or no longer exists (delete).
+func diffFields(before, after any) (map[string]fieldChange, error) {
+	b, err := toFieldMap(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := toFieldMap(after)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]fieldChange{}
+	for k := range diffIgnored {
+		delete(a, k)
+		delete(b, k)
+	}
+	for k, v := range a {
+		if old, ok := b[k]; !ok || !reflect.DeepEqual(old, v) {
+			out[k] = fieldChange{From: b[k], To: v}
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			out[k] = fieldChange{From: v, To: nil}
+		}
+	}
+	return out, nil
+}
+
+func toFieldMap(v any) (map[string]any, error) {
+	m := map[string]any{}
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+		return m, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &m)
+	return m, err
+}
+
+// searchedEntities are the audited entities whose changes show in the search
+// index. Their entity id is the movie's.
+var searchedEntities = map[string]bool{"movie": true, "tag": true, "translation": true}
+
+// recordAudit writes one audit_log row in the request's tenant, queueing
+// movie changes for the search indexer. Updates that change nothing are not
+// recorded.
+func recordAudit(r *http.Request, tx execer, entity string, entityID int64, action string, before, after any) error {
+	return recordAuditIn(r, tx, tenantFrom(r.Context()), entity, entityID, action, before, after)
+}
+
+// recordAuditIn is recordAudit for entities of another tenant, changed by an
+// operator.
+func recordAuditIn(r *http.Request, tx execer, tenant int64, entity string, entityID int64, action string, before, after any) error {
+	changes, err := diffFields(before, after)
+	if err != nil {
+		return err
+	}
+	if action == "update" && len(changes) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(r.Context(), `
+		INSERT INTO audit_log (tenant_id, entity, entity_id, action, actor, request_id, changes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		tenant, entity, entityID, action, actorFrom(r), requestIDFrom(r.Context()), raw)
+	if err == nil && searchedEntities[entity] {
+		err = queueSearchSync(r.Context(), tx, tenant, entityID)
+	}
+	return err
+}
+
+const auditColumns = `id, entity, entity_id, action, actor, request_id, changes, created_at`
+
+func queryAudit(ctx context.Context, db queryer, query string, args ...any) ([]AuditEntry, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []AuditEntry{}
+	for rows.Next() {
+		var (
+			e   AuditEntry
+			raw []byte
+		)
+		if err := rows.Scan(&e.ID, &e.Entity, &e.EntityID, &e.Action, &e.Actor, &e.RequestID, &raw, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &e.Changes); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// GET /movies/{id}/history
+//
+// Lists changes to the movie and its translations, newest first. History is
+// kept after a movie is deleted, so this doesn't 404 on deleted ids.
+func movieHistory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		out, err := queryAudit(r.Context(), db, `
+			SELECT `+auditColumns+` FROM audit_log
+			WHERE tenant_id=$2 AND entity IN ('movie', 'translation') AND entity_id=$1
+			ORDER BY id DESC`, id, tenantFrom(r.Context()))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// GET /admin/audit?entity=movie&entity_id=1&actor=bob&action=update
+//
+//	&since=2024-01-01T00:00:00Z&until=...&before_id=500&limit=100
+//
+// Queries the tenant's audit log across all entities, newest first. Pass the smallest
+// id of a page as before_id to fetch the next one.
+func adminAudit(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var (
+			where = []string{"tenant_id = $1"}
+			args  = []any{tenantFrom(r.Context())}
+		)
+		add := func(cond string, v any) {
+			args = append(args, v)
+			where = append(where, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+		}
+
+		for _, f := range []string{"entity", "actor", "action", "request_id"} {
+			if v := q.Get(f); v != "" {
+				add(f+" = ?", v)
+			}
+		}
+		if v := q.Get("entity_id"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid entity_id"})
+				return
+			}
+			add("entity_id = ?", n)
+		}
+		if v := q.Get("before_id"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid before_id"})
+				return
+			}
+			add("id < ?", n)
+		}
+		if v := q.Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be an RFC 3339 timestamp"})
+				return
+			}
+			add("created_at >= ?", t)
+		}
+		if v := q.Get("until"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "until must be an RFC 3339 timestamp"})
+				return
+			}
+			add("created_at < ?", t)
+		}
+		limit := 100
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 1000"})
+				return
+			}
+			limit = n
+		}
+
+		query := `SELECT ` + auditColumns + ` FROM audit_log WHERE ` + strings.Join(where, " AND ")
+		args = append(args, limit)
+		query += ` ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args))
+
+		out, err := queryAudit(r.Context(), db, query, args...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of auth_events rows.
+const (
+	authLogin             = "login"
+	authLoginFailed       = "login_failed"
+	authLockout           = "lockout"
+	authLogout            = "logout"
+	authPasswordChanged   = "password_changed"
+	authTokenCreated      = "token_created"
+	authTokenRevoked      = "token_revoked"
+	authTwoFactorEnabled  = "two_factor_enabled"
+	authTwoFactorDisabled = "two_factor_disabled"
+	authRecoveryCodes     = "recovery_codes_regenerated"
+	authRoleChanged       = "role_changed"
+	authPermissionGranted = "permission_granted"
+	authPermissionRevoked = "permission_revoked"
+)
+
+type AuthEvent struct {
+	ID        int64          `json:"id"`
+	UserID    *int64         `json:"user_id,omitempty"`
+	Type      string         `json:"type"`
+	IP        string         `json:"ip"`
+	UserAgent string         `json:"user_agent"`
+	Details   map[string]any `json:"details"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// recordAuthEvent writes one auth_events row for the request's client.
+// userID is 0 when there is no such account.
+func recordAuthEvent(r *http.Request, db execer, userID int64, typ string, details map[string]any) error {
+	if details == nil {
+		details = map[string]any{}
+	}
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	var uid sql.NullInt64
+	if userID > 0 {
+		uid = sql.NullInt64{Int64: userID, Valid: true}
+	}
+	_, err = db.ExecContext(r.Context(), `
+		INSERT INTO auth_events (user_id, type, ip, user_agent, details) VALUES ($1, $2, $3, $4, $5)`,
+		uid, typ, clientIPFrom(r), r.UserAgent(), raw)
+	return err
+}
+
+// logAuthEvent is recordAuthEvent outside a transaction: a failure to record
+// is logged rather than failing the request.
+func logAuthEvent(r *http.Request, db execer, userID int64, typ string, details map[string]any) {
+	if err := recordAuthEvent(r, db, userID, typ, details); err != nil {
+		log.Printf("record auth event %s: %v", typ, err)
+	}
+}
+
+const authEventColumns = `id, user_id, type, ip, user_agent, details, created_at`
+
+func queryAuthEvents(r *http.Request, db *sql.DB, where []string, args []any, limit int) ([]AuthEvent, error) {
+	query := `SELECT ` + authEventColumns + ` FROM auth_events`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	args = append(args, limit)
+	query += ` ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []AuthEvent{}
+	for rows.Next() {
+		var (
+			e   AuthEvent
+			raw []byte
+		)
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Type, &e.IP, &e.UserAgent, &raw, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &e.Details); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// authEventFilter reads the filters shared by both endpoints: before_id,
+// since and limit. It returns a message for the client on bad input.
+func authEventFilter(r *http.Request, add func(cond string, v any), maxLimit int) (int, string) {
+	q := r.URL.Query()
+	if v := q.Get("before_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, "invalid before_id"
+		}
+		add("id < ?", n)
+	}
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return 0, "since must be an RFC 3339 timestamp"
+		}
+		add("created_at >= ?", t)
+	}
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			return 0, "limit must be between 1 and " + strconv.Itoa(maxLimit)
+		}
+		limit = n
+	}
+	return limit, ""
+}
+
+// GET /me/activity lists the caller's recent account activity, newest first,
+// so they can spot sign-ins they don't recognise.
+func myActivity(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		where, args := []string{"user_id = $1"}, []any{userFrom(r.Context()).ID}
+		add := func(cond string, v any) {
+			args = append(args, v)
+			where = append(where, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+		}
+		limit, msg := authEventFilter(r, add, 200)
+		if msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+		out, err := queryAuthEvents(r, db, where, args, limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// GET /admin/auth-events?user_id=&type=&ip=&since=&before_id=&limit=
+func adminAuthEvents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var (
+			where []string
+			args  []any
+		)
+		add := func(cond string, v any) {
+			args = append(args, v)
+			where = append(where, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+		}
+		// Events without a user (sign-ins with unknown emails) belong to no
+		// tenant and are left out.
+		add("user_id IN (SELECT id FROM users WHERE tenant_id = ?)", tenantFrom(r.Context()))
+		for _, f := range []string{"type", "ip"} {
+			if v := q.Get(f); v != "" {
+				add(f+" = ?", v)
+			}
+		}
+		if v := q.Get("user_id"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user_id"})
+				return
+			}
+			add("user_id = ?", n)
+		}
+		limit, msg := authEventFilter(r, add, 1000)
+		if msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+		out, err := queryAuthEvents(r, db, where, args, limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
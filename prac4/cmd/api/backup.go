@@ -0,0 +1,597 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"practice4/migrations"
+
+	"github.com/lib/pq"
+)
+
+// restoreBatch is how many rows one INSERT of a restore loads.
+const restoreBatch = 1000
+
+// backupManifest is the first entry of a backup archive. Tables are listed
+// in the order they are restored: public first, then tenant schemas, and
+// referenced tables before the tables pointing at them.
+type backupManifest struct {
+	Version   string           `json:"version"`
+	CreatedAt time.Time        `json:"created_at"`
+	Tables    []backupTable    `json:"tables"`
+	Sequences []backupSequence `json:"sequences"`
+}
+
+type backupTable struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	// Months are the monthly partitions of a partitioned table, which are
+	// created before its rows are loaded.
+	Months []string `json:"months,omitempty"`
+
+	// hasID is set for tables with an id column, dumped in id order so
+	// rows referencing older rows of the same table load after them.
+	hasID bool
+}
+
+func (t backupTable) qualified() string {
+	return pq.QuoteIdentifier(t.Schema) + "." + pq.QuoteIdentifier(t.Name)
+}
+
+func (t backupTable) entry() string { return t.Schema + "/" + t.Name + ".ndjson" }
+
+type backupSequence struct {
+	Name      string `json:"name"`
+	LastValue int64  `json:"last_value"`
+	IsCalled  bool   `json:"is_called"`
+}
+
+// backupSkipped are tables a restore rebuilds rather than loads.
+var backupSkipped = map[string]bool{"schema_migrations": true, "matview_refreshes": true}
+
+// latestMigration is the newest migration this binary ships.
+func latestMigration() (string, error) {
+	names, err := fs.Glob(migrations.FS, "*.sql")
+	if err != nil || len(names) == 0 {
+		return "", err
+	}
+	sort.Strings(names)
+	return names[len(names)-1], nil
+}
+
+// backupCommand implements `api backup`: it writes every table of the API,
+// in public and the tenant schemas, to a gzipped tar of NDJSON files. All
+// of it is read in one repeatable-read transaction, so the backup is a
+// consistent snapshot while the API keeps serving. With -upload the file
+// also goes to the ARCHIVE_URL store, under backups/.
+func backupCommand(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "backup-"+time.Now().UTC().Format("20060102T150405Z")+".tar.gz", "file to write the backup to")
+	upload := fs.Bool("upload", false, "also store the backup under backups/ in ARCHIVE_URL")
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	store := newArchiveStore(cfg)
+	if *upload && store == nil {
+		log.Fatal("backup: -upload needs ARCHIVE_URL")
+	}
+	db := openDB(dsnFromEnv(), false, cfg)
+	defer db.Close()
+	waitForDB(db)
+
+	ctx := context.Background()
+	started := time.Now()
+	m, err := writeBackup(ctx, db, *out)
+	if err != nil {
+		os.Remove(*out)
+		log.Fatalf("backup: %v", err)
+	}
+	var rows int64
+	for _, t := range m.Tables {
+		rows += t.Rows
+	}
+	log.Printf("backup: %d rows of %d tables written to %s in %.1fs", rows, len(m.Tables), *out, time.Since(started).Seconds())
+
+	if *upload {
+		f, err := os.Open(*out)
+		if err != nil {
+			log.Fatalf("backup: %v", err)
+		}
+		defer f.Close()
+		key := "backups/" + filepath.Base(*out)
+		if err := store.put(ctx, key, f); err != nil {
+			log.Fatalf("backup: upload: %v", err)
+		}
+		log.Printf("backup: uploaded as %s", key)
+	}
+}
+
+func writeBackup(ctx context.Context, db *sql.DB, out string) (backupManifest, error) {
+	m := backupManifest{CreatedAt: time.Now().UTC()}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return m, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, `SELECT max(version) FROM schema_migrations`).Scan(&m.Version); err != nil {
+		return m, err
+	}
+	if m.Tables, err = backupTables(ctx, tx); err != nil {
+		return m, err
+	}
+	if m.Sequences, err = backupSequences(ctx, tx); err != nil {
+		return m, err
+	}
+
+	// Tar entries need their size up front, so each table is dumped to a
+	// temporary file first.
+	tmp, err := os.MkdirTemp("", "backup-*")
+	if err != nil {
+		return m, err
+	}
+	defer os.RemoveAll(tmp)
+	for i := range m.Tables {
+		t := &m.Tables[i]
+		if t.Rows, err = dumpTable(ctx, tx, *t, filepath.Join(tmp, strconv.Itoa(i))); err != nil {
+			return m, fmt.Errorf("%s: %w", t.qualified(), err)
+		}
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+	hdr := &tar.Header{Name: "manifest.json", Mode: 0o644, Size: int64(len(manifest)), ModTime: m.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return m, err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return m, err
+	}
+	for i, t := range m.Tables {
+		if err := addTarFile(tw, t.entry(), filepath.Join(tmp, strconv.Itoa(i)), m.CreatedAt); err != nil {
+			return m, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	if err := zw.Close(); err != nil {
+		return m, err
+	}
+	return m, f.Close()
+}
+
+// backupTables lists the tables to back up in restore order. Partitions are
+// read through their parent.
+func backupTables(ctx context.Context, tx *sql.Tx) ([]backupTable, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT n.nspname, c.relname, c.relkind = 'p',
+		  EXISTS (SELECT 1 FROM pg_attribute a WHERE a.attrelid = c.oid AND a.attname = 'id' AND NOT a.attisdropped)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND NOT c.relispartition
+		  AND (n.nspname = 'public' OR n.nspname ~ '^tenant_\d+$')
+		ORDER BY n.nspname <> 'public', n.nspname, c.relname`)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		tables      []backupTable
+		partitioned = map[string]bool{}
+	)
+	for rows.Next() {
+		var (
+			t backupTable
+			p bool
+		)
+		if err := rows.Scan(&t.Schema, &t.Name, &p, &t.hasID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if backupSkipped[t.Name] {
+			continue
+		}
+		tables = append(tables, t)
+		partitioned[t.qualified()] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, t := range tables {
+		if !partitioned[t.qualified()] {
+			continue
+		}
+		rows, err := tx.QueryContext(ctx, `
+			SELECT to_char(to_date(right(c.relname, 7), 'YYYY_MM'), 'YYYY-MM-DD')
+			FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+			WHERE i.inhparent = $1::regclass AND c.relname ~ '_\d{4}_\d{2}$'
+			ORDER BY 1`, t.qualified())
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var month string
+			if err := rows.Scan(&month); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tables[i].Months = append(tables[i].Months, month)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Foreign keys between the tables decide the order within a schema.
+	deps := map[string][]string{}
+	rows, err = tx.QueryContext(ctx, `
+		SELECT cn.nspname, c.relname, fn.nspname, f.relname
+		FROM pg_constraint k
+		JOIN pg_class c ON c.oid = k.conrelid JOIN pg_namespace cn ON cn.oid = c.relnamespace
+		JOIN pg_class f ON f.oid = k.confrelid JOIN pg_namespace fn ON fn.oid = f.relnamespace
+		WHERE k.contype = 'f' AND k.conrelid <> k.confrelid`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var from, to backupTable
+		if err := rows.Scan(&from.Schema, &from.Name, &to.Schema, &to.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deps[from.qualified()] = append(deps[from.qualified()], to.qualified())
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return orderTables(tables, deps), nil
+}
+
+// orderTables puts every table after the tables it references, keeping the
+// given order otherwise. Tables are already grouped with public first, and
+// public never references a tenant schema.
+func orderTables(tables []backupTable, deps map[string][]string) []backupTable {
+	byName := map[string]backupTable{}
+	for _, t := range tables {
+		byName[t.qualified()] = t
+	}
+	var (
+		out   []backupTable
+		done  = map[string]bool{}
+		visit func(name string)
+	)
+	visit = func(name string) {
+		t, ok := byName[name]
+		if !ok || done[name] {
+			return
+		}
+		done[name] = true
+		for _, dep := range deps[name] {
+			visit(dep)
+		}
+		out = append(out, t)
+	}
+	for _, t := range tables {
+		visit(t.qualified())
+	}
+	return out
+}
+
+// backupSequences reads the id sequences. Tenant tables draw from the ones
+// in public.
+func backupSequences(ctx context.Context, tx *sql.Tx) ([]backupSequence, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.relname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'S' AND n.nspname = 'public' ORDER BY c.relname`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]backupSequence, len(names))
+	for i, name := range names {
+		out[i].Name = name
+		err := tx.QueryRowContext(ctx, `SELECT last_value, is_called FROM public.`+pq.QuoteIdentifier(name)).
+			Scan(&out[i].LastValue, &out[i].IsCalled)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// dumpTable writes the rows of t to file as NDJSON and returns how many.
+func dumpTable(ctx context.Context, tx *sql.Tx, t backupTable, file string) (int64, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	query := `SELECT to_jsonb(t)::text FROM ` + t.qualified() + ` t`
+	if t.hasID {
+		query += ` ORDER BY t.id`
+	}
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var n int64
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return 0, err
+		}
+		w.Write(doc)
+		w.WriteByte('\n')
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return n, f.Close()
+}
+
+func addTarFile(tw *tar.Writer, name, file string, mod time.Time) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: info.Size(), ModTime: mod}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// restoreCommand implements `api restore`: it loads a backup made by the
+// same schema version into the database, replacing what the backed-up
+// tables hold. It is one transaction, so a failed restore changes nothing.
+// Without -force it refuses a database that already has movies or users.
+func restoreCommand(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fs.String("i", "", "backup file to restore")
+	force := fs.Bool("force", false, "replace the data of a database that isn't empty")
+	fs.Parse(args)
+	if *in == "" {
+		log.Fatal("restore: -i is required")
+	}
+
+	cfg := loadConfig()
+	schemas := cfg.TenantIsolation == isolationSchema
+	db := openDB(dsnFromEnv(), schemas, cfg)
+	defer db.Close()
+	waitForDB(db)
+	if err := migrate(db); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if !*force {
+		var used bool
+		err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM movies) OR EXISTS (SELECT 1 FROM users)`).Scan(&used)
+		if err != nil {
+			log.Fatalf("restore: %v", err)
+		}
+		if used {
+			log.Fatal("restore: the database already has data; use -force to replace it")
+		}
+	}
+
+	started := time.Now()
+	m, err := readBackup(ctx, db, *in)
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	var rows int64
+	for _, t := range m.Tables {
+		rows += t.Rows
+	}
+	log.Printf("restore: %d rows of %d tables from %s (taken %s) in %.1fs",
+		rows, len(m.Tables), *in, m.CreatedAt.Format(time.RFC3339), time.Since(started).Seconds())
+
+	// The views were skipped by the backup; fill them now rather than at
+	// the first refresh.
+	err = forEachTenant(ctx, db, schemas, func(ctx context.Context) error {
+		for _, v := range materializedViews(cfg) {
+			if err := refreshMatView(ctx, db, v.name); err != nil && err != errRefreshBusy {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("restore: refreshing materialized views: %v", err)
+	}
+}
+
+func readBackup(ctx context.Context, db *sql.DB, in string) (backupManifest, error) {
+	var m backupManifest
+	f, err := os.Open(in)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return m, err
+	}
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return m, err
+	}
+	if hdr.Name != "manifest.json" {
+		return m, errors.New("not a backup: manifest.json missing")
+	}
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return m, fmt.Errorf("manifest: %w", err)
+	}
+	latest, err := latestMigration()
+	if err != nil {
+		return m, err
+	}
+	if m.Version != latest {
+		return m, fmt.Errorf("the backup is of schema version %s, this binary is at %s; restore it with the matching release", m.Version, latest)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return m, err
+	}
+	defer tx.Rollback()
+
+	// Empty what's there, including the rows migrations seed.
+	var existing []string
+	for _, t := range m.Tables {
+		var ok bool
+		if err := tx.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, t.qualified()).Scan(&ok); err != nil {
+			return m, err
+		}
+		if ok {
+			existing = append(existing, t.qualified())
+		}
+	}
+	if len(existing) > 0 {
+		if _, err := tx.ExecContext(ctx, `TRUNCATE `+strings.Join(existing, ", ")+` CASCADE`); err != nil {
+			return m, err
+		}
+	}
+
+	migrated := map[string]bool{"public": true}
+	for _, t := range m.Tables {
+		hdr, err := tr.Next()
+		if err != nil {
+			return m, fmt.Errorf("%s: %w", t.entry(), err)
+		}
+		if hdr.Name != t.entry() {
+			return m, fmt.Errorf("expected %s in the backup, found %s", t.entry(), hdr.Name)
+		}
+		if !migrated[t.Schema] {
+			// The tenants are loaded by now, so the schema can be set up.
+			id, err := strconv.ParseInt(strings.TrimPrefix(t.Schema, "tenant_"), 10, 64)
+			if err != nil {
+				return m, fmt.Errorf("schema %s: %w", t.Schema, err)
+			}
+			if err := migrateTenant(ctx, tx, id); err != nil {
+				return m, err
+			}
+			migrated[t.Schema] = true
+		}
+		for _, month := range t.Months {
+			if _, err := tx.ExecContext(ctx, `SELECT create_month_partition($1::regclass, $2::date)`, t.qualified(), month); err != nil {
+				return m, err
+			}
+		}
+		if err := loadTable(ctx, tx, t, tr); err != nil {
+			return m, fmt.Errorf("%s: %w", t.qualified(), err)
+		}
+	}
+	for _, s := range m.Sequences {
+		_, err := tx.ExecContext(ctx, `SELECT setval($1, $2, $3)`, "public."+pq.QuoteIdentifier(s.Name), s.LastValue, s.IsCalled)
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, tx.Commit()
+}
+
+// loadTable inserts the NDJSON rows of r into t in batches. Generated
+// columns are left for the table to compute.
+func loadTable(ctx context.Context, tx *sql.Tx, t backupTable, r io.Reader) error {
+	var cols string
+	err := tx.QueryRowContext(ctx, `
+		SELECT string_agg(quote_ident(column_name), ', ' ORDER BY ordinal_position)
+		FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2 AND is_generated = 'NEVER'`, t.Schema, t.Name).Scan(&cols)
+	if err != nil {
+		return err
+	}
+	insert := `INSERT INTO ` + t.qualified() + ` (` + cols + `)
+		SELECT ` + cols + ` FROM jsonb_populate_recordset(NULL::` + t.qualified() + `, $1::jsonb)`
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 64<<20)
+	var (
+		batch strings.Builder
+		n     int
+	)
+	flush := func() error {
+		if n == 0 {
+			return nil
+		}
+		batch.WriteByte(']')
+		_, err := tx.ExecContext(ctx, insert, batch.String())
+		batch.Reset()
+		n = 0
+		return err
+	}
+	for sc.Scan() {
+		if n == 0 {
+			batch.WriteByte('[')
+		} else {
+			batch.WriteByte(',')
+		}
+		batch.Write(sc.Bytes())
+		n++
+		if n == restoreBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// maxBatchUpdate bounds the items of one PATCH /movies/batch.
+const maxBatchUpdate = 100
+
+// movieChange is one item of PATCH /movies/batch; absent fields are left
+// alone. A rating can be changed but not cleared.
+type movieChange struct {
+	ID            int64           `json:"id"`
+	Title         *string         `json:"title"`
+	Year          *int            `json:"year"`
+	Rating        *float64        `json:"rating"`
+	Genres        *[]string       `json:"genres"`
+	Certification *string         `json:"certification"`
+	Metadata      json.RawMessage `json:"metadata"`
+}
+
+// apply merges c into the current state of a movie. Metadata, when given,
+// replaces the movie's.
+func (c movieChange) apply(m Movie) movieInput {
+	in := movieInput{Title: m.Title, Year: m.Year, Rating: m.Rating, Genres: m.Genres, Certification: m.Certification, Metadata: m.Metadata}
+	if c.Title != nil {
+		in.Title = *c.Title
+	}
+	if c.Year != nil {
+		in.Year = *c.Year
+	}
+	if c.Rating != nil {
+		in.Rating = c.Rating
+	}
+	if c.Genres != nil {
+		in.Genres = *c.Genres
+	}
+	if c.Certification != nil {
+		in.Certification = *c.Certification
+	}
+	if c.Metadata != nil {
+		in.Metadata = c.Metadata
+	}
+	return in
+}
+
+type batchResult struct {
+	ID     int64  `json:"id"`
+	Status int    `json:"status"`
+	Movie  *Movie `json:"movie,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PATCH /movies/batch
+//
+// Applies an array of changes, e.g. [{"id":1,"year":1999},{"id":2,"genres":["Drama"]}],
+// in one transaction and reports on each item with the status a single
+// update would have had. Each item runs under a savepoint, so a failing item
+// is left out while the others are committed. Every change is audited like
+// PUT /movies/{id}.
+func batchUpdateMovies(db *sql.DB, refs *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var changes []movieChange
+		if err := readJSON(r, &changes); err != nil {
+			msg := "body must be a JSON array of changes"
+			var be *bodyError
+			if errors.As(err, &be) {
+				msg = be.msg
+			}
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+		if len(changes) == 0 || len(changes) > maxBatchUpdate {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "a batch has 1 to " + strconv.Itoa(maxBatchUpdate) + " changes"})
+			return
+		}
+		seen := make(map[int64]bool, len(changes))
+		for i, c := range changes {
+			if c.ID <= 0 || seen[c.ID] {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "item " + strconv.Itoa(i) + ": id must be a positive movie id, once per batch"})
+				return
+			}
+			seen[c.ID] = true
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		tenant := tenantFrom(r.Context())
+		results := make([]batchResult, len(changes))
+		updated := 0
+		for i, c := range changes {
+			res := batchResult{ID: c.ID}
+			if _, err := tx.Exec(`SAVEPOINT batch_item`); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			before, err := scanMovie(tx.QueryRow(`
+				SELECT `+movieColumns+` FROM movies WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL FOR UPDATE`, c.ID, tenant))
+			var (
+				m   Movie
+				msg string
+			)
+			if err == nil {
+				in := c.apply(before)
+				if msg = in.normalize(refs); msg == "" {
+					m, err = scanMovie(tx.QueryRow(`
+						UPDATE movies
+						SET title=$1, genres=$2, certification=NULLIF($3, ''), year=NULLIF($4, 0), rating=$5, metadata=$8, updated_at=now()
+						WHERE id=$6 AND tenant_id=$7
+						RETURNING `+movieColumns,
+						in.Title, pq.Array(in.Genres), in.Certification, in.Year, in.Rating, c.ID, tenant, []byte(in.Metadata)))
+				}
+			}
+			if err == nil && msg == "" {
+				err = recordAudit(r, tx, "movie", c.ID, "update", before, m)
+			}
+			switch {
+			case err == sql.ErrNoRows:
+				res.Status, res.Error = http.StatusNotFound, "not found"
+			case err != nil:
+				res.Status, res.Error = http.StatusInternalServerError, err.Error()
+			case msg != "":
+				res.Status, res.Error = http.StatusBadRequest, msg
+			default:
+				res.Status, res.Movie = http.StatusOK, &m
+				updated++
+			}
+			if res.Movie == nil {
+				_, err = tx.Exec(`ROLLBACK TO SAVEPOINT batch_item`)
+			} else {
+				_, err = tx.Exec(`RELEASE SAVEPOINT batch_item`)
+			}
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			results[i] = res
+		}
+		if err := commitUnlessDryRun(w, r, tx); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !isDryRun(r) {
+			for range updated {
+				countEvent(eventMovieUpdated)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"updated": updated, "failed": len(changes) - updated, "results": results})
+	}
+}
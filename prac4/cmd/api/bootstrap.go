@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createAdminCommand implements `api create-admin`: it creates the first
+// admin of a tenant, since the API itself only lets admins make admins. The
+// password comes from -password, ADMIN_PASSWORD or a line on stdin, in that
+// order; prefer the latter two, which don't show up in the process list.
+// With -if-none it does nothing when the tenant already has an active admin,
+// so it can run on every deployment. An existing user is only made admin
+// with -promote, which leaves their password alone.
+func createAdminCommand(args []string) {
+	fs := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	email := fs.String("email", os.Getenv("ADMIN_EMAIL"), "email of the admin (default $ADMIN_EMAIL)")
+	name := fs.String("name", envString("ADMIN_NAME", "Admin"), "display name (default $ADMIN_NAME or Admin)")
+	password := fs.String("password", "", "password; prefer $ADMIN_PASSWORD or stdin")
+	slug := fs.String("tenant", "", "slug of the tenant (default DEFAULT_TENANT)")
+	ifNone := fs.Bool("if-none", false, "do nothing if the tenant already has an active admin")
+	promote := fs.Bool("promote", false, "make an existing user with this email admin instead of failing")
+	fs.Parse(args)
+
+	*email = strings.ToLower(strings.TrimSpace(*email))
+	*name = strings.TrimSpace(*name)
+	if addr, err := mail.ParseAddress(*email); err != nil || addr.Address != *email {
+		log.Fatal("create-admin: -email (or ADMIN_EMAIL) must be a valid email")
+	}
+	if *name == "" {
+		log.Fatal("create-admin: -name can't be empty")
+	}
+
+	cfg := loadConfig()
+	schemas := cfg.TenantIsolation == isolationSchema
+	db := openDB(dsnFromEnv(), schemas, cfg)
+	defer db.Close()
+	waitForDB(db)
+	if err := migrate(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if *slug == "" {
+		*slug = cfg.DefaultTenant
+	}
+	var tenant int64
+	if err := db.QueryRow(`SELECT id FROM tenants WHERE slug=$1`, *slug).Scan(&tenant); err != nil {
+		log.Fatalf("create-admin: tenant %s: %v", *slug, err)
+	}
+	if *ifNone {
+		var admin string
+		err := db.QueryRow(`
+			SELECT email FROM users WHERE tenant_id=$1 AND role='admin' AND active AND erased_at IS NULL
+			ORDER BY id LIMIT 1`, tenant).Scan(&admin)
+		if err == nil {
+			log.Printf("create-admin: tenant %s already has an admin (%s); nothing to do", *slug, admin)
+			return
+		}
+		if err != sql.ErrNoRows {
+			log.Fatal(err)
+		}
+	}
+
+	var existing int64
+	err := db.QueryRow(`SELECT id FROM users WHERE email=$1`, *email).Scan(&existing)
+	switch {
+	case err == nil && !*promote:
+		log.Fatalf("create-admin: a user with email %s already exists; pass -promote to make them admin", *email)
+	case err == nil:
+		res, err := db.Exec(`UPDATE users SET role='admin', active=TRUE WHERE id=$1 AND tenant_id=$2`, existing, tenant)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Fatalf("create-admin: %s belongs to another tenant than %s", *email, *slug)
+		}
+		log.Printf("create-admin: %s (user %d) is now an admin of tenant %s", *email, existing, *slug)
+		return
+	case err != sql.ErrNoRows:
+		log.Fatal(err)
+	}
+
+	pw := *password
+	if pw == "" {
+		pw = os.Getenv("ADMIN_PASSWORD")
+	}
+	if pw == "" {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatal("create-admin: no password given (use ADMIN_PASSWORD or stdin)")
+		}
+		pw = strings.TrimRight(line, "\r\n")
+	}
+	if len(pw) < 8 || len(pw) > 72 {
+		log.Fatal("create-admin: password must be 8 to 72 bytes long")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), 12)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var id int64
+	err = db.QueryRow(`
+		INSERT INTO users (tenant_id, email, name, password_hash, role) VALUES ($1, $2, $3, $4, 'admin') RETURNING id`,
+		tenant, *email, *name, hash).Scan(&id)
+	if isUniqueViolation(err) {
+		log.Fatalf("create-admin: a user with email %s already exists", *email)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("create-admin: created admin %s (user %d) in tenant %s", *email, id, *slug)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+var errUnknownCertificate = errors.New("client certificate is not mapped to an identity")
+
+// certIdentity is who a client certificate acts as: a local user, created on
+// first use, and the role the service gets regardless of the user's own.
+type certIdentity struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// clientCerts maps verified client certificates to identities for
+// service-to-service calls without tokens. Keys are matched against the
+// leaf certificate's URI, DNS and email SANs, then its common name.
+type clientCerts map[string]certIdentity
+
+// loadClientCerts reads CLIENT_CERT_IDENTITIES, a JSON object such as
+// {"spiffe://prod/billing": {"email": "billing@svc.example.com", "role": "admin"}}.
+func loadClientCerts(path string) (clientCerts, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m clientCerts
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, id := range m {
+		id.Email = strings.ToLower(strings.TrimSpace(id.Email))
+		if addr, err := mail.ParseAddress(id.Email); err != nil || addr.Address != id.Email {
+			return nil, fmt.Errorf("%s: %s needs a valid email", path, name)
+		}
+		switch id.Role {
+		case "":
+			id.Role = roleUser
+		case roleUser, roleAdmin:
+		default:
+			return nil, fmt.Errorf("%s: %s has unknown role %q", path, name, id.Role)
+		}
+		m[name] = id
+	}
+	return m, nil
+}
+
+// clientTLSConfig requires (or, if optional, accepts) client certificates
+// signed by the CAs in caFile. An empty caFile leaves client certificates
+// off.
+func clientTLSConfig(caFile string, optional bool) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if optional {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// presented reports whether r came with a verified client certificate.
+func (cc clientCerts) presented(r *http.Request) bool {
+	return cc != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// name returns the first name of the leaf certificate that is mapped.
+func (cc clientCerts) name(cert *x509.Certificate) (string, bool) {
+	var names []string
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	names = append(names, cert.Subject.CommonName)
+	for _, n := range names {
+		if _, ok := cc[n]; n != "" && ok {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// user returns the local user for the request's client certificate,
+// linking one by email the first time a name is seen.
+func (cc clientCerts) user(r *http.Request, db *sql.DB) (User, error) {
+	name, ok := cc.name(r.TLS.VerifiedChains[0][0])
+	if !ok {
+		return User{}, errUnknownCertificate
+	}
+	id := cc[name]
+
+	selectUser := `SELECT ` + userColumns + ` FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.provider='mtls' AND i.subject=$1 AND u.active`
+	u, err := scanUser(db.QueryRowContext(r.Context(), selectUser, name))
+	if err == sql.ErrNoRows {
+		err = cc.link(r, db, name, id)
+		if err == nil {
+			u, err = scanUser(db.QueryRowContext(r.Context(), selectUser, name))
+		}
+	}
+	if err == sql.ErrNoRows {
+		// Linked to a deactivated user.
+		return User{}, errUnknownCertificate
+	}
+	if err != nil {
+		return User{}, err
+	}
+	u.Role = id.Role
+	u.certName = name
+	return u, nil
+}
+
+func (cc clientCerts) link(r *http.Request, db *sql.DB, name string, id certIdentity) error {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := linkIdentity(r, tx, "mtls", externalIdentity{Subject: name, Email: id.Email, EmailVerified: true, Name: name}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies works out the real client address for requests arriving
+// through load balancers. Forwarding headers are only believed when the
+// connection comes from a trusted proxy; otherwise anyone could claim any
+// address.
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies reads a comma-separated list of CIDRs or single
+// addresses.
+func parseTrustedProxies(raw string) (trustedProxies, error) {
+	var out trustedProxies
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+func (tp trustedProxies) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range tp {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of whoever sent r. From a trusted peer it
+// uses Forwarded, then X-Forwarded-For, then X-Real-IP; chained addresses
+// are walked from the right, skipping trusted proxies, so a client can't
+// spoof its address by prepending entries.
+func (tp trustedProxies) clientIP(r *http.Request) string {
+	peer := remoteHost(r.RemoteAddr)
+	addr, err := netip.ParseAddr(peer)
+	if err != nil || !tp.trusted(addr) {
+		return peer
+	}
+
+	var chain []string
+	if v := r.Header.Values("Forwarded"); len(v) > 0 {
+		chain = forwardedParam(v, "for")
+	} else if v := r.Header.Values("X-Forwarded-For"); len(v) > 0 {
+		for _, h := range v {
+			for _, part := range strings.Split(h, ",") {
+				chain = append(chain, strings.TrimSpace(part))
+			}
+		}
+	} else if v := strings.TrimSpace(r.Header.Get("X-Real-IP")); v != "" {
+		chain = []string{v}
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		a, err := netip.ParseAddr(remoteHost(chain[i]))
+		if err != nil {
+			break
+		}
+		client = a.Unmap().String()
+		if !tp.trusted(a) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedParam extracts one parameter (for=, proto=, host=) from each
+// element of RFC 7239 Forwarded headers.
+func forwardedParam(values []string, name string) []string {
+	var out []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, name) {
+					out = append(out, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return out
+}
+
+// remoteHost strips the port (and IPv6 brackets) from an address.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// middleware stores the client address for clientIPFrom.
+func (tp trustedProxies) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := tp.clientIP(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxClientIP, ip)))
+	})
+}
+
+// clientIPFrom returns the client address worked out by the middleware,
+// falling back to the connection's peer.
+func clientIPFrom(r *http.Request) string {
+	if ip, ok := r.Context().Value(ctxClientIP).(string); ok {
+		return ip
+	}
+	return remoteHost(r.RemoteAddr)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Comment statuses. Comments start pending and only approved ones are
+// shown; a moderator approves or rejects them, or the filter rejects them
+// on arrival.
+const (
+	commentPending  = "pending"
+	commentApproved = "approved"
+	commentRejected = "rejected"
+)
+
+const (
+	maxCommentLength = 4000
+	// maxCommentDepth bounds how deeply replies nest.
+	maxCommentDepth = 8
+	// maxCommentLinks is how many links a comment may carry before the
+	// default filter holds it as spam.
+	maxCommentLinks = 2
+)
+
+type Comment struct {
+	ID             int64      `json:"id"`
+	MovieID        int64      `json:"movie_id"`
+	ParentID       *int64     `json:"parent_id"`
+	UserID         int64      `json:"user_id"`
+	Author         string     `json:"author"`
+	Body           string     `json:"body"`
+	Status         string     `json:"status"`
+	ModerationNote string     `json:"moderation_note,omitempty"`
+	ModeratedBy    *int64     `json:"moderated_by,omitempty"`
+	ModeratedAt    *time.Time `json:"moderated_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Replies        []*Comment `json:"replies,omitempty"`
+}
+
+const commentColumns = `c.id, c.movie_id, c.parent_id, c.user_id, u.name, c.body, c.status,
+	c.moderation_note, c.moderated_by, c.moderated_at, c.created_at`
+
+func scanComment(row interface{ Scan(...any) error }) (Comment, error) {
+	var c Comment
+	err := row.Scan(&c.ID, &c.MovieID, &c.ParentID, &c.UserID, &c.Author, &c.Body, &c.Status,
+		&c.ModerationNote, &c.ModeratedBy, &c.ModeratedAt, &c.CreatedAt)
+	return c, err
+}
+
+// commentFilter screens a new comment before it is stored. It returns the
+// status the comment starts in (pending, or rejected to drop it without a
+// moderator) and, for rejections, the reason, which becomes the moderation
+// note. Hook in an external spam or profanity service by implementing it.
+type commentFilter interface {
+	screen(ctx context.Context, c Comment) (status, reason string, err error)
+}
+
+// blocklistFilter is the default filter: it rejects comments containing a
+// blocklisted word and ones with more links than maxCommentLinks.
+type blocklistFilter struct {
+	words *regexp.Regexp
+}
+
+var commentLinkRe = regexp.MustCompile(`(?i)(https?://|www\.)`)
+
+// newBlocklistFilter takes COMMENT_BLOCKLIST, a comma-separated word list.
+// Words match whole and case-insensitively.
+func newBlocklistFilter(list string) *blocklistFilter {
+	var words []string
+	for _, w := range strings.Split(list, ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			words = append(words, regexp.QuoteMeta(w))
+		}
+	}
+	f := &blocklistFilter{}
+	if len(words) > 0 {
+		f.words = regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+	}
+	return f
+}
+
+func (f *blocklistFilter) screen(_ context.Context, c Comment) (string, string, error) {
+	if f.words != nil && f.words.MatchString(c.Body) {
+		return commentRejected, "blocked word", nil
+	}
+	if len(commentLinkRe.FindAllStringIndex(c.Body, -1)) > maxCommentLinks {
+		return commentRejected, "too many links", nil
+	}
+	return commentPending, "", nil
+}
+
+// GET /movies/{id}/comments
+//
+// The movie's approved comments as threads, oldest first, with replies
+// nested under their parents. A reply whose parent isn't approved (any
+// more) isn't shown either.
+func listComments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		exists, err := movieExists(r.Context(), db, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT `+commentColumns+` FROM comments c JOIN users u ON u.id = c.user_id
+			WHERE c.movie_id=$1 AND c.tenant_id=$2 AND c.status='approved' ORDER BY c.id`, id, tenantFrom(r.Context()))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		// Parents have lower ids than their replies, so each reply's parent
+		// has been seen by the time it comes up.
+		byID := map[int64]*Comment{}
+		threads := []*Comment{}
+		count := 0
+		for rows.Next() {
+			c, err := scanComment(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if c.ParentID == nil {
+				threads = append(threads, &c)
+			} else if parent, ok := byID[*c.ParentID]; ok {
+				parent.Replies = append(parent.Replies, &c)
+			} else {
+				continue
+			}
+			byID[c.ID] = &c
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"movie_id": id, "count": count, "comments": threads})
+	}
+}
+
+// POST /movies/{id}/comments with {"body": "...", "parent_id": 12}
+//
+// Posts a comment, or a reply to an approved comment on the same movie. It
+// waits for moderation unless the filter rejects it outright; either way
+// the response is 202 with the comment and its status. Users posting more
+// than their rate limit allows per window get 429 with Retry-After.
+func createComment(db *sql.DB, filter commentFilter, limits *rateLimits, window time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		var in struct {
+			Body     string `json:"body"`
+			ParentID *int64 `json:"parent_id"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		in.Body = strings.TrimSpace(in.Body)
+		if in.Body == "" || utf8.RuneCountInString(in.Body) > maxCommentLength {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body must be 1-" + strconv.Itoa(maxCommentLength) + " characters"})
+			return
+		}
+
+		ctx := r.Context()
+		user, tenant := userFrom(ctx), tenantFrom(ctx)
+		exists, err := movieExists(ctx, db, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if in.ParentID != nil {
+			var depth int
+			err := db.QueryRowContext(ctx, `
+				WITH RECURSIVE thread AS (
+					SELECT id, parent_id, 1 AS depth FROM comments
+					WHERE id=$1 AND movie_id=$2 AND tenant_id=$3 AND status='approved'
+					UNION ALL
+					SELECT c.id, c.parent_id, t.depth + 1 FROM comments c JOIN thread t ON c.id = t.parent_id
+				)
+				SELECT max(depth) FROM thread HAVING count(*) > 0`, *in.ParentID, id, tenant).Scan(&depth)
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "parent_id must be an approved comment on this movie"})
+				return
+			}
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if depth >= maxCommentDepth {
+				writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "replies can't nest more than " + strconv.Itoa(maxCommentDepth) + " deep"})
+				return
+			}
+		}
+
+		if limit := limits.forRequest(user).Comments; limit > 0 {
+			var (
+				recent int
+				oldest sql.NullTime
+			)
+			err := db.QueryRowContext(ctx, `
+				SELECT count(*), min(created_at) FROM comments
+				WHERE user_id=$1 AND tenant_id=$2 AND created_at > now() - make_interval(secs => $3)`,
+				user.ID, tenant, window.Seconds()).Scan(&recent, &oldest)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if recent >= limit {
+				w.Header().Set("Retry-After", retryAfter(time.Until(oldest.Time.Add(window))))
+				writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many comments; try again later"})
+				return
+			}
+		}
+
+		c := Comment{MovieID: id, ParentID: in.ParentID, UserID: user.ID, Author: user.Name, Body: in.Body}
+		status, reason, err := filter.screen(ctx, c)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(`
+			INSERT INTO comments (tenant_id, movie_id, parent_id, user_id, body, status, moderation_note, moderated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, CASE WHEN $6 = 'rejected' THEN now() END)
+			RETURNING id, status, moderation_note, moderated_at, created_at`,
+			tenant, id, in.ParentID, user.ID, in.Body, status, reason).
+			Scan(&c.ID, &c.Status, &c.ModerationNote, &c.ModeratedAt, &c.CreatedAt)
+		if err == nil {
+			err = recordAudit(r, tx, "comment", c.ID, "create", nil, c)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, c)
+	}
+}
+
+// GET /admin/comments?status=pending&movie_id=3
+//
+// The moderation queue: comments in a status, pending by default, oldest
+// first, at most 100 at a time.
+func adminListComments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		status := q.Get("status")
+		if status == "" {
+			status = commentPending
+		}
+		if status != commentPending && status != commentApproved && status != commentRejected {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "status must be pending, approved or rejected"})
+			return
+		}
+		query := `SELECT ` + commentColumns + ` FROM comments c JOIN users u ON u.id = c.user_id
+			WHERE c.tenant_id=$1 AND c.status=$2`
+		args := []any{tenantFrom(r.Context()), status}
+		if v := q.Get("movie_id"); v != "" {
+			movieID, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || movieID <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid movie_id"})
+				return
+			}
+			query += ` AND c.movie_id=$3`
+			args = append(args, movieID)
+		}
+
+		rows, err := db.QueryContext(r.Context(), query+` ORDER BY c.id LIMIT 100`, args...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []Comment{}
+		for rows.Next() {
+			c, err := scanComment(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			out = append(out, c)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// POST /admin/comments/{id}/approve and /reject, optionally with
+// {"note": "off topic"}
+//
+// Moderates a comment. A moderator may also reconsider: approve a rejected
+// comment or reject an approved one, which hides its replies too.
+func adminModerateComment(db *sql.DB, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		var in struct {
+			Note string `json:"note"`
+		}
+		if err := readJSON(r, &in); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		tenant := tenantFrom(r.Context())
+		before, err := scanComment(tx.QueryRow(`
+			SELECT `+commentColumns+` FROM comments c JOIN users u ON u.id = c.user_id
+			WHERE c.id=$1 AND c.tenant_id=$2 FOR UPDATE OF c`, id, tenant))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		after := before
+		err = tx.QueryRow(`
+			UPDATE comments SET status=$3, moderation_note=$4, moderated_by=$5, moderated_at=now()
+			WHERE id=$1 AND tenant_id=$2
+			RETURNING status, moderation_note, moderated_by, moderated_at`,
+			id, tenant, status, strings.TrimSpace(in.Note), userFrom(r.Context()).ID).
+			Scan(&after.Status, &after.ModerationNote, &after.ModeratedBy, &after.ModeratedAt)
+		if err == nil && status == commentApproved && before.Status != commentApproved && before.ParentID != nil {
+			// A reply reaches the parent's author once it is visible.
+			var (
+				parentAuthor int64
+				title        string
+			)
+			err = tx.QueryRow(`
+				SELECT c.user_id, m.title FROM comments c JOIN movies m ON m.id = c.movie_id AND m.tenant_id = c.tenant_id
+				WHERE c.id=$1`, *before.ParentID).Scan(&parentAuthor, &title)
+			if err == nil {
+				err = notify(r.Context(), tx, parentAuthor, before.UserID, notifyCommentReply, "comment", id,
+					before.Author+" replied to your comment on "+title)
+			}
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "comment", id, "update", before, after)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, after)
+	}
+}
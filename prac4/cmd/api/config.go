@@ -0,0 +1,547 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds operator settings read from the environment at startup.
+type config struct {
+	Port string
+
+	// ConfigFile holds settings that can be changed without a restart; see
+	// runtimeSettings.
+	ConfigFile string
+
+	// Listener and connection limits. Zero disables a limit.
+	MaxHeaderBytes int
+	MaxConns       int
+	MaxConnsPerIP  int
+	MaxIdleConns   int
+	IdleTimeout    time.Duration
+
+	// Server and handler timeouts. LongHandlerTimeout applies to bulk
+	// routes (see longRoutes) instead of HandlerTimeout. Zero disables each.
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	HandlerTimeout     time.Duration
+	LongHandlerTimeout time.Duration
+
+	// In-flight request cap and how many requests may queue behind it, and
+	// for how long. MaxInFlight zero disables the limit.
+	MaxInFlight  int
+	MaxQueue     int
+	QueueTimeout time.Duration
+
+	// DBPoolWaitThreshold is the average connection wait above which
+	// low-priority requests are shed. Zero disables shedding.
+	DBPoolWaitThreshold time.Duration
+
+	// Database pool bounds; the server sizes the pool between them every
+	// DBPoolTuneInterval (see poolTuner), zero keeping it at its starting
+	// size. DBConnMaxLifetime recycles connections, zero never.
+	DBPoolMin          int
+	DBPoolMax          int
+	DBPoolTuneInterval time.Duration
+	DBConnMaxLifetime  time.Duration
+
+	// Debug endpoints (/debug/vars, /debug/pprof/) are off unless enabled,
+	// and always need DebugToken. DebugAddr serves them on a separate
+	// listener instead of the public port.
+	DebugEndpoints bool
+	DebugAddr      string
+	DebugToken     string
+
+	// FaultInjection lets operators add latency, errors and dropped
+	// connections to routes through /admin/faults, for resilience tests.
+	// Never on by default.
+	FaultInjection bool
+
+	// Authorization: an OPA-compatible decision URL, or a JSON file of role
+	// grants for the built-in engine. Neither means the default roles.
+	AuthzPolicyURL string
+	AuthzRBACFile  string
+
+	// Error reporting to Sentry or a compatible service; off without a DSN.
+	SentryDSN         string
+	SentryEnvironment string
+
+	// Access log: "combined", "json" or "off"; where to write it; and the
+	// fraction of 2xx requests logged (errors always are).
+	AccessLogFormat     string
+	AccessLogOutput     string
+	AccessLogSampleRate float64
+
+	// Request recording for debugging integrations: how many recent
+	// request/response pairs to keep (0 is off), how much of each body, and
+	// which path prefixes (empty records every path).
+	RecordRequests  int
+	RecordBodyLimit int
+	RecordPaths     string
+
+	// TrustedProxies are CIDRs whose forwarding headers are believed when
+	// working out the client address.
+	TrustedProxies string
+
+	// PublicBaseURL prefixes the URLs in _links; empty uses the request's
+	// scheme and host.
+	PublicBaseURL string
+
+	// Sign-in with external accounts; see AUTH_PROVIDERS. JWTSecret signs
+	// the session tokens issued on success.
+	AuthProviders []authProviderConfig
+	JWTSecret     string
+
+	// AccessMode is what anonymous requests may do: open (whatever the
+	// authorization policy allows), read-only or private; see access.go.
+	AccessMode string
+
+	// Require2FAForAdmins makes admins set up two-factor authentication
+	// before they can use the API.
+	Require2FAForAdmins bool
+
+	// Password sign-in throttling; see loginGuard. Zero disables a limit.
+	LoginMaxFailures      int
+	LoginMaxFailuresPerIP int
+	LoginLockout          time.Duration
+
+	// SignatureWindow is how far a signed request's timestamp may be from
+	// the server's clock. SigningSecret derives each token's signing key;
+	// signed requests are off without it.
+	SignatureWindow time.Duration
+	SigningSecret   string
+
+	// Tokens from an external identity provider, validated against its
+	// JWKS. Issuer and audience are required with the URL: without them a
+	// token the provider issued to any other client would be accepted. The
+	// claims name the user's email and roles (dotted paths reach nested
+	// claims).
+	JWKSURL        string
+	JWKSIssuer     string
+	JWKSAudience   string
+	JWKSEmailClaim string
+	JWKSRolesClaim string
+	JWKSAdminRole  string
+
+	// Monthly quotas per personal access token; zero is unlimited.
+	MonthlyRequestQuota int
+	MonthlyByteQuota    int
+
+	// TLS on the public listener, and client certificates signed by
+	// ClientCAFile (required unless ClientCertOptional). ClientCertIdentities
+	// maps certificate names to users; see clientCerts.
+	TLSCertFile          string
+	TLSKeyFile           string
+	ClientCAFile         string
+	ClientCertOptional   bool
+	ClientCertIdentities string
+
+	// DefaultTenant is the slug of the tenant for anonymous requests
+	// without X-Tenant-ID. TenantIsolation is row (shared tables) or schema
+	// (a schema per tenant); see schemas.go.
+	DefaultTenant   string
+	TenantIsolation string
+
+	// AutoMigrate applies pending migrations at startup; without it they
+	// wait for POST /admin/migrations/apply. SchemaCheck is what drift
+	// between the live schema and the migrations does at startup: fail,
+	// warn or off. See schemacheck.go.
+	AutoMigrate bool
+	SchemaCheck string
+
+	// PublicIDs is both (paths take serial ids and UUIDs) or uuid (UUIDs
+	// only); see publicids.go. JSONIDs is how ids are written when the
+	// request doesn't say: number or string; see jsonids.go.
+	PublicIDs string
+	JSONIDs   string
+
+	// Comment posting limits per user (zero disables) and the words the
+	// default comment filter rejects; see comments.go.
+	CommentRateLimit  int
+	CommentRateWindow time.Duration
+	CommentBlocklist  string
+
+	// SMTP server for outgoing email; see mailer. Without SMTPAddr emails
+	// are only logged.
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// SearchEngine is the external index GET /search uses, elasticsearch
+	// or meilisearch; empty keeps search in Postgres. See searchindex.go.
+	SearchEngine string
+	SearchURL    string
+	SearchIndex  string
+	SearchAPIKey string
+
+	// Analytics events from POST /events: the fraction kept, and where they
+	// go. Without EventSinkURL they are stored in analytics_events.
+	EventSampleRate float64
+	EventSinkURL    string
+	EventSinkToken  string
+
+	// FeatureFlags are the flag defaults from FEATURE_FLAGS; rows in
+	// feature_flags override them.
+	FeatureFlags map[string]Flag
+
+	// AccountDeletionGrace is how long a deleted account can still be
+	// restored by signing in before its personal data is erased.
+	AccountDeletionGrace time.Duration
+
+	// Retention policies: how long soft-deleted movies, audit entries,
+	// auth events, analytics events and revoked or expired tokens are kept.
+	// Zero keeps them for good. See retention.go.
+	RetainDeletedMovies   time.Duration
+	RetainAuditLog        time.Duration
+	RetainAuthEvents      time.Duration
+	RetainAnalyticsEvents time.Duration
+	RetainTokens          time.Duration
+	RetentionInterval     time.Duration
+
+	// ArchiveURL is the cold storage for purged movies and audit entries,
+	// a file:// directory or an HTTP bucket URL; empty purges without a
+	// copy. See archive.go.
+	ArchiveURL      string
+	ArchiveToken    string
+	ArchiveInterval time.Duration
+
+	// ExportDir holds the files of export jobs, which are deleted ExportTTL
+	// after they finish; see exports.go.
+	ExportDir string
+	ExportTTL time.Duration
+
+	// ImportDir holds the uploads of import jobs until they are loaded, and
+	// their error reports until ImportTTL after they finish; see imports.go.
+	// Uploads larger than ImportMaxBytes are refused.
+	ImportDir      string
+	ImportTTL      time.Duration
+	ImportMaxBytes int64
+
+	// How often the materialized views behind GET /movies/trending and
+	// GET /stats/movies are refreshed; see matviews.go.
+	TrendingRefreshInterval time.Duration
+	StatsRefreshInterval    time.Duration
+}
+
+func loadConfig() config {
+	cfg := config{
+		Port:           envString("PORT", "8080"),
+		ConfigFile:     envString("CONFIG_FILE", ""),
+		MaxHeaderBytes: envInt("MAX_HEADER_BYTES", 1<<20),
+		MaxConns:       envInt("MAX_CONNS", 0),
+		MaxConnsPerIP:  envInt("MAX_CONNS_PER_IP", 0),
+		MaxIdleConns:   envInt("MAX_IDLE_CONNS", 0),
+		IdleTimeout:    envDuration("IDLE_TIMEOUT", 60*time.Second),
+
+		ReadTimeout:        envDuration("READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:       envDuration("WRITE_TIMEOUT", 30*time.Second),
+		HandlerTimeout:     envDuration("HANDLER_TIMEOUT", 10*time.Second),
+		LongHandlerTimeout: envDuration("LONG_HANDLER_TIMEOUT", 10*time.Minute),
+
+		MaxInFlight:  envInt("MAX_IN_FLIGHT", 0),
+		MaxQueue:     envInt("MAX_QUEUE", 100),
+		QueueTimeout: envDuration("QUEUE_TIMEOUT", time.Second),
+
+		DBPoolWaitThreshold: envDuration("DB_POOL_WAIT_THRESHOLD", 100*time.Millisecond),
+
+		DBPoolMin:          envInt("DB_POOL_MIN", 2),
+		DBPoolMax:          envInt("DB_POOL_MAX", 25),
+		DBPoolTuneInterval: envDuration("DB_POOL_TUNE_INTERVAL", 30*time.Second),
+		DBConnMaxLifetime:  envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+
+		DebugEndpoints: envBool("DEBUG_ENDPOINTS", false),
+		DebugAddr:      envString("DEBUG_ADDR", ""),
+		DebugToken:     envString("DEBUG_TOKEN", ""),
+
+		FaultInjection: envBool("FAULT_INJECTION", false),
+
+		AuthzPolicyURL: envString("AUTHZ_POLICY_URL", ""),
+		AuthzRBACFile:  envString("AUTHZ_RBAC_FILE", ""),
+
+		SentryDSN:         envString("SENTRY_DSN", ""),
+		SentryEnvironment: envString("SENTRY_ENVIRONMENT", "production"),
+
+		AccessLogFormat:     envString("ACCESS_LOG_FORMAT", "combined"),
+		AccessLogOutput:     envString("ACCESS_LOG_OUTPUT", "stdout"),
+		AccessLogSampleRate: envFraction("ACCESS_LOG_SAMPLE_RATE", 1),
+
+		RecordRequests:  envInt("RECORD_REQUESTS", 0),
+		RecordBodyLimit: envInt("RECORD_BODY_LIMIT", 16<<10),
+		RecordPaths:     envString("RECORD_PATHS", ""),
+
+		TrustedProxies: envString("TRUSTED_PROXIES", ""),
+		PublicBaseURL:  envString("PUBLIC_BASE_URL", ""),
+
+		AuthProviders: loadAuthProviders(),
+		JWTSecret:     envString("JWT_SECRET", ""),
+
+		AccessMode: envString("ACCESS_MODE", accessOpen),
+
+		Require2FAForAdmins: envBool("REQUIRE_2FA_FOR_ADMINS", false),
+
+		LoginMaxFailures:      envInt("LOGIN_MAX_FAILURES", 10),
+		LoginMaxFailuresPerIP: envInt("LOGIN_MAX_FAILURES_PER_IP", 50),
+		LoginLockout:          envDuration("LOGIN_LOCKOUT", 15*time.Minute),
+
+		SignatureWindow: envDuration("SIGNATURE_WINDOW", 5*time.Minute),
+		SigningSecret:   envString("SIGNING_SECRET", ""),
+
+		JWKSURL:        envString("JWKS_URL", ""),
+		JWKSIssuer:     envString("JWKS_ISSUER", ""),
+		JWKSAudience:   envString("JWKS_AUDIENCE", ""),
+		JWKSEmailClaim: envString("JWKS_EMAIL_CLAIM", "email"),
+		JWKSRolesClaim: envString("JWKS_ROLES_CLAIM", "roles"),
+		JWKSAdminRole:  envString("JWKS_ADMIN_ROLE", roleAdmin),
+
+		MonthlyRequestQuota: envInt("MONTHLY_REQUEST_QUOTA", 0),
+		MonthlyByteQuota:    envInt("MONTHLY_BYTE_QUOTA", 0),
+
+		TLSCertFile:          envString("TLS_CERT_FILE", ""),
+		TLSKeyFile:           envString("TLS_KEY_FILE", ""),
+		ClientCAFile:         envString("CLIENT_CA_FILE", ""),
+		ClientCertOptional:   envBool("CLIENT_CERT_OPTIONAL", false),
+		ClientCertIdentities: envString("CLIENT_CERT_IDENTITIES", ""),
+
+		DefaultTenant:   envString("DEFAULT_TENANT", "default"),
+		TenantIsolation: envString("TENANT_ISOLATION", isolationRow),
+
+		AutoMigrate: envBool("AUTO_MIGRATE", true),
+		SchemaCheck: envString("SCHEMA_CHECK", schemaCheckFail),
+
+		PublicIDs: envString("PUBLIC_IDS", publicIDsBoth),
+		JSONIDs:   envString("JSON_IDS", jsonIDsNumber),
+
+		CommentRateLimit:  envInt("COMMENT_RATE_LIMIT", 5),
+		CommentRateWindow: envDuration("COMMENT_RATE_WINDOW", 10*time.Minute),
+		CommentBlocklist:  envString("COMMENT_BLOCKLIST", ""),
+
+		SMTPAddr:     envString("SMTP_ADDR", ""),
+		SMTPFrom:     envString("SMTP_FROM", "notifications@localhost"),
+		SMTPUsername: envString("SMTP_USERNAME", ""),
+		SMTPPassword: envString("SMTP_PASSWORD", ""),
+
+		SearchEngine: envString("SEARCH_ENGINE", ""),
+		SearchURL:    envString("SEARCH_URL", ""),
+		SearchIndex:  envString("SEARCH_INDEX", "movies"),
+		SearchAPIKey: envString("SEARCH_API_KEY", ""),
+
+		EventSampleRate: envFraction("EVENT_SAMPLE_RATE", 1),
+		EventSinkURL:    envString("EVENT_SINK_URL", ""),
+		EventSinkToken:  envString("EVENT_SINK_TOKEN", ""),
+
+		FeatureFlags: loadFeatureFlags(),
+
+		AccountDeletionGrace: envDuration("ACCOUNT_DELETION_GRACE", 30*24*time.Hour),
+
+		RetainDeletedMovies:   envDuration("RETAIN_DELETED_MOVIES", 0),
+		RetainAuditLog:        envDuration("RETAIN_AUDIT_LOG", 0),
+		RetainAuthEvents:      envDuration("RETAIN_AUTH_EVENTS", 0),
+		RetainAnalyticsEvents: envDuration("RETAIN_ANALYTICS_EVENTS", 0),
+		RetainTokens:          envDuration("RETAIN_TOKENS", 30*24*time.Hour),
+		RetentionInterval:     envDuration("RETENTION_INTERVAL", time.Hour),
+
+		ArchiveURL:      envString("ARCHIVE_URL", ""),
+		ArchiveToken:    envString("ARCHIVE_TOKEN", ""),
+		ArchiveInterval: envDuration("ARCHIVE_INTERVAL", 24*time.Hour),
+
+		ExportDir: envString("EXPORT_DIR", filepath.Join(os.TempDir(), "movie-exports")),
+		ExportTTL: envDuration("EXPORT_TTL", 24*time.Hour),
+
+		ImportDir:      envString("IMPORT_DIR", filepath.Join(os.TempDir(), "movie-imports")),
+		ImportTTL:      envDuration("IMPORT_TTL", 24*time.Hour),
+		ImportMaxBytes: int64(envInt("IMPORT_MAX_BYTES", 10<<30)),
+
+		TrendingRefreshInterval: envDuration("TRENDING_REFRESH_INTERVAL", 10*time.Minute),
+		StatsRefreshInterval:    envDuration("STATS_REFRESH_INTERVAL", 5*time.Minute),
+	}
+	if cfg.WriteTimeout > 0 && cfg.HandlerTimeout >= cfg.WriteTimeout {
+		log.Fatalf("HANDLER_TIMEOUT must be shorter than WRITE_TIMEOUT")
+	}
+	if cfg.DebugEndpoints && cfg.DebugToken == "" {
+		log.Fatalf("DEBUG_ENDPOINTS requires DEBUG_TOKEN")
+	}
+	if cfg.JWKSURL != "" && (cfg.JWKSIssuer == "" || cfg.JWKSAudience == "") {
+		log.Fatalf("JWKS_URL requires JWKS_ISSUER and JWKS_AUDIENCE")
+	}
+	if cfg.SigningSecret != "" && len(cfg.SigningSecret) < 32 {
+		log.Fatalf("invalid env var SIGNING_SECRET: must be at least 32 characters")
+	}
+	if len(cfg.AuthProviders) > 0 && len(cfg.JWTSecret) < 32 {
+		log.Fatalf("AUTH_PROVIDERS requires JWT_SECRET of at least 32 characters")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		log.Fatalf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.ClientCAFile != "" && cfg.TLSCertFile == "" {
+		log.Fatalf("CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if cfg.ClientCertIdentities != "" && cfg.ClientCAFile == "" {
+		log.Fatalf("CLIENT_CERT_IDENTITIES requires CLIENT_CA_FILE")
+	}
+	if !tenantSlugRe.MatchString(cfg.DefaultTenant) {
+		log.Fatalf("invalid env var DEFAULT_TENANT: must be a tenant slug")
+	}
+	switch cfg.AccessMode {
+	case accessOpen, accessReadOnly, accessPrivate:
+	default:
+		log.Fatalf("invalid env var ACCESS_MODE: must be open, read-only or private")
+	}
+	if cfg.DBPoolMin < 1 {
+		log.Fatalf("invalid env var DB_POOL_MIN: must be at least 1")
+	}
+	if cfg.DBPoolMax < cfg.DBPoolMin {
+		log.Fatalf("invalid env var DB_POOL_MAX: must be at least DB_POOL_MIN")
+	}
+	if cfg.TenantIsolation != isolationRow && cfg.TenantIsolation != isolationSchema {
+		log.Fatalf("invalid env var TENANT_ISOLATION: must be row or schema")
+	}
+	switch cfg.SchemaCheck {
+	case schemaCheckFail, schemaCheckWarn, schemaCheckOff:
+	default:
+		log.Fatalf("invalid env var SCHEMA_CHECK: must be fail, warn or off")
+	}
+	if cfg.PublicIDs != publicIDsBoth && cfg.PublicIDs != publicIDsUUID {
+		log.Fatalf("invalid env var PUBLIC_IDS: must be both or uuid")
+	}
+	if cfg.JSONIDs != jsonIDsNumber && cfg.JSONIDs != jsonIDsString {
+		log.Fatalf("invalid env var JSON_IDS: must be number or string")
+	}
+	if cfg.CommentRateLimit > 0 && cfg.CommentRateWindow <= 0 {
+		log.Fatalf("invalid env var COMMENT_RATE_WINDOW: must be positive")
+	}
+	if cfg.RetentionInterval <= 0 {
+		log.Fatalf("invalid env var RETENTION_INTERVAL: must be positive")
+	}
+	if cfg.ArchiveURL != "" {
+		u, err := url.Parse(cfg.ArchiveURL)
+		if err != nil || (u.Scheme != "file" && u.Scheme != "http" && u.Scheme != "https") {
+			log.Fatalf("invalid env var ARCHIVE_URL: must be a file, http or https URL")
+		}
+		if cfg.ArchiveInterval <= 0 {
+			log.Fatalf("invalid env var ARCHIVE_INTERVAL: must be positive")
+		}
+	}
+	if cfg.ExportTTL <= 0 {
+		log.Fatalf("invalid env var EXPORT_TTL: must be positive")
+	}
+	if cfg.ImportTTL <= 0 {
+		log.Fatalf("invalid env var IMPORT_TTL: must be positive")
+	}
+	if cfg.ImportMaxBytes <= 0 {
+		log.Fatalf("invalid env var IMPORT_MAX_BYTES: must be positive")
+	}
+	if cfg.TrendingRefreshInterval <= 0 {
+		log.Fatalf("invalid env var TRENDING_REFRESH_INTERVAL: must be positive")
+	}
+	if cfg.StatsRefreshInterval <= 0 {
+		log.Fatalf("invalid env var STATS_REFRESH_INTERVAL: must be positive")
+	}
+	switch cfg.SearchEngine {
+	case "":
+	case searchElasticsearch, searchMeilisearch:
+		if cfg.SearchURL == "" {
+			log.Fatalf("SEARCH_ENGINE=%s needs SEARCH_URL", cfg.SearchEngine)
+		}
+	default:
+		log.Fatalf("invalid env var SEARCH_ENGINE: must be elasticsearch or meilisearch")
+	}
+	return cfg
+}
+
+// loadFeatureFlags reads FEATURE_FLAGS; see parseFeatureFlags.
+func loadFeatureFlags() map[string]Flag {
+	flags, err := parseFeatureFlags(envString("FEATURE_FLAGS", ""))
+	if err != nil {
+		log.Fatalf("invalid env var FEATURE_FLAGS: %v", err)
+	}
+	return flags
+}
+
+// loadAuthProviders reads AUTH_PROVIDERS, e.g. "google,github,keycloak", and
+// AUTH_<NAME>_CLIENT_ID, _CLIENT_SECRET and _ISSUER for each. github needs
+// no issuer and google defaults to Google's.
+func loadAuthProviders() []authProviderConfig {
+	var out []authProviderConfig
+	for _, name := range strings.Split(envString("AUTH_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "AUTH_" + strings.ToUpper(name) + "_"
+		p := authProviderConfig{
+			Name:         name,
+			Issuer:       envString(prefix+"ISSUER", ""),
+			ClientID:     envString(prefix+"CLIENT_ID", ""),
+			ClientSecret: envString(prefix+"CLIENT_SECRET", ""),
+		}
+		if name == "google" && p.Issuer == "" {
+			p.Issuer = "https://accounts.google.com"
+		}
+		if p.ClientID == "" || p.ClientSecret == "" || (p.Issuer == "" && name != "github") {
+			log.Fatalf("sign-in provider %s needs %sCLIENT_ID, %sCLIENT_SECRET and %sISSUER", name, prefix, prefix, prefix)
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+func envString(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("invalid env var %s: must be a non-negative integer", key)
+	}
+	return n
+}
+
+func envFraction(key string, def float64) float64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		log.Fatalf("invalid env var %s: must be a number between 0 and 1", key)
+	}
+	return f
+}
+
+func envBool(key string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid env var %s: must be true or false", key)
+	}
+	return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("invalid env var %s: must be a duration such as 30s", key)
+	}
+	return d
+}
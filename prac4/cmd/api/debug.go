@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// debugHandler serves expvar and pprof behind the operator token. It uses its
+// own mux rather than http.DefaultServeMux, where those packages register
+// themselves unprotected.
+func debugHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "operator token required"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// mountDebug routes /debug/ to dbg ahead of user authentication, since the
+// operator token isn't a user token.
+func mountDebug(dbg, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			dbg.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveDebug runs the debug endpoints on their own (typically internal-only)
+// address.
+func serveDebug(addr string, dbg http.Handler) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           dbg,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Printf("debug endpoints listening on %s", addr)
+	log.Fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	digestPeriod = 7 * 24 * time.Hour
+	// digestMaxMovies caps how many movies one digest lists.
+	digestMaxMovies = 25
+	// digestBatch is how many users one pass of the job handles.
+	digestBatch = 100
+)
+
+// runWeeklyDigest emails, once a week, each user who opted in to the digest
+// (and to email) the movies added to their tenant since their last one,
+// narrowed to their favorite genres if they picked any. Users with nothing
+// new are skipped until next week. base is the URL unsubscribe links point
+// to.
+func runWeeklyDigest(db *sql.DB, base string, interval time.Duration) {
+	for range time.Tick(interval) {
+		for {
+			n, err := sendDigests(context.Background(), db, base)
+			if err != nil {
+				log.Printf("weekly digest: %v", err)
+			}
+			if err != nil || n < digestBatch {
+				break
+			}
+		}
+	}
+}
+
+// sendDigests queues the digests of up to digestBatch due users and returns
+// how many it handled.
+func sendDigests(ctx context.Context, db *sql.DB, base string) (int, error) {
+	for n := 0; n < digestBatch; n++ {
+		done, err := sendDigest(ctx, db, base)
+		if err != nil || !done {
+			return n, err
+		}
+	}
+	return digestBatch, nil
+}
+
+// sendDigest handles one due user in its own transaction, so a failure
+// leaves them due for the next pass. It reports whether there was one.
+func sendDigest(ctx context.Context, db *sql.DB, base string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID, tenant int64
+		email, name    string
+		genres         []string
+		last           sql.NullTime
+		token          sql.NullString
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT u.id, u.tenant_id, u.email, u.name, p.favorite_genres, p.last_digest_at, p.unsubscribe_token
+		FROM user_preferences p JOIN users u ON u.id = p.user_id
+		WHERE p.weekly_digest AND p.email_notifications AND u.active AND u.erased_at IS NULL
+			AND (p.last_digest_at IS NULL OR p.last_digest_at <= now() - make_interval(secs => $1))
+		ORDER BY p.last_digest_at NULLS FIRST
+		LIMIT 1
+		FOR UPDATE OF p SKIP LOCKED`, digestPeriod.Seconds()).
+		Scan(&userID, &tenant, &email, &name, pq.Array(&genres), &last, &token)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	since := time.Now().Add(-digestPeriod)
+	if last.Valid && last.Time.After(since) {
+		since = last.Time
+	}
+	// Movies are the tenant's, which in schema mode means its schema.
+	tctx := context.WithValue(ctx, ctxTenant, tenantScope{id: tenant})
+	rows, err := db.QueryContext(tctx, `
+		SELECT title, year FROM movies
+		WHERE tenant_id=$1 AND deleted_at IS NULL AND created_at > $2 AND (cardinality($3::text[]) = 0 OR genres && $3)
+		ORDER BY created_at DESC LIMIT $4`, tenant, since, pq.Array(genres), digestMaxMovies)
+	if err != nil {
+		return false, err
+	}
+	items := []any{}
+	for rows.Next() {
+		var (
+			title string
+			year  sql.NullInt64
+		)
+		if err := rows.Scan(&title, &year); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if year.Valid {
+			title += " (" + strconv.FormatInt(year.Int64, 10) + ")"
+		}
+		items = append(items, title)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	if !token.Valid {
+		token.String = randomToken(16)
+		_, err = tx.ExecContext(ctx, `UPDATE user_preferences SET unsubscribe_token=$2 WHERE user_id=$1`, userID, token.String)
+	}
+	if err == nil && len(items) > 0 {
+		err = enqueueEmail(ctx, tx, tenant, userID, email, "digest", map[string]any{
+			"Name":           name,
+			"Items":          items,
+			"Since":          since.UTC().Format("January 2"),
+			"UnsubscribeURL": base + "/unsubscribe/digest?token=" + url.QueryEscape(token.String),
+		})
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE user_preferences SET last_digest_at=now() WHERE user_id=$1`, userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return err == nil, err
+}
+
+const unsubscribePage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body style="font-family: sans-serif; max-width: 480px; margin: 48px auto;">
+<form method="post"><p>Stop getting the weekly digest?</p><button type="submit">Unsubscribe</button></form>
+</body></html>`
+
+// GET and POST /unsubscribe/digest?token=...
+//
+// The link in every digest. GET shows a confirmation page, since mail
+// scanners follow links; POST, from that page or a mail client's one-click
+// unsubscribe, turns the digest off. Unknown tokens are a 404.
+func unsubscribeDigest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		var userID int64
+		err := db.QueryRowContext(r.Context(), `
+			SELECT user_id FROM user_preferences WHERE unsubscribe_token=$1`, token).Scan(&userID)
+		if err == sql.ErrNoRows || token == "" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown unsubscribe link"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(unsubscribePage))
+			return
+		}
+		if _, err := db.ExecContext(r.Context(), `
+			UPDATE user_preferences SET weekly_digest=FALSE, updated_at=now() WHERE user_id=$1`, userID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "unsubscribed"})
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Analytics event types accepted by POST /events.
+const (
+	analyticsMovieViewed         = "movie.viewed"
+	analyticsSearchPerformed     = "search.performed"
+	analyticsSearchResultClicked = "search.result_clicked"
+)
+
+type propKind int
+
+const (
+	propString propKind = iota
+	propNumber
+	propBool
+)
+
+func (k propKind) String() string {
+	return [...]string{"a string", "a number", "true or false"}[k]
+}
+
+// analyticsSchema is what an event type may carry: whether it names a
+// movie, and its properties, which are flat and typed. Anything else is
+// rejected so the table stays queryable.
+type analyticsSchema struct {
+	movie    bool
+	props    map[string]propKind
+	required []string
+}
+
+var analyticsSchemas = map[string]analyticsSchema{
+	analyticsMovieViewed: {
+		movie: true,
+		props: map[string]propKind{"source": propString, "duration_ms": propNumber},
+	},
+	analyticsSearchPerformed: {
+		props:    map[string]propKind{"query": propString, "results": propNumber, "engine": propString},
+		required: []string{"query"},
+	},
+	analyticsSearchResultClicked: {
+		movie:    true,
+		props:    map[string]propKind{"query": propString, "position": propNumber},
+		required: []string{"query", "position"},
+	},
+}
+
+const (
+	// maxEventBatch is how many events one POST /events may carry.
+	maxEventBatch = 100
+	// maxEventString caps string properties.
+	maxEventString = 500
+	// maxEventAge is how far in the past occurred_at may be; clients
+	// holding events longer than that (offline, say) drop them.
+	maxEventAge = 24 * time.Hour
+	// eventBufferSize bounds the events waiting for a flush; past it
+	// POST /events answers 503.
+	eventBufferSize = 10000
+	// eventFlushSize is how many events go to the sink in one write.
+	eventFlushSize = 1000
+)
+
+type eventInput struct {
+	Type string `json:"type"`
+	// Movie is the movie's id or UUID, as in paths.
+	Movie      string         `json:"movie"`
+	Properties map[string]any `json:"properties"`
+	OccurredAt *time.Time     `json:"occurred_at"`
+}
+
+// validate checks in against its type's schema and returns a message for
+// the client, or "".
+func (in eventInput) validate(now time.Time) string {
+	s, ok := analyticsSchemas[in.Type]
+	if !ok {
+		return "unknown type: " + in.Type
+	}
+	if s.movie && in.Movie == "" {
+		return in.Type + " needs a movie"
+	}
+	if !s.movie && in.Movie != "" {
+		return in.Type + " doesn't take a movie"
+	}
+	for _, name := range s.required {
+		if _, ok := in.Properties[name]; !ok {
+			return in.Type + " needs properties." + name
+		}
+	}
+	for name, v := range in.Properties {
+		kind, ok := s.props[name]
+		if !ok {
+			return "unknown property for " + in.Type + ": " + name
+		}
+		valid := false
+		switch v := v.(type) {
+		case string:
+			valid = kind == propString && len(v) <= maxEventString
+		case float64:
+			valid = kind == propNumber
+		case bool:
+			valid = kind == propBool
+		}
+		if !valid {
+			return fmt.Sprintf("properties.%s must be %s", name, kind)
+		}
+	}
+	if t := in.OccurredAt; t != nil && (t.Before(now.Add(-maxEventAge)) || t.After(now.Add(5*time.Minute))) {
+		return "occurred_at must be within the last 24 hours"
+	}
+	return ""
+}
+
+// analyticsEvent is an accepted event as it is stored or forwarded.
+type analyticsEvent struct {
+	TenantID   int64          `json:"tenant_id"`
+	UserID     int64          `json:"user_id,omitempty"`
+	Type       string         `json:"type"`
+	MovieID    int64          `json:"movie_id,omitempty"`
+	Properties map[string]any `json:"properties"`
+	// SampleRate is the EVENT_SAMPLE_RATE the event was kept at.
+	SampleRate float64   `json:"sample_rate"`
+	OccurredAt time.Time `json:"occurred_at"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// eventSink is where flushed events end up.
+type eventSink interface {
+	write(ctx context.Context, events []analyticsEvent) error
+}
+
+// dbEventSink appends events to analytics_events.
+type dbEventSink struct {
+	db *sql.DB
+}
+
+func (s dbEventSink) write(ctx context.Context, events []analyticsEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("analytics_events",
+		"tenant_id", "user_id", "type", "movie_id", "properties", "sample_rate", "occurred_at", "received_at"))
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		var user, movie any
+		if e.UserID != 0 {
+			user = e.UserID
+		}
+		if e.MovieID != 0 {
+			movie = e.MovieID
+		}
+		props, err := json.Marshal(e.Properties)
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, e.TenantID, user, e.Type, movie, string(props), e.SampleRate, e.OccurredAt, e.ReceivedAt)
+		}
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// httpEventSink forwards events to a collector as {"events": [...]}, for
+// setups that keep analytics out of the main database.
+type httpEventSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s httpEventSink) write(ctx context.Context, events []analyticsEvent) error {
+	body, err := json.Marshal(map[string]any{"events": events})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("event sink: %s", resp.Status)
+	}
+	return nil
+}
+
+// eventCollector buffers accepted events and hands them to the sink in
+// batches on every flush, so a burst of page views costs a few writes
+// rather than one per request. Events still buffered when the process
+// dies are lost; analytics can afford that.
+type eventCollector struct {
+	sink       eventSink
+	sampleRate float64
+
+	mu      sync.Mutex
+	pending []analyticsEvent
+}
+
+func newEventCollector(db *sql.DB, cfg config) *eventCollector {
+	var sink eventSink = dbEventSink{db}
+	if cfg.EventSinkURL != "" {
+		sink = httpEventSink{url: cfg.EventSinkURL, token: cfg.EventSinkToken, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return &eventCollector{sink: sink, sampleRate: cfg.EventSampleRate}
+}
+
+// add buffers events, reporting false if there is no room for them.
+func (c *eventCollector) add(events []analyticsEvent) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending)+len(events) > eventBufferSize {
+		return false
+	}
+	c.pending = append(c.pending, events...)
+	return true
+}
+
+// run flushes the buffer every interval.
+func (c *eventCollector) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.flush()
+	}
+}
+
+func (c *eventCollector) flush() {
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	for len(batch) > 0 {
+		n := min(len(batch), eventFlushSize)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := c.sink.write(ctx, batch[:n])
+		cancel()
+		if err != nil {
+			log.Printf("events flush: %v", err)
+			break
+		}
+		batch = batch[n:]
+	}
+	if len(batch) == 0 {
+		return
+	}
+	// Put back what wasn't written, ahead of what arrived meanwhile, as far
+	// as the buffer has room.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keep := min(len(batch), eventBufferSize-len(c.pending))
+	if dropped := len(batch) - keep; dropped > 0 {
+		metrics.Add("analytics_events_dropped_total", "Analytics events dropped because the sink was unavailable and the buffer full.", float64(dropped))
+	}
+	c.pending = append(batch[:keep:keep], c.pending...)
+}
+
+// POST /events
+//
+//	{"events": [{"type": "movie.viewed", "movie": "42", "properties": {"source": "search"}},
+//	            {"type": "search.performed", "properties": {"query": "heat", "results": 3}}]}
+//
+// Client-side analytics, up to maxEventBatch events per request. Each is
+// checked against its type's schema (see analyticsSchemas) and the whole
+// batch is rejected if one is invalid, naming it by index. Anonymous
+// clients may send events; signed-in ones are attributed to the user.
+// EVENT_SAMPLE_RATE keeps that fraction of the valid events, recording the
+// rate on each so counts can be scaled back up. Events are written in the
+// background, so the answer is 202.
+func trackEvents(db *sql.DB, c *eventCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Events []eventInput `json:"events"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if len(in.Events) == 0 || len(in.Events) > maxEventBatch {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("events must hold 1 to %d events", maxEventBatch)})
+			return
+		}
+		now := time.Now()
+		var refs []string
+		for i, e := range in.Events {
+			if msg := e.validate(now); msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("events[%d]: %s", i, msg)})
+				return
+			}
+			if e.Movie != "" {
+				refs = append(refs, strings.ToLower(e.Movie))
+			}
+		}
+
+		ctx := r.Context()
+		tenant := tenantFrom(ctx)
+		movies := map[string]int64{}
+		if len(refs) > 0 {
+			// Movies are named as in paths: a UUID, or in both mode an id too.
+			mode, _ := ctx.Value(ctxPublicIDs).(string)
+			rows, err := db.QueryContext(ctx, `
+				SELECT id, id::text, uuid::text FROM movies
+				WHERE tenant_id=$1 AND deleted_at IS NULL AND (uuid::text = ANY($2) OR ($3 AND id::text = ANY($2)))`,
+				tenant, pq.Array(refs), mode != publicIDsUUID)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var (
+					id       int64
+					ref, uid string
+				)
+				if err := rows.Scan(&id, &ref, &uid); err != nil {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+					return
+				}
+				if mode != publicIDsUUID {
+					movies[ref] = id
+				}
+				movies[uid] = id
+			}
+			if err := rows.Err(); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+
+		var userID int64
+		if u := userFrom(ctx); u != nil {
+			userID = u.ID
+		}
+		kept := []analyticsEvent{}
+		for i, e := range in.Events {
+			var movieID int64
+			if e.Movie != "" {
+				id, ok := movies[strings.ToLower(e.Movie)]
+				if !ok {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("events[%d]: unknown movie: %s", i, e.Movie)})
+					return
+				}
+				movieID = id
+			}
+			if c.sampleRate < 1 && rand.Float64() >= c.sampleRate {
+				continue
+			}
+			occurred := now
+			if e.OccurredAt != nil {
+				occurred = *e.OccurredAt
+			}
+			if e.Properties == nil {
+				e.Properties = map[string]any{}
+			}
+			kept = append(kept, analyticsEvent{
+				TenantID: tenant, UserID: userID, Type: e.Type, MovieID: movieID, Properties: e.Properties,
+				SampleRate: c.sampleRate, OccurredAt: occurred, ReceivedAt: now,
+			})
+		}
+		if !c.add(kept) {
+			w.Header().Set("Retry-After", retryAfter(5*time.Second))
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "too many events queued, try again shortly"})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]int{"accepted": len(in.Events), "recorded": len(kept)})
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// maxActiveExports is how many export jobs a user may have queued or
+// running at once.
+const maxActiveExports = 3
+
+// ExportJob is a background export of the catalog: GET /movies/export with
+// its format and filters, written to a file instead of a response.
+type ExportJob struct {
+	ID          int64             `json:"id"`
+	Format      string            `json:"format"`
+	Filters     map[string]string `json:"filters"`
+	Status      string            `json:"status"`
+	Movies      int64             `json:"movies"`
+	Bytes       int64             `json:"bytes"`
+	Error       string            `json:"error,omitempty"`
+	DownloadURL string            `json:"download_url,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	StartedAt   *time.Time        `json:"started_at"`
+	FinishedAt  *time.Time        `json:"finished_at"`
+	ExpiresAt   *time.Time        `json:"expires_at"`
+
+	tenant    int64
+	stringIDs bool
+	key       []byte
+}
+
+const exportJobColumns = `id, format, filters, status, movies, bytes, error, created_at, started_at, finished_at, expires_at,
+	tenant_id, string_ids, download_key`
+
+func scanExportJob(row rowScanner) (ExportJob, error) {
+	var (
+		job     ExportJob
+		filters []byte
+	)
+	err := row.Scan(&job.ID, &job.Format, &filters, &job.Status, &job.Movies, &job.Bytes, &job.Error, &job.CreatedAt,
+		&job.StartedAt, &job.FinishedAt, &job.ExpiresAt, &job.tenant, &job.stringIDs, &job.key)
+	if err == nil {
+		err = json.Unmarshal(filters, &job.Filters)
+	}
+	return job, err
+}
+
+// withDownloadURL sets the signed download URL of a finished job; see
+// signedLink.
+func (job *ExportJob) withDownloadURL(r *http.Request) {
+	if job.Status != "succeeded" || job.ExpiresAt == nil {
+		return
+	}
+	job.DownloadURL = signedLink(r, "/exports/"+strconv.FormatInt(job.ID, 10)+"/download", job.key, *job.ExpiresAt)
+}
+
+// exporter runs export jobs on a jobWorker; the files go to EXPORT_DIR,
+// which instances must share.
+type exporter struct {
+	db   *sql.DB
+	refs *refData
+	dir  string
+	ttl  time.Duration
+	jobs *jobWorker[ExportJob]
+}
+
+func newExporter(db *sql.DB, refs *refData, cfg config) (*exporter, error) {
+	if err := os.MkdirAll(cfg.ExportDir, 0o755); err != nil {
+		return nil, err
+	}
+	e := &exporter{db: db, refs: refs, dir: cfg.ExportDir, ttl: cfg.ExportTTL}
+	e.jobs = &jobWorker[ExportJob]{db: db, name: "export", columns: exportJobColumns, scan: scanExportJob,
+		process: e.process, prune: e.prune, kick: make(chan struct{}, 1)}
+	return e, nil
+}
+
+func (e *exporter) path(job ExportJob) string {
+	return filepath.Join(e.dir, "export-"+strconv.FormatInt(job.ID, 10)+"."+job.Format)
+}
+
+// process writes the export of job and records the outcome.
+func (e *exporter) process(job ExportJob) {
+	ctx := context.WithValue(context.Background(), ctxTenant, tenantScope{id: job.tenant})
+	started := time.Now()
+	stop := e.jobs.heartbeat(job.ID)
+	movies, size, err := e.write(ctx, job)
+	stop()
+
+	status, msg := "succeeded", ""
+	if err != nil {
+		status, msg = "failed", err.Error()
+		log.Printf("export job %d: %v", job.ID, err)
+	} else {
+		log.Printf("export job %d: %d movies, %d bytes in %s", job.ID, movies, size, time.Since(started).Round(time.Millisecond))
+	}
+	_, uerr := e.db.ExecContext(ctx, `
+		UPDATE export_jobs SET status=$2, movies=$3, bytes=$4, error=$5, finished_at=now(),
+			expires_at=now() + $6 * interval '1 second'
+		WHERE id=$1`, job.ID, status, movies, size, msg, e.ttl.Seconds())
+	if uerr != nil {
+		log.Printf("export job %d: %v", job.ID, uerr)
+	}
+}
+
+// write exports the movies job selects to its file, through a temporary
+// file so a failed export leaves nothing behind.
+func (e *exporter) write(ctx context.Context, job ExportJob) (movies, size int64, err error) {
+	q := url.Values{}
+	for k, v := range job.Filters {
+		q.Set(k, v)
+	}
+	// The filters were checked when the job was accepted, but reference
+	// data may have changed since.
+	filter, msg := exportFilter(ctx, q, e.refs)
+	if msg != "" {
+		return 0, 0, errors.New(msg)
+	}
+	rows, err := e.db.QueryContext(ctx, `
+		SELECT `+movieColumns+` FROM movies WHERE `+filter.String()+` ORDER BY id`, filter.args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	f, err := os.CreateTemp(e.dir, "export-*.tmp")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name())
+	movies, err = writeExport(f, rows, exportFormats[job.Format], job.stringIDs)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+	return movies, info.Size(), os.Rename(f.Name(), e.path(job))
+}
+
+// prune deletes expired jobs and their files.
+func (e *exporter) prune(ctx context.Context) error {
+	rows, err := e.db.QueryContext(ctx, `DELETE FROM export_jobs WHERE expires_at < now() RETURNING id, format`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var job ExportJob
+		if err := rows.Scan(&job.ID, &job.Format); err != nil {
+			return err
+		}
+		if err := os.Remove(e.path(job)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("export prune: %v", err)
+		}
+	}
+	return rows.Err()
+}
+
+// POST /exports
+//
+// Queues an export of the catalog, for catalogs too large to download from
+// GET /movies/export in one go. The body names the format (json, ndjson or
+// parquet; default json) and the filters of GET /movies, as strings. The
+// job runs in the background; poll GET /exports/{id} until it has a
+// download_url. Ids are strings in the file if the request asks for them.
+func createExport(db *sql.DB, refs *refData, e *exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Format  string            `json:"format"`
+			Filters map[string]string `json:"filters"`
+		}
+		if err := readJSON(r, &in); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if in.Format == "" {
+			in.Format = "json"
+		}
+		if _, ok := exportFormats[in.Format]; !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be json, ndjson or parquet"})
+			return
+		}
+		if in.Filters == nil {
+			in.Filters = map[string]string{}
+		}
+		q := url.Values{}
+		for k, v := range in.Filters {
+			q.Set(k, v)
+		}
+		if _, msg := exportFilter(r.Context(), q, refs); msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+
+		u := userFrom(r.Context())
+		var active int
+		err := db.QueryRowContext(r.Context(), `
+			SELECT count(*) FROM export_jobs WHERE user_id=$1 AND status IN ('queued', 'running')`, u.ID).Scan(&active)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if active >= maxActiveExports {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many exports in progress; wait for one to finish"})
+			return
+		}
+
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		filters, _ := json.Marshal(in.Filters)
+		job, err := scanExportJob(db.QueryRowContext(r.Context(), `
+			INSERT INTO export_jobs (tenant_id, user_id, format, filters, string_ids, download_key)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING `+exportJobColumns,
+			tenantFrom(r.Context()), u.ID, in.Format, filters, wantsStringIDs(w), key))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		e.jobs.wake()
+		w.Header().Set("Location", "/exports/"+strconv.FormatInt(job.ID, 10))
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// GET /exports
+//
+// The caller's export jobs, newest first.
+func listExports(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT `+exportJobColumns+` FROM export_jobs WHERE user_id=$1 ORDER BY created_at DESC, id DESC`,
+			userFrom(r.Context()).ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+		out := []ExportJob{}
+		for rows.Next() {
+			job, err := scanExportJob(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			job.withDownloadURL(r)
+			out = append(out, job)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// GET /exports/{id}
+//
+// The status of one of the caller's export jobs, with a signed
+// download_url once it has succeeded.
+func getExport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		job, err := scanExportJob(db.QueryRowContext(r.Context(), `
+			SELECT `+exportJobColumns+` FROM export_jobs WHERE id=$1 AND user_id=$2`, id, userFrom(r.Context()).ID))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "export not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		job.withDownloadURL(r)
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+// GET /exports/{id}/download?expires=...&signature=...
+//
+// The file of a finished export. The signature is the authorization, so
+// the URL works without credentials, e.g. from a warehouse loader or a
+// CDN, until it expires. Range requests are supported.
+func downloadExport(db *sql.DB, e *exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		denied := func() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "invalid or expired download link"})
+		}
+		job, err := scanExportJob(db.QueryRowContext(r.Context(), `
+			SELECT `+exportJobColumns+` FROM export_jobs WHERE id=$1 AND status='succeeded' AND expires_at > now()`, id))
+		if err == sql.ErrNoRows {
+			denied()
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		expires, ok := signedUntil(r, job.key)
+		if !ok {
+			denied()
+			return
+		}
+
+		f, err := os.Open(e.path(job))
+		if errors.Is(err, os.ErrNotExist) {
+			writeJSON(w, http.StatusGone, map[string]string{"error": "export file is no longer available"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", exportFormats[job.Format].contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="movies-export-`+strconv.FormatInt(job.ID, 10)+"."+job.Format+`"`)
+		w.Header().Set("ETag", `"export-`+strconv.FormatInt(job.ID, 10)+`"`)
+		serveSigned(w, expires)
+		http.ServeContent(w, r, "", *job.FinishedAt, f)
+	}
+}
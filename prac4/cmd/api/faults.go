@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults a rule can inject.
+const (
+	faultLatency = "latency"
+	faultError   = "error"
+	faultDrop    = "drop"
+)
+
+// faultRule injects faults into requests whose path starts with Path (and of
+// Method, when set). Rules expire on their own, so a test that forgets to
+// clean up doesn't leave the API broken.
+type faultRule struct {
+	ID          int64     `json:"id"`
+	Method      string    `json:"method,omitempty"`
+	Path        string    `json:"path"`
+	LatencyMS   int       `json:"latency_ms"`
+	JitterMS    int       `json:"jitter_ms"`
+	ErrorRate   float64   `json:"error_rate"`
+	ErrorStatus int       `json:"error_status"`
+	DropRate    float64   `json:"drop_rate"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func (f faultRule) matches(r *http.Request) bool {
+	return (f.Method == "" || f.Method == r.Method) && strings.HasPrefix(r.URL.Path, f.Path)
+}
+
+// faultInjector holds the rules set through /admin/faults. It only exists
+// with FAULT_INJECTION=true; there are no rules until an operator adds one.
+type faultInjector struct {
+	mu    sync.Mutex
+	rules []faultRule
+	seq   int64
+}
+
+func newFaultInjector(enabled bool) *faultInjector {
+	if !enabled {
+		return nil
+	}
+	log.Printf("FAULT_INJECTION is on; operators can slow down or break requests through /admin/faults")
+	return &faultInjector{}
+}
+
+// active drops expired rules and returns the rest.
+func (fi *faultInjector) active() []faultRule {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	now := time.Now()
+	fi.rules = slices.DeleteFunc(fi.rules, func(f faultRule) bool { return now.After(f.ExpiresAt) })
+	return slices.Clone(fi.rules)
+}
+
+// rule returns the rule for r: the one with the longest matching path, the
+// newest of those on a tie.
+func (fi *faultInjector) rule(r *http.Request) (faultRule, bool) {
+	var (
+		best  faultRule
+		found bool
+	)
+	for _, f := range fi.active() {
+		if f.matches(r) && (!found || len(f.Path) >= len(best.Path)) {
+			best, found = f, true
+		}
+	}
+	return best, found
+}
+
+func (fi *faultInjector) add(f faultRule) faultRule {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.seq++
+	f.ID = fi.seq
+	fi.rules = append(fi.rules, f)
+	return f
+}
+
+func (fi *faultInjector) remove(id int64) (faultRule, bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for i, f := range fi.rules {
+		if f.ID == id {
+			fi.rules = slices.Delete(fi.rules, i, i+1)
+			return f, true
+		}
+	}
+	return faultRule{}, false
+}
+
+func (fi *faultInjector) clear() int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	n := len(fi.rules)
+	fi.rules = nil
+	return n
+}
+
+// middleware applies the matching rule: the delay first, then maybe a
+// dropped connection, then maybe an error response instead of the handler.
+// /admin and the health endpoints are exempt, so faults can always be
+// turned off again.
+func (fi *faultInjector) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := fi.rule(r)
+		if !ok || maintenanceExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if d := time.Duration(f.LatencyMS) * time.Millisecond; d > 0 || f.JitterMS > 0 {
+			if f.JitterMS > 0 {
+				d += time.Duration(rand.IntN(f.JitterMS+1)) * time.Millisecond
+			}
+			countFault(faultLatency)
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+		if f.DropRate > 0 && rand.Float64() < f.DropRate {
+			countFault(faultDrop)
+			// Closes the connection (or resets the HTTP/2 stream) without
+			// a response; net/http doesn't log it.
+			panic(http.ErrAbortHandler)
+		}
+		if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+			countFault(faultError)
+			if f.ErrorStatus == http.StatusServiceUnavailable || f.ErrorStatus == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			writeJSON(w, f.ErrorStatus, map[string]string{"error": "injected fault"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func countFault(kind string) {
+	metrics.Inc("api_faults_injected_total", "Faults injected by FAULT_INJECTION rules, by kind.", "kind", kind)
+}
+
+// GET /admin/faults
+func adminListFaults(fi *faultInjector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fi == nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "fault injection is off"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"faults": fi.active()})
+	}
+}
+
+// POST /admin/faults
+func adminAddFault(db *sql.DB, fi *faultInjector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fi == nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "fault injection is off"})
+			return
+		}
+		var in struct {
+			Method      string  `json:"method"`
+			Path        string  `json:"path"`
+			LatencyMS   int     `json:"latency_ms"`
+			JitterMS    int     `json:"jitter_ms"`
+			ErrorRate   float64 `json:"error_rate"`
+			ErrorStatus int     `json:"error_status"`
+			DropRate    float64 `json:"drop_rate"`
+			TTLSeconds  int     `json:"ttl_seconds"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if in.ErrorStatus == 0 {
+			in.ErrorStatus = http.StatusServiceUnavailable
+		}
+		if in.TTLSeconds == 0 {
+			in.TTLSeconds = 600
+		}
+		var msg string
+		switch {
+		case !strings.HasPrefix(in.Path, "/"):
+			msg = "path must start with /"
+		case in.Path == "/admin" || strings.HasPrefix(in.Path, "/admin/"):
+			msg = "faults can't be injected into /admin"
+		case in.LatencyMS < 0 || in.JitterMS < 0 || in.LatencyMS+in.JitterMS > 120_000:
+			msg = "latency_ms plus jitter_ms must be between 0 and 120000"
+		case in.ErrorRate < 0 || in.ErrorRate > 1 || in.DropRate < 0 || in.DropRate > 1:
+			msg = "error_rate and drop_rate must be between 0 and 1"
+		case in.ErrorStatus < 400 || in.ErrorStatus > 599:
+			msg = "error_status must be a 4xx or 5xx status"
+		case in.TTLSeconds < 1 || in.TTLSeconds > 86400:
+			msg = "ttl_seconds must be between 1 and 86400"
+		case in.LatencyMS == 0 && in.JitterMS == 0 && in.ErrorRate == 0 && in.DropRate == 0:
+			msg = "a fault needs latency_ms, jitter_ms, error_rate or drop_rate"
+		}
+		if msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+
+		f := fi.add(faultRule{
+			Method:      strings.ToUpper(in.Method),
+			Path:        in.Path,
+			LatencyMS:   in.LatencyMS,
+			JitterMS:    in.JitterMS,
+			ErrorRate:   in.ErrorRate,
+			ErrorStatus: in.ErrorStatus,
+			DropRate:    in.DropRate,
+			ExpiresAt:   time.Now().UTC().Add(time.Duration(in.TTLSeconds) * time.Second),
+		})
+		if err := recordAudit(r, db, "fault", f.ID, "create", nil, f); err != nil {
+			log.Printf("audit fault rule: %v", err)
+		}
+		writeJSON(w, http.StatusCreated, f)
+	}
+}
+
+// DELETE /admin/faults/{id}
+func adminRemoveFault(db *sql.DB, fi *faultInjector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fi == nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "fault injection is off"})
+			return
+		}
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		f, ok := fi.remove(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err := recordAudit(r, db, "fault", f.ID, "delete", f, nil); err != nil {
+			log.Printf("audit fault rule: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DELETE /admin/faults
+func adminClearFaults(fi *faultInjector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fi == nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "fault injection is off"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"cleared": fi.clear()})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// feedSize is how many of the newest movies the feeds list.
+const feedSize = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Links     []atomLink `xml:"link"`
+	Summary   string     `xml:"summary"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Self          atomLink  `xml:"atom:link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// feedSummary is the one-line description of m in the feeds.
+func feedSummary(m Movie) string {
+	var parts []string
+	if m.Year != 0 {
+		parts = append(parts, strconv.Itoa(m.Year))
+	}
+	if len(m.Genres) > 0 {
+		parts = append(parts, strings.Join(m.Genres, ", "))
+	}
+	if m.Certification != "" {
+		parts = append(parts, m.Certification)
+	}
+	if m.Rating != nil {
+		parts = append(parts, fmt.Sprintf("rated %.1f", *m.Rating))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// GET /movies/feed.atom and GET /movies/feed.rss
+//
+// The newest movies as an Atom or RSS 2.0 feed. Entries are identified by
+// the movie's UUID, so they keep their identity whatever the PUBLIC_IDS
+// mode. The ETag and Last-Modified change whenever a listed movie does;
+// conditional requests get 304.
+func movieFeed(db *sql.DB, format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT `+movieColumns+` FROM movies
+			WHERE tenant_id=$1 AND deleted_at IS NULL
+			ORDER BY created_at DESC, id DESC LIMIT $2`, tenantFrom(r.Context()), feedSize)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		var movies []Movie
+		// The validators cover every listed movie's last change, so an
+		// edit to an older entry also invalidates caches.
+		h := sha256.New()
+		var modified time.Time
+		for rows.Next() {
+			m, err := scanMovie(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			fmt.Fprintf(h, "%d:%d;", m.ID, m.UpdatedAt.UnixNano())
+			if m.UpdatedAt.After(modified) {
+				modified = m.UpdatedAt
+			}
+			movies = append(movies, m)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if modified.IsZero() {
+			modified = time.Unix(0, 0)
+		}
+
+		self := linkTo(r, r.URL.Path).Href
+		home := linkTo(r, "/movies").Href
+		var doc any
+		contentType := "application/atom+xml; charset=utf-8"
+		if format == "atom" {
+			feed := atomFeed{
+				ID:      self,
+				Title:   "Recently added movies",
+				Updated: modified.UTC().Format(time.RFC3339),
+				Author:  atomPerson{Name: "Movies API"},
+				Links: []atomLink{
+					{Rel: "self", Type: "application/atom+xml", Href: self},
+					{Rel: "alternate", Type: "application/json", Href: home},
+				},
+				Entries: []atomEntry{},
+			}
+			for _, m := range movies {
+				feed.Entries = append(feed.Entries, atomEntry{
+					ID:        "urn:uuid:" + m.UUID,
+					Title:     m.Title,
+					Published: m.CreatedAt.UTC().Format(time.RFC3339),
+					Updated:   m.UpdatedAt.UTC().Format(time.RFC3339),
+					Links:     []atomLink{{Rel: "alternate", Type: "application/json", Href: movieLinks(r, m)["self"].Href}},
+					Summary:   feedSummary(m),
+				})
+			}
+			doc = feed
+		} else {
+			contentType = "application/rss+xml; charset=utf-8"
+			feed := rssFeed{Version: "2.0", Atom: "http://www.w3.org/2005/Atom", Channel: rssChannel{
+				Title:         "Recently added movies",
+				Link:          home,
+				Self:          atomLink{Rel: "self", Type: "application/rss+xml", Href: self},
+				Description:   "The newest titles in the catalog.",
+				LastBuildDate: modified.UTC().Format(time.RFC1123Z),
+				Items:         []rssItem{},
+			}}
+			for _, m := range movies {
+				feed.Channel.Items = append(feed.Channel.Items, rssItem{
+					Title:       m.Title,
+					Link:        movieLinks(r, m)["self"].Href,
+					GUID:        rssGUID{Value: "urn:uuid:" + m.UUID},
+					PubDate:     m.CreatedAt.UTC().Format(time.RFC1123Z),
+					Description: feedSummary(m),
+				})
+			}
+			doc = feed
+		}
+
+		var b bytes.Buffer
+		b.WriteString(xml.Header)
+		enc := xml.NewEncoder(&b)
+		enc.Indent("", "  ")
+		if err := enc.Encode(doc); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(h.Sum(nil)[:16])+`"`)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		// Feeds differ per tenant, which anonymous clients pick by header.
+		w.Header().Add("Vary", tenantHeader)
+		http.ServeContent(w, r, "", modified, bytes.NewReader(b.Bytes()))
+	}
+}
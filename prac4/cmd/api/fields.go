@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// movieFieldColumns maps each selectable movie field to its columns.
+var movieFieldColumns = map[string][]string{
+	"id":            {"id"},
+	"uuid":          {"uuid"},
+	"slug":          {"slug"},
+	"title":         {"title"},
+	"year":          {"year"},
+	"rating":        {"rating"},
+	"genres":        {"genres"},
+	"certification": {"certification"},
+	"external_ids":  {"imdb_id", "tmdb_id"},
+	"metadata":      {"metadata"},
+	"views":         {"views"},
+	"created_at":    {"created_at"},
+	"updated_at":    {"updated_at"},
+}
+
+// movieProjection is the ?fields= selection. Only the selected columns are
+// queried and only the selected fields are rendered. The zero value selects
+// everything.
+type movieProjection struct {
+	fields []string
+}
+
+func parseFields(raw string) (movieProjection, error) {
+	if strings.TrimSpace(raw) == "" {
+		return movieProjection{}, nil
+	}
+	var p movieProjection
+	seen := map[string]bool{}
+	for _, f := range strings.Split(raw, ",") {
+		f = strings.TrimSpace(f)
+		if _, ok := movieFieldColumns[f]; !ok {
+			valid := make([]string, 0, len(movieFieldColumns))
+			for name := range movieFieldColumns {
+				valid = append(valid, name)
+			}
+			sort.Strings(valid)
+			return movieProjection{}, fmt.Errorf("unknown field %q (valid: %s)", f, strings.Join(valid, ", "))
+		}
+		if !seen[f] {
+			seen[f] = true
+			p.fields = append(p.fields, f)
+		}
+	}
+	return p, nil
+}
+
+func (p movieProjection) all() bool {
+	return p.fields == nil
+}
+
+// columns is the SELECT list for the projection. id, uuid and slug are
+// always included, since pagination, relations and links key on them.
+func (p movieProjection) columns() string {
+	if p.all() {
+		return movieColumns
+	}
+	cols := []string{"id", "uuid", "slug"}
+	for _, f := range p.fields {
+		if f != "id" && f != "uuid" && f != "slug" {
+			cols = append(cols, movieFieldColumns[f]...)
+		}
+	}
+	return strings.Join(cols, ", ")
+}
+
+// scan reads a row selected with columns().
+func (p movieProjection) scan(row rowScanner) (Movie, error) {
+	if p.all() {
+		return scanMovie(row)
+	}
+	var (
+		m    Movie
+		year sql.NullInt64
+		cert sql.NullString
+		imdb sql.NullString
+		tmdb sql.NullInt64
+		meta []byte
+	)
+	dest := []any{&m.ID, &m.UUID, &m.Slug}
+	for _, f := range p.fields {
+		switch f {
+		case "title":
+			dest = append(dest, &m.Title)
+		case "year":
+			dest = append(dest, &year)
+		case "rating":
+			dest = append(dest, &m.Rating)
+		case "genres":
+			dest = append(dest, pq.Array(&m.Genres))
+		case "certification":
+			dest = append(dest, &cert)
+		case "external_ids":
+			dest = append(dest, &imdb, &tmdb)
+		case "metadata":
+			dest = append(dest, &meta)
+		case "views":
+			dest = append(dest, &m.Views)
+		case "created_at":
+			dest = append(dest, &m.CreatedAt)
+		case "updated_at":
+			dest = append(dest, &m.UpdatedAt)
+		}
+	}
+	if err := row.Scan(dest...); err != nil {
+		return Movie{}, err
+	}
+	m.Year = int(year.Int64)
+	m.Certification = cert.String
+	m.Metadata = meta
+	if imdb.Valid || tmdb.Valid {
+		m.ExternalIDs = &ExternalIDs{IMDbID: imdb.String, TMDbID: tmdb.Int64}
+	}
+	return m, nil
+}
+
+// render returns m itself, or a map holding only the selected fields.
+// Selected fields that are empty come out as null rather than vanishing.
+func (p movieProjection) render(m Movie) any {
+	if p.all() {
+		return m
+	}
+	full, _ := toFieldMap(m)
+	out := make(map[string]any, len(p.fields))
+	for _, f := range p.fields {
+		out[f] = full[f]
+	}
+	return out
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// whereClause collects the conditions of a WHERE clause with their
+// arguments. Conditions use ? for their values, which become numbered
+// placeholders in the order they were added.
+type whereClause struct {
+	conds []string
+	args  []any
+}
+
+func (wc *whereClause) add(cond string, args ...any) {
+	for _, a := range args {
+		cond = strings.Replace(cond, "?", wc.arg(a), 1)
+	}
+	wc.conds = append(wc.conds, cond)
+}
+
+// arg adds a value that isn't part of a condition, e.g. a LIMIT, and
+// returns its placeholder.
+func (wc *whereClause) arg(v any) string {
+	wc.args = append(wc.args, v)
+	return "$" + strconv.Itoa(len(wc.args))
+}
+
+func (wc *whereClause) String() string {
+	return strings.Join(wc.conds, " AND ")
+}
+
+// movieFilters adds the filters of movie listings and exports to wc: genre,
+// genres (comma-separated; movies with any of them, or with
+// genres_match=all all of them) and certification, which are checked
+// against the cached reference data so an unknown value is a clear 400
+// rather than an empty list, a free-form tag, and the ranges year_min/year_max,
+// rating_min/rating_max and created_after/created_before (RFC 3339,
+// exclusive), and metadata.<path> containment (see metadataFilters). It
+// returns a message for the client on bad input.
+func movieFilters(q url.Values, refs *refData, wc *whereClause) string {
+	if g := q.Get("genre"); g != "" {
+		if !refs.hasGenre(g) {
+			return unknownGenreMessage(refs, g)
+		}
+		wc.add("? = ANY(genres)", g)
+	}
+	if v := q.Get("genres"); v != "" {
+		genres := cleanLabels(strings.Split(v, ","))
+		if len(genres) == 0 {
+			return "genres must name at least one genre"
+		}
+		if g, ok := refs.unknownGenre(genres); ok {
+			return unknownGenreMessage(refs, g)
+		}
+		switch q.Get("genres_match") {
+		case "", "any":
+			wc.add("genres && ?", pq.Array(genres))
+		case "all":
+			wc.add("genres @> ?", pq.Array(genres))
+		default:
+			return "genres_match must be any or all"
+		}
+	}
+	if v := q.Get("tag"); v != "" {
+		tag, ok := normalizeTag(v)
+		if !ok {
+			return "invalid tag"
+		}
+		wc.add("id IN (SELECT mt.movie_id FROM movie_tags mt JOIN tags t ON t.id = mt.tag_id WHERE t.name = ?)", tag)
+	}
+	if c := q.Get("certification"); c != "" {
+		if !refs.hasCertification(c) {
+			return "unknown certification: " + c
+		}
+		wc.add("certification = ?", c)
+	}
+
+	var yearMin, yearMax int
+	for _, p := range []struct {
+		name string
+		cond string
+		dst  *int
+	}{{"year_min", "year >= ?", &yearMin}, {"year_max", "year <= ?", &yearMax}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return p.name + " must be a year"
+			}
+			*p.dst = n
+			wc.add(p.cond, n)
+		}
+	}
+	if yearMin > 0 && yearMax > 0 && yearMin > yearMax {
+		return "year_min must not be after year_max"
+	}
+
+	var ratingMin, ratingMax float64 = 0, 10
+	for _, p := range []struct {
+		name string
+		cond string
+		dst  *float64
+	}{{"rating_min", "rating >= ?", &ratingMin}, {"rating_max", "rating <= ?", &ratingMax}} {
+		if v := q.Get(p.name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 10 {
+				return p.name + " must be between 0 and 10"
+			}
+			*p.dst = f
+			wc.add(p.cond, f)
+		}
+	}
+	if ratingMin > ratingMax {
+		return "rating_min must not be above rating_max"
+	}
+
+	var after, before time.Time
+	for _, p := range []struct {
+		name string
+		cond string
+		dst  *time.Time
+	}{{"created_after", "created_at > ?", &after}, {"created_before", "created_at < ?", &before}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return p.name + " must be an RFC 3339 timestamp"
+			}
+			*p.dst = t
+			wc.add(p.cond, t)
+		}
+	}
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		return "created_after must be before created_before"
+	}
+	return metadataFilters(q, wc)
+}
+
+// unknownGenreMessage names the genres that are known, so the client can
+// correct the filter without another request.
+func unknownGenreMessage(refs *refData, g string) string {
+	return "unknown genre: " + g + " (known genres: " + strings.Join(refs.genreList(), ", ") + ")"
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var flagNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+// Flag gates a behavior that is being rolled out. It is on for a request if
+// it is enabled outright, if the request's tenant is listed, or if the
+// caller falls into the first Percentage of 100 buckets. Buckets are picked
+// per user (per client address when anonymous) and per flag, so the same
+// caller keeps seeing the same behavior.
+type Flag struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Enabled     bool       `json:"enabled"`
+	Percentage  int        `json:"percentage"`
+	Tenants     []int64    `json:"tenants"`
+	Source      string     `json:"source"` // "config" or "database"
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	id          int64
+}
+
+func (f Flag) on(r *http.Request) bool {
+	if f.Enabled || slices.Contains(f.Tenants, tenantFrom(r.Context())) {
+		return true
+	}
+	if f.Percentage <= 0 {
+		return false
+	}
+	subject := "ip:" + clientIPFrom(r)
+	if u := userFrom(r.Context()); u != nil {
+		subject = "user:" + strconv.FormatInt(u.ID, 10)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(f.Name + "/" + subject))
+	return int(h.Sum32()%100) < f.Percentage
+}
+
+// parseFeatureFlags reads FEATURE_FLAGS, e.g. "new_pagination,jsonapi_v2=25%,legacy_ids=off".
+// A bare name is on.
+func parseFeatureFlags(s string) (map[string]Flag, error) {
+	out := map[string]Flag{}
+	for _, part := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		if !flagNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid flag name %q", name)
+		}
+		f := Flag{Name: name, Tenants: []int64{}, Source: "config"}
+		switch value = strings.TrimSpace(value); {
+		case value == "" || value == "on":
+			f.Enabled = true
+		case value == "off":
+		case strings.HasSuffix(value, "%"):
+			n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || n < 0 || n > 100 {
+				return nil, fmt.Errorf("flag %s: percentage must be between 0%% and 100%%", name)
+			}
+			f.Percentage = n
+		default:
+			return nil, fmt.Errorf("flag %s: value must be on, off or a percentage", name)
+		}
+		out[name] = f
+	}
+	return out, nil
+}
+
+// featureFlags is the in-memory set of flags: the FEATURE_FLAGS defaults
+// with the feature_flags table on top. Like refData it is reloaded
+// periodically and whenever the table's trigger sends a cache_invalidate
+// notification.
+type featureFlags struct {
+	db       *sql.DB
+	defaults map[string]Flag
+
+	mu    sync.RWMutex
+	flags map[string]Flag
+}
+
+func newFeatureFlags(db *sql.DB, defaults map[string]Flag) (*featureFlags, error) {
+	ff := &featureFlags{db: db, defaults: defaults}
+	if err := ff.reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return ff, nil
+}
+
+func (ff *featureFlags) reload(ctx context.Context) error {
+	flags := make(map[string]Flag, len(ff.defaults))
+	for name, f := range ff.defaults {
+		flags[name] = f
+	}
+	rows, err := ff.db.QueryContext(ctx, `
+		SELECT id, name, description, enabled, percentage, tenants, updated_at FROM feature_flags`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := Flag{Source: "database"}
+		var updated time.Time
+		if err := rows.Scan(&f.id, &f.Name, &f.Description, &f.Enabled, &f.Percentage, pq.Array(&f.Tenants), &updated); err != nil {
+			return err
+		}
+		f.UpdatedAt = &updated
+		flags[f.Name] = f
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ff.mu.Lock()
+	ff.flags = flags
+	ff.mu.Unlock()
+	return nil
+}
+
+// watch keeps the flags fresh until the process exits; see refData.watch.
+func (ff *featureFlags) watch(dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("feature flag listener: %v", err)
+		}
+	})
+	if err := listener.Listen("cache_invalidate"); err != nil {
+		log.Printf("feature flag listener: %v", err)
+	}
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n != nil && n.Extra != "feature_flags" {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if err := ff.reload(context.Background()); err != nil {
+			log.Printf("feature flag reload: %v", err)
+		}
+	}
+}
+
+// enabled reports whether the flag is on for r. Unknown flags are off.
+func (ff *featureFlags) enabled(r *http.Request, name string) bool {
+	ff.mu.RLock()
+	f, ok := ff.flags[name]
+	ff.mu.RUnlock()
+	return ok && f.on(r)
+}
+
+func (ff *featureFlags) list() []Flag {
+	ff.mu.RLock()
+	out := make([]Flag, 0, len(ff.flags))
+	for _, f := range ff.flags {
+		out = append(out, f)
+	}
+	ff.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// GET /flags tells clients which flags are on for them, so they can follow
+// the behavior the API is rolling out.
+func listMyFlags(ff *featureFlags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out := map[string]bool{}
+		for _, f := range ff.list() {
+			out[f.Name] = f.on(r)
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// GET /admin/flags
+func adminListFlags(ff *featureFlags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ff.list())
+	}
+}
+
+// PUT /admin/flags/{name} creates or replaces the stored flag, which takes
+// precedence over a FEATURE_FLAGS default of the same name.
+func adminPutFlag(db *sql.DB, ff *featureFlags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !flagNameRe.MatchString(name) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "flag names are lowercase letters, digits and underscores"})
+			return
+		}
+		var in struct {
+			Description string  `json:"description"`
+			Enabled     bool    `json:"enabled"`
+			Percentage  int     `json:"percentage"`
+			Tenants     []int64 `json:"tenants"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if in.Percentage < 0 || in.Percentage > 100 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "percentage must be between 0 and 100"})
+			return
+		}
+		slices.Sort(in.Tenants)
+		in.Tenants = slices.Compact(in.Tenants)
+		if in.Tenants == nil {
+			in.Tenants = []int64{}
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		var known int
+		if err := tx.QueryRow(`SELECT count(*) FROM tenants WHERE id = ANY($1)`, pq.Array(in.Tenants)).Scan(&known); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if known != len(in.Tenants) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "tenants contains an unknown tenant id"})
+			return
+		}
+
+		var before *Flag
+		old := Flag{Name: name}
+		err = tx.QueryRow(`
+			SELECT description, enabled, percentage, tenants FROM feature_flags WHERE name=$1 FOR UPDATE`, name).
+			Scan(&old.Description, &old.Enabled, &old.Percentage, pq.Array(&old.Tenants))
+		switch {
+		case err == nil:
+			before = &old
+		case err != sql.ErrNoRows:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		f := Flag{Name: name, Description: strings.TrimSpace(in.Description), Enabled: in.Enabled,
+			Percentage: in.Percentage, Tenants: in.Tenants, Source: "database"}
+		var updated time.Time
+		err = tx.QueryRow(`
+			INSERT INTO feature_flags (name, description, enabled, percentage, tenants) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (name) DO UPDATE SET description=EXCLUDED.description, enabled=EXCLUDED.enabled,
+				percentage=EXCLUDED.percentage, tenants=EXCLUDED.tenants, updated_at=now()
+			RETURNING id, updated_at`,
+			f.Name, f.Description, f.Enabled, f.Percentage, pq.Array(f.Tenants)).Scan(&f.id, &updated)
+		f.UpdatedAt = &updated
+		if err == nil {
+			action := "update"
+			if before == nil {
+				action = "create"
+			}
+			after := f
+			after.Source, after.UpdatedAt = "", nil
+			err = recordAudit(r, tx, "feature_flag", f.id, action, before, after)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err == nil {
+			err = ff.reload(r.Context())
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		code := http.StatusOK
+		if before == nil {
+			code = http.StatusCreated
+		}
+		writeJSON(w, code, f)
+	}
+}
+
+// DELETE /admin/flags/{name} removes the stored flag; a FEATURE_FLAGS
+// default of the same name applies again.
+func adminDeleteFlag(db *sql.DB, ff *featureFlags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		before := Flag{Name: r.PathValue("name")}
+		err = tx.QueryRow(`
+			DELETE FROM feature_flags WHERE name=$1
+			RETURNING id, description, enabled, percentage, tenants`, before.Name).
+			Scan(&before.id, &before.Description, &before.Enabled, &before.Percentage, pq.Array(&before.Tenants))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "feature_flag", before.id, "delete", before, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err == nil {
+			err = ff.reload(r.Context())
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// cleanLabels trims names (genres, event types, ...), drops empty entries and
+// duplicates while keeping the client's order. It always returns a non-nil
+// slice so the column never ends up NULL and responses render [] rather than
+// null.
+func cleanLabels(in []string) []string {
+	out := []string{}
+	seen := make(map[string]bool, len(in))
+	for _, g := range in {
+		g = strings.Join(strings.Fields(g), " ")
+		if g == "" || seen[g] {
+			continue
+		}
+		seen[g] = true
+		out = append(out, g)
+	}
+	return out
+}
+
+// POST /admin/genres/rename
+//
+// Renames a genre across every tenant's catalog. If a movie already carries
+// the target genre the two are merged, so this doubles as the merge
+// operation (e.g. "Sci Fi" -> "Science Fiction"). Everything happens in one
+// transaction, including an audit entry per affected movie (in the movie's
+// tenant) and the update of the genres reference table, whose trigger
+// announces the cache invalidation with NOTIFY once the change is committed.
+func renameGenre(db *sql.DB, schemas bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		in.From = strings.Join(strings.Fields(in.From), " ")
+		in.To = strings.Join(strings.Fields(in.To), " ")
+		if in.From == "" || in.To == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "from and to are required"})
+			return
+		}
+		if in.From == in.To {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "from and to must differ"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		ids := []int64{}
+		err = inEachTenant(r.Context(), tx, schemas, func() error {
+			renamed, err := renameGenreIn(r, tx, in.From, in.To)
+			ids = append(ids, renamed...)
+			return err
+		})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		// Keep the reference table in step; its trigger notifies the caches.
+		if _, err := tx.ExecContext(r.Context(), `INSERT INTO genres (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, in.To); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, err := tx.ExecContext(r.Context(), `DELETE FROM genres WHERE name=$1`, in.From); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		countEvent(eventGenreRenamed)
+		log.Printf("genre renamed from=%q to=%q movies=%v", in.From, in.To, ids)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"from":           in.From,
+			"to":             in.To,
+			"movies_updated": len(ids),
+			"movie_ids":      ids,
+		})
+	}
+}
+
+// renameGenreIn renames the genre on the movies tx sees and audits each
+// change in the movie's tenant. It returns the ids of the changed movies.
+func renameGenreIn(r *http.Request, tx *sql.Tx, from, to string) ([]int64, error) {
+	// array_replace may leave the target twice when merging; rebuild the
+	// array keeping the first occurrence of each genre in its position.
+	rows, err := tx.QueryContext(r.Context(), `
+		WITH old AS (
+			SELECT id, genres FROM movies WHERE $1 = ANY(genres) FOR UPDATE
+		)
+		UPDATE movies m SET genres = ARRAY(
+			SELECT g FROM unnest(array_replace(m.genres, $1, $2)) WITH ORDINALITY AS t(g, n)
+			GROUP BY g ORDER BY min(n)
+		)
+		FROM old WHERE m.id = old.id
+		RETURNING m.id, m.tenant_id, old.genres, m.genres`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	type change struct {
+		id, tenant    int64
+		before, after []string
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.id, &c.tenant, pq.Array(&c.before), pq.Array(&c.after)); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, c := range changes {
+		err := recordAuditIn(r, tx, c.tenant, "movie", c.id, "update",
+			map[string]any{"genres": c.before}, map[string]any{"genres": c.after})
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, c.id)
+	}
+	return ids, nil
+}
+
+type Genre struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// POST /admin/genres adds a genre to the reference list.
+func createGenre(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Name string `json:"name"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		g := Genre{Name: strings.Join(strings.Fields(in.Name), " ")}
+		if g.Name == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(`INSERT INTO genres (name) VALUES ($1) RETURNING id`, g.Name).Scan(&g.ID)
+		if isUniqueViolation(err) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "genre already exists"})
+			return
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "genre", g.ID, "create", nil, g)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, g)
+	}
+}
+
+// DELETE /admin/genres/{name}
+//
+// Only unused genres can be deleted; merge a genre that is still in use into
+// another one with the rename operation instead.
+func deleteGenre(db *sql.DB, schemas bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		var inUse bool
+		err = inEachTenant(r.Context(), tx, schemas, func() error {
+			var used bool
+			err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM movies WHERE $1 = ANY(genres))`, name).Scan(&used)
+			inUse = inUse || used
+			return err
+		})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if inUse {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "genre is in use; rename it into another genre instead"})
+			return
+		}
+
+		g := Genre{Name: name}
+		err = tx.QueryRow(`DELETE FROM genres WHERE name=$1 RETURNING id`, name).Scan(&g.ID)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "genre", g.ID, "delete", g, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// importBatchSize is how many rows go through COPY before they are moved
+// into movies and progress is logged.
+const importBatchSize = 5000
+
+// movieRecord is one row on its way into the movies table in bulk.
+type movieRecord struct {
+	movieInput
+	ExternalIDs *ExternalIDs `json:"external_ids"`
+}
+
+type importSummary struct {
+	Received          int64   `json:"received"`
+	Imported          int64   `json:"imported"`
+	SkippedDuplicates int64   `json:"skipped_duplicates"`
+	Batches           int     `json:"batches"`
+	Seconds           float64 `json:"seconds"`
+}
+
+// movieCopier loads movies with COPY into a temporary staging table and
+// moves each batch into movies with a single INSERT ... SELECT, which is
+// far faster than row-by-row INSERTs. Rows clashing with an existing
+// external ID are skipped rather than failing the batch; see flush.
+type movieCopier struct {
+	tx      *sql.Tx
+	tenant  int64
+	pending []movieRecord
+	sum     importSummary
+	started time.Time
+}
+
+func newMovieCopier(ctx context.Context, tx *sql.Tx) (*movieCopier, error) {
+	_, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE movie_import (
+		  title TEXT, genres TEXT[], certification TEXT, year INTEGER,
+		  rating NUMERIC(3, 1), imdb_id TEXT, tmdb_id BIGINT, metadata JSONB
+		) ON COMMIT DROP`)
+	if err != nil {
+		return nil, err
+	}
+	return &movieCopier{tx: tx, tenant: tenantFrom(ctx), started: time.Now()}, nil
+}
+
+// add queues a validated record, flushing a full batch.
+func (c *movieCopier) add(ctx context.Context, rec movieRecord) error {
+	c.sum.Received++
+	c.pending = append(c.pending, rec)
+	if len(c.pending) >= importBatchSize {
+		return c.flush(ctx)
+	}
+	return nil
+}
+
+func (c *movieCopier) flush(ctx context.Context) error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	stmt, err := c.tx.PrepareContext(ctx, pq.CopyIn("movie_import",
+		"title", "genres", "certification", "year", "rating", "imdb_id", "tmdb_id", "metadata"))
+	if err != nil {
+		return err
+	}
+	for _, rec := range c.pending {
+		imdb, tmdb := rec.ExternalIDs.nullable()
+		var year, cert, meta any
+		if rec.Year != 0 {
+			year = rec.Year
+		}
+		if len(rec.Metadata) > 0 {
+			meta = string(rec.Metadata)
+		}
+		if rec.Certification != "" {
+			cert = rec.Certification
+		}
+		if _, err := stmt.ExecContext(ctx, rec.Title, pq.Array(rec.Genres), cert, year, rec.Rating, imdb, tmdb, meta); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	// Imports are audited as a whole, so the new movies are queued for the
+	// search indexer here. Rows whose imdb id is taken are skipped by the
+	// ON CONFLICT, and rows whose tmdb id is taken by the WHERE. A clash on
+	// the slug or tmdb id with a movie another transaction adds meanwhile
+	// runs the batch again; nothing else counts as a duplicate.
+	var n int64
+	err = retryInsert(ctx, c.tx, func() error {
+		res, err := c.tx.ExecContext(ctx, `
+			WITH imported AS (
+				INSERT INTO movies (tenant_id, title, genres, certification, year, rating, imdb_id, tmdb_id, metadata)
+				SELECT $1, title, genres, certification, year, rating, imdb_id, tmdb_id, coalesce(metadata, '{}')
+				FROM (SELECT *, ctid AS ord, row_number() OVER (PARTITION BY tmdb_id ORDER BY ctid) AS k FROM movie_import) i
+				WHERE tmdb_id IS NULL OR (k = 1 AND NOT EXISTS (
+					SELECT 1 FROM movies m WHERE m.tenant_id = $1 AND m.tmdb_id = i.tmdb_id AND m.deleted_at IS NULL))
+				ORDER BY ord
+				ON CONFLICT (tenant_id, imdb_id) WHERE deleted_at IS NULL DO NOTHING
+				RETURNING id
+			)
+			INSERT INTO search_outbox (tenant_id, movie_id) SELECT $1, id FROM imported`, c.tenant)
+		if err == nil {
+			n, err = res.RowsAffected()
+		}
+		return err
+	}, slugKey, "movies_tmdb_id_key")
+	if err != nil {
+		return err
+	}
+	if _, err := c.tx.ExecContext(ctx, `TRUNCATE movie_import`); err != nil {
+		return err
+	}
+	c.sum.Imported += n
+	c.sum.SkippedDuplicates += int64(len(c.pending)) - n
+	c.sum.Batches++
+	c.pending = c.pending[:0]
+
+	elapsed := time.Since(c.started)
+	log.Printf("import: %d rows received, %d imported in %d batches (%.0f rows/s)",
+		c.sum.Received, c.sum.Imported, c.sum.Batches, float64(c.sum.Received)/elapsed.Seconds())
+	return nil
+}
+
+// finish flushes what's left and returns the totals.
+func (c *movieCopier) finish(ctx context.Context) (importSummary, error) {
+	err := c.flush(ctx)
+	c.sum.Seconds = time.Since(c.started).Seconds()
+	return c.sum, err
+}
+
+// importReader decodes the rows of an import body as they arrive: a JSON
+// array of movies in the create format, or NDJSON with one per line.
+// Unknown fields are ignored so an export (ids, timestamps) imports as is.
+type importReader struct {
+	dec     *json.Decoder
+	ndjson  bool
+	started bool
+	row     int // index of the last row returned
+}
+
+func newImportReader(r io.Reader, ndjson bool) *importReader {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return &importReader{dec: dec, ndjson: ndjson, row: -1}
+}
+
+// errNotAnArray is a body that isn't the JSON array an import expects.
+var errNotAnArray = &bodyError{"body must be a JSON array of movies"}
+
+// isNDJSON reports whether r's body is NDJSON rather than a JSON array.
+func isNDJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == ndjsonMediaType
+}
+
+// next returns the next row, validated, with a message saying what is wrong
+// with it if anything; the caller decides whether that rejects the import.
+// A body that can't be decoded any further is an error, and the end of it
+// io.EOF.
+func (ir *importReader) next(refs *refData) (movieRecord, string, error) {
+	var rec movieRecord
+	if !ir.ndjson {
+		if !ir.started {
+			if tok, err := ir.dec.Token(); err != nil || tok != json.Delim('[') {
+				return rec, "", errNotAnArray
+			}
+			ir.started = true
+		}
+		if !ir.dec.More() {
+			if _, err := ir.dec.Token(); err != nil {
+				return rec, "", errNotAnArray
+			}
+			return rec, "", io.EOF
+		}
+	}
+	err := ir.dec.Decode(&rec)
+	if ir.ndjson && err == io.EOF {
+		return rec, "", io.EOF
+	}
+	ir.row++
+	// A value of the wrong type is skipped whole, so the rows after it
+	// still decode; anything else leaves the decoder lost.
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return rec, invalidJSON(explainJSONError(err)), nil
+	}
+	if err != nil {
+		return rec, "", &bodyError{fmt.Sprintf("row %d: invalid json", ir.row)}
+	}
+	msg := rec.normalize(refs)
+	if msg == "" {
+		msg = rec.ExternalIDs.validate()
+	}
+	return rec, msg, nil
+}
+
+// POST /movies/import
+//
+// Bulk-creates movies from a JSON array in the create format, or from
+// NDJSON (Content-Type application/x-ndjson), one movie per line, as
+// exported with format=ndjson; see importReader. The body is decoded as it
+// arrives, so it can be far larger than memory. The import is all or
+// nothing: one invalid row rejects it with the row's index. It is audited
+// as a single entry rather than one per movie. For imports that take long,
+// see POST /imports.
+func importMovies(db *sql.DB, refs *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Every way out but a finished import counts as a failed one.
+		done := false
+		defer func() {
+			if !done && !isDryRun(r) {
+				countEvent(eventImportFailed)
+			}
+		}()
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		copier, err := newMovieCopier(r.Context(), tx)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		ir := newImportReader(r.Body, isNDJSON(r))
+		for {
+			rec, msg, err := ir.next(refs)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+				return
+			}
+			if msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("row %d: %s", ir.row, msg)})
+				return
+			}
+			if err := copier.add(r.Context(), rec); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+
+		sum, err := copier.finish(r.Context())
+		if err == nil {
+			err = recordAudit(r, tx, "import", 0, "create", nil, sum)
+		}
+		if err == nil {
+			err = commitUnlessDryRun(w, r, tx)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		done = true
+		if !isDryRun(r) {
+			countEvent(eventMoviesImported)
+		}
+		writeJSON(w, http.StatusOK, sum)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxActiveImports is how many import jobs a user may have queued or
+	// running at once.
+	maxActiveImports = 3
+	// importErrorsShown is how many row errors a job reports itself; the
+	// report file has all of them.
+	importErrorsShown = 20
+)
+
+// importRowError is a row an import job skipped, and why.
+type importRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportJob is a background POST /movies/import of an uploaded file.
+// Unlike the synchronous import it skips invalid rows, reporting them,
+// rather than rejecting the whole file; a file that can't be decoded to
+// the end imports nothing.
+type ImportJob struct {
+	ID                int64            `json:"id"`
+	Format            string           `json:"format"`
+	Bytes             int64            `json:"bytes"`
+	Status            string           `json:"status"`
+	Processed         int64            `json:"processed"`
+	Imported          int64            `json:"imported"`
+	SkippedDuplicates int64            `json:"skipped_duplicates"`
+	Failed            int64            `json:"failed"`
+	Errors            []importRowError `json:"errors"`
+	Error             string           `json:"error,omitempty"`
+	ErrorsURL         string           `json:"errors_url,omitempty"`
+	CreatedAt         time.Time        `json:"created_at"`
+	StartedAt         *time.Time       `json:"started_at"`
+	FinishedAt        *time.Time       `json:"finished_at"`
+	ExpiresAt         *time.Time       `json:"expires_at"`
+
+	tenant    int64
+	userID    int64
+	requestID string
+	key       []byte
+}
+
+const importJobColumns = `id, format, bytes, status, processed, imported, skipped_duplicates, failed, errors, error,
+	created_at, started_at, finished_at, expires_at, tenant_id, user_id, request_id, download_key`
+
+func scanImportJob(row rowScanner) (ImportJob, error) {
+	var (
+		job  ImportJob
+		errs []byte
+	)
+	err := row.Scan(&job.ID, &job.Format, &job.Bytes, &job.Status, &job.Processed, &job.Imported, &job.SkippedDuplicates,
+		&job.Failed, &errs, &job.Error, &job.CreatedAt, &job.StartedAt, &job.FinishedAt, &job.ExpiresAt,
+		&job.tenant, &job.userID, &job.requestID, &job.key)
+	if err == nil {
+		err = json.Unmarshal(errs, &job.Errors)
+	}
+	return job, err
+}
+
+// withLinks sets the signed link to the error report of a finished job
+// that skipped rows; see signedLink.
+func (job *ImportJob) withLinks(r *http.Request) {
+	if job.Failed > 0 && job.FinishedAt != nil && job.ExpiresAt != nil {
+		job.ErrorsURL = signedLink(r, "/imports/"+strconv.FormatInt(job.ID, 10)+"/errors", job.key, *job.ExpiresAt)
+	}
+}
+
+// importer runs import jobs on a jobWorker, so IMPORT_DIR must be shared
+// by all instances.
+type importer struct {
+	db       *sql.DB
+	refs     *refData
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+	jobs     *jobWorker[ImportJob]
+}
+
+func newImporter(db *sql.DB, refs *refData, cfg config) (*importer, error) {
+	if err := os.MkdirAll(cfg.ImportDir, 0o755); err != nil {
+		return nil, err
+	}
+	im := &importer{db: db, refs: refs, dir: cfg.ImportDir, ttl: cfg.ImportTTL, maxBytes: cfg.ImportMaxBytes}
+	// A run that died committed nothing, so its counts start over.
+	im.jobs = &jobWorker[ImportJob]{db: db, name: "import", columns: importJobColumns, scan: scanImportJob,
+		requeue: `, processed=0, imported=0, skipped_duplicates=0, failed=0, errors='[]'`,
+		process: im.process, prune: im.prune, kick: make(chan struct{}, 1)}
+	return im, nil
+}
+
+func (im *importer) uploadPath(id int64, format string) string {
+	return filepath.Join(im.dir, "import-"+strconv.FormatInt(id, 10)+"."+format)
+}
+
+func (im *importer) reportPath(id int64) string {
+	return filepath.Join(im.dir, "import-"+strconv.FormatInt(id, 10)+"-errors.ndjson")
+}
+
+// importProgress is what a running job has done so far.
+type importProgress struct {
+	processed int64
+	failed    int64
+	errors    []importRowError
+	copier    *movieCopier
+}
+
+// save records p on job id, outside the import's transaction so that
+// GET /imports/{id} sees it while the job runs.
+func (im *importer) save(ctx context.Context, id int64, p *importProgress, extra string, args ...any) error {
+	errs, _ := json.Marshal(p.errors)
+	var imported, skipped int64
+	if p.copier != nil {
+		imported, skipped = p.copier.sum.Imported, p.copier.sum.SkippedDuplicates
+	}
+	_, err := im.db.ExecContext(ctx, `
+		UPDATE import_jobs SET processed=$2, imported=$3, skipped_duplicates=$4, failed=$5, errors=$6, heartbeat_at=now()`+extra+`
+		WHERE id=$1`, append([]any{id, p.processed, imported, skipped, p.failed, errs}, args...)...)
+	return err
+}
+
+// process loads the upload of job and records the outcome. The upload is
+// removed when it is done; the error report stays until the job expires.
+func (im *importer) process(job ImportJob) {
+	ctx := context.WithValue(context.Background(), ctxTenant, tenantScope{id: job.tenant})
+	started := time.Now()
+	p := &importProgress{errors: []importRowError{}}
+	stop := im.jobs.heartbeat(job.ID)
+	err := im.load(ctx, job, p)
+	stop()
+	os.Remove(im.uploadPath(job.ID, job.Format))
+
+	status, msg := "succeeded", ""
+	if err != nil {
+		status, msg = "failed", err.Error()
+		// Nothing was committed.
+		if p.copier != nil {
+			p.copier.sum.Imported, p.copier.sum.SkippedDuplicates = 0, 0
+		}
+		log.Printf("import job %d: %v", job.ID, err)
+		countEvent(eventImportFailed)
+	} else {
+		log.Printf("import job %d: %d rows, %d imported, %d failed in %s",
+			job.ID, p.processed, p.copier.sum.Imported, p.failed, time.Since(started).Round(time.Millisecond))
+		countEvent(eventMoviesImported)
+	}
+	uerr := im.save(ctx, job.ID, p, `, status=$7, error=$8, finished_at=now(), expires_at=now() + $9 * interval '1 second'`,
+		status, msg, im.ttl.Seconds())
+	if uerr != nil {
+		log.Printf("import job %d: %v", job.ID, uerr)
+	}
+}
+
+// load imports the rows of job's upload in one transaction, writing the
+// rows it skips to the error report.
+func (im *importer) load(ctx context.Context, job ImportJob, p *importProgress) error {
+	in, err := os.Open(im.uploadPath(job.ID, job.Format))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	report, err := os.Create(im.reportPath(job.ID))
+	if err != nil {
+		return err
+	}
+	defer report.Close()
+	rw := bufio.NewWriter(report)
+	enc := json.NewEncoder(rw)
+
+	tx, err := im.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if p.copier, err = newMovieCopier(ctx, tx); err != nil {
+		return err
+	}
+
+	ir := newImportReader(bufio.NewReader(in), job.Format == "ndjson")
+	for {
+		rec, msg, err := ir.next(im.refs)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p.processed++
+		if msg != "" {
+			p.failed++
+			rowErr := importRowError{Row: ir.row, Error: msg}
+			if len(p.errors) < importErrorsShown {
+				p.errors = append(p.errors, rowErr)
+			}
+			if err := enc.Encode(rowErr); err != nil {
+				return err
+			}
+		} else if err := p.copier.add(ctx, rec); err != nil {
+			return err
+		}
+		if p.processed%importBatchSize == 0 {
+			if err := im.save(ctx, job.ID, p, ""); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+
+	sum, err := p.copier.finish(ctx)
+	var changes []byte
+	if err == nil {
+		var diff map[string]fieldChange
+		diff, err = diffFields(nil, sum)
+		changes, _ = json.Marshal(diff)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO audit_log (tenant_id, entity, entity_id, action, actor, request_id, changes)
+			VALUES ($1, 'import', $2, 'create', $3, $4, $5)`,
+			job.tenant, job.ID, "user:"+strconv.FormatInt(job.userID, 10), job.requestID, changes)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// prune deletes expired jobs and their error reports.
+func (im *importer) prune(ctx context.Context) error {
+	rows, err := im.db.QueryContext(ctx, `DELETE FROM import_jobs WHERE expires_at < now() RETURNING id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if err := os.Remove(im.reportPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("import prune: %v", err)
+		}
+	}
+	return rows.Err()
+}
+
+// POST /imports
+//
+// Queues an import of the body, a JSON array or NDJSON as for
+// POST /movies/import, for files too large to load within one request. The
+// body is stored first and loaded in the background; poll GET /imports/{id}
+// for progress. A body over IMPORT_MAX_BYTES is refused with 413.
+func createImport(db *sql.DB, im *importer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := userFrom(r.Context())
+		var active int
+		err := db.QueryRowContext(r.Context(), `
+			SELECT count(*) FROM import_jobs WHERE user_id=$1 AND status IN ('queued', 'running')`, u.ID).Scan(&active)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if active >= maxActiveImports {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many imports in progress; wait for one to finish"})
+			return
+		}
+
+		format := "json"
+		if isNDJSON(r) {
+			format = "ndjson"
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		f, err := os.CreateTemp(im.dir, "upload-*.tmp")
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer os.Remove(f.Name())
+		size, err := io.Copy(f, http.MaxBytesReader(w, r.Body, im.maxBytes))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{
+				"error": "imports are limited to " + strconv.FormatInt(tooLarge.Limit, 10) + " bytes"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reading body: " + err.Error()})
+			return
+		}
+		if size == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body is empty"})
+			return
+		}
+
+		// The job is queued once its upload is in place.
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		job, err := scanImportJob(tx.QueryRowContext(r.Context(), `
+			INSERT INTO import_jobs (tenant_id, user_id, request_id, format, bytes, download_key)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING `+importJobColumns,
+			tenantFrom(r.Context()), u.ID, requestIDFrom(r.Context()), format, size, key))
+		if err == nil {
+			err = os.Rename(f.Name(), im.uploadPath(job.ID, format))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			os.Remove(im.uploadPath(job.ID, format))
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		im.jobs.wake()
+		w.Header().Set("Location", "/imports/"+strconv.FormatInt(job.ID, 10))
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// GET /imports
+//
+// The caller's import jobs, newest first.
+func listImports(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT `+importJobColumns+` FROM import_jobs WHERE user_id=$1 ORDER BY created_at DESC, id DESC`,
+			userFrom(r.Context()).ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+		out := []ImportJob{}
+		for rows.Next() {
+			job, err := scanImportJob(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			job.withLinks(r)
+			out = append(out, job)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// userImportJob loads the caller's import job named by the path, answering
+// the request itself if it can't.
+func userImportJob(w http.ResponseWriter, r *http.Request, db *sql.DB) (ImportJob, bool) {
+	id, ok := pathID(r)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return ImportJob{}, false
+	}
+	job, err := scanImportJob(db.QueryRowContext(r.Context(), `
+		SELECT `+importJobColumns+` FROM import_jobs WHERE id=$1 AND user_id=$2`, id, userFrom(r.Context()).ID))
+	if err == sql.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "import not found"})
+		return ImportJob{}, false
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return ImportJob{}, false
+	}
+	return job, true
+}
+
+// GET /imports/{id}
+//
+// The progress of one of the caller's import jobs: rows processed, movies
+// imported and the first errors so far, updated every few thousand rows.
+// Once it has finished with skipped rows, errors_url links the full report.
+func getImport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := userImportJob(w, r, db)
+		if !ok {
+			return
+		}
+		job.withLinks(r)
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+// GET /imports/{id}/errors?expires=...&signature=...
+//
+// Every row a finished import job skipped, as NDJSON of row index and
+// error. Like an export download the signature is the authorization, so
+// the errors_url of the job can be passed on to whoever fixes the file.
+func importErrors(db *sql.DB, im *importer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		denied := func() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "invalid or expired download link"})
+		}
+		job, err := scanImportJob(db.QueryRowContext(r.Context(), `
+			SELECT `+importJobColumns+` FROM import_jobs WHERE id=$1 AND finished_at IS NOT NULL AND expires_at > now()`, id))
+		if err == sql.ErrNoRows {
+			denied()
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		expires, ok := signedUntil(r, job.key)
+		if !ok {
+			denied()
+			return
+		}
+
+		f, err := os.Open(im.reportPath(job.ID))
+		if errors.Is(err, os.ErrNotExist) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "import has no error report"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", ndjsonMediaType)
+		w.Header().Set("Content-Disposition", `attachment; filename="import-`+strconv.FormatInt(job.ID, 10)+`-errors.ndjson"`)
+		serveSigned(w, expires)
+		http.ServeContent(w, r, "", *job.FinishedAt, f)
+	}
+}
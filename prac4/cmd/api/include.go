@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// includeParallelism caps how many relation queries one detail request may
+// run at once, so a single ?include= can't drain the connection pool.
+const includeParallelism = 4
+
+// relationLoader fetches one relation of a movie for ?include=.
+type relationLoader func(ctx context.Context, db *sql.DB, movieID int64) (any, error)
+
+var relationLoaders = map[string]relationLoader{
+	"translations": func(ctx context.Context, db *sql.DB, id int64) (any, error) {
+		return queryTranslations(ctx, db, id)
+	},
+	"similar": loadSimilar,
+}
+
+// parseIncludes validates a comma-separated ?include= value.
+func parseIncludes(raw string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if _, ok := relationLoaders[name]; !ok {
+			valid := make([]string, 0, len(relationLoaders))
+			for k := range relationLoaders {
+				valid = append(valid, k)
+			}
+			sort.Strings(valid)
+			return nil, fmt.Errorf("unknown include %q (valid: %s)", name, strings.Join(valid, ", "))
+		}
+		seen[name] = true
+		out = append(out, name)
+	}
+	return out, nil
+}
+
+type movieDetail struct {
+	Movie
+	Localized *Localized     `json:"localized,omitempty"`
+	Included  map[string]any `json:"included,omitempty"`
+	Links     links          `json:"_links,omitempty"`
+}
+
+// loadMovieDetail fetches a movie and the requested relations concurrently.
+// The first failure cancels the remaining queries. A missing movie is
+// reported as sql.ErrNoRows.
+func loadMovieDetail(ctx context.Context, db *sql.DB, id int64, includes []string, proj movieProjection) (movieDetail, error) {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(includeParallelism)
+
+	var d movieDetail
+	g.Go(func() error {
+		m, err := proj.scan(db.QueryRowContext(ctx, `
+			SELECT `+proj.columns()+` FROM movies WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL`, id, tenantFrom(ctx)))
+		d.Movie = m
+		return err
+	})
+
+	results := make([]any, len(includes))
+	for i, name := range includes {
+		load := relationLoaders[name]
+		g.Go(func() error {
+			v, err := load(ctx, db, id)
+			if err != nil {
+				return fmt.Errorf("include %s: %w", name, err)
+			}
+			results[i] = v
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return movieDetail{}, err
+	}
+
+	if len(includes) > 0 {
+		d.Included = make(map[string]any, len(includes))
+		for i, name := range includes {
+			d.Included[name] = results[i]
+		}
+	}
+	return d, nil
+}
+
+// render applies a ?fields= projection; included relations are kept.
+func (d movieDetail) render(proj movieProjection) any {
+	if proj.all() {
+		return d
+	}
+	out := proj.render(d.Movie).(map[string]any)
+	if d.Localized != nil {
+		out["localized"] = d.Localized
+	}
+	if d.Included != nil {
+		out["included"] = d.Included
+	}
+	if d.Links != nil {
+		out["_links"] = d.Links
+	}
+	return out
+}
+
+// loadSimilar returns up to five titles that look like the movie's title.
+func loadSimilar(ctx context.Context, db *sql.DB, id int64) (any, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT o.id, o.title FROM movies m
+		JOIN movies o ON o.tenant_id = m.tenant_id AND o.id <> m.id AND o.title % m.title AND o.deleted_at IS NULL
+		WHERE m.id = $1 AND m.tenant_id = $2
+		ORDER BY similarity(o.title, m.title) DESC, o.id
+		LIMIT 5`, id, tenantFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []suggestion{}
+	for rows.Next() {
+		var s suggestion
+		if err := rows.Scan(&s.ID, &s.Title); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
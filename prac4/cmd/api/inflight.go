@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// inflightLimiter caps concurrent requests. Up to maxQueue more wait for a
+// slot, for at most queueTimeout; anything beyond gets an immediate 503 so
+// latency stays bounded instead of spiralling under overload.
+type inflightLimiter struct {
+	slots        chan struct{}
+	maxQueue     int64
+	queueTimeout time.Duration
+
+	queued atomic.Int64
+}
+
+func newInflightLimiter(maxInFlight, maxQueue int, queueTimeout time.Duration) *inflightLimiter {
+	l := &inflightLimiter{
+		slots:        make(chan struct{}, maxInFlight),
+		maxQueue:     int64(maxQueue),
+		queueTimeout: queueTimeout,
+	}
+	metrics.GaugeFunc("http_requests_in_flight", "Requests currently being served.", func() float64 {
+		return float64(len(l.slots))
+	})
+	metrics.GaugeFunc("http_requests_queued", "Requests waiting for an in-flight slot.", func() float64 {
+		return float64(l.queued.Load())
+	})
+	return l
+}
+
+func (l *inflightLimiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Probes must keep answering while the API is overloaded.
+		if r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if !l.wait(r) {
+				metrics.Inc("http_requests_shed_total", "Requests rejected by the in-flight limit.")
+				w.Header().Set("Retry-After", "1")
+				writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "server overloaded, try again shortly"})
+				return
+			}
+		}
+		defer func() { <-l.slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait queues r for a slot, reporting whether it got one.
+func (l *inflightLimiter) wait(r *http.Request) bool {
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	t := time.NewTimer(l.queueTimeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	// jobPollInterval is how often a worker looks for queued jobs that
+	// another instance accepted.
+	jobPollInterval = 5 * time.Second
+	// jobHeartbeat is how often a running job records that its instance is
+	// alive; a job silent for jobStaleAfter is queued again.
+	jobHeartbeat  = 30 * time.Second
+	jobStaleAfter = 2 * time.Minute
+)
+
+// jobWorker runs the jobs queued in one table, export_jobs or import_jobs,
+// one at a time. Jobs are claimed from the table, so with several
+// instances each job runs once, wherever it was accepted.
+type jobWorker[J any] struct {
+	db      *sql.DB
+	name    string // export or import, naming the table <name>_jobs
+	columns string
+	scan    func(rowScanner) (J, error)
+	// requeue resets, as more SET clauses, what a run that died left on
+	// its job.
+	requeue string
+	process func(J)
+	prune   func(context.Context) error
+	kick    chan struct{}
+}
+
+// wake starts the worker on a job accepted by this instance without
+// waiting for the next poll.
+func (jw *jobWorker[J]) wake() {
+	select {
+	case jw.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run works through queued jobs until the process exits, and prunes
+// expired jobs along the way.
+func (jw *jobWorker[J]) run() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := jw.prune(context.Background()); err != nil {
+			log.Printf("%s prune: %v", jw.name, err)
+		}
+		for {
+			job, err := jw.claim(context.Background())
+			if err == sql.ErrNoRows {
+				break
+			}
+			if err != nil {
+				log.Printf("%s claim: %v", jw.name, err)
+				break
+			}
+			jw.process(job)
+		}
+		select {
+		case <-jw.kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim marks the oldest queued job running and returns it. A running job
+// whose heartbeat has stopped belonged to an instance that died, and is
+// queued again first.
+func (jw *jobWorker[J]) claim(ctx context.Context) (J, error) {
+	res, err := jw.db.ExecContext(ctx, `
+		UPDATE `+jw.name+`_jobs SET status='queued', started_at=NULL, heartbeat_at=NULL`+jw.requeue+`
+		WHERE status='running' AND heartbeat_at < now() - $1 * interval '1 second'`, jobStaleAfter.Seconds())
+	if err != nil {
+		var zero J
+		return zero, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("%s claim: queued %d jobs of stopped instances again", jw.name, n)
+	}
+	return jw.scan(jw.db.QueryRowContext(ctx, `
+		UPDATE `+jw.name+`_jobs SET status='running', started_at=now(), heartbeat_at=now()
+		WHERE id = (SELECT id FROM `+jw.name+`_jobs WHERE status='queued' ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING `+jw.columns))
+}
+
+// heartbeat touches the heartbeat_at of job id every jobHeartbeat until
+// stop is called, so that claim leaves the job alone.
+func (jw *jobWorker[J]) heartbeat(id int64) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(jobHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := jw.db.Exec(`UPDATE `+jw.name+`_jobs SET heartbeat_at=now() WHERE id=$1`, id); err != nil {
+					log.Printf("%s job %d heartbeat: %v", jw.name, id, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
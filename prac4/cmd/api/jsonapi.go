@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSON:API (https://jsonapi.org) representation of movies, used when the
+// client sends Accept: application/vnd.api+json. Other endpoints keep their
+// plain JSON bodies; errors are converted everywhere (see jsonAPIErrors).
+const jsonAPIMediaType = "application/vnd.api+json"
+
+func wantsJSONAPI(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), jsonAPIMediaType)
+}
+
+type jsonAPIDocument struct {
+	Data     any               `json:"data"`
+	Included []jsonAPIResource `json:"included,omitempty"`
+	Meta     any               `json:"meta,omitempty"`
+	Links    links             `json:"links,omitempty"`
+}
+
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id"`
+	Attributes    map[string]any                 `json:"attributes,omitempty"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+	Links         links                          `json:"links,omitempty"`
+}
+
+type jsonAPIIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type jsonAPIRelationship struct {
+	Data []jsonAPIIdentifier `json:"data"`
+}
+
+func writeJSONAPI(w http.ResponseWriter, code int, doc any) {
+	w.Header().Set("Content-Type", jsonAPIMediaType)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(doc)
+}
+
+// splitGenreInclude takes "genres" out of an ?include= value: genres are
+// embedded in the movie row, so they are compounded without a loader.
+func splitGenreInclude(raw string) (rest string, genres bool) {
+	var keep []string
+	for _, name := range strings.Split(raw, ",") {
+		if strings.TrimSpace(name) == "genres" {
+			genres = true
+			continue
+		}
+		keep = append(keep, name)
+	}
+	return strings.Join(keep, ","), genres
+}
+
+// jsonAPIBuilder collects a document's included resources without
+// duplicates.
+type jsonAPIBuilder struct {
+	r        *http.Request
+	proj     movieProjection
+	genres   bool
+	seen     map[jsonAPIIdentifier]bool
+	included []jsonAPIResource
+}
+
+func newJSONAPIBuilder(r *http.Request, proj movieProjection, includeGenres bool) *jsonAPIBuilder {
+	return &jsonAPIBuilder{r: r, proj: proj, genres: includeGenres, seen: map[jsonAPIIdentifier]bool{}}
+}
+
+func (b *jsonAPIBuilder) include(res jsonAPIResource) {
+	key := jsonAPIIdentifier{res.Type, res.ID}
+	if !b.seen[key] {
+		b.seen[key] = true
+		b.included = append(b.included, res)
+	}
+}
+
+// movie turns m into a resource object; genres become a relationship.
+func (b *jsonAPIBuilder) movie(m Movie) jsonAPIResource {
+	attrs, _ := toFieldMap(b.proj.render(m))
+	delete(attrs, "id")
+	res := jsonAPIResource{Type: "movies", ID: strconv.FormatInt(m.ID, 10), Attributes: attrs,
+		Links: links{"self": movieLinks(b.r, m)["self"]}}
+	if _, ok := attrs["genres"]; ok {
+		delete(attrs, "genres")
+		rel := jsonAPIRelationship{Data: []jsonAPIIdentifier{}}
+		for _, g := range m.Genres {
+			rel.Data = append(rel.Data, jsonAPIIdentifier{"genres", g})
+			if b.genres {
+				b.include(jsonAPIResource{Type: "genres", ID: g, Attributes: map[string]any{"name": g}})
+			}
+		}
+		res.Relationships = map[string]jsonAPIRelationship{"genres": rel}
+	}
+	return res
+}
+
+// relate adds a loaded ?include= relation to res and the included set.
+func (b *jsonAPIBuilder) relate(res *jsonAPIResource, name string, v any) {
+	rel := jsonAPIRelationship{Data: []jsonAPIIdentifier{}}
+	switch items := v.(type) {
+	case []Translation:
+		for _, t := range items {
+			id := fmt.Sprintf("%d-%s", t.MovieID, t.Language)
+			rel.Data = append(rel.Data, jsonAPIIdentifier{"translations", id})
+			b.include(jsonAPIResource{Type: "translations", ID: id, Attributes: map[string]any{
+				"language": t.Language, "description": t.Description, "status": t.Status, "updated_at": t.UpdatedAt,
+			}})
+		}
+	case []suggestion:
+		for _, s := range items {
+			id := strconv.FormatInt(s.ID, 10)
+			rel.Data = append(rel.Data, jsonAPIIdentifier{"movies", id})
+			b.include(jsonAPIResource{Type: "movies", ID: id, Attributes: map[string]any{"title": s.Title}})
+		}
+	}
+	if res.Relationships == nil {
+		res.Relationships = map[string]jsonAPIRelationship{}
+	}
+	res.Relationships[name] = rel
+}
+
+func movieDetailDocument(r *http.Request, d movieDetail, proj movieProjection, includeGenres bool) jsonAPIDocument {
+	b := newJSONAPIBuilder(r, proj, includeGenres)
+	res := b.movie(d.Movie)
+	names := make([]string, 0, len(d.Included))
+	for name := range d.Included {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.relate(&res, name, d.Included[name])
+	}
+	return jsonAPIDocument{Data: res, Included: b.included, Links: links{"self": res.Links["self"]}}
+}
+
+// movieListDocument renders a list; meta is nil for unpaginated lists.
+func movieListDocument(r *http.Request, movies []Movie, proj movieProjection, includeGenres bool, meta *pageMetadata) jsonAPIDocument {
+	b := newJSONAPIBuilder(r, proj, includeGenres)
+	data := make([]jsonAPIResource, len(movies))
+	for i, m := range movies {
+		data[i] = b.movie(m)
+	}
+	doc := jsonAPIDocument{Data: data, Included: b.included, Links: links{"self": linkTo(r, r.URL.RequestURI())}}
+	if meta != nil {
+		doc.Meta = meta
+		doc.Links = pageLinks(r, *meta)
+	}
+	return doc
+}
+
+// jsonAPIErrors rewrites {"error": "..."} responses into a JSON:API errors
+// document for clients that asked for JSON:API.
+func jsonAPIErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wantsJSONAPI(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &jsonAPIErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.status == 0 {
+			return
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(ew.body.Bytes(), &body)
+		if body.Error == "" {
+			body.Error = http.StatusText(ew.status)
+		}
+		writeJSONAPI(w, ew.status, map[string]any{"errors": []map[string]string{{
+			"status": strconv.Itoa(ew.status),
+			"title":  http.StatusText(ew.status),
+			"detail": body.Error,
+		}}})
+	})
+}
+
+// jsonAPIErrorWriter holds back error responses (status >= 400) so they can
+// be rewritten; anything else passes straight through.
+type jsonAPIErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (e *jsonAPIErrorWriter) WriteHeader(code int) {
+	if code >= 400 {
+		e.status = code
+		return
+	}
+	e.ResponseWriter.WriteHeader(code)
+}
+
+func (e *jsonAPIErrorWriter) Write(b []byte) (int, error) {
+	if e.status != 0 {
+		return e.body.Write(b)
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+func (e *jsonAPIErrorWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
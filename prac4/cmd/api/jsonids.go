@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ID formats. JavaScript numbers lose precision past 2^53, so clients that
+// can't hold an int64 ask for ids as strings, per request with
+// "Accept: application/json; ids=string" or for everyone with JSON_IDS.
+const (
+	jsonIDsNumber = "number"
+	jsonIDsString = "string"
+)
+
+// stringIDsSkip are the fields whose contents belong to clients, and are
+// left as they are even if they hold ids.
+var stringIDsSkip = map[string]bool{"metadata": true, "properties": true}
+
+// jsonIDFormat picks the ID format of each request: the ids parameter of
+// its Accept header, else def. In string mode responses written with
+// writeJSON carry ids as strings, and readJSON takes them as strings too.
+func jsonIDFormat(def string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+			format := def
+			for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+				if _, params, err := mime.ParseMediaType(part); err == nil {
+					if ids := params["ids"]; ids == jsonIDsNumber || ids == jsonIDsString {
+						format = ids
+						break
+					}
+				}
+			}
+			if format != jsonIDsString {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := context.WithValue(r.Context(), ctxStringIDs, true)
+			next.ServeHTTP(&stringIDWriter{w}, r.WithContext(ctx))
+		})
+	}
+}
+
+// stringIDWriter marks a response whose ids go out as strings; writeJSON
+// looks for it.
+type stringIDWriter struct {
+	http.ResponseWriter
+}
+
+func (s *stringIDWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// wantsStringIDs reports whether w, or a writer it wraps, is a
+// stringIDWriter.
+func wantsStringIDs(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(*stringIDWriter); ok {
+			return true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
+
+func stringIDsFrom(ctx context.Context) bool {
+	on, _ := ctx.Value(ctxStringIDs).(bool)
+	return on
+}
+
+// isIDField reports whether a field named key holds an id ("id",
+// "parent_id") or, with list, a list of them ("ids", "movie_ids").
+func isIDField(key string, list bool) bool {
+	if list {
+		return key == "ids" || strings.HasSuffix(key, "_ids")
+	}
+	return key == "id" || strings.HasSuffix(key, "_id")
+}
+
+// convertIDs rewrites the ids in a JSON document: whole numbers become
+// strings with toStrings, and strings of digits numbers without it. Field
+// order and everything else stay as they are.
+func convertIDs(src []byte, toStrings bool) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+	type frame struct {
+		object bool
+		n      int    // tokens so far; in objects keys and values alternate
+		key    string // the current key, in objects
+		ids    bool   // an array of ids
+		skip   bool   // inside a stringIDsSkip field
+	}
+	var (
+		out   bytes.Buffer
+		stack []frame
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			out.WriteByte(byte(d))
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		var top *frame
+		id, key := false, ""
+		if len(stack) > 0 {
+			top = &stack[len(stack)-1]
+			switch {
+			case top.object && top.n%2 == 1:
+				out.WriteByte(':')
+			case top.n > 0:
+				out.WriteByte(',')
+			}
+			if top.object && top.n%2 == 0 {
+				top.key = tok.(string)
+				top.n++
+				b, _ := json.Marshal(top.key)
+				out.Write(b)
+				continue
+			}
+			top.n++
+			if !top.skip {
+				key = top.key
+				id = top.ids || top.object && isIDField(key, false)
+			}
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			out.WriteByte(byte(v))
+			f := frame{object: v == '{'}
+			if top != nil {
+				f.skip = top.skip || top.object && stringIDsSkip[key]
+				f.ids = !f.skip && !f.object && top.object && isIDField(key, true)
+			}
+			stack = append(stack, f)
+		case json.Number:
+			if _, err := v.Int64(); id && toStrings && err == nil {
+				out.WriteString(`"` + v.String() + `"`)
+			} else {
+				out.WriteString(v.String())
+			}
+		case string:
+			if id && !toStrings && v != "" && strings.Trim(v, "0123456789") == "" {
+				out.WriteString(v)
+			} else {
+				b, _ := json.Marshal(v)
+				out.Write(b)
+			}
+		case bool:
+			fmt.Fprint(&out, v)
+		case nil:
+			out.WriteString("null")
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// bodyError is a request body that isn't what the handler expects, with a
+// message that says why.
+type bodyError struct {
+	msg string
+}
+
+func (e *bodyError) Error() string { return e.msg }
+
+// explainJSONError turns a decode error into a bodyError naming the field,
+// so a number too large for an id is a clear 400 rather than "invalid json".
+func explainJSONError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && strings.HasPrefix(typeErr.Value, "number") && isNumberKind(typeErr.Type) {
+		field := typeErr.Field
+		if field == "" {
+			field = "value"
+		}
+		return &bodyError{fmt.Sprintf("%s: %s is not a valid %s", field, strings.TrimPrefix(typeErr.Value, "number "), typeErr.Type)}
+	}
+	return err
+}
+
+func isNumberKind(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// writeStringIDs writes v as JSON with its ids as strings, followed by a
+// newline like json.Encoder.
+func writeStringIDs(w io.Writer, v any) error {
+	raw, err := json.Marshal(v)
+	if err == nil {
+		raw, err = convertIDs(raw, true)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(raw, '\n'))
+	return err
+}
+
+// invalidJSON is the message for a body readJSON rejected.
+func invalidJSON(err error) string {
+	var be *bodyError
+	if errors.As(err, &be) {
+		return be.msg
+	}
+	return "invalid json"
+}
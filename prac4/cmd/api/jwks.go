@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// errLinkRequired refuses to link an external token to an account by email
+// when the account can sign in on its own: whoever controls the provider's
+// email claim would otherwise get into it without the password or second
+// factor. The owner links it with POST /me/identities instead.
+var errLinkRequired = errors.New("this email belongs to an account with a password or two-factor authentication; " +
+	"sign in to it and link the token with POST /me/identities")
+
+// externalJWTs validates RS256 tokens issued by an outside identity provider
+// against its JWKS. Keys are cached and refetched when a token names one
+// that isn't known yet, which picks up key rotation.
+type externalJWTs struct {
+	verifier   *oidc.IDTokenVerifier
+	emailClaim string
+	rolesClaim string
+	adminRole  string
+}
+
+func newExternalJWTs(cfg config) *externalJWTs {
+	if cfg.JWKSURL == "" {
+		return nil
+	}
+	keys := oidc.NewRemoteKeySet(context.Background(), cfg.JWKSURL)
+	return &externalJWTs{
+		verifier: oidc.NewVerifier(cfg.JWKSIssuer, keys, &oidc.Config{
+			ClientID:             cfg.JWKSAudience,
+			SupportedSigningAlgs: []string{oidc.RS256},
+		}),
+		emailClaim: cfg.JWKSEmailClaim,
+		rolesClaim: cfg.JWKSRolesClaim,
+		adminRole:  cfg.JWKSAdminRole,
+	}
+}
+
+// handles reports whether token is an RS256 JWT, leaving everything else
+// (including our own HS256 tokens) to the token table.
+func (x *externalJWTs) handles(token string) bool {
+	if x == nil {
+		return false
+	}
+	header, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(header)
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	return err == nil && json.Unmarshal(b, &h) == nil && h.Alg == oidc.RS256
+}
+
+// user verifies token and returns the local user for its subject, linking
+// or creating one by email on first sight. That takes an email the provider
+// marks verified, and an account without a password or authenticator; see
+// errLinkRequired. The role comes from the roles claim: the admin role maps
+// to admin, anything else to user.
+func (x *externalJWTs) user(r *http.Request, db *sql.DB, token string) (User, error) {
+	idt, err := x.verifier.Verify(r.Context(), token)
+	if err != nil {
+		return User{}, errInvalidToken
+	}
+	var claims map[string]any
+	if err := idt.Claims(&claims); err != nil {
+		return User{}, errInvalidToken
+	}
+
+	selectUser := `SELECT ` + userColumns + ` FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.provider=$1 AND i.subject=$2 AND u.active`
+	u, err := scanUser(db.QueryRowContext(r.Context(), selectUser, idt.Issuer, idt.Subject))
+	if err == sql.ErrNoRows {
+		email, _ := claim(claims, x.emailClaim).(string)
+		verified, _ := claims["email_verified"].(bool)
+		if email == "" || !verified {
+			return User{}, errInvalidToken
+		}
+		name, _ := claims["name"].(string)
+		err = x.link(r, db, idt.Issuer, externalIdentity{Subject: idt.Subject, Email: email, EmailVerified: true, Name: name})
+		if err == nil {
+			u, err = scanUser(db.QueryRowContext(r.Context(), selectUser, idt.Issuer, idt.Subject))
+		}
+	}
+	if err == sql.ErrNoRows {
+		return User{}, errInvalidToken
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	u.Role = roleUser
+	for _, role := range claimStrings(claim(claims, x.rolesClaim)) {
+		if role == x.adminRole {
+			u.Role = roleAdmin
+		}
+	}
+	return u, nil
+}
+
+func (x *externalJWTs) link(r *http.Request, db *sql.DB, issuer string, id externalIdentity) error {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var protected bool
+	err = tx.QueryRow(`
+		SELECT length(u.password_hash) > 0 OR EXISTS (
+			SELECT 1 FROM user_totp t WHERE t.user_id = u.id AND t.confirmed_at IS NOT NULL)
+		FROM users u WHERE u.email=$1`, strings.ToLower(id.Email)).Scan(&protected)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if protected {
+		return errLinkRequired
+	}
+	if _, err := linkIdentity(r, tx, issuer, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// POST /me/identities
+//
+//	{"token": "<JWT from the JWKS_URL provider>"}
+//
+// Links the token's subject to the signed-in account, for accounts that
+// aren't linked by email on first use (see errLinkRequired). It needs a
+// real sign-in, not a personal access token. Linking again is a no-op; a
+// subject already linked to someone else is 409.
+func linkExternalToken(db *sql.DB, x *externalJWTs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Token string `json:"token"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		u := userFrom(r.Context())
+		if u.tokenScopes != nil {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "personal access tokens cannot link identities"})
+			return
+		}
+		idt, err := x.verifier.Verify(r.Context(), in.Token)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "token: " + errInvalidToken.Error()})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		// The no-op update makes RETURNING report an existing link too;
+		// xmax is 0 only for a row this statement inserted.
+		var owner int64
+		var inserted bool
+		err = tx.QueryRow(`
+			INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (provider, subject) DO UPDATE SET provider = EXCLUDED.provider
+			RETURNING user_id, xmax = 0`, idt.Issuer, idt.Subject, u.ID, u.Email).Scan(&owner, &inserted)
+		if err == nil && owner != u.ID {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "this identity is linked to another account"})
+			return
+		}
+		identity := map[string]string{"provider": idt.Issuer, "subject": idt.Subject}
+		if err == nil && inserted {
+			err = recordAudit(r, tx, "user", u.ID, "update", nil, map[string]any{"linked_identity": identity})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, identity)
+	}
+}
+
+// claim looks up a claim by a dotted path, e.g. "realm_access.roles" for
+// Keycloak.
+func claim(claims map[string]any, path string) any {
+	var v any = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// claimStrings accepts a list claim or a space-separated string.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtIssuer signs session tokens as HS256 JWTs. Each one is also stored in
+// tokens under the hash of its ID, so authenticate, logout and revocation
+// treat it like any other session token.
+type jwtIssuer struct {
+	secret []byte
+}
+
+func newJWTIssuer(secret string) *jwtIssuer {
+	if secret == "" {
+		return nil
+	}
+	return &jwtIssuer{secret: []byte(secret)}
+}
+
+func (j *jwtIssuer) issue(ctx context.Context, db execer, userID int64) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(tokenTTL)
+	id := randomToken(16)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ID:        id,
+		Subject:   strconv.FormatInt(userID, 10),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expires),
+	}).SignedString(j.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO tokens (hash, user_id, expires_at) VALUES ($1, $2, $3)`, hashToken(id), userID, expires)
+	return token, expires, err
+}
+
+// storedHash is the hash token is stored under in tokens.
+func (j *jwtIssuer) storedHash(token string) []byte {
+	if id, ok := j.tokenID(token); ok {
+		return hashToken(id)
+	}
+	return hashToken(token)
+}
+
+// tokenID returns the ID of a validly signed, unexpired JWT. ok is false
+// for anything else, including opaque tokens, and on a nil issuer.
+func (j *jwtIssuer) tokenID(token string) (id string, ok bool) {
+	if j == nil {
+		return "", false
+	}
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return j.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || claims.ID == "" {
+		return "", false
+	}
+	return claims.ID, true
+}
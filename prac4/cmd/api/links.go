@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// HAL-style _links on movie representations, so clients can follow URLs
+// instead of building them from templates.
+type link struct {
+	Href string `json:"href"`
+}
+
+type links map[string]link
+
+// parseBaseURL validates PUBLIC_BASE_URL. Empty means links are built from
+// each request's own scheme and host.
+func parseBaseURL(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("PUBLIC_BASE_URL must be an absolute http(s) URL, got %q", raw)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// linkBase stores the base URL for links in the request context: the
+// configured one, or the origin the client used. Behind a trusted proxy the
+// forwarded scheme and host are honoured.
+func linkBase(configured string, tp trustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			base := configured
+			if base == "" {
+				base = tp.origin(r)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxLinkBase, base)))
+		})
+	}
+}
+
+// origin is the scheme://host r was sent to.
+func (tp trustedProxies) origin(r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if addr, err := netip.ParseAddr(remoteHost(r.RemoteAddr)); err == nil && tp.trusted(addr) {
+		// The first element was added by the outermost proxy, which saw
+		// the client's request.
+		fwd := r.Header.Values("Forwarded")
+		if v := forwardedParam(fwd, "proto"); len(v) > 0 {
+			scheme = strings.Trim(v[0], `"`)
+		} else if v := firstHeaderValue(r, "X-Forwarded-Proto"); v != "" {
+			scheme = v
+		}
+		if v := forwardedParam(fwd, "host"); len(v) > 0 {
+			host = strings.Trim(v[0], `"`)
+		} else if v := firstHeaderValue(r, "X-Forwarded-Host"); v != "" {
+			host = v
+		}
+	}
+	return strings.ToLower(scheme) + "://" + host
+}
+
+func firstHeaderValue(r *http.Request, name string) string {
+	first, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(first)
+}
+
+// linkTo makes an absolute URL for a path (with optional query) on this API.
+func linkTo(r *http.Request, path string) link {
+	base, _ := r.Context().Value(ctxLinkBase).(string)
+	return link{Href: base + path}
+}
+
+// movieLinks are the links of a single movie.
+func movieLinks(r *http.Request, m Movie) links {
+	self := "/movies/" + publicMovieID(r, m)
+	l := links{
+		"self":         linkTo(r, self),
+		"collection":   linkTo(r, "/movies"),
+		"history":      linkTo(r, self+"/history"),
+		"translations": linkTo(r, self+"/translations"),
+	}
+	if m.Slug != "" {
+		l["slug"] = linkTo(r, "/movies/slug/"+url.PathEscape(m.Slug))
+	}
+	return l
+}
+
+// withLinks adds _links to a rendered movie: m itself or a ?fields= map.
+func withLinks(v any, l links) any {
+	switch v := v.(type) {
+	case map[string]any:
+		v["_links"] = l
+		return v
+	case Movie:
+		return struct {
+			Movie
+			Links links `json:"_links"`
+		}{v, l}
+	}
+	return v
+}
+
+// pageLinks are the links of a page of the movie list. The other query
+// parameters (filters, fields, limit) carry over.
+func pageLinks(r *http.Request, meta pageMetadata) links {
+	at := func(cursor string) link {
+		q := r.URL.Query()
+		if cursor == "" {
+			q.Del("cursor")
+		} else {
+			q.Set("cursor", cursor)
+		}
+		return linkTo(r, r.URL.Path+"?"+q.Encode())
+	}
+	l := links{"self": linkTo(r, r.URL.RequestURI()), "first": at("")}
+	if meta.NextCursor != "" {
+		l["next"] = at(meta.NextCursor)
+	}
+	if meta.PrevCursor != "" {
+		l["prev"] = at(meta.PrevCursor)
+	}
+	return l
+}
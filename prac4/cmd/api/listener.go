@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// limitListener enforces connection caps before any HTTP parsing happens.
+// When the global cap is reached Accept blocks, leaving new connections in
+// the kernel backlog; a client over its per-IP cap is disconnected right away
+// so one host can't starve everybody else.
+type limitListener struct {
+	net.Listener
+	maxPerIP int
+	slots    chan struct{}
+
+	mu    sync.Mutex
+	perIP map[string]int
+}
+
+func newLimitListener(l net.Listener, maxConns, maxPerIP int) net.Listener {
+	if maxConns == 0 && maxPerIP == 0 {
+		return l
+	}
+	ll := &limitListener{Listener: l, maxPerIP: maxPerIP, perIP: map[string]int{}}
+	if maxConns > 0 {
+		ll.slots = make(chan struct{}, maxConns)
+	}
+	return ll
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.slots != nil {
+			l.slots <- struct{}{}
+		}
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.releaseSlot()
+			return nil, err
+		}
+
+		ip := remoteIP(c)
+		if l.maxPerIP > 0 {
+			l.mu.Lock()
+			if l.perIP[ip] >= l.maxPerIP {
+				l.mu.Unlock()
+				l.releaseSlot()
+				c.Close()
+				log.Printf("connection from %s rejected: per-IP limit of %d reached", ip, l.maxPerIP)
+				continue
+			}
+			l.perIP[ip]++
+			l.mu.Unlock()
+		}
+		return &limitConn{Conn: c, l: l, ip: ip}, nil
+	}
+}
+
+func (l *limitListener) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limitListener) release(ip string) {
+	if l.maxPerIP > 0 {
+		l.mu.Lock()
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+		l.mu.Unlock()
+	}
+	l.releaseSlot()
+}
+
+type limitConn struct {
+	net.Conn
+	l    *limitListener
+	ip   string
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.l.release(c.ip) })
+	return err
+}
+
+func remoteIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+// idleLimiter caps the number of keep-alive connections sitting idle between
+// requests. It is installed as http.Server.ConnState; a connection that would
+// exceed the cap is closed as soon as it goes idle.
+type idleLimiter struct {
+	max int
+
+	mu   sync.Mutex
+	idle map[net.Conn]bool
+}
+
+func newIdleLimiter(max int) *idleLimiter {
+	return &idleLimiter{max: max, idle: map[net.Conn]bool{}}
+}
+
+func (il *idleLimiter) connState(c net.Conn, state http.ConnState) {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	if state != http.StateIdle {
+		delete(il.idle, c)
+		return
+	}
+	if len(il.idle) >= il.max {
+		c.Close()
+		return
+	}
+	il.idle[c] = true
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// loadOps are the requests `api loadtest` can mix. Writes only touch movies
+// the run created itself, unless they are dry runs.
+var loadOps = map[string]func(*loadClient, *rand.Rand) (int, error){
+	"list": func(c *loadClient, rng *rand.Rand) (int, error) {
+		return c.do(http.MethodGet, "/movies?limit=20", nil, nil)
+	},
+	"get": func(c *loadClient, rng *rand.Rand) (int, error) {
+		id, ok := c.pick(rng, false)
+		if !ok {
+			return c.do(http.MethodGet, "/movies?limit=1", nil, nil)
+		}
+		return c.do(http.MethodGet, "/movies/"+id, nil, nil)
+	},
+	"search": func(c *loadClient, rng *rand.Rand) (int, error) {
+		q := seedTitleSecond[rng.IntN(len(seedTitleSecond))]
+		return c.do(http.MethodGet, "/search/movies?q="+url.QueryEscape(q), nil, nil)
+	},
+	"stats": func(c *loadClient, rng *rand.Rand) (int, error) {
+		return c.do(http.MethodGet, "/stats/movies", nil, nil)
+	},
+	"trending": func(c *loadClient, rng *rand.Rand) (int, error) {
+		return c.do(http.MethodGet, "/movies/trending", nil, nil)
+	},
+	"create": loadCreate,
+	"update": func(c *loadClient, rng *rand.Rand) (int, error) {
+		id, ok := c.pick(rng, !c.dryRun)
+		if !ok {
+			return loadCreate(c, rng)
+		}
+		return c.do(http.MethodPut, "/movies/"+id, loadMovie(rng), nil)
+	},
+}
+
+func loadCreate(c *loadClient, rng *rand.Rand) (int, error) {
+	var m struct {
+		ID json.RawMessage `json:"id"`
+	}
+	code, err := c.do(http.MethodPost, "/movies", loadMovie(rng), &m)
+	if err == nil && code == http.StatusCreated && !c.dryRun {
+		c.created(loadID(m.ID))
+	}
+	return code, err
+}
+
+// loadtestCommand implements `api loadtest`: it sends a weighted mix of reads
+// and writes to a running API from -concurrency workers for -duration and
+// prints throughput and latency percentiles per request kind, so pool and
+// cache changes can be compared run to run.
+func loadtestCommand(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the API")
+	token := fs.String("token", os.Getenv("LOADTEST_TOKEN"), "bearer token sent with every request (default $LOADTEST_TOKEN); writes need one")
+	tenant := fs.String("tenant", "", "tenant slug sent as X-Tenant-ID")
+	mix := fs.String("mix", "list=50,get=35,search=10,stats=5", "comma-separated kind=weight; kinds: list, get, search, stats, trending, create, update")
+	concurrency := fs.Int("concurrency", 10, "number of concurrent workers")
+	duration := fs.Duration("duration", 30*time.Second, "how long to send requests")
+	rate := fs.Float64("rate", 0, "requests per second across all workers; 0 is as fast as they go")
+	timeout := fs.Duration("timeout", 10*time.Second, "per-request timeout")
+	dryRun := fs.Bool("dry-run", false, "send writes with ?dry_run=true so nothing is saved")
+	keep := fs.Bool("keep", false, "keep the movies the run created instead of deleting them at the end")
+	seed := fs.Uint64("seed", 1, "random seed for the request mix")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	weights, err := parseLoadMix(*mix)
+	if err != nil {
+		log.Fatalf("loadtest: %v", err)
+	}
+	if *concurrency < 1 || *duration <= 0 || *rate < 0 || *timeout <= 0 {
+		log.Fatal("loadtest: -concurrency, -duration and -timeout must be positive, -rate not negative")
+	}
+
+	c := &loadClient{
+		http:   &http.Client{Timeout: *timeout},
+		target: strings.TrimRight(*target, "/"),
+		token:  *token,
+		tenant: *tenant,
+		dryRun: *dryRun,
+	}
+	if err := c.loadIDs(); err != nil {
+		log.Fatalf("loadtest: %s: %v", c.target, err)
+	}
+	log.Printf("loadtest: %d workers for %s against %s (%s)", *concurrency, *duration, c.target, *mix)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	var ticks <-chan time.Time
+	if *rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer t.Stop()
+		ticks = t.C
+	}
+
+	results := newLoadResults()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(*seed, uint64(i)))
+			for {
+				if ticks != nil {
+					select {
+					case <-ticks:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				op := weights.pick(rng)
+				t := time.Now()
+				code, err := loadOps[op](c, rng)
+				results.add(op, time.Since(t), code, err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if !*keep {
+		c.cleanup()
+	}
+	report := results.report(elapsed)
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+	report.print(os.Stdout)
+}
+
+// loadMix is the weighted list of request kinds.
+type loadMix struct {
+	ops   []string
+	total int
+	upTo  []int
+}
+
+func parseLoadMix(s string) (loadMix, error) {
+	var m loadMix
+	for _, part := range strings.Split(s, ",") {
+		name, w, ok := strings.Cut(strings.TrimSpace(part), "=")
+		weight, err := strconv.Atoi(w)
+		if !ok || err != nil || weight < 0 {
+			return m, fmt.Errorf("-mix: %q is not kind=weight", part)
+		}
+		if loadOps[name] == nil {
+			return m, fmt.Errorf("-mix: unknown kind %q", name)
+		}
+		if weight == 0 {
+			continue
+		}
+		m.total += weight
+		m.ops = append(m.ops, name)
+		m.upTo = append(m.upTo, m.total)
+	}
+	if m.total == 0 {
+		return m, fmt.Errorf("-mix has no kind with a positive weight")
+	}
+	return m, nil
+}
+
+func (m loadMix) pick(rng *rand.Rand) string {
+	n := rng.IntN(m.total)
+	i, _ := slices.BinarySearch(m.upTo, n+1)
+	return m.ops[i]
+}
+
+// loadClient sends the requests and tracks the movie IDs they can use: some
+// existing ones for reads, and the ones the run created for writes.
+type loadClient struct {
+	http   *http.Client
+	target string
+	token  string
+	tenant string
+	dryRun bool
+
+	mu    sync.Mutex
+	ids   []string
+	owned []string
+}
+
+// do sends a request and discards the body, or decodes it into out on
+// success. Only transport failures are errors; the status is the result.
+func (c *loadClient) do(method, path string, body, out any) (int, error) {
+	var rd io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		rd = bytes.NewReader(raw)
+	}
+	if c.dryRun && method != http.MethodGet && method != http.MethodDelete {
+		path += "?dry_run=true"
+	}
+	req, err := http.NewRequest(method, c.target+path, rd)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.tenant != "" {
+		req.Header.Set(tenantHeader, c.tenant)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// loadIDs fetches the IDs "get" reads, which also checks the target is up.
+func (c *loadClient) loadIDs() error {
+	var page struct {
+		Movies []struct {
+			ID json.RawMessage `json:"id"`
+		} `json:"movies"`
+	}
+	code, err := c.do(http.MethodGet, "/movies?limit=100", nil, &page)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("GET /movies answered %d", code)
+	}
+	for _, m := range page.Movies {
+		c.ids = append(c.ids, loadID(m.ID))
+	}
+	return nil
+}
+
+// loadID reads a movie ID as rendered, a number or (with PUBLIC_IDS=uuid)
+// a string.
+func loadID(raw json.RawMessage) string {
+	return strings.Trim(string(raw), `"`)
+}
+
+func (c *loadClient) created(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids = append(c.ids, id)
+	c.owned = append(c.owned, id)
+}
+
+// pick returns a random movie ID, one the run created if owned is set.
+func (c *loadClient) pick(rng *rand.Rand, owned bool) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := c.ids
+	if owned {
+		ids = c.owned
+	}
+	if len(ids) == 0 {
+		return "", false
+	}
+	return ids[rng.IntN(len(ids))], true
+}
+
+// cleanup soft-deletes the movies the run created.
+func (c *loadClient) cleanup() {
+	failed := 0
+	for _, id := range c.owned {
+		if code, err := c.do(http.MethodDelete, "/movies/"+id, nil, nil); err != nil || code >= 300 {
+			failed++
+		}
+	}
+	if len(c.owned) > 0 {
+		log.Printf("loadtest: deleted %d created movies (%d failed)", len(c.owned)-failed, failed)
+	}
+}
+
+func loadMovie(rng *rand.Rand) movieInput {
+	rating := math.Round((1+rng.Float64()*9)*10) / 10
+	return movieInput{
+		Title: "Loadtest " + seedTitleFirst[rng.IntN(len(seedTitleFirst))] + " " +
+			seedTitleSecond[rng.IntN(len(seedTitleSecond))],
+		Year:   1950 + rng.IntN(76),
+		Rating: &rating,
+	}
+}
+
+// loadResults collects the latency of every request, by kind.
+type loadResults struct {
+	mu  sync.Mutex
+	ops map[string]*loadOpResult
+}
+
+type loadOpResult struct {
+	latencies []time.Duration
+	failed    int
+	statuses  map[string]int
+}
+
+func newLoadResults() *loadResults {
+	return &loadResults{ops: map[string]*loadOpResult{}}
+}
+
+// add records one request. Transport errors and 4xx/5xx answers count as
+// failed; their latency is kept too, since a slow timeout is worth seeing.
+func (lr *loadResults) add(op string, d time.Duration, code int, err error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	r := lr.ops[op]
+	if r == nil {
+		r = &loadOpResult{statuses: map[string]int{}}
+		lr.ops[op] = r
+	}
+	r.latencies = append(r.latencies, d)
+	status := strconv.Itoa(code)
+	if err != nil {
+		status = "error"
+	}
+	r.statuses[status]++
+	if err != nil || code >= 400 {
+		r.failed++
+	}
+}
+
+type loadReport struct {
+	Seconds float64        `json:"seconds"`
+	Ops     []loadOpReport `json:"ops"`
+	Total   loadOpReport   `json:"total"`
+}
+
+type loadOpReport struct {
+	Op       string         `json:"op"`
+	Requests int            `json:"requests"`
+	Failed   int            `json:"failed"`
+	RPS      float64        `json:"rps"`
+	P50MS    float64        `json:"p50_ms"`
+	P90MS    float64        `json:"p90_ms"`
+	P99MS    float64        `json:"p99_ms"`
+	MaxMS    float64        `json:"max_ms"`
+	Statuses map[string]int `json:"statuses"`
+}
+
+func (lr *loadResults) report(elapsed time.Duration) loadReport {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	rep := loadReport{Seconds: elapsed.Seconds()}
+	all := &loadOpResult{statuses: map[string]int{}}
+	names := make([]string, 0, len(lr.ops))
+	for name := range lr.ops {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		r := lr.ops[name]
+		rep.Ops = append(rep.Ops, r.summary(name, elapsed))
+		all.latencies = append(all.latencies, r.latencies...)
+		all.failed += r.failed
+		for s, n := range r.statuses {
+			all.statuses[s] += n
+		}
+	}
+	rep.Total = all.summary("total", elapsed)
+	return rep
+}
+
+func (r *loadOpResult) summary(name string, elapsed time.Duration) loadOpReport {
+	slices.Sort(r.latencies)
+	pct := func(p float64) float64 {
+		if len(r.latencies) == 0 {
+			return 0
+		}
+		i := int(math.Ceil(p*float64(len(r.latencies)))) - 1
+		return float64(r.latencies[max(i, 0)].Microseconds()) / 1000
+	}
+	return loadOpReport{
+		Op:       name,
+		Requests: len(r.latencies),
+		Failed:   r.failed,
+		RPS:      float64(len(r.latencies)) / elapsed.Seconds(),
+		P50MS:    pct(0.50),
+		P90MS:    pct(0.90),
+		P99MS:    pct(0.99),
+		MaxMS:    pct(1),
+		Statuses: r.statuses,
+	}
+}
+
+func (rep loadReport) print(out io.Writer) {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\trequests\tfailed\trps\tp50 ms\tp90 ms\tp99 ms\tmax ms\t")
+	for _, o := range append(rep.Ops, rep.Total) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n",
+			o.Op, o.Requests, o.Failed, o.RPS, o.P50MS, o.P90MS, o.P99MS, o.MaxMS)
+	}
+	tw.Flush()
+	fmt.Fprintf(out, "%.1fs\n", rep.Seconds)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// maxLanguagePrefs bounds how many Accept-Language entries are considered.
+const maxLanguagePrefs = 10
+
+// Localized is a movie's title and description in the language picked for
+// the request. Title falls back to the original when the translation has
+// none.
+type Localized struct {
+	Language    string `json:"language"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// languageChain is the fallback chain of the request: ?lang= if given,
+// otherwise Accept-Language by preference. Each regional tag is followed by
+// its language, so fr-CH falls back to fr. Tags that aren't simple BCP 47
+// tags, like * or zh-Hant, are skipped.
+func languageChain(r *http.Request) []string {
+	type pref struct {
+		lang string
+		q    float64
+	}
+	var prefs []pref
+	if v := r.URL.Query().Get("lang"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			prefs = append(prefs, pref{s, 1})
+		}
+	} else {
+		for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+			tag, params, _ := strings.Cut(part, ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					continue
+				}
+				q = f
+			}
+			if q > 0 {
+				prefs = append(prefs, pref{tag, q})
+			}
+		}
+		sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	}
+
+	var chain []string
+	seen := map[string]bool{}
+	for _, p := range prefs {
+		lang, ok := normalizeLanguage(p.lang)
+		if !ok {
+			continue
+		}
+		base, _, _ := strings.Cut(lang, "-")
+		for _, l := range []string{lang, base} {
+			if !seen[l] {
+				seen[l] = true
+				chain = append(chain, l)
+			}
+		}
+		if len(chain) >= maxLanguagePrefs {
+			break
+		}
+	}
+	return chain
+}
+
+// localize picks, for each movie in titles, the translation earliest in
+// chain. titles holds the original titles, the fallback for translations
+// without one. Movies without a translation are left out of the result.
+func localize(ctx context.Context, db *sql.DB, titles map[int64]string, chain []string) (map[int64]Localized, error) {
+	out := map[int64]Localized{}
+	if len(chain) == 0 || len(titles) == 0 {
+		return out, nil
+	}
+	ids := make([]int64, 0, len(titles))
+	for id := range titles {
+		ids = append(ids, id)
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT ON (movie_id) movie_id, language, coalesce(title, ''), description
+		FROM movie_translations
+		WHERE movie_id = ANY($1) AND tenant_id = $2 AND language = ANY($3)
+		ORDER BY movie_id, array_position($3, language)`, pq.Array(ids), tenantFrom(ctx), pq.Array(chain))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id int64
+			l  Localized
+		)
+		if err := rows.Scan(&id, &l.Language, &l.Title, &l.Description); err != nil {
+			return nil, err
+		}
+		if l.Title == "" {
+			l.Title = titles[id]
+		}
+		out[id] = l
+	}
+	return out, rows.Err()
+}
+
+// withLocalized adds localized to a rendered movie: m itself or a ?fields=
+// map. It goes before withLinks, which only knows those two shapes.
+func withLocalized(v any, l Localized, ok bool) any {
+	if !ok {
+		return v
+	}
+	if m, isMovie := v.(Movie); isMovie {
+		fields, err := toFieldMap(m)
+		if err != nil {
+			return v
+		}
+		v = fields
+	}
+	if fields, isMap := v.(map[string]any); isMap {
+		fields["localized"] = l
+	}
+	return v
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// loginGuard slows down and then locks out password guessing. Failures are
+// counted per account and per client IP in the database, so every instance
+// sees the same counts. After a few failures each further attempt has to
+// wait twice as long as the last, up to a minute; at the limit the account
+// (423) or the IP (429) is locked for the lockout period.
+type loginGuard struct {
+	db            *sql.DB
+	maxAccount    int
+	maxIP         int
+	lockout       time.Duration
+	freeFailures  int
+	maxRetryDelay time.Duration
+}
+
+func newLoginGuard(db *sql.DB, cfg config) *loginGuard {
+	return &loginGuard{
+		db:            db,
+		maxAccount:    cfg.LoginMaxFailures,
+		maxIP:         cfg.LoginMaxFailuresPerIP,
+		lockout:       cfg.LoginLockout,
+		freeFailures:  3,
+		maxRetryDelay: time.Minute,
+	}
+}
+
+func accountKey(email string) string { return "account:" + email }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+// check reports whether a sign-in for email from ip may go ahead. When it
+// may not, it has written the 423 or 429 response.
+func (g *loginGuard) check(w http.ResponseWriter, r *http.Request, email string) bool {
+	rows, err := g.db.QueryContext(r.Context(), `
+		SELECT key, failures, last_failure_at, locked_until FROM login_failures
+		WHERE key = ANY($1) AND last_failure_at > now() - make_interval(secs => $2)`,
+		pq.Array([]string{accountKey(email), ipKey(clientIPFrom(r))}), g.lockout.Seconds())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return false
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var (
+			key      string
+			failures int
+			last     time.Time
+			locked   sql.NullTime
+		)
+		if err := rows.Scan(&key, &failures, &last, &locked); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return false
+		}
+		if locked.Valid && locked.Time.After(now) {
+			w.Header().Set("Retry-After", retryAfter(locked.Time.Sub(now)))
+			if key == accountKey(email) {
+				writeJSON(w, http.StatusLocked, map[string]string{"error": "account locked after too many failed sign-ins; try again later"})
+			} else {
+				writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many failed sign-ins from your address; try again later"})
+			}
+			return false
+		}
+		if wait := last.Add(g.delay(failures)).Sub(now); wait > 0 {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many failed sign-ins; retry after " + retryAfter(wait) + "s"})
+			return false
+		}
+	}
+	if err := rows.Err(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// delay is how long to wait after the last of failures.
+func (g *loginGuard) delay(failures int) time.Duration {
+	if failures < g.freeFailures {
+		return 0
+	}
+	exp := min(failures-g.freeFailures, 16)
+	return min(time.Duration(math.Pow(2, float64(exp)))*time.Second, g.maxRetryDelay)
+}
+
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// fail counts a failed sign-in and locks the account or IP when it hits
+// the limit. Failures and lockouts go to auth_events so credential stuffing
+// can be alerted on. userID is 0 when no such account exists; reason says
+// which check failed.
+func (g *loginGuard) fail(r *http.Request, email string, userID int64, reason string) {
+	countEvent(eventLoginFailed)
+	logAuthEvent(r, g.db, userID, authLoginFailed, map[string]any{"email": email, "reason": reason})
+	for _, k := range []struct {
+		key string
+		max int
+	}{{accountKey(email), g.maxAccount}, {ipKey(clientIPFrom(r)), g.maxIP}} {
+		if k.max <= 0 {
+			continue
+		}
+		var (
+			failures int
+			locked   bool
+		)
+		err := g.db.QueryRowContext(r.Context(), `
+			INSERT INTO login_failures AS f (key, failures, last_failure_at) VALUES ($1, 1, now())
+			ON CONFLICT (key) DO UPDATE SET
+				failures = CASE WHEN f.last_failure_at < now() - make_interval(secs => $2) THEN 1 ELSE f.failures + 1 END,
+				last_failure_at = now(),
+				locked_until = CASE WHEN f.last_failure_at >= now() - make_interval(secs => $2) AND f.failures + 1 >= $3
+					THEN now() + make_interval(secs => $2) ELSE f.locked_until END
+			RETURNING failures, COALESCE(locked_until > now(), false)`,
+			k.key, g.lockout.Seconds(), k.max).Scan(&failures, &locked)
+		if err != nil {
+			log.Printf("count failed sign-in: %v", err)
+			continue
+		}
+		if locked && failures == k.max {
+			countEvent(eventLoginLockout)
+			log.Printf("ALERT: %s locked after %d failed sign-ins", k.key, failures)
+			logAuthEvent(r, g.db, userID, authLockout, map[string]any{"key": k.key, "failures": failures})
+		}
+	}
+}
+
+// succeed clears the account's failures. The IP's count stays: one good
+// password doesn't excuse guessing at others.
+func (g *loginGuard) succeed(r *http.Request, email string) {
+	if _, err := g.db.ExecContext(r.Context(), `DELETE FROM login_failures WHERE key=$1`, accountKey(email)); err != nil {
+		log.Printf("clear failed sign-ins: %v", err)
+	}
+}
+
+// prune drops counts that have aged out of the lockout window.
+func (g *loginGuard) prune(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := g.db.Exec(`
+			DELETE FROM login_failures
+			WHERE last_failure_at < now() - make_interval(secs => $1) AND (locked_until IS NULL OR locked_until < now())`,
+			g.lockout.Seconds()); err != nil {
+			log.Printf("prune failed sign-ins: %v", err)
+		}
+	}
+}
@@ -1,24 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/XSAM/otelsql"
+	"github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 )
 
-type Movie struct {
-	ID    int64  `json:"id"`
-	Title string `json:"title"`
-}
-
 func mustEnv(key string) string {
 	v := strings.TrimSpace(os.Getenv(key))
 	if v == "" {
@@ -27,8 +31,8 @@ func mustEnv(key string) string {
 	return v
 }
 
-func openDB() *sql.DB {
-	dsn := fmt.Sprintf(
+func dsnFromEnv() string {
+	return fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		mustEnv("DB_HOST"),
 		mustEnv("DB_PORT"),
@@ -36,14 +40,28 @@ func openDB() *sql.DB {
 		mustEnv("DB_PASSWORD"),
 		mustEnv("DB_NAME"),
 	)
+}
 
-	db, err := sql.Open("postgres", dsn)
+// openDB connects to Postgres. With schemas, connections follow the search
+// path of each query's tenant. The pool starts at poolSize; the server
+// tunes it from there.
+func openDB(dsn string, schemas bool, cfg config) *sql.DB {
+	pg, err := pq.NewConnector(dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
-	db.SetConnMaxLifetime(30 * time.Minute)
+	var connector driver.Connector = pg
+	if schemas {
+		connector = schemaConnector{pg}
+	}
+	// otelsql wraps the driver so every query gets a span under the request.
+	db := otelsql.OpenDB(connector,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}))
+	size := poolSize(cfg.DBPoolMin, cfg.DBPoolMax)
+	db.SetMaxOpenConns(size)
+	db.SetMaxIdleConns(size)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
 	return db
 }
 
@@ -60,81 +78,352 @@ func waitForDB(db *sql.DB) {
 func writeJSON(w http.ResponseWriter, code int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
+	if wantsStringIDs(w) {
+		_ = writeStringIDs(w, v)
+		return
+	}
 	_ = json.NewEncoder(w).Encode(v)
 }
 
+// readJSON decodes the body into dst. Numbers that don't fit the field they
+// are decoded into come back as a bodyError naming it; see invalidJSON.
 func readJSON(r *http.Request, dst any) error {
-	dec := json.NewDecoder(r.Body)
+	var body io.Reader = r.Body
+	if stringIDsFrom(r.Context()) {
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(raw)) == 0 {
+			return io.EOF
+		}
+		if raw, err = convertIDs(raw, false); err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
-	return dec.Decode(dst)
+	dec.UseNumber()
+	return explainJSONError(dec.Decode(dst))
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if strings.TrimSpace(port) == "" {
-		port = "8080"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "seed":
+			seedCommand(os.Args[2:])
+			return
+		case "backup":
+			backupCommand(os.Args[2:])
+			return
+		case "restore":
+			restoreCommand(os.Args[2:])
+			return
+		case "loadtest":
+			loadtestCommand(os.Args[2:])
+			return
+		case "create-admin":
+			createAdminCommand(os.Args[2:])
+			return
+		}
 	}
 
-	db := openDB()
+	cfg := loadConfig()
+	if err := initTracing(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	reporter, err := newErrorReporter(cfg.SentryDSN, cfg.SentryEnvironment)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dsn := dsnFromEnv()
+	schemas := cfg.TenantIsolation == isolationSchema
+	db := openDB(dsn, schemas, cfg)
 	defer db.Close()
 
 	waitForDB(db)
 	log.Println("Database connected")
-	log.Println("Starting the Server...")
+	if cfg.AutoMigrate {
+		if err := migrate(db); err != nil {
+			log.Fatal(err)
+		}
+		if schemas {
+			if err := migrateTenants(db); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if err := verifySchema(db, schemas, cfg.SchemaCheck, !cfg.AutoMigrate); err != nil {
+		log.Fatal(err)
+	}
+
+	refs, err := newRefData(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go refs.watch(dsn)
+	flags, err := newFeatureFlags(db, cfg.FeatureFlags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go flags.watch(dsn)
+	limits, err := newRateLimits(db, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go limits.watch(dsn)
+	log.Printf("Starting the Server... version=%s commit=%s built=%s %s",
+		build.Version, build.Commit, build.BuildDate, build.GoVersion)
+
+	maint := newMaintenance()
+	go maint.watchSignals()
+	jwts := newJWTIssuer(cfg.JWTSecret)
 
 	mux := http.NewServeMux()
 
+	mux.Handle("GET /metrics", metrics)
+	mux.HandleFunc("GET /version", versionHandler)
+
 	// Health endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		// Still 200 in maintenance mode: the process is healthy and load
+		// balancers shouldn't pull it.
+		writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "maintenance": maint.get().Enabled})
 	})
 
+	// Detail fetches are counted in memory; see views.go.
+	views := newViewCounter(db)
+	go views.run(30 * time.Second)
+
 	// Collection endpoints
 	mux.HandleFunc("/movies", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
-		case http.MethodGet:
-			rows, err := db.Query(`SELECT id, title FROM movies ORDER BY id`)
+		case http.MethodGet, http.MethodHead:
+			var filter whereClause
+			filter.add("tenant_id = ?", tenantFrom(r.Context()))
+			filter.add("deleted_at IS NULL")
+			if msg := movieFilters(r.URL.Query(), refs, &filter); msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+				return
+			}
+			proj, err := parseFields(r.URL.Query().Get("fields"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			jsonAPI, includeGenres := wantsJSONAPI(r), false
+			if inc := r.URL.Query().Get("include"); inc != "" {
+				rest, genres := splitGenreInclude(inc)
+				if !jsonAPI || strings.TrimSpace(rest) != "" {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "the movie list only supports include=genres, with JSON:API"})
+					return
+				}
+				includeGenres = genres
+			}
+			// Keyset pagination: rows after the cursor's id (or before it,
+			// going backwards), one extra to know whether another page
+			// follows.
+			page, msg := parsePage(r)
+			if msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+				return
+			}
+			// ?sample=N is N movies picked at random, listed like the whole
+			// catalog; it can't be paged.
+			sample, seed, msg := parseSample(r.URL.Query())
+			if msg == "" && sample > 0 && page.paged {
+				msg = "sample can't be combined with limit or cursor"
+			}
+			if msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+				return
+			}
+			// ?sort=trending ranks by recent views. It is one page, the
+			// top limit movies; cursors follow ids, so it can't be paged.
+			trending := false
+			switch r.URL.Query().Get("sort") {
+			case "", "id":
+			case "trending":
+				trending = true
+				if page.after.ID > 0 || sample > 0 {
+					msg = "sort=trending can't be combined with cursor or sample"
+				}
+			default:
+				msg = "sort must be id or trending"
+			}
+			if msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+				return
+			}
+			order := "id"
+			if sample > 0 {
+				order = randomOrder(&filter, seed)
+			}
+			if trending {
+				order = trendingOrder(&filter)
+				page.paged = true
+			}
+			if page.after.ID > 0 {
+				if page.after.Before {
+					filter.add("id < ?", page.after.ID)
+					order = "id DESC"
+				} else {
+					filter.add("id > ?", page.after.ID)
+				}
+			}
+			query := `SELECT ` + proj.columns() + ` FROM movies WHERE ` + filter.String() + ` ORDER BY ` + order
+			if page.paged {
+				query += ` LIMIT ` + filter.arg(page.limit+1)
+			} else if sample > 0 {
+				query += ` LIMIT ` + filter.arg(sample)
+			}
+
+			rows, err := db.QueryContext(r.Context(), query, filter.args...)
 			if err != nil {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
 			defer rows.Close()
+			if !page.paged && !jsonAPI {
+				// The whole catalog: stream it rather than build a slice.
+				streamJSONArray(w, r, rows, func(row rowScanner) (any, error) {
+					m, err := proj.scan(row)
+					return withLinks(proj.render(m), movieLinks(r, m)), err
+				})
+				return
+			}
 
 			var out []Movie
 			for rows.Next() {
-				var m Movie
-				if err := rows.Scan(&m.ID, &m.Title); err != nil {
+				m, err := proj.scan(rows)
+				if err != nil {
 					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 					return
 				}
 				out = append(out, m)
 			}
-			writeJSON(w, http.StatusOK, out)
+			if err := rows.Err(); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if !page.paged {
+				writeJSONAPI(w, http.StatusOK, movieListDocument(r, out, proj, includeGenres, nil))
+				return
+			}
+
+			more := len(out) > page.limit
+			if more {
+				out = out[:page.limit]
+			}
+			more = more && !trending
+			if page.after.Before {
+				slices.Reverse(out)
+			}
+			// Coming from a cursor there is always a page on the side we came
+			// from; on the other side only if the extra row showed up.
+			hasNext, hasPrev := more, page.after.ID > 0
+			if page.after.Before {
+				hasNext, hasPrev = true, more
+			}
+			meta := pageMetadata{Limit: page.limit}
+			if len(out) > 0 {
+				if hasNext {
+					meta.NextCursor = pageCursor{ID: out[len(out)-1].ID}.encode()
+				}
+				if hasPrev {
+					meta.PrevCursor = pageCursor{ID: out[0].ID, Before: true}.encode()
+				}
+			}
+			if jsonAPI {
+				writeJSONAPI(w, http.StatusOK, movieListDocument(r, out, proj, includeGenres, &meta))
+				return
+			}
+			w.Header().Add("Vary", "Accept-Language")
+			titles := make(map[int64]string, len(out))
+			for _, m := range out {
+				titles[m.ID] = m.Title
+			}
+			loc, err := localize(r.Context(), db, titles, languageChain(r))
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			movies := make([]any, len(out))
+			for i, m := range out {
+				l, ok := loc[m.ID]
+				movies[i] = withLinks(withLocalized(proj.render(m), l, ok), movieLinks(r, m))
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"movies": movies, "metadata": meta, "_links": pageLinks(r, meta)})
 
 		case http.MethodPost:
 			var in struct {
-				Title string `json:"title"`
+				movieInput
+				ExternalIDs *ExternalIDs `json:"external_ids"`
 			}
 			if err := readJSON(r, &in); err != nil {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+				return
+			}
+			if msg := in.normalize(refs); msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
 				return
 			}
-			in.Title = strings.TrimSpace(in.Title)
-			if in.Title == "" {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "title is required"})
+			if msg := in.ExternalIDs.validate(); msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
 				return
 			}
 
-			var id int64
-			err := db.QueryRow(`INSERT INTO movies (title) VALUES ($1) RETURNING id`, in.Title).Scan(&id)
+			tx, err := db.BeginTx(r.Context(), nil)
 			if err != nil {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			writeJSON(w, http.StatusCreated, Movie{ID: id, Title: in.Title})
+			defer tx.Rollback()
+
+			imdb, tmdb := in.ExternalIDs.nullable()
+			var m Movie
+			err = retryInsert(r.Context(), tx, func() (err error) {
+				m, err = scanMovie(tx.QueryRow(`
+					INSERT INTO movies (tenant_id, title, genres, certification, year, rating, imdb_id, tmdb_id, metadata)
+					VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, 0), $6, $7, $8, $9)
+					RETURNING `+movieColumns,
+					tenantFrom(r.Context()), in.Title, pq.Array(in.Genres), in.Certification, in.Year, in.Rating, imdb, tmdb, []byte(in.Metadata)))
+				return err
+			}, slugKey)
+			if uniqueConstraint(err) == slugKey {
+				writeJSON(w, http.StatusConflict, map[string]string{"error": slugBusyMessage})
+				return
+			}
+			if isUniqueViolation(err) {
+				// Hand back the record that already owns the external ID so
+				// importers can link to it instead of retrying.
+				existing, err := findDuplicate(r.Context(), db, in.ExternalIDs)
+				if err != nil {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+					return
+				}
+				writeJSON(w, http.StatusConflict, map[string]any{"error": "external id already exists", "movie": existing})
+				return
+			}
+			if err == nil {
+				err = recordAudit(r, tx, "movie", m.ID, "create", nil, m)
+			}
+			if err == nil {
+				err = commitUnlessDryRun(w, r, tx)
+			}
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if !isDryRun(r) {
+				countEvent(eventMovieCreated)
+			}
+			writeJSON(w, http.StatusCreated, m)
 
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			methodNotAllowed(w, "GET, HEAD, POST, OPTIONS")
 		}
 	})
 
@@ -148,10 +437,23 @@ func main() {
 		}
 
 		switch r.Method {
-		case http.MethodGet:
-			var m Movie
-			err := db.QueryRow(`SELECT id, title FROM movies WHERE id=$1`, id).Scan(&m.ID, &m.Title)
-			if err == sql.ErrNoRows {
+		case http.MethodGet, http.MethodHead:
+			inc, includeGenres := r.URL.Query().Get("include"), false
+			if wantsJSONAPI(r) {
+				inc, includeGenres = splitGenreInclude(inc)
+			}
+			includes, err := parseIncludes(inc)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			proj, err := parseFields(r.URL.Query().Get("fields"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			d, err := loadMovieDetail(r.Context(), db, id, includes, proj)
+			if errors.Is(err, sql.ErrNoRows) {
 				writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
 				return
 			}
@@ -159,57 +461,356 @@ func main() {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			writeJSON(w, http.StatusOK, m)
+			if r.Method == http.MethodGet {
+				views.record(tenantFrom(r.Context()), id)
+			}
+			if wantsJSONAPI(r) {
+				writeJSONAPI(w, http.StatusOK, movieDetailDocument(r, d, proj, includeGenres))
+				return
+			}
+			w.Header().Add("Vary", "Accept-Language")
+			loc, err := localize(r.Context(), db, map[int64]string{d.ID: d.Title}, languageChain(r))
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if l, ok := loc[d.ID]; ok {
+				d.Localized = &l
+				w.Header().Set("Content-Language", l.Language)
+			}
+			d.Links = movieLinks(r, d.Movie)
+			writeJSON(w, http.StatusOK, d.render(proj))
 
 		case http.MethodPut:
-			var in struct {
-				Title string `json:"title"`
-			}
+			var in movieInput
 			if err := readJSON(r, &in); err != nil {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
 				return
 			}
-			in.Title = strings.TrimSpace(in.Title)
-			if in.Title == "" {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "title is required"})
+			if msg := in.normalize(refs); msg != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
 				return
 			}
 
-			res, err := db.Exec(`UPDATE movies SET title=$1 WHERE id=$2`, in.Title, id)
+			tx, err := db.BeginTx(r.Context(), nil)
 			if err != nil {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			aff, _ := res.RowsAffected()
-			if aff == 0 {
+			defer tx.Rollback()
+
+			tenant := tenantFrom(r.Context())
+			before, err := scanMovie(tx.QueryRow(`
+				SELECT `+movieColumns+` FROM movies WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL FOR UPDATE`, id, tenant))
+			if err == sql.ErrNoRows {
 				writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
 				return
 			}
-			writeJSON(w, http.StatusOK, Movie{ID: id, Title: in.Title})
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			m, err := scanMovie(tx.QueryRow(`
+				UPDATE movies
+				SET title=$1, genres=$2, certification=NULLIF($3, ''), year=NULLIF($4, 0), rating=$5, metadata=$8, updated_at=now()
+				WHERE id=$6 AND tenant_id=$7
+				RETURNING `+movieColumns,
+				in.Title, pq.Array(in.Genres), in.Certification, in.Year, in.Rating, id, tenant, []byte(in.Metadata)))
+			if err == nil {
+				err = recordAudit(r, tx, "movie", id, "update", before, m)
+			}
+			if err == nil {
+				err = commitUnlessDryRun(w, r, tx)
+			}
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if !isDryRun(r) {
+				countEvent(eventMovieUpdated)
+			}
+			writeJSON(w, http.StatusOK, m)
 
 		case http.MethodDelete:
-			res, err := db.Exec(`DELETE FROM movies WHERE id=$1`, id)
+			tx, err := db.BeginTx(r.Context(), nil)
 			if err != nil {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			aff, _ := res.RowsAffected()
-			if aff == 0 {
+			defer tx.Rollback()
+
+			// Soft delete: the row stays for history and can be purged by an
+			// admin with DELETE /admin/movies/{id}.
+			before, err := scanMovie(tx.QueryRow(`
+				UPDATE movies SET deleted_at=now() WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL
+				RETURNING `+movieColumns, id, tenantFrom(r.Context())))
+			if err == sql.ErrNoRows {
 				writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
 				return
 			}
+			if err == nil {
+				err = recordAudit(r, tx, "movie", id, "delete", before, nil)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			countEvent(eventMovieDeleted)
 			w.WriteHeader(http.StatusNoContent)
 
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			methodNotAllowed(w, "GET, HEAD, PUT, DELETE, OPTIONS")
 		}
 	})
 
+	mux.HandleFunc("GET /movies/export", exportMovies(db, refs))
+	mux.HandleFunc("POST /movies/import", importMovies(db, refs))
+	mux.HandleFunc("GET /movies/by-external/{source}/{id}", getMovieByExternalID(db))
+	mux.HandleFunc("PUT /movies/by-external/imdb/{id}", upsertMovieByExternalID(db, refs, "imdb"))
+	mux.HandleFunc("PUT /movies/by-external/tmdb/{id}", upsertMovieByExternalID(db, refs, "tmdb"))
+	mux.HandleFunc("GET /movies/{id}/history", movieHistory(db))
+	mux.HandleFunc("GET /movies/{id}/revisions", movieRevisions(db))
+	mux.HandleFunc("POST /movies/{id}/revisions/{n}/revert", revertMovie(db, refs))
+	mux.HandleFunc("GET /movies/{id}/related", relatedMovies(db))
+	mux.HandleFunc("POST /movies/{id}/merge", mergeMovie(db))
+
+	mux.HandleFunc("GET /search/movies", searchMovies(db))
+	search := newSearchIndex(cfg)
+	mux.HandleFunc("GET /search", searchCatalog(db, refs, search))
+	go runSearchIndexer(db, search)
+	mux.HandleFunc("GET /movies/suggest", suggestMovies(db))
+	mux.HandleFunc("GET /movies/random", randomMovie(db, refs))
+	mux.HandleFunc("GET /movies/feed.atom", movieFeed(db, "atom"))
+	mux.HandleFunc("GET /movies/feed.rss", movieFeed(db, "rss"))
+	mux.HandleFunc("GET /movies/manifest", movieManifest(db))
+	matviews := materializedViews(cfg)
+	go runMatViewRefresher(db, schemas, matviews)
+	mux.HandleFunc("GET /movies/trending", movieTrending(db, refs, matviews))
+	mux.HandleFunc("PATCH /movies/batch", batchUpdateMovies(db, refs))
+
+	// Translation endpoints
+	mux.HandleFunc("GET /movies/{id}/translations", listTranslations(db))
+	mux.HandleFunc("PUT /movies/{id}/translations/{lang}", putTranslation(db))
+	mux.HandleFunc("DELETE /movies/{id}/translations/{lang}", deleteTranslation(db))
+	mux.HandleFunc("GET /translations/missing", missingTranslationsReport(db))
+
+	// Free-form tags
+	mux.HandleFunc("GET /movies/{id}/tags", listMovieTags(db))
+	mux.HandleFunc("POST /movies/{id}/tags", addMovieTags(db))
+	mux.HandleFunc("DELETE /movies/{id}/tags/{tag}", removeMovieTag(db))
+	mux.HandleFunc("GET /tags", tagCloud(db))
+
+	// Comment threads; see comments.go for moderation
+	comments := newBlocklistFilter(cfg.CommentBlocklist)
+	mux.HandleFunc("GET /movies/{id}/comments", listComments(db))
+	mux.Handle("POST /movies/{id}/comments", requireUser(createComment(db, comments, limits, cfg.CommentRateWindow)))
+
+	// Webhook subscriptions
+	mux.Handle("POST /webhooks", requireUser(createWebhook(db)))
+	mux.Handle("GET /webhooks", requireUser(listWebhooks(db)))
+	mux.Handle("GET /webhooks/{id}", requireUser(getWebhook(db)))
+	mux.Handle("POST /webhooks/{id}/verify", requireUser(reverifyWebhook(db)))
+	mux.Handle("DELETE /webhooks/{id}", requireUser(deleteWebhook(db)))
+	go runWebhookVerifier(db, schemas)
+
+	mux.HandleFunc("GET /stats/movies", movieStatsHandler(db, matviews))
+
+	// Client-side analytics; see events.go
+	events := newEventCollector(db, cfg)
+	go events.run(5 * time.Second)
+	mux.HandleFunc("POST /events", trackEvents(db, events))
+
+	// Reference data
+	mux.HandleFunc("GET /genres", listGenres(refs))
+	mux.HandleFunc("GET /certifications", listCertifications(refs))
+	mux.HandleFunc("GET /flags", listMyFlags(flags))
+
+	// Users and authentication
+	mux.HandleFunc("POST /users", registerUser(db))
+	signer := newRequestSigner(db, cfg)
+	go signer.prune(time.Minute)
+	meter := newUsageMeter(db, limits)
+	go meter.run(30 * time.Second)
+	guard := newLoginGuard(db, cfg)
+	go guard.prune(10 * time.Minute)
+	mux.HandleFunc("POST /tokens/authentication", createAuthToken(db, guard))
+	mux.Handle("POST /tokens/revoke", requireUser(revokeToken(db, jwts)))
+	mux.Handle("POST /logout", requireUser(logout(db)))
+	ext := newExternalJWTs(cfg)
+	if ext != nil {
+		mux.Handle("POST /me/identities", requireUser(linkExternalToken(db, ext)))
+	}
+	if len(cfg.AuthProviders) > 0 {
+		// JWT_SECRET is required with AUTH_PROVIDERS, so jwts is set here.
+		providers := newAuthProviders(cfg.AuthProviders)
+		mux.HandleFunc("GET /auth/{provider}/login", oauthLogin(providers, jwts))
+		mux.HandleFunc("GET /auth/{provider}/callback", oauthCallback(db, providers, jwts, guard))
+		mux.HandleFunc("POST /auth/two-factor", oauthTwoFactor(db, guard, jwts))
+	}
+	mux.Handle("GET /me", requireUser(getProfile(db)))
+	mux.Handle("PATCH /me", requireUser(updateProfile(db, refs)))
+	mux.Handle("DELETE /me", requireUser(deleteAccount(db, cfg.AccountDeletionGrace)))
+	mux.Handle("GET /me/export", requireUser(exportAccount(db)))
+	go runAccountEraser(db, cfg.AccountDeletionGrace, time.Hour)
+	go runRetention(db, schemas, retentionPolicies(cfg), cfg.RetentionInterval)
+	archive := newArchiver(db, cfg, schemas)
+	if archive.store != nil {
+		go archive.run(cfg.ArchiveInterval)
+	}
+	go runPartitionMaintenance(db, schemas, 24*time.Hour)
+	exports, err := newExporter(db, refs, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go exports.jobs.run()
+	mux.Handle("POST /exports", requireUser(createExport(db, refs, exports)))
+	mux.Handle("GET /exports", requireUser(listExports(db)))
+	mux.Handle("GET /exports/{id}", requireUser(getExport(db)))
+	mux.HandleFunc("GET /exports/{id}/download", downloadExport(db, exports))
+	imports, err := newImporter(db, refs, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go imports.jobs.run()
+	mux.Handle("POST /imports", requireUser(createImport(db, imports)))
+	mux.Handle("GET /imports", requireUser(listImports(db)))
+	mux.Handle("GET /imports/{id}", requireUser(getImport(db)))
+	mux.HandleFunc("GET /imports/{id}/errors", importErrors(db, imports))
+	mux.Handle("PUT /me/password", requireUser(changePassword(db)))
+	mux.Handle("GET /me/activity", requireUser(myActivity(db)))
+	mux.Handle("GET /me/usage", requireUser(myUsage(db, meter)))
+	mux.Handle("GET /me/notifications", requireUser(myNotifications(db)))
+	mux.Handle("POST /me/notifications/read", requireUser(markNotificationsRead(db)))
+	go runMailer(db, newMailer(cfg))
+	mux.HandleFunc("GET /unsubscribe/digest", unsubscribeDigest(db))
+	mux.HandleFunc("POST /unsubscribe/digest", unsubscribeDigest(db))
+	mux.Handle("POST /me/2fa/totp", requireUser(enrollTOTP(db)))
+	mux.Handle("POST /me/2fa/totp/confirm", requireUser(confirmTOTP(db)))
+	mux.Handle("DELETE /me/2fa/totp", requireUser(disableTOTP(db, cfg.Require2FAForAdmins)))
+	mux.Handle("POST /me/2fa/recovery-codes", requireUser(regenerateRecoveryCodes(db)))
+	mux.Handle("POST /me/tokens", requireUser(createPersonalToken(db, signer)))
+	mux.Handle("GET /me/tokens", requireUser(listPersonalTokens(db)))
+	mux.Handle("DELETE /me/tokens/{id}", requireUser(revokePersonalToken(db)))
+	mux.Handle("GET /me/tokens/{id}/signing-key", requireUser(personalTokenSigningKey(db, signer)))
+
+	// Admin operations
+	recordings := newRecorder(cfg.RecordRequests, cfg.RecordBodyLimit, cfg.RecordPaths)
+	faults := newFaultInjector(cfg.FaultInjection)
+	admin := adminMux(db, refs, maint, flags, limits, matviews, archive, recordings, faults, schemas)
+	mux.Handle("/admin/", requireUser(admin))
+	mux.Handle("GET /admin/ui/", adminUI())
+	mux.Handle("GET /admin/ui", http.RedirectHandler("/admin/ui/", http.StatusMovedPermanently))
+
+	policy, err := newPolicy(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certs, err := loadClientCerts(cfg.ClientCertIdentities)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tenants := newTenantDirectory(db, cfg.DefaultTenant)
+	var handler http.Handler = authenticate(db, jwts, ext, signer, certs, cfg.AccessMode)(bindUserTenant(meter.middleware(requireTwoFactor(cfg.Require2FAForAdmins)(authorize(policy)(reportErrors(reporter)(resolvePublicIDs(db, cfg.PublicIDs)(dryRuns(mux)(jsonIDFormat(cfg.JSONIDs)(mux)))))))))
+	handler = tenants.resolve(handler)
+	handler = timeouts(cfg.HandlerTimeout, cfg.LongHandlerTimeout)(handler)
+	routes := newRouteMethods(mux)
+	routes.subs["/admin/"] = admin
+	handler = normalizePaths(headResponses(routes.options(routes.unmatched(requireJSONBodies(handler)))))
+	pool := newPoolMonitor(db, cfg.DBPoolWaitThreshold)
+	go pool.run(time.Second)
+	if cfg.DBPoolTuneInterval > 0 && cfg.DBPoolMin < cfg.DBPoolMax {
+		go newPoolTuner(db, cfg).run(cfg.DBPoolTuneInterval)
+	}
+	handler = pool.shed(handler)
+	if faults != nil {
+		handler = faults.middleware(handler)
+	}
+	handler = maint.guard(handler)
+	if cfg.MaxInFlight > 0 {
+		handler = newInflightLimiter(cfg.MaxInFlight, cfg.MaxQueue, cfg.QueueTimeout).limit(handler)
+	}
+	if cfg.DebugEndpoints {
+		dbg := debugHandler(cfg.DebugToken)
+		if cfg.DebugAddr != "" {
+			go serveDebug(cfg.DebugAddr, dbg)
+		} else {
+			handler = mountDebug(dbg, handler)
+		}
+	}
+
+	access, err := newAccessLogger(cfg.AccessLogFormat, cfg.AccessLogOutput, cfg.AccessLogSampleRate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.ConfigFile != "" {
+		rl := &reloader{path: cfg.ConfigFile, pool: pool, maint: maint, limits: limits, access: access,
+			commentWindow: cfg.CommentRateWindow}
+		if err := rl.load(); err != nil {
+			log.Fatal(err)
+		}
+		go rl.watch(5 * time.Second)
+	}
+	if recordings.enabled() {
+		handler = recordings.middleware(handler)
+	}
+	if access != nil {
+		handler = access.middleware(handler)
+	}
+
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	base, err := parseBaseURL(cfg.PublicBaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler = linkBase(base, proxies)(handler)
+
+	// Emails have no request to take an origin from.
+	emailBase := base
+	if emailBase == "" {
+		emailBase = "http://localhost:" + cfg.Port
+		log.Printf("PUBLIC_BASE_URL is not set; links in emails point to %s", emailBase)
+	}
+	go runWeeklyDigest(db, emailBase, time.Hour)
+
 	srv := &http.Server{
-		Addr:              ":" + port,
-		Handler:           mux,
+		Addr:              ":" + cfg.Port,
+		Handler:           versionHeader(requestID(proxies.middleware(traceRequests(jsonAPIErrors(handler))))),
 		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.MaxIdleConns > 0 {
+		srv.ConnState = newIdleLimiter(cfg.MaxIdleConns).connState
+	}
+
+	if cfg.TLSCertFile != "" {
+		if srv.TLSConfig, err = clientTLSConfig(cfg.ClientCAFile, cfg.ClientCertOptional); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = newLimitListener(ln, cfg.MaxConns, cfg.MaxConnsPerIP)
+	if cfg.TLSCertFile != "" {
+		err = srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	meter.flush()
+	views.flush()
+	events.flush()
+	flushErrors()
+	log.Fatal(err)
 }
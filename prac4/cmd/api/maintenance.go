@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maintenanceState is what the admin endpoint reads and writes.
+type maintenanceState struct {
+	Enabled    bool       `json:"enabled"`
+	AllowReads bool       `json:"allow_reads"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter int        `json:"retry_after"` // seconds
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+// maintenance puts the API into maintenance mode at runtime: writes get 503,
+// and reads too unless AllowReads is set. Operational endpoints and /admin
+// keep working so the mode can be switched off again.
+type maintenance struct {
+	mu    sync.RWMutex
+	state maintenanceState
+}
+
+func newMaintenance() *maintenance {
+	return &maintenance{state: maintenanceState{AllowReads: true, RetryAfter: 60}}
+}
+
+func (m *maintenance) get() maintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+func (m *maintenance) set(s maintenanceState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.Enabled && !m.state.Enabled {
+		now := time.Now().UTC()
+		s.Since = &now
+	} else if s.Enabled {
+		s.Since = m.state.Since
+	} else {
+		s.Since = nil
+	}
+	if s.RetryAfter <= 0 {
+		s.RetryAfter = 60
+	}
+	if s.Enabled != m.state.Enabled || s.AllowReads != m.state.AllowReads {
+		log.Printf("maintenance mode enabled=%t allow_reads=%t", s.Enabled, s.AllowReads)
+	}
+	m.state = s
+}
+
+// watchSignals toggles maintenance mode (reads still allowed) on SIGUSR1, for
+// when the API itself is unreachable.
+func (m *maintenance) watchSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		s := m.get()
+		s.Enabled = !s.Enabled
+		m.set(s)
+	}
+}
+
+// maintenanceExempt are paths served even in full maintenance mode. Signing
+// in, by password or through /auth/, stays open so admins can get a token
+// to switch it off again.
+func maintenanceExempt(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/health", "/metrics", "/version", "/tokens/authentication":
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/auth/")
+}
+
+func (m *maintenance) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := m.get()
+		if !s.Enabled || maintenanceExempt(r) ||
+			(s.AllowReads && (r.Method == http.MethodGet || r.Method == http.MethodHead)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		msg := s.Message
+		if msg == "" {
+			msg = "down for maintenance"
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(s.RetryAfter))
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": msg})
+	})
+}
+
+// GET /admin/maintenance
+func adminGetMaintenance(m *maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.get())
+	}
+}
+
+// maintenanceInput is how maintenance mode is requested, by the admin
+// endpoint or the config file. Reads stay allowed unless turned off.
+type maintenanceInput struct {
+	Enabled    bool   `json:"enabled"`
+	AllowReads *bool  `json:"allow_reads"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+func (in maintenanceInput) state() maintenanceState {
+	s := maintenanceState{Enabled: in.Enabled, AllowReads: true, Message: strings.TrimSpace(in.Message), RetryAfter: in.RetryAfter}
+	if in.AllowReads != nil {
+		s.AllowReads = *in.AllowReads
+	}
+	return s
+}
+
+// PUT /admin/maintenance
+func adminSetMaintenance(db *sql.DB, m *maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in maintenanceInput
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if in.RetryAfter < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "retry_after must not be negative"})
+			return
+		}
+
+		before := m.get()
+		m.set(in.state())
+		after := m.get()
+
+		if err := recordAudit(r, db, "maintenance", 0, "update", before, after); err != nil {
+			log.Printf("audit maintenance change: %v", err)
+		}
+		writeJSON(w, http.StatusOK, after)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// manifestLimit is the default page size of the manifest; ?limit= goes up
+// to the usual 500.
+const manifestLimit = 500
+
+type manifestEntry struct {
+	// ID is left out in PUBLIC_IDS=uuid mode, like everywhere else.
+	ID        *int64    `json:"id,omitempty"`
+	UUID      string    `json:"uuid"`
+	Slug      string    `json:"slug"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GET /movies/manifest?cursor=...&limit=500
+//
+// Every movie as just its ids, slug and last change, in id order, for
+// static site builds to enumerate the pages to render and skip unchanged
+// ones. It is always paged, forwards only; follow next_cursor until it is
+// absent.
+func movieManifest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, msg := parsePage(r)
+		if msg == "" && page.after.Before {
+			msg = "the manifest only pages forwards"
+		}
+		if msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+		if r.URL.Query().Get("limit") == "" {
+			page.limit = manifestLimit
+		}
+
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT id, uuid, slug, updated_at FROM movies
+			WHERE tenant_id=$1 AND deleted_at IS NULL AND id > $2
+			ORDER BY id LIMIT $3`, tenantFrom(r.Context()), page.after.ID, page.limit+1)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		mode, _ := r.Context().Value(ctxPublicIDs).(string)
+		out := []manifestEntry{}
+		var (
+			lastID int64
+			more   bool
+		)
+		for rows.Next() {
+			var (
+				e  manifestEntry
+				id int64
+			)
+			if err := rows.Scan(&id, &e.UUID, &e.Slug, &e.UpdatedAt); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if len(out) == page.limit {
+				more = true
+				break
+			}
+			if mode != publicIDsUUID {
+				e.ID = &id
+			}
+			out = append(out, e)
+			lastID = id
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		meta := pageMetadata{Limit: page.limit}
+		if more {
+			meta.NextCursor = pageCursor{ID: lastID}.encode()
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"movies": out, "metadata": meta, "_links": pageLinks(r, meta)})
+	}
+}
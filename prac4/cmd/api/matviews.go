@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// matView is a materialized view the API keeps refreshed. Each lives in
+// public and, in schema-per-tenant mode, in every tenant schema.
+type matView struct {
+	name     string
+	interval time.Duration
+}
+
+const (
+	matViewTrending = "movie_trending"
+	matViewStats    = "movie_stats"
+)
+
+// materializedViews are the views behind the heavy aggregates.
+func materializedViews(cfg config) []matView {
+	return []matView{
+		{matViewTrending, cfg.TrendingRefreshInterval},
+		{matViewStats, cfg.StatsRefreshInterval},
+	}
+}
+
+// errRefreshBusy means another instance is refreshing the view.
+var errRefreshBusy = errors.New("a refresh of the view is already running")
+
+// freshness says how old the numbers in a response are. Source is "live"
+// for numbers computed for the request, or "materialized" with the age of
+// the view they came from.
+type freshness struct {
+	Source          string     `json:"source"`
+	ComputedAt      *time.Time `json:"computed_at,omitempty"`
+	AgeSeconds      *int64     `json:"age_seconds,omitempty"`
+	RefreshInterval *int64     `json:"refresh_interval_seconds,omitempty"`
+}
+
+var liveFreshness = &freshness{Source: "live"}
+
+// runMatViewRefresher refreshes each view once its interval has passed
+// since the last refresh, in every tenant schema when schemas is set. The
+// last refresh is tracked in the database, so several instances share the
+// work rather than each refreshing on its own clock.
+func runMatViewRefresher(db *sql.DB, schemas bool, views []matView) {
+	tick := time.Minute
+	for _, v := range views {
+		tick = min(tick, v.interval)
+	}
+	for ; ; time.Sleep(tick) {
+		err := forEachTenant(context.Background(), db, schemas, func(ctx context.Context) error {
+			for _, v := range views {
+				f, err := matViewFreshness(ctx, db, v)
+				if err != nil {
+					return err
+				}
+				if f.ComputedAt != nil && time.Since(*f.ComputedAt) < v.interval {
+					continue
+				}
+				if err := refreshMatView(ctx, db, v.name); err != nil && err != errRefreshBusy {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("materialized views: %v", err)
+		}
+	}
+}
+
+// refreshMatView refreshes the view in ctx's tenant schema and records when.
+// CONCURRENTLY keeps the old contents readable meanwhile.
+func refreshMatView(ctx context.Context, db *sql.DB, name string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var locked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT pg_try_advisory_xact_lock(hashtext($1), hashtext(current_schema()))`, name).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errRefreshBusy
+	}
+	started := time.Now()
+	// name is one of materializedViews, never client input.
+	if _, err := tx.ExecContext(ctx, `REFRESH MATERIALIZED VIEW CONCURRENTLY `+name); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO matview_refreshes (name, schema_name, refreshed_at, duration_ms)
+		VALUES ($1, current_schema(), now(), $2)
+		ON CONFLICT (name, schema_name) DO UPDATE SET refreshed_at=EXCLUDED.refreshed_at, duration_ms=EXCLUDED.duration_ms`,
+		name, time.Since(started).Milliseconds())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// matViewFreshness is the age of v in ctx's tenant schema. ComputedAt is
+// nil if it was never refreshed.
+func matViewFreshness(ctx context.Context, db *sql.DB, v matView) (*freshness, error) {
+	interval := int64(v.interval.Seconds())
+	f := &freshness{Source: "materialized", RefreshInterval: &interval}
+	var at time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT refreshed_at FROM matview_refreshes WHERE name=$1 AND schema_name=current_schema()`, v.name).Scan(&at)
+	if err == sql.ErrNoRows {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	age := int64(time.Since(at).Seconds())
+	f.ComputedAt, f.AgeSeconds = &at, &age
+	return f, nil
+}
+
+func findMatView(views []matView, name string) (matView, bool) {
+	for _, v := range views {
+		if v.name == name {
+			return v, true
+		}
+	}
+	return matView{}, false
+}
+
+// viewFreshness is matViewFreshness by name, for handlers reading a view.
+func viewFreshness(ctx context.Context, db *sql.DB, views []matView, name string) (*freshness, error) {
+	v, _ := findMatView(views, name)
+	return matViewFreshness(ctx, db, v)
+}
+
+// GET /admin/matviews
+//
+// The materialized views with their age in the tenant's schema and how
+// long the last refresh took.
+func adminListMatViews(db *sql.DB, views []matView) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type entry struct {
+			Name string `json:"name"`
+			freshness
+			DurationMS *int64 `json:"last_duration_ms,omitempty"`
+		}
+		out := []entry{}
+		for _, v := range views {
+			f, err := matViewFreshness(r.Context(), db, v)
+			var ms sql.NullInt64
+			if err == nil {
+				err = db.QueryRowContext(r.Context(), `
+					SELECT duration_ms FROM matview_refreshes WHERE name=$1 AND schema_name=current_schema()`, v.name).Scan(&ms)
+			}
+			if err != nil && err != sql.ErrNoRows {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			e := entry{Name: v.name, freshness: *f}
+			if ms.Valid {
+				e.DurationMS = &ms.Int64
+			}
+			out = append(out, e)
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// POST /admin/matviews/{name}/refresh
+//
+// Refreshes the view now, e.g. after a bulk import, and returns its new
+// freshness. Without schema isolation the view covers every tenant, so
+// this is for operators. 409 if a refresh is already running.
+func adminRefreshMatView(db *sql.DB, views []matView) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := findMatView(views, r.PathValue("name"))
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown materialized view"})
+			return
+		}
+		err := refreshMatView(r.Context(), db, v.name)
+		if err == errRefreshBusy {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		var f *freshness
+		if err == nil {
+			f, err = matViewFreshness(r.Context(), db, v)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"name": v.name, "freshness": f})
+	}
+}
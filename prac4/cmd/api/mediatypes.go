@@ -0,0 +1,65 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// supportedMediaTypes are the request bodies the handlers read: all of them
+// decode JSON, JSON:API documents included.
+var supportedMediaTypes = []string{"application/json", jsonAPIMediaType}
+
+// pathMediaTypes are the bodies some paths take on top of
+// supportedMediaTypes.
+var pathMediaTypes = map[string][]string{
+	"/movies/import": {ndjsonMediaType},
+	"/imports":       {ndjsonMediaType},
+}
+
+// requireJSONBodies turns away POST, PUT and PATCH bodies that aren't JSON
+// with 415, listing the supported types in the error and in Accept. A
+// charset other than UTF-8 is refused too. Requests without a body pass, as
+// does /unsubscribe/digest, which takes form posts from mail clients and
+// ignores the body.
+func requireJSONBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength == 0 || r.URL.Path == "/unsubscribe/digest" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		supported := append(slices.Clip(supportedMediaTypes), pathMediaTypes[r.URL.Path]...)
+		if msg := checkMediaType(r.Header.Get("Content-Type"), supported); msg != "" {
+			w.Header().Set("Accept", strings.Join(supported, ", "))
+			writeJSON(w, http.StatusUnsupportedMediaType, map[string]any{"error": msg, "supported": supported})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkMediaType explains what is wrong with a request's Content-Type given
+// the supported media types, or returns "".
+func checkMediaType(v string, supported []string) string {
+	if v == "" {
+		return "Content-Type is required"
+	}
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "invalid Content-Type"
+	}
+	if !slices.Contains(supported, mediaType) {
+		return "unsupported media type " + mediaType
+	}
+	if cs, ok := params["charset"]; ok && !strings.EqualFold(cs, "utf-8") {
+		return "unsupported charset " + cs + "; send utf-8"
+	}
+	return ""
+}
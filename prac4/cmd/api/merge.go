@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// mergedMovie is how a merge shows up in the surviving movie's audit entry.
+type mergedMovie struct {
+	Movie
+	MergedFrom int64 `json:"merged_from,omitempty"`
+}
+
+// POST /movies/{id}/merge with {"target_id": 7}
+//
+// Folds the duplicate {id} into the target: translations and tags the
+// target lacks move over, external IDs and metadata keys the target lacks
+// are taken from the duplicate, its views are added to the target's, and
+// the duplicate is soft-deleted. The target keeps its own fields otherwise.
+// Both changes are audited, the target's with merged_from.
+func mergeMovie(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		var in struct {
+			TargetID int64 `json:"target_id"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if in.TargetID <= 0 || in.TargetID == id {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "target_id must be another movie's id"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		// Lock both in id order so opposite merges can't deadlock.
+		tenant := tenantFrom(r.Context())
+		rows, err := tx.Query(`
+			SELECT `+movieColumns+` FROM movies
+			WHERE id IN ($1, $2) AND tenant_id=$3 AND deleted_at IS NULL
+			ORDER BY id FOR UPDATE`, id, in.TargetID, tenant)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		var dup, target *Movie
+		for rows.Next() {
+			m, err := scanMovie(rows)
+			if err != nil {
+				rows.Close()
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if m.ID == id {
+				dup = &m
+			} else {
+				target = &m
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if dup == nil || target == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "both movies must exist"})
+			return
+		}
+
+		// The duplicate goes first: that frees its external IDs, which are
+		// unique only among live movies.
+		res, err := tx.Exec(`
+			UPDATE movie_translations d SET movie_id=$2
+			WHERE d.movie_id=$1 AND d.tenant_id=$3
+				AND NOT EXISTS (SELECT 1 FROM movie_translations t WHERE t.movie_id=$2 AND t.language=d.language)`,
+			id, in.TargetID, tenant)
+		var moved int64
+		if err == nil {
+			moved, _ = res.RowsAffected()
+			_, err = tx.Exec(`
+				UPDATE movie_tags d SET movie_id=$2
+				WHERE d.movie_id=$1 AND d.tenant_id=$3
+					AND NOT EXISTS (SELECT 1 FROM movie_tags t WHERE t.movie_id=$2 AND t.tag_id=d.tag_id)`,
+				id, in.TargetID, tenant)
+		}
+		if err == nil {
+			// The target inherits the duplicate's views, for trending too.
+			_, err = tx.Exec(`
+				WITH moved AS (DELETE FROM movie_views WHERE movie_id=$1 AND tenant_id=$3 RETURNING day, views)
+				INSERT INTO movie_views (tenant_id, movie_id, day, views) SELECT $3, $2, day, views FROM moved
+				ON CONFLICT (movie_id, day) DO UPDATE SET views = movie_views.views + EXCLUDED.views`,
+				id, in.TargetID, tenant)
+		}
+		if err == nil {
+			_, err = tx.Exec(`UPDATE movies SET deleted_at=now() WHERE id=$1 AND tenant_id=$2`, id, tenant)
+		}
+		var merged Movie
+		if err == nil {
+			imdb, tmdb := dup.ExternalIDs.nullable()
+			merged, err = scanMovie(tx.QueryRow(`
+				UPDATE movies SET imdb_id=COALESCE(imdb_id, $1), tmdb_id=COALESCE(tmdb_id, $2),
+					metadata=$5::jsonb || metadata, views=views + $6, updated_at=now()
+				WHERE id=$3 AND tenant_id=$4
+				RETURNING `+movieColumns, imdb, tmdb, in.TargetID, tenant, []byte(dup.Metadata), dup.Views))
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "movie", id, "delete", dup, nil)
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "movie", in.TargetID, "update",
+				mergedMovie{Movie: *target}, mergedMovie{Movie: merged, MergedFrom: id})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		countEvent(eventMovieDeleted)
+		countEvent(eventMovieUpdated)
+		writeJSON(w, http.StatusOK, map[string]any{"movie": merged, "merged_from": id, "translations_moved": moved})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bounds of a movie's metadata: its size as sent and how deeply objects and
+// arrays may nest, counting the top-level object as 1.
+const (
+	maxMetadataBytes = 8 << 10
+	maxMetadataDepth = 4
+)
+
+// movieMetadataFilter is the query prefix of metadata filters on the movie
+// list, as in ?metadata.language=fr.
+const movieMetadataFilter = "metadata."
+
+// normalizeMetadata validates the metadata of a movie input and returns it
+// compacted. Absent or null metadata is an empty object.
+func normalizeMetadata(raw json.RawMessage) (json.RawMessage, string) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return json.RawMessage("{}"), ""
+	}
+	if len(raw) > maxMetadataBytes {
+		return nil, "metadata must be at most " + strconv.Itoa(maxMetadataBytes) + " bytes"
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, "metadata must be valid JSON"
+	}
+	if _, ok := v.(map[string]any); !ok {
+		return nil, "metadata must be a JSON object"
+	}
+	if jsonDepth(v) > maxMetadataDepth {
+		return nil, "metadata must not nest more than " + strconv.Itoa(maxMetadataDepth) + " levels deep"
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return nil, "metadata must be valid JSON"
+	}
+	return buf.Bytes(), ""
+}
+
+// jsonDepth is how deeply objects and arrays nest in v; a scalar is 0.
+func jsonDepth(v any) int {
+	depth := 0
+	switch v := v.(type) {
+	case map[string]any:
+		for _, e := range v {
+			depth = max(depth, jsonDepth(e))
+		}
+	case []any:
+		for _, e := range v {
+			depth = max(depth, jsonDepth(e))
+		}
+	default:
+		return 0
+	}
+	return depth + 1
+}
+
+// metadataFilters adds a containment condition for every metadata.<path>
+// parameter, e.g. ?metadata.language=fr or ?metadata.awards.oscars=2, which
+// movies_metadata_idx serves. Values are matched as strings, and also as
+// numbers or booleans when they read as one.
+func metadataFilters(q url.Values, wc *whereClause) string {
+	var keys []string
+	for k := range q {
+		if strings.HasPrefix(k, movieMetadataFilter) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		path := strings.Split(strings.TrimPrefix(k, movieMetadataFilter), ".")
+		for _, p := range path {
+			if p == "" {
+				return k + " is not a metadata path"
+			}
+		}
+		v := q.Get(k)
+		conds := []string{"metadata @> ?"}
+		docs := []any{metadataDoc(path, v)}
+		var scalar any
+		if dec := json.NewDecoder(strings.NewReader(v)); dec.Decode(&scalar) == nil && !dec.More() {
+			switch scalar.(type) {
+			case float64, bool:
+				conds = append(conds, "metadata @> ?")
+				docs = append(docs, metadataDoc(path, json.RawMessage(v)))
+			}
+		}
+		wc.add("("+strings.Join(conds, " OR ")+")", docs...)
+	}
+	return ""
+}
+
+// metadataDoc is the JSON document {"a":{"b":v}} for the path a.b.
+func metadataDoc(path []string, v any) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		v = map[string]any{path[i]: v}
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
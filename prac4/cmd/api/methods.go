@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// probeMethods are the methods OPTIONS asks the router about.
+var probeMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+}
+
+// routeMethods answers "which methods does this path take" for OPTIONS by
+// probing the router. A pattern registered without a method matches every
+// method, so it is probed again in a sub-router: the real one for route
+// groups, or one describing what the handler's method switch accepts.
+type routeMethods struct {
+	mux  *http.ServeMux
+	subs map[string]*http.ServeMux
+}
+
+func newRouteMethods(mux *http.ServeMux) *routeMethods {
+	rm := &routeMethods{mux: mux, subs: map[string]*http.ServeMux{}}
+	rm.describe("/health", "GET /health")
+	rm.describe("/movies", "GET /movies", "POST /movies")
+	rm.describe("/movies/", "GET /movies/{id}", "PUT /movies/{id}", "DELETE /movies/{id}")
+	return rm
+}
+
+// describe records the method patterns served by the method-less pattern.
+func (rm *routeMethods) describe(pattern string, routes ...string) {
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.Handle(route, http.NotFoundHandler())
+	}
+	rm.subs[pattern] = mux
+}
+
+// matches reports whether a route takes r, method included.
+func (rm *routeMethods) matches(r *http.Request) bool {
+	_, pattern := rm.mux.Handler(r)
+	if pattern == "" {
+		return false
+	}
+	if sub := rm.subs[pattern]; sub != nil {
+		_, p := sub.Handler(r)
+		return p != ""
+	}
+	return true
+}
+
+func (rm *routeMethods) allowed(r *http.Request) []string {
+	var out []string
+	for _, m := range probeMethods {
+		req := r.Clone(r.Context())
+		req.Method = m
+		if rm.matches(req) {
+			out = append(out, m)
+		}
+	}
+	if out != nil {
+		out = append(out, http.MethodOptions)
+	}
+	return out
+}
+
+// options answers OPTIONS with the path's Allow header, ahead of
+// authentication: what a route accepts isn't a secret.
+func (rm *routeMethods) options(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allow := rm.allowed(r)
+		if allow == nil {
+			notFound(w)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// unmatched answers requests no route takes, which the router would turn
+// away in plain text: 405 with the Allow header when the path takes other
+// methods, else 404. Like options it runs ahead of authentication.
+func (rm *routeMethods) unmatched(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || rm.matches(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allow := rm.allowed(r); allow != nil {
+			methodNotAllowed(w, strings.Join(allow, ", "))
+			return
+		}
+		notFound(w)
+	})
+}
+
+func notFound(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+}
+
+// methodNotAllowed answers 405 listing the methods in allow.
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+}
+
+// headResponses runs HEAD requests through the GET handler with the body
+// discarded, and sets Content-Length to what the body would have been.
+func headResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hw := &headWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(hw, r)
+		if hw.status != http.StatusNoContent && hw.status != http.StatusNotModified && w.Header().Get("Content-Length") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(hw.n))
+		}
+		w.WriteHeader(hw.status)
+	})
+}
+
+// headWriter holds back the status line until the handler is done, counting
+// and dropping the body.
+type headWriter struct {
+	http.ResponseWriter
+	status int
+	n      int
+}
+
+func (h *headWriter) WriteHeader(code int) {
+	h.status = code
+}
+
+func (h *headWriter) Write(b []byte) (int, error) {
+	h.n += len(b)
+	return len(b), nil
+}
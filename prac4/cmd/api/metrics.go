@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metrics is the process-wide registry exposed at /metrics in the Prometheus
+// text format. It only supports what the API needs: counters, gauges and
+// gauges computed at scrape time.
+var metrics = newMetricsRegistry()
+
+type metricFamily struct {
+	name, help, typ string
+	values          map[string]float64 // keyed by rendered label set
+	fn              func() float64
+}
+
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{families: map[string]*metricFamily{}}
+}
+
+func (m *metricsRegistry) family(name, help, typ string) *metricFamily {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, typ: typ, values: map[string]float64{}}
+		m.families[name] = f
+	}
+	return f
+}
+
+// renderLabels turns "k1", "v1", "k2", "v2" into {k1="v1",k2="v2"}.
+func renderLabels(kv []string) string {
+	if len(kv) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		parts = append(parts, kv[i]+`="`+v+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Add increments a counter by delta.
+func (m *metricsRegistry) Add(name, help string, delta float64, labels ...string) {
+	m.mu.Lock()
+	m.family(name, help, "counter").values[renderLabels(labels)] += delta
+	m.mu.Unlock()
+}
+
+// Inc increments a counter by one.
+func (m *metricsRegistry) Inc(name, help string, labels ...string) {
+	m.Add(name, help, 1, labels...)
+}
+
+// Set sets a gauge.
+func (m *metricsRegistry) Set(name, help string, v float64, labels ...string) {
+	m.mu.Lock()
+	m.family(name, help, "gauge").values[renderLabels(labels)] = v
+	m.mu.Unlock()
+}
+
+// GaugeFunc registers a gauge whose value is computed on every scrape.
+func (m *metricsRegistry) GaugeFunc(name, help string, fn func() float64) {
+	m.mu.Lock()
+	m.family(name, help, "gauge").fn = fn
+	m.mu.Unlock()
+}
+
+// Value returns the current value of a metric, for summaries shown outside
+// /metrics.
+func (m *metricsRegistry) Value(name string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.families[name]
+	if !ok {
+		return 0
+	}
+	if f.fn != nil {
+		return f.fn()
+	}
+	return f.values[renderLabels(labels)]
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		if f.fn != nil {
+			fmt.Fprintf(&b, "%s %g\n", f.name, f.fn())
+			continue
+		}
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s%s %g\n", f.name, k, f.values[k])
+		}
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// Business events counted in business_events_total. Alert on these to catch
+// product problems (nothing created for hours, webhooks piling up as dead
+// letters) that HTTP status codes alone don't show.
+const (
+	eventMovieCreated        = "movie.created"
+	eventMovieUpdated        = "movie.updated"
+	eventMovieDeleted        = "movie.deleted"
+	eventMoviePurged         = "movie.purged"
+	eventTranslationSaved    = "translation.saved"
+	eventGenreRenamed        = "genre.renamed"
+	eventUserRegistered      = "user.registered"
+	eventLoginFailed         = "auth.login_failed"
+	eventLoginLockout        = "auth.lockout"
+	eventWebhookVerified     = "webhook.verified"
+	eventWebhookDeadLettered = "webhook.dead_lettered"
+	eventMoviesImported      = "movies.imported"
+	eventImportFailed        = "movies.import_failed"
+
+	eventEmailSent   = "email.sent"
+	eventEmailFailed = "email.failed"
+)
+
+var businessEvents = []string{
+	eventMovieCreated, eventMovieUpdated, eventMovieDeleted, eventMoviePurged,
+	eventTranslationSaved, eventGenreRenamed, eventUserRegistered, eventLoginFailed,
+	eventLoginLockout, eventWebhookVerified, eventWebhookDeadLettered, eventMoviesImported,
+	eventImportFailed, eventEmailSent, eventEmailFailed,
+}
+
+const businessEventsHelp = "Business-level events by type."
+
+func init() {
+	// Export every known event from the start so rate() and absence alerts
+	// work before the first occurrence.
+	for _, ev := range businessEvents {
+		metrics.Add("business_events_total", businessEventsHelp, 0, "event", ev)
+	}
+}
+
+// countEvent records one business event. Call it only after the change it
+// describes has been committed.
+func countEvent(event string) {
+	metrics.Inc("business_events_total", businessEventsHelp, "event", event)
+}
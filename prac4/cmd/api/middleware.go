@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+)
+
+type ctxKey int
+
+const (
+	ctxRequestID ctxKey = iota
+	ctxUser
+	ctxAccessRecord
+	ctxClientIP
+	ctxLinkBase
+	ctxTenant
+	ctxPublicIDs
+	ctxDryRun
+	ctxStringIDs
+)
+
+// requestIDRe limits client-supplied request IDs to something safe to log.
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID propagates X-Request-ID from the client (or generates one) into
+// the request context and echoes it on the response, so a log line, an audit
+// entry and a client bug report can be tied together.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) {
+			id = randomToken(8)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxRequestID, id)))
+	})
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(ctxRequestID).(string)
+	return id
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+
+	"practice4/migrations"
+)
+
+// migrationLockID is an arbitrary key for pg_advisory_lock so that several
+// replicas starting at once don't apply the same migration twice.
+const migrationLockID = 7240001
+
+// migrate applies every embedded migration that isn't recorded in
+// schema_migrations yet. Each file runs in its own transaction together with
+// the bookkeeping row, so a failed migration leaves nothing half-applied.
+func migrate(db *sql.DB) error {
+	_, err := applyMigrations(db)
+	return err
+}
+
+// applyMigrations is migrate, returning the versions it applied.
+func applyMigrations(db *sql.DB) ([]string, error) {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version TEXT PRIMARY KEY,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := fs.Glob(migrations.FS, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var done []string
+	for _, name := range names {
+		var applied bool
+		err := conn.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version=$1)`, name).Scan(&applied)
+		if err != nil {
+			return done, err
+		}
+		if applied {
+			continue
+		}
+
+		body, err := fs.ReadFile(migrations.FS, name)
+		if err != nil {
+			return done, err
+		}
+		sum := sha256.Sum256(body)
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return done, err
+		}
+		if _, err := tx.ExecContext(ctx, string(body)); err != nil {
+			tx.Rollback()
+			return done, fmt.Errorf("migration %s: %w", name, err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO schema_migrations (version, checksum) VALUES ($1, $2)`,
+			name, hex.EncodeToString(sum[:])); err != nil {
+			tx.Rollback()
+			return done, err
+		}
+		if err := tx.Commit(); err != nil {
+			return done, err
+		}
+		log.Printf("Applied migration %s", name)
+		done = append(done, name)
+	}
+	return done, nil
+}
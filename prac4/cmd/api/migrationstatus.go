@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"practice4/migrations"
+
+	"github.com/lib/pq"
+)
+
+// Migration statuses.
+const (
+	migrationApplied  = "applied"
+	migrationPending  = "pending"
+	migrationModified = "modified" // applied, but the file has changed since
+	migrationUnknown  = "unknown"  // applied, but not part of this build
+)
+
+type migrationStatus struct {
+	Version         string     `json:"version"`
+	Status          string     `json:"status"`
+	Checksum        string     `json:"checksum,omitempty"`
+	AppliedChecksum string     `json:"applied_checksum,omitempty"`
+	AppliedAt       *time.Time `json:"applied_at,omitempty"`
+}
+
+// migrationStatuses compares the migrations in fsys with the ones recorded
+// in schema's schema_migrations, in version order. Versions only the
+// database knows come last.
+func migrationStatuses(ctx context.Context, db *sql.DB, schema string, fsys fs.FS, pattern string) ([]migrationStatus, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT version, checksum, applied_at FROM `+pq.QuoteIdentifier(schema)+`.schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[string]migrationStatus{}
+	var versions []string
+	for rows.Next() {
+		var (
+			m  migrationStatus
+			at time.Time
+		)
+		if err := rows.Scan(&m.Version, &m.AppliedChecksum, &at); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.AppliedAt = &at
+		applied[m.Version] = m
+		versions = append(versions, m.Version)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	names, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var out []migrationStatus
+	for _, name := range names {
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(body)
+		m, ok := applied[path.Base(name)]
+		m.Version, m.Checksum = path.Base(name), hex.EncodeToString(sum[:])
+		switch {
+		case !ok:
+			m.Status = migrationPending
+		case m.AppliedChecksum != m.Checksum:
+			m.Status = migrationModified
+		default:
+			m.Status, m.AppliedChecksum = migrationApplied, ""
+		}
+		out = append(out, m)
+		delete(applied, m.Version)
+	}
+	for _, v := range versions {
+		if m, ok := applied[v]; ok {
+			m.Status = migrationUnknown
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// tenantMigrationStatuses is migrationStatuses for the tenant's schema. All
+// tenant migrations are pending while the schema doesn't exist yet.
+func tenantMigrationStatuses(ctx context.Context, db *sql.DB, id int64) ([]migrationStatus, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, pq.QuoteIdentifier(tenantSchema(id))+".schema_migrations").Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return migrationStatuses(ctx, db, tenantSchema(id), migrations.TenantFS, "tenant/*.sql")
+	}
+	names, err := fs.Glob(migrations.TenantFS, "tenant/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	out := make([]migrationStatus, len(names))
+	for i, name := range names {
+		out[i] = migrationStatus{Version: path.Base(name), Status: migrationPending}
+	}
+	return out, nil
+}
+
+// pendingCount is how many of statuses haven't been applied.
+func pendingCount(statuses []migrationStatus) int {
+	n := 0
+	for _, m := range statuses {
+		if m.Status == migrationPending {
+			n++
+		}
+	}
+	return n
+}
+
+type tenantMigrations struct {
+	Schema  string `json:"schema"`
+	Pending int    `json:"pending"`
+}
+
+// GET /admin/migrations
+//
+// The migrations of this build against the database: applied (with when),
+// pending, modified since they were applied, or unknown to this build. In
+// schema-per-tenant mode each tenant schema's pending count is listed too.
+func adminMigrations(db *sql.DB, schemas bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := migrationStatuses(r.Context(), db, "public", migrations.FS, "*.sql")
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		resp := map[string]any{"migrations": statuses, "pending": pendingCount(statuses)}
+		if schemas {
+			ids, err := tenantIDs(r.Context(), db)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			tenants := []tenantMigrations{}
+			for _, id := range ids {
+				if id == defaultTenantID {
+					continue
+				}
+				st, err := tenantMigrationStatuses(r.Context(), db, id)
+				if err != nil {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+					return
+				}
+				tenants = append(tenants, tenantMigrations{Schema: tenantSchema(id), Pending: pendingCount(st)})
+			}
+			resp["tenants"] = tenants
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// POST /admin/migrations/apply?force=true
+//
+// Applies the pending migrations, then those of the tenant schemas, and
+// reports what was applied and any drift left. Schema changes can lock
+// tables or break requests halfway, so this wants maintenance mode on unless
+// force is set. Other instances keep their own maintenance state.
+func adminApplyMigrations(db *sql.DB, maint *maintenance, schemas bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !maint.get().Enabled && r.URL.Query().Get("force") != "true" {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "turn maintenance mode on first (PUT /admin/maintenance), or pass force=true"})
+			return
+		}
+		applied, err := applyMigrations(db)
+		if err == nil && schemas {
+			err = migrateTenants(db)
+		}
+		if applied == nil {
+			applied = []string{}
+		}
+		if len(applied) > 0 {
+			if aerr := recordAudit(r, db, "migrations", 0, "update", nil, applied); aerr != nil {
+				err = errors.Join(err, aerr)
+			}
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error(), "applied": applied})
+			return
+		}
+		drift, err := checkSchema(r.Context(), db, schemas)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error(), "applied": applied})
+			return
+		}
+		left := []string{}
+		for _, d := range drift {
+			left = append(left, d.String())
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"applied": applied, "drift": left})
+	}
+}
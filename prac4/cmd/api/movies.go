@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"golang.org/x/text/unicode/norm"
+)
+
+type Movie struct {
+	ID            int64        `json:"id"`
+	UUID          string       `json:"uuid"`
+	Slug          string       `json:"slug"`
+	Title         string       `json:"title"`
+	Year          int          `json:"year,omitempty"`
+	Rating        *float64     `json:"rating,omitempty"`
+	Genres        []string     `json:"genres"`
+	Certification string       `json:"certification,omitempty"`
+	ExternalIDs   *ExternalIDs `json:"external_ids,omitempty"`
+	// Metadata holds extensible attributes such as distributor or awards.
+	Metadata json.RawMessage `json:"metadata"`
+	// Views counts fetches of the movie's detail, as of the last flush.
+	Views     int64     `json:"views"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// movieInput is the writable part of a movie, shared by create and update.
+type movieInput struct {
+	Title         string   `json:"title"`
+	Year          int      `json:"year"`
+	Rating        *float64 `json:"rating"`
+	Genres        []string `json:"genres"`
+	Certification string   `json:"certification"`
+	// Metadata is replaced as a whole; see normalizeMetadata.
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// normalize cleans up the input in place and returns a validation message,
+// or "" when the input is acceptable.
+func (in *movieInput) normalize(rd *refData) string {
+	in.Title = cleanTitle(in.Title)
+	if in.Title == "" {
+		return "title is required"
+	}
+	if utf8.RuneCountInString(in.Title) > maxTitleLength {
+		return fmt.Sprintf("title is longer than %d characters", maxTitleLength)
+	}
+	if in.Year != 0 && (in.Year < 1888 || in.Year > time.Now().Year()+10) {
+		return "year is out of range"
+	}
+	if in.Rating != nil && (*in.Rating < 0 || *in.Rating > 10) {
+		return "rating must be between 0 and 10"
+	}
+	in.Genres = cleanLabels(in.Genres)
+	var msg string
+	if in.Metadata, msg = normalizeMetadata(in.Metadata); msg != "" {
+		return msg
+	}
+	return validateClassification(rd, in.Genres, in.Certification)
+}
+
+// maxTitleLength is the longest title, in characters, that a movie or a
+// translation may have.
+const maxTitleLength = 300
+
+// cleanTitle puts a title in the one form titles are stored in, so the same
+// title typed on different keyboards compares, sorts and searches alike:
+// Unicode NFC, no control characters, and single spaces between words.
+// Migration 0037's clean_title does the same in SQL.
+func cleanTitle(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(s))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// ExternalIDs link a movie to upstream catalogs. Both are unique within a
+// tenant so the same title can't be imported twice.
+type ExternalIDs struct {
+	IMDbID string `json:"imdb_id,omitempty"`
+	TMDbID int64  `json:"tmdb_id,omitempty"`
+}
+
+var imdbIDRe = regexp.MustCompile(`^tt[0-9]{7,}$`)
+
+// movieColumns is the projection scanMovie expects.
+const movieColumns = `id, uuid, slug, title, year, rating, genres, certification, imdb_id, tmdb_id, metadata, views, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMovie reads a row selected with movieColumns. Any extra destinations
+// are scanned from the columns that follow.
+func scanMovie(row rowScanner, extra ...any) (Movie, error) {
+	var (
+		m    Movie
+		year sql.NullInt64
+		cert sql.NullString
+		imdb sql.NullString
+		tmdb sql.NullInt64
+		meta []byte
+	)
+	dest := append([]any{&m.ID, &m.UUID, &m.Slug, &m.Title, &year, &m.Rating, pq.Array(&m.Genres), &cert, &imdb, &tmdb,
+		&meta, &m.Views, &m.CreatedAt, &m.UpdatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return Movie{}, err
+	}
+	m.Year = int(year.Int64)
+	m.Certification = cert.String
+	m.Metadata = meta
+	if imdb.Valid || tmdb.Valid {
+		m.ExternalIDs = &ExternalIDs{IMDbID: imdb.String, TMDbID: tmdb.Int64}
+	}
+	return m, nil
+}
+
+// validate checks the format of the IDs that are set; all of them are
+// optional.
+func (e *ExternalIDs) validate() string {
+	if e == nil {
+		return ""
+	}
+	if e.IMDbID != "" && !imdbIDRe.MatchString(e.IMDbID) {
+		return "external_ids.imdb_id must look like tt0816692"
+	}
+	if e.TMDbID < 0 {
+		return "external_ids.tmdb_id must be positive"
+	}
+	return ""
+}
+
+// nullable returns the IDs as values suitable for nullable columns.
+func (e *ExternalIDs) nullable() (sql.NullString, sql.NullInt64) {
+	if e == nil {
+		return sql.NullString{}, sql.NullInt64{}
+	}
+	return sql.NullString{String: e.IMDbID, Valid: e.IMDbID != ""},
+		sql.NullInt64{Int64: e.TMDbID, Valid: e.TMDbID != 0}
+}
+
+// findDuplicate returns the movie already holding one of the given external
+// IDs, or sql.ErrNoRows.
+func findDuplicate(ctx context.Context, db *sql.DB, e *ExternalIDs) (Movie, error) {
+	imdb, tmdb := e.nullable()
+	return scanMovie(db.QueryRowContext(ctx, `
+		SELECT `+movieColumns+` FROM movies
+		WHERE (imdb_id = $1 OR tmdb_id = $2) AND tenant_id = $3 AND deleted_at IS NULL
+		ORDER BY id LIMIT 1`, imdb, tmdb, tenantFrom(ctx)))
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// uniqueConstraint is the constraint or unique index err violates, or "" if
+// it isn't a unique violation.
+func uniqueConstraint(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return pqErr.Constraint
+	}
+	return ""
+}
+
+// slugKey is the unique index on a tenant's movie slugs.
+const slugKey = "movies_slug_key"
+
+// slugBusyMessage is the 409 for a slug clash that retryInsert gave up on.
+const slugBusyMessage = "other movies with this title are being created; try again"
+
+// retryInsert runs insert, a statement adding rows to movies, from a
+// savepoint, and runs it again when it violates one of the given unique
+// indexes. The slug trigger picks a free slug, but movies with the same
+// title created at once can pick the same one; a retry sees the winner and
+// gets the next suffix. After three attempts the violation is returned.
+func retryInsert(ctx context.Context, tx *sql.Tx, insert func() error, indexes ...string) error {
+	for attempt := 1; ; attempt++ {
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT insert_movie`); err != nil {
+			return err
+		}
+		err := insert()
+		if attempt == 3 || !slices.Contains(indexes, uniqueConstraint(err)) {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT insert_movie`); err != nil {
+			return err
+		}
+	}
+}
+
+// GET /movies/by-external/{source}/{id}, where source is imdb or tmdb.
+func getMovieByExternalID(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var query string
+		switch r.PathValue("source") {
+		case "imdb":
+			query = `SELECT ` + movieColumns + ` FROM movies WHERE imdb_id=$1 AND tenant_id=$2 AND deleted_at IS NULL`
+		case "tmdb":
+			query = `SELECT ` + movieColumns + ` FROM movies WHERE tmdb_id::text=$1 AND tenant_id=$2 AND deleted_at IS NULL`
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown external id source"})
+			return
+		}
+
+		m, err := scanMovie(db.QueryRowContext(r.Context(), query, r.PathValue("id"), tenantFrom(r.Context())))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+	}
+}
+
+// PUT /movies/by-external/imdb/{id} and /tmdb/{id}
+//
+// Creates or updates the movie with that external ID in one INSERT ... ON
+// CONFLICT, for sync jobs mirroring an upstream catalog: 201 when it was
+// created, 200 when it already existed. The body is a movie in the create
+// format without external_ids. The sources are separate routes because a
+// {source} wildcard would clash with PUT /movies/{id}/translations/{lang}.
+func upsertMovieByExternalID(db *sql.DB, refs *refData, source string) http.HandlerFunc {
+	if source != "imdb" && source != "tmdb" {
+		panic("unknown external id source " + source)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			column string
+			key    any
+		)
+		switch source {
+		case "imdb":
+			if !imdbIDRe.MatchString(r.PathValue("id")) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "imdb ids look like tt0816692"})
+				return
+			}
+			column, key = "imdb_id", r.PathValue("id")
+		case "tmdb":
+			n, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "tmdb ids are positive numbers"})
+				return
+			}
+			column, key = "tmdb_id", n
+		}
+		var in movieInput
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if msg := in.normalize(refs); msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		// The current version, for the audit diff. Without one the upsert
+		// still updates if a concurrent request inserted first.
+		tenant := tenantFrom(r.Context())
+		var before *Movie
+		old, err := scanMovie(tx.QueryRow(`
+			SELECT `+movieColumns+` FROM movies WHERE `+column+`=$1 AND tenant_id=$2 AND deleted_at IS NULL FOR UPDATE`,
+			key, tenant))
+		switch {
+		case err == nil:
+			before = &old
+		case err != sql.ErrNoRows:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		var m Movie
+		var created bool
+		err = retryInsert(r.Context(), tx, func() (err error) {
+			m, err = scanMovie(tx.QueryRow(`
+				INSERT INTO movies (tenant_id, title, genres, certification, year, rating, metadata, `+column+`)
+				VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, 0), $6, $7, $8)
+				ON CONFLICT (tenant_id, `+column+`) WHERE deleted_at IS NULL DO UPDATE
+				SET title=EXCLUDED.title, genres=EXCLUDED.genres, certification=EXCLUDED.certification,
+					year=EXCLUDED.year, rating=EXCLUDED.rating, metadata=EXCLUDED.metadata, updated_at=now()
+				RETURNING `+movieColumns+`, xmax = 0`,
+				tenant, in.Title, pq.Array(in.Genres), in.Certification, in.Year, in.Rating, []byte(in.Metadata), key), &created)
+			return err
+		}, slugKey)
+		if uniqueConstraint(err) == slugKey {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": slugBusyMessage})
+			return
+		}
+		if err == nil {
+			if created {
+				err = recordAudit(r, tx, "movie", m.ID, "create", nil, m)
+			} else {
+				err = recordAudit(r, tx, "movie", m.ID, "update", before, m)
+			}
+		}
+		if err == nil {
+			err = commitUnlessDryRun(w, r, tx)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		code, event := http.StatusOK, eventMovieUpdated
+		if created {
+			code, event = http.StatusCreated, eventMovieCreated
+		}
+		if !isDryRun(r) {
+			countEvent(event)
+		}
+		writeJSON(w, code, m)
+	}
+}
+
+// validateClassification checks genres and certification against the cached
+// reference data.
+func validateClassification(rd *refData, genres []string, certification string) string {
+	if g, ok := rd.unknownGenre(genres); ok {
+		return "unknown genre: " + g
+	}
+	if certification != "" && !rd.hasCertification(certification) {
+		return "unknown certification: " + certification
+	}
+	return ""
+}
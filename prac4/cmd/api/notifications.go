@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Notification kinds, each switched on or off by a preference column in
+// user_preferences. An email goes out for every kind the user gets when
+// they have email_notifications on.
+const (
+	notifyCommentReply = "comment.reply"
+	notifyMovieReview  = "movie.review"
+)
+
+var notificationPrefs = map[string]string{
+	notifyCommentReply: "notify_replies",
+	notifyMovieReview:  "notify_reviews",
+}
+
+type Notification struct {
+	ID          int64      `json:"id"`
+	Kind        string     `json:"kind"`
+	SubjectType string     `json:"subject_type"`
+	SubjectID   int64      `json:"subject_id"`
+	ActorID     *int64     `json:"actor_id"`
+	Message     string     `json:"message"`
+	Read        bool       `json:"read"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// notify puts a notification in userID's inbox, as part of tx, unless they
+// turned that kind off or their account is inactive, and queues an email
+// for it when they get notifications by email. Users don't hear about their
+// own actions.
+func notify(ctx context.Context, tx *sql.Tx, userID, actorID int64, kind, subjectType string, subjectID int64, message string) error {
+	pref, ok := notificationPrefs[kind]
+	if !ok {
+		return fmt.Errorf("unknown notification kind %q", kind)
+	}
+	if userID == actorID {
+		return nil
+	}
+	var (
+		tenant      int64
+		email, name string
+		byEmail     bool
+	)
+	err := tx.QueryRowContext(ctx, `
+		SELECT u.tenant_id, u.email, u.name, COALESCE(p.email_notifications, TRUE)
+		FROM users u LEFT JOIN user_preferences p ON p.user_id = u.id
+		WHERE u.id=$1 AND u.active AND COALESCE(p.`+pref+`, TRUE)`, userID).Scan(&tenant, &email, &name, &byEmail)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO notifications (tenant_id, user_id, kind, subject_type, subject_id, actor_id, message)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7)`,
+			tenant, userID, kind, subjectType, subjectID, actorID, message)
+	}
+	if err == nil && byEmail {
+		err = enqueueEmail(ctx, tx, tenant, userID, email, "notification", map[string]any{"Name": name, "Message": message})
+	}
+	return err
+}
+
+// GET /me/notifications?unread=true&before=120&limit=50
+//
+// The user's notifications, newest first, with the number still unread.
+// before is the id of the last notification of the previous page.
+func myNotifications(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := userFrom(r.Context())
+		q := r.URL.Query()
+		limit := 50
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 100 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be 1-100"})
+				return
+			}
+			limit = n
+		}
+		query := `SELECT id, kind, subject_type, subject_id, actor_id, message, read_at, created_at
+			FROM notifications WHERE user_id=$1 AND tenant_id=$2`
+		args := []any{u.ID, u.TenantID}
+		switch q.Get("unread") {
+		case "", "false":
+		case "true":
+			query += ` AND read_at IS NULL`
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unread must be true or false"})
+			return
+		}
+		if v := q.Get("before"); v != "" {
+			before, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid before"})
+				return
+			}
+			args = append(args, before)
+			query += ` AND id < $` + strconv.Itoa(len(args))
+		}
+		args = append(args, limit)
+		query += ` ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args))
+
+		rows, err := db.QueryContext(r.Context(), query, args...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []Notification{}
+		for rows.Next() {
+			var n Notification
+			if err := rows.Scan(&n.ID, &n.Kind, &n.SubjectType, &n.SubjectID, &n.ActorID, &n.Message, &n.ReadAt, &n.CreatedAt); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			n.Read = n.ReadAt != nil
+			out = append(out, n)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		var unread int
+		err = db.QueryRowContext(r.Context(), `
+			SELECT count(*) FROM notifications WHERE user_id=$1 AND tenant_id=$2 AND read_at IS NULL`,
+			u.ID, u.TenantID).Scan(&unread)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"unread": unread, "notifications": out})
+	}
+}
+
+// POST /me/notifications/read with {"ids": [3, 4]}, or no body for all
+//
+// Marks notifications read. Ids that aren't the user's are ignored.
+func markNotificationsRead(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			IDs []int64 `json:"ids"`
+		}
+		if err := readJSON(r, &in); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		u := userFrom(r.Context())
+		query := `UPDATE notifications SET read_at=now() WHERE user_id=$1 AND tenant_id=$2 AND read_at IS NULL`
+		args := []any{u.ID, u.TenantID}
+		if in.IDs != nil {
+			query += ` AND id = ANY($3)`
+			args = append(args, pq.Array(in.IDs))
+		}
+		res, err := db.ExecContext(r.Context(), query, args...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		n, _ := res.RowsAffected()
+		writeJSON(w, http.StatusOK, map[string]int64{"marked": n})
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// authProviderConfig is one AUTH_PROVIDERS entry.
+type authProviderConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+}
+
+// authProvider signs users in with an external account: any OpenID Connect
+// issuer, or GitHub, which only speaks plain OAuth2.
+type authProvider struct {
+	cfg authProviderConfig
+
+	// OIDC discovery happens on first use, so a provider that is down
+	// doesn't keep the API from starting.
+	mu       sync.Mutex
+	endpoint oauth2.Endpoint
+	verifier *oidc.IDTokenVerifier
+}
+
+func (p *authProvider) github() bool {
+	return p.cfg.Name == "github"
+}
+
+func newAuthProviders(cfgs []authProviderConfig) map[string]*authProvider {
+	out := make(map[string]*authProvider, len(cfgs))
+	for _, c := range cfgs {
+		out[c.Name] = &authProvider{cfg: c}
+	}
+	return out
+}
+
+func (p *authProvider) oauth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoint.AuthURL == "" {
+		if p.github() {
+			p.endpoint = github.Endpoint
+		} else {
+			op, err := oidc.NewProvider(ctx, p.cfg.Issuer)
+			if err != nil {
+				return nil, err
+			}
+			p.endpoint = op.Endpoint()
+			p.verifier = op.Verifier(&oidc.Config{ClientID: p.cfg.ClientID})
+		}
+	}
+	scopes := []string{oidc.ScopeOpenID, "email", "profile"}
+	if p.github() {
+		scopes = []string{"read:user", "user:email"}
+	}
+	return &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		Endpoint:     p.endpoint,
+		RedirectURL:  linkTo(r, "/auth/"+p.cfg.Name+"/callback").Href,
+		Scopes:       scopes,
+	}, nil
+}
+
+// externalIdentity is who the provider says signed in.
+type externalIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// identity reads the signed-in account from the token response: the ID
+// token for OIDC, the user API for GitHub.
+func (p *authProvider) identity(ctx context.Context, oc *oauth2.Config, tok *oauth2.Token, nonce string) (externalIdentity, error) {
+	if p.github() {
+		return githubIdentity(ctx, oc.Client(ctx, tok))
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return externalIdentity{}, errors.New("no id_token in token response")
+	}
+	idt, err := p.verifier.Verify(ctx, raw)
+	if err != nil {
+		return externalIdentity{}, err
+	}
+	if idt.Nonce != nonce {
+		return externalIdentity{}, errors.New("id_token nonce mismatch")
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := idt.Claims(&claims); err != nil {
+		return externalIdentity{}, err
+	}
+	return externalIdentity{Subject: idt.Subject, Email: claims.Email, EmailVerified: claims.EmailVerified, Name: claims.Name}, nil
+}
+
+func githubIdentity(ctx context.Context, client *http.Client) (externalIdentity, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := githubGet(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return externalIdentity{}, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := githubGet(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return externalIdentity{}, err
+	}
+	id := externalIdentity{Subject: strconv.FormatInt(user.ID, 10), Name: user.Name}
+	if id.Name == "" {
+		id.Name = user.Login
+	}
+	for _, e := range emails {
+		if e.Primary {
+			id.Email, id.EmailVerified = e.Email, e.Verified
+		}
+	}
+	return id, nil
+}
+
+func githubGet(ctx context.Context, client *http.Client, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// oauthState travels in a signed cookie between login and callback. State
+// guards against CSRF, the nonce against ID token replay, and the PKCE
+// verifier against intercepted codes.
+type oauthState struct {
+	Provider string    `json:"provider"`
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Expires  time.Time `json:"expires"`
+}
+
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStateTTL    = 10 * time.Minute
+)
+
+// signPayload signs v as JSON, for verifyPayload to read back. kind
+// keeps a value signed for one purpose from passing for another.
+func signPayload(secret []byte, kind string, v any) string {
+	b, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(kind + "." + payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyPayload(secret []byte, kind, signed string, v any) bool {
+	payload, sig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(kind + "." + payload))
+	want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	return hmac.Equal([]byte(sig), []byte(want)) && err == nil && json.Unmarshal(b, v) == nil
+}
+
+func signState(secret []byte, s oauthState) string {
+	return signPayload(secret, "state", s)
+}
+
+func verifyState(secret []byte, v string) (oauthState, bool) {
+	var s oauthState
+	if !verifyPayload(secret, "state", v, &s) || time.Now().After(s.Expires) {
+		return oauthState{}, false
+	}
+	return s, true
+}
+
+// twoFactorTicket stands for an external sign-in that still needs the
+// account's second factor; POST /auth/two-factor redeems it with the code.
+type twoFactorTicket struct {
+	UserID   int64     `json:"user_id"`
+	Provider string    `json:"provider"`
+	Expires  time.Time `json:"expires"`
+}
+
+const twoFactorTicketTTL = 5 * time.Minute
+
+// GET /auth/{provider}/login redirects to the provider's sign-in page.
+func oauthLogin(providers map[string]*authProvider, jwts *jwtIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("provider")
+		p, ok := providers[name]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown sign-in provider: " + name})
+			return
+		}
+		oc, err := p.oauth2Config(r.Context(), r)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "sign-in provider unavailable: " + err.Error()})
+			return
+		}
+		s := oauthState{
+			Provider: name,
+			State:    randomToken(16),
+			Nonce:    randomToken(16),
+			Verifier: oauth2.GenerateVerifier(),
+			Expires:  time.Now().Add(oauthStateTTL),
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oauthStateCookie,
+			Value:    signState(jwts.secret, s),
+			Path:     "/auth/",
+			MaxAge:   int(oauthStateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(oc.RedirectURL, "https:"),
+			SameSite: http.SameSiteLaxMode,
+		})
+		opts := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(s.Verifier)}
+		if !p.github() {
+			opts = append(opts, oidc.Nonce(s.Nonce))
+		}
+		http.Redirect(w, r, oc.AuthCodeURL(s.State, opts...), http.StatusFound)
+	}
+}
+
+// GET /auth/{provider}/callback
+//
+// Finishes sign-in and returns a JWT session token. The external account is
+// linked to the local user with the same verified email, or to a new user
+// if there is none. Accounts created this way have no password.
+func oauthCallback(db *sql.DB, providers map[string]*authProvider, jwts *jwtIssuer, guard *loginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("provider")
+		p, ok := providers[name]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown sign-in provider: " + name})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth/", MaxAge: -1})
+		if e := r.URL.Query().Get("error"); e != "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "sign-in failed: " + e})
+			return
+		}
+		c, err := r.Cookie(oauthStateCookie)
+		var s oauthState
+		if err == nil {
+			s, ok = verifyState(jwts.secret, c.Value)
+		}
+		if err != nil || !ok || s.Provider != name || s.State != r.URL.Query().Get("state") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sign-in session expired or invalid; start again"})
+			return
+		}
+
+		oc, err := p.oauth2Config(r.Context(), r)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "sign-in provider unavailable: " + err.Error()})
+			return
+		}
+		tok, err := oc.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(s.Verifier))
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "sign-in failed: " + err.Error()})
+			return
+		}
+		id, err := p.identity(r.Context(), oc, tok, s.Nonce)
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "sign-in failed: " + err.Error()})
+			return
+		}
+		if id.Email == "" || !id.EmailVerified {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "the provider account has no verified email"})
+			return
+		}
+
+		if !guard.check(w, r, strings.ToLower(id.Email)) {
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		userID, err := linkIdentity(r, tx, name, id)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		// The provider vouches for the first factor only. An account with
+		// two-factor authentication gets a ticket to finish with its code.
+		acct, err := findSignInAccount(r.Context(), db, "id", userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !acct.canSignIn() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "account is deactivated"})
+			return
+		}
+		var extra map[string]any
+		if acct.twoFactor {
+			ticket := twoFactorTicket{UserID: acct.id, Provider: name, Expires: time.Now().Add(twoFactorTicketTTL)}
+			extra = map[string]any{"two_factor_ticket": signPayload(jwts.secret, "two_factor", ticket)}
+		}
+		if !finishSignIn(w, r, db, guard, acct, "", extra) {
+			return
+		}
+		issueExternalSession(w, r, db, jwts, acct, name)
+	}
+}
+
+// POST /auth/two-factor
+//
+//	{"ticket": "...", "otp": "123456"}
+//
+// Finishes an external sign-in to an account with two-factor
+// authentication: the callback answered two_factor_required with a
+// two_factor_ticket, valid for twoFactorTicketTTL, and this takes it with a
+// current TOTP or an unused recovery code. A wrong code can be retried with
+// the same ticket, throttled by guard like password sign-in.
+func oauthTwoFactor(db *sql.DB, guard *loginGuard, jwts *jwtIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Ticket string `json:"ticket"`
+			OTP    string `json:"otp"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		var t twoFactorTicket
+		if !verifyPayload(jwts.secret, "two_factor", in.Ticket, &t) || time.Now().After(t.Expires) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "sign-in ticket expired or invalid; start again"})
+			return
+		}
+		acct, err := findSignInAccount(r.Context(), db, "id", t.UserID)
+		if err == sql.ErrNoRows || err == nil && !acct.canSignIn() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "account is deactivated"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !guard.check(w, r, acct.email) {
+			return
+		}
+		if !finishSignIn(w, r, db, guard, acct, in.OTP, map[string]any{"two_factor_ticket": in.Ticket}) {
+			return
+		}
+		issueExternalSession(w, r, db, jwts, acct, t.Provider)
+	}
+}
+
+// issueExternalSession answers a finished external sign-in with a JWT
+// session token.
+func issueExternalSession(w http.ResponseWriter, r *http.Request, db *sql.DB, jwts *jwtIssuer, acct signInAccount, provider string) {
+	token, expires, err := jwts.issue(r.Context(), db, acct.id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	logAuthEvent(r, db, acct.id, authLogin, map[string]any{"method": provider, "two_factor": acct.twoFactor})
+	writeJSON(w, http.StatusCreated, map[string]any{"token": token, "expires_at": expires})
+}
+
+// linkIdentity finds or creates the local user for an external account.
+func linkIdentity(r *http.Request, tx *sql.Tx, provider string, id externalIdentity) (userID int64, err error) {
+	err = tx.QueryRow(`
+		SELECT u.id FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.provider=$1 AND i.subject=$2`, provider, id.Subject).Scan(&userID)
+	if err != sql.ErrNoRows {
+		return userID, err
+	}
+
+	email := strings.ToLower(id.Email)
+	err = tx.QueryRow(`SELECT id FROM users WHERE email=$1`, email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		name := strings.TrimSpace(id.Name)
+		if name == "" {
+			name, _, _ = strings.Cut(email, "@")
+		}
+		// An empty hash never matches, so password sign-in stays off.
+		err = tx.QueryRow(`
+			INSERT INTO users (tenant_id, email, name, password_hash) VALUES ($1, $2, $3, '') RETURNING id`,
+			tenantFrom(r.Context()), email, name).Scan(&userID)
+		if err == nil {
+			countEvent(eventUserRegistered)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)`,
+		provider, id.Subject, userID, email); err != nil {
+		return 0, err
+	}
+	identity := map[string]any{"linked_identity": map[string]string{"provider": provider, "subject": id.Subject}}
+	return userID, recordAudit(r, tx, "user", userID, "update", nil, identity)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"practice4/mailer"
+)
+
+// emailMaxAttempts is how many times an email is tried before it is marked
+// failed.
+const emailMaxAttempts = 5
+
+// newMailer is the SMTP sender, or without SMTP_ADDR one that only logs.
+func newMailer(cfg config) mailer.Sender {
+	if cfg.SMTPAddr == "" {
+		return mailer.Log{}
+	}
+	return &mailer.SMTP{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}
+}
+
+// enqueueEmail queues the template for to, as part of x's transaction so
+// it only goes out if the change that caused it commits. The template is
+// rendered once here so bad data fails the request rather than the send.
+// userID ties the email to an account for erasure; 0 for none.
+func enqueueEmail(ctx context.Context, x execer, tenant, userID int64, to, template string, data map[string]any) error {
+	if _, err := mailer.Render(template, to, data); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = x.ExecContext(ctx, `
+		INSERT INTO email_outbox (tenant_id, user_id, to_address, template, data)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5)`, tenant, userID, to, template, raw)
+	return err
+}
+
+// runMailer works through the email outbox.
+func runMailer(db *sql.DB, sender mailer.Sender) {
+	for {
+		if err := sendQueuedEmails(context.Background(), db, sender); err != nil {
+			log.Printf("mailer: %v", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func sendQueuedEmails(ctx context.Context, db *sql.DB, sender mailer.Sender) error {
+	// Claim a batch by pushing it out of reach of other instances for a
+	// minute, as the webhook verifier does.
+	rows, err := db.QueryContext(ctx, `
+		UPDATE email_outbox SET next_attempt_at = now() + interval '1 minute'
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT 20
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, attempts, to_address, template, data`)
+	if err != nil {
+		return err
+	}
+	type claim struct {
+		id       int64
+		attempts int
+		to       string
+		template string
+		data     []byte
+	}
+	var claims []claim
+	for rows.Next() {
+		var c claim
+		if err := rows.Scan(&c.id, &c.attempts, &c.to, &c.template, &c.data); err != nil {
+			rows.Close()
+			return err
+		}
+		claims = append(claims, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range claims {
+		var data map[string]any
+		serr := json.Unmarshal(c.data, &data)
+		var m mailer.Message
+		if serr == nil {
+			m, serr = mailer.Render(c.template, c.to, data)
+		}
+		if serr == nil {
+			sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			serr = sender.Send(sendCtx, m)
+			cancel()
+		}
+		if serr == nil {
+			_, err = db.ExecContext(ctx, `
+				UPDATE email_outbox SET status='sent', attempts=attempts+1, last_error='', sent_at=now()
+				WHERE id=$1`, c.id)
+			countEvent(eventEmailSent)
+		} else if c.attempts+1 >= emailMaxAttempts {
+			_, err = db.ExecContext(ctx, `
+				UPDATE email_outbox SET status='failed', attempts=attempts+1, last_error=$2
+				WHERE id=$1`, c.id, serr.Error())
+			countEvent(eventEmailFailed)
+			log.Printf("email %d (%s) failed permanently: %v", c.id, c.template, serr)
+		} else {
+			// Exponential backoff: 30s, 1m, 2m, ... between attempts.
+			delay := (30 * time.Second) << c.attempts
+			_, err = db.ExecContext(ctx, `
+				UPDATE email_outbox
+				SET attempts=attempts+1, last_error=$2, next_attempt_at=now() + make_interval(secs => $3)
+				WHERE id=$1`, c.id, serr.Error(), delay.Seconds())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// pageCursor is the position after the last row of a page. Clients treat
+// the encoded form as opaque, so fields can be added when lists grow other
+// sort orders.
+type pageCursor struct {
+	ID int64 `json:"id"`
+	// Before pages backwards: the rows just before ID.
+	Before bool `json:"before,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (pageCursor, bool) {
+	var c pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.ID <= 0 {
+		return pageCursor{}, false
+	}
+	return c, true
+}
+
+// pageParams reads ?limit= and ?cursor=. Lists stay unpaginated unless one of
+// them is present, so existing clients keep getting every row.
+type pageParams struct {
+	paged bool
+	limit int
+	after pageCursor
+}
+
+func parsePage(r *http.Request) (pageParams, string) {
+	q := r.URL.Query()
+	p := pageParams{limit: 50}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			return p, "limit must be between 1 and 500"
+		}
+		p.paged, p.limit = true, n
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, ok := decodeCursor(v)
+		if !ok {
+			return p, "invalid cursor"
+		}
+		p.paged, p.after = true, c
+	}
+	return p, ""
+}
+
+// pageMetadata accompanies a page; NextCursor is empty on the last one and
+// PrevCursor on the first.
+type pageMetadata struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
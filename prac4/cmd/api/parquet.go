@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+)
+
+// The movie export in Parquet, for loading into a warehouse as is. The
+// writer is the small part of the format the export needs, written by
+// hand rather than pulled in as a dependency: flat columns plus one list,
+// one gzip-compressed PLAIN data page per column chunk, and the footer in
+// Thrift's compact protocol. See https://parquet.apache.org/docs/file-format/.
+// parquet_test.go reads the layout back; scripts/parquet_roundtrip.py also
+// checks a real export against pyarrow, worth running after changing the
+// writer.
+
+const parquetMediaType = "application/vnd.apache.parquet"
+
+// parquetRowGroupRows is how many rows are buffered before they are written
+// out as a row group, which bounds the writer's memory.
+const parquetRowGroupRows = 10000
+
+// Parquet enum values used here, from parquet.thrift.
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+	parquetRepeated = 2
+
+	parquetUTF8            = 0
+	parquetList            = 3
+	parquetTimestampMicros = 10
+	parquetJSON            = 19
+	parquetNone            = -1
+
+	parquetPlain = 0
+	parquetRLE   = 3
+	parquetGzip  = 2
+)
+
+// parquetColumn buffers one column of the current row group. A list column
+// is an optional group (LIST) of a repeated group of required elements,
+// the layout the format recommends.
+type parquetColumn struct {
+	name      string
+	kind      int32
+	converted int32
+	optional  bool
+	list      bool
+
+	n      int64 // values including nulls; level entries for lists
+	defs   []uint8
+	reps   []uint8
+	values bytes.Buffer
+}
+
+func (c *parquetColumn) maxDef() uint8 {
+	switch {
+	case c.list:
+		return 2
+	case c.optional:
+		return 1
+	}
+	return 0
+}
+
+func (c *parquetColumn) path() []string {
+	if c.list {
+		return []string{c.name, "list", "element"}
+	}
+	return []string{c.name}
+}
+
+func (c *parquetColumn) null() {
+	c.n++
+	c.defs = append(c.defs, 0)
+	if c.list {
+		c.reps = append(c.reps, 0)
+	}
+}
+
+func (c *parquetColumn) present() {
+	c.n++
+	if c.optional {
+		c.defs = append(c.defs, 1)
+	}
+}
+
+func (c *parquetColumn) int32(v int32) {
+	c.present()
+	c.values.Write(binary.LittleEndian.AppendUint32(nil, uint32(v)))
+}
+
+func (c *parquetColumn) int64(v int64) {
+	c.present()
+	c.values.Write(binary.LittleEndian.AppendUint64(nil, uint64(v)))
+}
+
+func (c *parquetColumn) double(v float64) {
+	c.present()
+	c.values.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func (c *parquetColumn) bytes(v []byte) {
+	c.present()
+	c.appendBytes(v)
+}
+
+func (c *parquetColumn) appendBytes(v []byte) {
+	c.values.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(v))))
+	c.values.Write(v)
+}
+
+// strings adds a row of a list column; an empty list is not a null one.
+func (c *parquetColumn) strings(vs []string) {
+	if len(vs) == 0 {
+		c.n++
+		c.defs = append(c.defs, 1)
+		c.reps = append(c.reps, 0)
+		return
+	}
+	for i, v := range vs {
+		var rep uint8
+		if i > 0 {
+			rep = 1
+		}
+		c.n++
+		c.defs = append(c.defs, 2)
+		c.reps = append(c.reps, rep)
+		c.appendBytes([]byte(v))
+	}
+}
+
+// page returns the column's buffered data as a data page body: repetition
+// and definition levels, then the values.
+func (c *parquetColumn) page() []byte {
+	var b []byte
+	if c.list {
+		b = appendLevels(b, c.reps)
+	}
+	if c.maxDef() > 0 {
+		b = appendLevels(b, c.defs)
+	}
+	return append(b, c.values.Bytes()...)
+}
+
+func (c *parquetColumn) reset() {
+	c.n = 0
+	c.defs = c.defs[:0]
+	c.reps = c.reps[:0]
+	c.values.Reset()
+}
+
+// appendLevels appends levels in the RLE/bit-packed hybrid encoding, as RLE
+// runs only, after their length. Levels here are at most 2, so every run
+// value fits a byte.
+func appendLevels(b []byte, levels []uint8) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		b = binary.AppendUvarint(b, uint64(j-i)<<1)
+		b = append(b, levels[i])
+		i = j
+	}
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+type parquetChunk struct {
+	offset       int64
+	values       int64
+	uncompressed int64
+	compressed   int64
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	size   int64
+	chunks []parquetChunk
+}
+
+// parquetWriter writes a Parquet file to w a row group at a time. Nothing
+// is written before the first row group, and Close writes the footer.
+type parquetWriter struct {
+	w       io.Writer
+	offset  int64
+	columns []*parquetColumn
+	rows    int64 // in the current row group
+	groups  []parquetRowGroup
+}
+
+func newParquetWriter(w io.Writer, columns []*parquetColumn) *parquetWriter {
+	return &parquetWriter{w: w, columns: columns}
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// endRow counts a row whose values were added to every column, writing the
+// row group when it is full.
+func (pw *parquetWriter) endRow() error {
+	pw.rows++
+	if pw.rows >= parquetRowGroupRows {
+		return pw.flush()
+	}
+	return nil
+}
+
+func (pw *parquetWriter) flush() error {
+	if pw.rows == 0 {
+		return nil
+	}
+	if pw.offset == 0 {
+		if err := pw.write([]byte("PAR1")); err != nil {
+			return err
+		}
+	}
+	g := parquetRowGroup{rows: pw.rows}
+	for _, c := range pw.columns {
+		body := c.page()
+		var z bytes.Buffer
+		zw := gzip.NewWriter(&z)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		var t thriftWriter
+		t.begin()
+		t.i32(1, 0) // DATA_PAGE
+		t.i32(2, int32(len(body)))
+		t.i32(3, int32(z.Len()))
+		t.structField(5)
+		t.i32(1, int32(c.n))
+		t.i32(2, parquetPlain)
+		t.i32(3, parquetRLE)
+		t.i32(4, parquetRLE)
+		t.end()
+		t.end()
+
+		chunk := parquetChunk{
+			offset:       pw.offset,
+			values:       c.n,
+			uncompressed: int64(t.buf.Len() + len(body)),
+			compressed:   int64(t.buf.Len() + z.Len()),
+		}
+		if err := pw.write(t.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(z.Bytes()); err != nil {
+			return err
+		}
+		g.size += chunk.uncompressed
+		g.chunks = append(g.chunks, chunk)
+		c.reset()
+	}
+	pw.groups = append(pw.groups, g)
+	pw.rows = 0
+	return nil
+}
+
+// Close writes the last row group and the footer.
+func (pw *parquetWriter) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+	if pw.offset == 0 {
+		if err := pw.write([]byte("PAR1")); err != nil {
+			return err
+		}
+	}
+
+	var t thriftWriter
+	t.begin()
+	t.i32(1, 1) // version
+	elements := 1
+	for _, c := range pw.columns {
+		elements += len(c.path())
+	}
+	t.list(2, thriftStruct, elements)
+	t.begin()
+	t.str(4, "schema")
+	t.i32(5, int32(len(pw.columns)))
+	t.end()
+	for _, c := range pw.columns {
+		if c.list {
+			t.begin()
+			t.i32(3, parquetOptional)
+			t.str(4, c.name)
+			t.i32(5, 1)
+			t.i32(6, parquetList)
+			t.end()
+			t.begin()
+			t.i32(3, parquetRepeated)
+			t.str(4, "list")
+			t.i32(5, 1)
+			t.end()
+		}
+		t.begin()
+		t.i32(1, c.kind)
+		if c.optional {
+			t.i32(3, parquetOptional)
+		} else {
+			t.i32(3, parquetRequired)
+		}
+		t.str(4, c.path()[len(c.path())-1])
+		if c.converted != parquetNone {
+			t.i32(6, c.converted)
+		}
+		t.end()
+	}
+	var rows int64
+	for _, g := range pw.groups {
+		rows += g.rows
+	}
+	t.i64(3, rows)
+	t.list(4, thriftStruct, len(pw.groups))
+	for _, g := range pw.groups {
+		t.begin()
+		t.list(1, thriftStruct, len(g.chunks))
+		for i, ch := range g.chunks {
+			c := pw.columns[i]
+			t.begin()
+			t.i64(2, ch.offset)
+			t.structField(3)
+			t.i32(1, c.kind)
+			t.list(2, thriftI32, 2)
+			t.rawI32(parquetPlain)
+			t.rawI32(parquetRLE)
+			t.list(3, thriftBinary, len(c.path()))
+			for _, p := range c.path() {
+				t.rawStr(p)
+			}
+			t.i32(4, parquetGzip)
+			t.i64(5, ch.values)
+			t.i64(6, ch.uncompressed)
+			t.i64(7, ch.compressed)
+			t.i64(9, ch.offset)
+			t.end()
+			t.end()
+		}
+		t.i64(2, g.size)
+		t.i64(3, g.rows)
+		t.end()
+	}
+	t.str(6, "practice4 movies export")
+	t.end()
+
+	footer := binary.LittleEndian.AppendUint32(t.buf.Bytes(), uint32(t.buf.Len()))
+	return pw.write(append(footer, "PAR1"...))
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in Thrift's compact protocol, which is what
+// Parquet's page headers and footer are.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // the last field id of each open struct
+}
+
+func (t *thriftWriter) begin() { t.last = append(t.last, 0) }
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.buf.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.uvarint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func zigzag(v int64) uint64 { return uint64(v<<1) ^ uint64(v>>63) }
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.rawI32(v)
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.uvarint(zigzag(v))
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.rawStr(s)
+}
+
+func (t *thriftWriter) rawI32(v int32) { t.uvarint(zigzag(int64(v))) }
+
+func (t *thriftWriter) rawStr(s string) {
+	t.uvarint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// list starts a list field of n elements; elements that are structs begin
+// and end like one.
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.uvarint(uint64(n))
+	}
+}
+
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// movieParquet writes movies as Parquet, one column per field of the JSON
+// export; metadata is a JSON column and timestamps are UTC microseconds.
+type movieParquet struct {
+	*parquetWriter
+	id, uuid, slug, title, year, rating, genres, certification *parquetColumn
+	imdbID, tmdbID, metadata, views, createdAt, updatedAt      *parquetColumn
+}
+
+func newMovieParquet(w io.Writer) *movieParquet {
+	col := func(name string, kind, converted int32, optional bool) *parquetColumn {
+		return &parquetColumn{name: name, kind: kind, converted: converted, optional: optional}
+	}
+	mp := &movieParquet{
+		id:            col("id", parquetInt64, parquetNone, false),
+		uuid:          col("uuid", parquetByteArray, parquetUTF8, false),
+		slug:          col("slug", parquetByteArray, parquetUTF8, false),
+		title:         col("title", parquetByteArray, parquetUTF8, false),
+		year:          col("year", parquetInt32, parquetNone, true),
+		rating:        col("rating", parquetDouble, parquetNone, true),
+		genres:        &parquetColumn{name: "genres", kind: parquetByteArray, converted: parquetUTF8, list: true},
+		certification: col("certification", parquetByteArray, parquetUTF8, true),
+		imdbID:        col("imdb_id", parquetByteArray, parquetUTF8, true),
+		tmdbID:        col("tmdb_id", parquetInt64, parquetNone, true),
+		metadata:      col("metadata", parquetByteArray, parquetJSON, true),
+		views:         col("views", parquetInt64, parquetNone, false),
+		createdAt:     col("created_at", parquetInt64, parquetTimestampMicros, false),
+		updatedAt:     col("updated_at", parquetInt64, parquetTimestampMicros, false),
+	}
+	mp.parquetWriter = newParquetWriter(w, []*parquetColumn{
+		mp.id, mp.uuid, mp.slug, mp.title, mp.year, mp.rating, mp.genres, mp.certification,
+		mp.imdbID, mp.tmdbID, mp.metadata, mp.views, mp.createdAt, mp.updatedAt,
+	})
+	return mp
+}
+
+func (mp *movieParquet) add(m Movie) error {
+	mp.id.int64(m.ID)
+	mp.uuid.bytes([]byte(m.UUID))
+	mp.slug.bytes([]byte(m.Slug))
+	mp.title.bytes([]byte(m.Title))
+	if m.Year != 0 {
+		mp.year.int32(int32(m.Year))
+	} else {
+		mp.year.null()
+	}
+	if m.Rating != nil {
+		mp.rating.double(*m.Rating)
+	} else {
+		mp.rating.null()
+	}
+	mp.genres.strings(m.Genres)
+	optionalString(mp.certification, m.Certification)
+	var ext ExternalIDs
+	if m.ExternalIDs != nil {
+		ext = *m.ExternalIDs
+	}
+	optionalString(mp.imdbID, ext.IMDbID)
+	if ext.TMDbID != 0 {
+		mp.tmdbID.int64(ext.TMDbID)
+	} else {
+		mp.tmdbID.null()
+	}
+	if len(m.Metadata) > 0 {
+		mp.metadata.bytes(m.Metadata)
+	} else {
+		mp.metadata.null()
+	}
+	mp.views.int64(m.Views)
+	mp.createdAt.int64(m.CreatedAt.UnixMicro())
+	mp.updatedAt.int64(m.UpdatedAt.UnixMicro())
+	return mp.endRow()
+}
+
+func optionalString(c *parquetColumn, s string) {
+	if s == "" {
+		c.null()
+		return
+	}
+	c.bytes([]byte(s))
+}
+
+// written is how many rows have gone out in row groups.
+func (mp *movieParquet) written() int {
+	var n int64
+	for _, g := range mp.groups {
+		n += g.rows
+	}
+	return int(n)
+}
+
+// writeRows adds rows and closes the file.
+func (mp *movieParquet) writeRows(rows *sql.Rows) error {
+	for rows.Next() {
+		m, err := scanMovie(rows)
+		if err != nil {
+			return err
+		}
+		if err := mp.add(m); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return mp.Close()
+}
+
+// streamMovieParquet writes rows to a response as Parquet. As in streamRows
+// the status line waits for the first bytes, which come with the first row
+// group, and a failure after them aborts the connection.
+func streamMovieParquet(w http.ResponseWriter, r *http.Request, rows *sql.Rows) {
+	mp := newMovieParquet(&parquetResponse{w: w})
+	if err := mp.writeRows(rows); err != nil {
+		failStream(w, r, mp.written(), err)
+	}
+}
+
+// parquetResponse sends the headers of a Parquet download on the first
+// write.
+type parquetResponse struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (p *parquetResponse) Write(b []byte) (int, error) {
+	if !p.started {
+		p.w.Header().Set("Content-Type", parquetMediaType)
+		p.w.WriteHeader(http.StatusOK)
+		p.started = true
+	}
+	return p.w.Write(b)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// These tests read the writer's output back with a decoder of their own,
+// independent of parquet.go, and check the layout a reader relies on: the
+// footer, where each column chunk starts and ends, and the levels and
+// values of each page. scripts/parquet_roundtrip.py checks an export
+// against pyarrow as well.
+
+// thriftReader decodes Thrift's compact protocol into maps of field id to
+// int64, string, []any or nested maps.
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	v := r.b[r.pos]
+	r.pos++
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	if n <= 0 {
+		panic(fmt.Sprintf("bad varint at %d", r.pos))
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.uvarint())
+		s := string(r.b[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	panic(fmt.Sprintf("unexpected thrift type %d at %d", typ, r.pos))
+}
+
+func (r *thriftReader) structure() map[int16]any {
+	fields := map[int16]any{}
+	var last int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return fields
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		fields[id] = r.value(h & 0x0f)
+		last = id
+	}
+}
+
+// parquetFile is a written file with its footer decoded.
+type parquetFile struct {
+	data   []byte
+	footer map[int16]any
+	start  int // of the footer
+}
+
+func readParquetFile(t *testing.T, data []byte) parquetFile {
+	t.Helper()
+	if len(data) < 12 || string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		t.Fatalf("file does not start and end with PAR1")
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	start := len(data) - 8 - size
+	r := &thriftReader{b: data[start : len(data)-8]}
+	footer := r.structure()
+	if r.pos != size {
+		t.Fatalf("footer is %d bytes, decoded %d", size, r.pos)
+	}
+	return parquetFile{data: data, footer: footer, start: start}
+}
+
+func (f parquetFile) rowGroups() []map[int16]any {
+	var groups []map[int16]any
+	for _, g := range f.footer[4].([]any) {
+		groups = append(groups, g.(map[int16]any))
+	}
+	return groups
+}
+
+// parquetPage is the data page of one column chunk.
+type parquetPage struct {
+	path   []string
+	values int64 // as the page header counts them, nulls included
+	reps   []uint8
+	defs   []uint8
+	data   []byte // the encoded values after the levels
+}
+
+// page decodes the data page of a chunk, checking the sizes the chunk's
+// metadata gives for it.
+func (f parquetFile) page(t *testing.T, chunk map[int16]any) parquetPage {
+	t.Helper()
+	meta := chunk[3].(map[int16]any)
+	var p parquetPage
+	for _, s := range meta[3].([]any) {
+		p.path = append(p.path, s.(string))
+	}
+	offset := int(meta[9].(int64))
+	if chunk[2].(int64) != int64(offset) {
+		t.Errorf("%v: chunk offset %d, data page at %d", p.path, chunk[2], offset)
+	}
+	r := &thriftReader{b: f.data, pos: offset}
+	header := r.structure()
+	if header[1].(int64) != 0 {
+		t.Fatalf("%v: page type %d, want DATA_PAGE", p.path, header[1])
+	}
+	compressed := int(header[3].(int64))
+	if got := int64(r.pos - offset + compressed); got != meta[7].(int64) {
+		t.Errorf("%v: chunk is %d bytes, metadata says %d", p.path, got, meta[7])
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(f.data[r.pos : r.pos+compressed]))
+	if err != nil {
+		t.Fatalf("%v: %v", p.path, err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("%v: %v", p.path, err)
+	}
+	if int64(len(body)) != header[2].(int64) {
+		t.Errorf("%v: page body is %d bytes, header says %d", p.path, len(body), header[2])
+	}
+
+	dph := header[5].(map[int16]any)
+	p.values = dph[1].(int64)
+	if p.values != meta[5].(int64) {
+		t.Errorf("%v: page has %d values, chunk metadata %d", p.path, p.values, meta[5])
+	}
+	if len(p.path) > 1 {
+		p.reps, body = readLevels(t, body, p.values)
+	}
+	if len(p.path) > 1 || f.optional(p.path) {
+		p.defs, body = readLevels(t, body, p.values)
+	}
+	p.data = body
+	return p
+}
+
+// optional reports whether the schema has path as an optional leaf.
+func (f parquetFile) optional(path []string) bool {
+	for _, e := range f.footer[2].([]any) {
+		el := e.(map[int16]any)
+		if el[4] == path[len(path)-1] && el[3] == int64(parquetOptional) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLevels decodes n levels in the RLE/bit-packed hybrid encoding after
+// their length, and returns what follows them.
+func readLevels(t *testing.T, b []byte, n int64) ([]uint8, []byte) {
+	t.Helper()
+	size := int(binary.LittleEndian.Uint32(b))
+	r := &thriftReader{b: b[4 : 4+size]}
+	var levels []uint8
+	for r.pos < size {
+		h := r.uvarint()
+		if h&1 != 0 {
+			t.Fatalf("bit-packed run in levels")
+		}
+		v := r.byte()
+		for range h >> 1 {
+			levels = append(levels, v)
+		}
+	}
+	if int64(len(levels)) != n {
+		t.Fatalf("%d levels, want %d", len(levels), n)
+	}
+	return levels, b[4+size:]
+}
+
+// testMovie is a movie with every column set, to blank out case by case.
+func testMovie(id int64) Movie {
+	rating := 8.6
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	return Movie{
+		ID: id, UUID: fmt.Sprintf("0190-%d", id), Slug: fmt.Sprintf("movie-%d", id), Title: fmt.Sprintf("Movie %d", id),
+		Year: 1999, Rating: &rating, Genres: []string{"Crime", "Drama"}, Certification: "R",
+		ExternalIDs: &ExternalIDs{IMDbID: "tt0816692", TMDbID: 157336},
+		Metadata:    json.RawMessage(`{"cut":"director's"}`),
+		Views:       42, CreatedAt: at, UpdatedAt: at.Add(time.Hour),
+	}
+}
+
+func writeTestParquet(t *testing.T, movies []Movie) parquetFile {
+	t.Helper()
+	var buf bytes.Buffer
+	mp := newMovieParquet(&buf)
+	for _, m := range movies {
+		if err := mp.add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return readParquetFile(t, buf.Bytes())
+}
+
+func TestParquetNullsAndEmptyLists(t *testing.T) {
+	full := testMovie(1)
+	blank := testMovie(2)
+	blank.Year, blank.Rating, blank.Genres, blank.Certification = 0, nil, nil, ""
+	blank.ExternalIDs, blank.Metadata = nil, nil
+	empty := testMovie(3)
+	empty.Genres = []string{}
+	empty.ExternalIDs = &ExternalIDs{TMDbID: 27205}
+	f := writeTestParquet(t, []Movie{full, blank, empty})
+
+	if v := f.footer[1].(int64); v != 1 {
+		t.Errorf("version %d, want 1", v)
+	}
+	if n := f.footer[3].(int64); n != 3 {
+		t.Errorf("num_rows %d, want 3", n)
+	}
+	var names []string
+	schema := f.footer[2].([]any)
+	for _, e := range schema[1:] {
+		names = append(names, e.(map[int16]any)[4].(string))
+	}
+	wantNames := []string{"id", "uuid", "slug", "title", "year", "rating", "genres", "list", "element",
+		"certification", "imdb_id", "tmdb_id", "metadata", "views", "created_at", "updated_at"}
+	if !slices.Equal(names, wantNames) {
+		t.Errorf("schema %v, want %v", names, wantNames)
+	}
+	if n := schema[0].(map[int16]any)[5].(int64); n != 14 {
+		t.Errorf("root has %d children, want 14", n)
+	}
+
+	groups := f.rowGroups()
+	if len(groups) != 1 {
+		t.Fatalf("%d row groups, want 1", len(groups))
+	}
+	pages := map[string]parquetPage{}
+	for _, c := range groups[0][1].([]any) {
+		p := f.page(t, c.(map[int16]any))
+		pages[p.path[0]] = p
+	}
+
+	// Definition levels of the optional columns: the blank movie has none
+	// of them, the last one only a year and a tmdb id.
+	wantDefs := map[string][]uint8{
+		"year": {1, 0, 1}, "rating": {1, 0, 1}, "certification": {1, 0, 1},
+		"imdb_id": {1, 0, 0}, "tmdb_id": {1, 0, 1}, "metadata": {1, 0, 1},
+	}
+	for name, want := range wantDefs {
+		if got := pages[name].defs; !slices.Equal(got, want) {
+			t.Errorf("%s definition levels %v, want %v", name, got, want)
+		}
+	}
+	if got := pages["year"].data; !bytes.Equal(got, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 1999), 1999)) {
+		t.Errorf("year values %x, want 1999 twice", got)
+	}
+	if got := pages["rating"].data; len(got) != 16 || math.Float64frombits(binary.LittleEndian.Uint64(got)) != 8.6 {
+		t.Errorf("rating values %x, want 8.6 twice", got)
+	}
+	for _, name := range []string{"id", "views", "created_at"} {
+		if p := pages[name]; p.defs != nil || len(p.data) != 3*8 {
+			t.Errorf("%s: %d definition levels and %d bytes of values, want none and 24", name, len(p.defs), len(p.data))
+		}
+	}
+
+	// A null and an empty genre list are both one entry defined to the
+	// list, with no value; the elements of a list repeat at level 1.
+	genres := pages["genres"]
+	if genres.values != 4 {
+		t.Errorf("genres page has %d values, want 4", genres.values)
+	}
+	if want := []uint8{0, 1, 0, 0}; !slices.Equal(genres.reps, want) {
+		t.Errorf("genres repetition levels %v, want %v", genres.reps, want)
+	}
+	if want := []uint8{2, 2, 1, 1}; !slices.Equal(genres.defs, want) {
+		t.Fatalf("genres definition levels %v, want %v", genres.defs, want)
+	}
+	var elements []string
+	for b := genres.data; len(b) > 0; {
+		n := binary.LittleEndian.Uint32(b)
+		elements = append(elements, string(b[4:4+n]))
+		b = b[4+n:]
+	}
+	if want := []string{"Crime", "Drama"}; !slices.Equal(elements, want) {
+		t.Errorf("genres elements %v, want %v", elements, want)
+	}
+}
+
+func TestParquetRowGroups(t *testing.T) {
+	movies := make([]Movie, parquetRowGroupRows+1)
+	for i := range movies {
+		movies[i] = testMovie(int64(i + 1))
+		if i%2 == 1 {
+			movies[i].Genres = nil
+		}
+	}
+	f := writeTestParquet(t, movies)
+
+	if n := f.footer[3].(int64); n != int64(len(movies)) {
+		t.Errorf("num_rows %d, want %d", n, len(movies))
+	}
+	groups := f.rowGroups()
+	if len(groups) != 2 {
+		t.Fatalf("%d row groups, want 2", len(groups))
+	}
+	// The chunks follow each other from just after the magic number up to
+	// the footer, and each group's size is that of its pages.
+	next := int64(4)
+	for i, g := range groups {
+		want := int64(parquetRowGroupRows)
+		if i == 1 {
+			want = 1
+		}
+		if rows := g[3].(int64); rows != want {
+			t.Errorf("row group %d has %d rows, want %d", i, rows, want)
+		}
+		var size int64
+		for _, c := range g[1].([]any) {
+			meta := c.(map[int16]any)[3].(map[int16]any)
+			if off := meta[9].(int64); off != next {
+				t.Errorf("row group %d: chunk at %d, want %d", i, off, next)
+			}
+			next = meta[9].(int64) + meta[7].(int64)
+			size += meta[6].(int64)
+			p := f.page(t, c.(map[int16]any))
+			if p.path[0] == "id" {
+				first := int64(binary.LittleEndian.Uint64(p.data))
+				if first != int64(i*parquetRowGroupRows+1) {
+					t.Errorf("row group %d starts at movie %d", i, first)
+				}
+			}
+		}
+		if total := g[2].(int64); total != size {
+			t.Errorf("row group %d: total_byte_size %d, chunks add up to %d", i, total, size)
+		}
+	}
+	if next != int64(f.start) {
+		t.Errorf("chunks end at %d, footer starts at %d", next, f.start)
+	}
+}
+
+func TestParquetEmpty(t *testing.T) {
+	f := writeTestParquet(t, nil)
+	if n := f.footer[3].(int64); n != 0 {
+		t.Errorf("num_rows %d, want 0", n)
+	}
+	if len(f.rowGroups()) != 0 {
+		t.Errorf("%d row groups, want none", len(f.rowGroups()))
+	}
+	if f.start != 4 {
+		t.Errorf("footer at %d, want right after the magic number", f.start)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// partitionsAhead is how many months past the current one have their
+// partitions created in advance, so inserts never find their month missing
+// even if the API is down for a while.
+const partitionsAhead = 3
+
+// partitionedTable is a log table partitioned by month (migration 0034).
+type partitionedTable struct {
+	table  string
+	column string
+	// perTenant marks tables that live in tenant schemas.
+	perTenant bool
+}
+
+var partitionedTables = []partitionedTable{
+	{"audit_log", "created_at", true},
+	{"auth_events", "created_at", false},
+	{"analytics_events", "received_at", false},
+}
+
+// runPartitionMaintenance creates the upcoming monthly partitions at startup
+// and then every interval. Expired months are dropped by the retention
+// policies instead.
+func runPartitionMaintenance(db *sql.DB, schemas bool, interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		for _, t := range partitionedTables {
+			err := forEachTenant(context.Background(), db, schemas && t.perTenant, func(ctx context.Context) error {
+				var created int
+				err := db.QueryRowContext(ctx, `
+					SELECT count(*) FILTER (WHERE create_month_partition($1::regclass,
+						((now() AT TIME ZONE 'UTC') + make_interval(months => m))::date))
+					FROM generate_series(0, $2) AS m`, t.table, partitionsAhead).Scan(&created)
+				if created > 0 {
+					log.Printf("partitions %s: created %d", t.table, created)
+				}
+				return err
+			})
+			if err != nil {
+				log.Printf("partitions %s: %v", t.table, err)
+			}
+		}
+	}
+}
+
+// backfillPartitions creates the partitions of the table in schema for every
+// month since the oldest of the tenant's rows in public, which are about to
+// move there.
+func backfillPartitions(ctx context.Context, tx *sql.Tx, schema string, t partitionedTable, tenant int64) error {
+	_, err := tx.ExecContext(ctx, `
+		SELECT create_month_partition($1::regclass, m::date)
+		FROM generate_series(
+			date_trunc('month', (SELECT min(`+t.column+`) FROM public.`+t.table+` WHERE tenant_id = $2) AT TIME ZONE 'UTC'),
+			now() AT TIME ZONE 'UTC', interval '1 month') AS m`, schema+"."+t.table, tenant)
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// keepTrailingSlash are the path prefixes whose routes are registered with
+// a trailing slash, so normalizePaths leaves it alone.
+var keepTrailingSlash = []string{"/admin/ui/"}
+
+// normalizePaths gives every resource one spelling before routing:
+// duplicate slashes collapse and a trailing slash goes, so /movies/ is the
+// collection and //movies/5/ is /movies/5. GET and HEAD are redirected to
+// the canonical path, so caches and links converge on it; other methods are
+// rewritten in place, since not every client repeats a body on redirect.
+// Paths with . or .. segments, encoded or not, are rejected with 400
+// instead of being resolved.
+func normalizePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, seg := range strings.Split(r.URL.Path, "/") {
+			if seg == "." || seg == ".." {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid path"})
+				return
+			}
+		}
+		escaped := r.URL.EscapedPath()
+		clean := canonicalPath(escaped)
+		if clean == escaped {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			loc := clean
+			if r.URL.RawQuery != "" {
+				loc += "?" + r.URL.RawQuery
+			}
+			w.Header().Set("Location", loc)
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		path, err := url.PathUnescape(clean)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid path"})
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path, r2.URL.RawPath = path, clean
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// canonicalPath collapses runs of slashes in an escaped path and drops the
+// trailing one, except under keepTrailingSlash.
+func canonicalPath(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.ReplaceAll(p, "//", "/")
+	}
+	if len(p) > 1 && strings.HasSuffix(p, "/") {
+		for _, prefix := range keepTrailingSlash {
+			if strings.HasPrefix(p, prefix) {
+				return p
+			}
+		}
+		p = strings.TrimSuffix(p, "/")
+	}
+	return p
+}
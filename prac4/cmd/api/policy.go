@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Authorization decisions go through a policyEngine. The built-in engine is
+// role based; deployments with their own rules can point AUTHZ_POLICY_URL at
+// an OPA-compatible decision endpoint instead of changing handlers.
+type policyEngine interface {
+	decide(ctx context.Context, in PolicyInput) (Decision, error)
+}
+
+// PolicyInput describes one request to authorize. It is also the "input"
+// document sent to external engines, so field names are part of the contract.
+type PolicyInput struct {
+	Subject  *PolicySubject `json:"subject"` // nil for anonymous requests
+	Action   string         `json:"action"`
+	Resource string         `json:"resource"`
+	Method   string         `json:"method"`
+}
+
+type PolicySubject struct {
+	ID          int64    `json:"id"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+	Scopes      []string `json:"scopes,omitempty"` // set for personal access tokens
+}
+
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// requestAction names what r does, for policies and personal access token
+// scopes. Requests without an action (health, sign-in, the admin UI assets,
+// signed downloads) are not authorized.
+func requestAction(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/admin/ui"), isSignedDownload(path):
+		return ""
+	case strings.HasPrefix(path, "/exports"):
+		// Queuing an export writes a job, but only reads the catalog.
+		return "movies:read"
+	case strings.HasPrefix(path, "/imports"):
+		// Reading an import job's progress is part of writing it.
+		return "movies:write"
+	case strings.HasPrefix(path, "/admin/"):
+		return roleAdmin
+	case strings.HasPrefix(path, "/webhooks"):
+		return "webhooks"
+	case strings.HasPrefix(path, "/movies"), strings.HasPrefix(path, "/search"),
+		strings.HasPrefix(path, "/translations"), strings.HasPrefix(path, "/stats"),
+		strings.HasPrefix(path, "/genres"), strings.HasPrefix(path, "/certifications"),
+		strings.HasPrefix(path, "/tags"):
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return "movies:read"
+		}
+		return "movies:write"
+	}
+	return ""
+}
+
+// authorize asks p about every request that has an action. When the engine
+// can't answer the request fails closed.
+func authorize(p policyEngine) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			action := requestAction(r)
+			if action == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			in := PolicyInput{Action: action, Resource: r.URL.Path, Method: r.Method}
+			u := userFrom(r.Context())
+			if u != nil {
+				in.Subject = &PolicySubject{ID: u.ID, Role: u.Role, Permissions: u.Permissions, Scopes: u.tokenScopes}
+			}
+
+			d, err := p.decide(r.Context(), in)
+			if err != nil {
+				log.Printf("authorization policy: %v", err)
+				writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "authorization unavailable"})
+				return
+			}
+			if !d.Allow {
+				msg := d.Reason
+				if msg == "" {
+					msg = "not allowed to " + action
+				}
+				if u == nil {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					writeJSON(w, http.StatusUnauthorized, map[string]string{"error": msg})
+					return
+				}
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": msg})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// roleAnonymous is the rbacPolicy role for requests without a token.
+const roleAnonymous = "anonymous"
+
+// rbacPolicy grants actions per role, plus whatever a user holds as
+// permissions. "*" matches any action and "movies:*" any movies action.
+type rbacPolicy struct {
+	Roles map[string][]string `json:"roles"`
+}
+
+// defaultRBAC lets anyone read the catalog, signed-in users change it and
+// manage webhooks, and reserves /admin for admins.
+var defaultRBAC = &rbacPolicy{Roles: map[string][]string{
+	roleAnonymous: {"movies:read"},
+	roleUser:      {"movies:*", "webhooks"},
+	roleAdmin:     {"*"},
+}}
+
+func (p *rbacPolicy) decide(_ context.Context, in PolicyInput) (Decision, error) {
+	role, grants := roleAnonymous, []string(nil)
+	if in.Subject != nil {
+		role, grants = in.Subject.Role, in.Subject.Permissions
+	}
+	for _, g := range append(p.Roles[role], grants...) {
+		if actionMatches(g, in.Action) {
+			return Decision{Allow: true}, nil
+		}
+	}
+	if in.Action == roleAdmin {
+		return Decision{Reason: "requires the admin role"}, nil
+	}
+	return Decision{}, nil
+}
+
+func actionMatches(pattern, action string) bool {
+	if pattern == "*" || pattern == action {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	return ok && strings.HasPrefix(action, prefix)
+}
+
+// loadRBAC reads role grants from a JSON file such as
+// {"roles": {"anonymous": ["movies:read"], "user": ["movies:*", "webhooks"], "admin": ["*"]}}.
+func loadRBAC(path string) (*rbacPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p rbacPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// externalPolicy asks an OPA-style decision API. It POSTs {"input": ...} and
+// accepts either {"result": true} or {"result": {"allow": true, "reason": "..."}}.
+type externalPolicy struct {
+	url    string
+	client *http.Client
+}
+
+func newExternalPolicy(url string) *externalPolicy {
+	return &externalPolicy{url: url, client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+func (p *externalPolicy) decide(ctx context.Context, in PolicyInput) (Decision, error) {
+	body, err := json.Marshal(map[string]any{"input": in})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("policy endpoint returned %s", resp.Status)
+	}
+
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return Decision{}, err
+	}
+	var d Decision
+	if err := json.Unmarshal(out.Result, &d.Allow); err == nil {
+		return d, nil
+	}
+	if err := json.Unmarshal(out.Result, &d); err != nil {
+		// An undefined result (no rule matched) arrives as a missing field.
+		return Decision{}, nil
+	}
+	return d, nil
+}
+
+// newPolicy picks the engine from config.
+func newPolicy(cfg config) (policyEngine, error) {
+	switch {
+	case cfg.AuthzPolicyURL != "":
+		return newExternalPolicy(cfg.AuthzPolicyURL), nil
+	case cfg.AuthzRBACFile != "":
+		return loadRBAC(cfg.AuthzRBACFile)
+	default:
+		return defaultRBAC, nil
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"slices"
+	"time"
+)
+
+const (
+	// defaultPoolSize is the size the pool starts at, within
+	// DB_POOL_MIN..DB_POOL_MAX.
+	defaultPoolSize = 10
+	// poolGrowWait is the average connection wait over a tuning interval
+	// that grows the pool. It is well below DB_POOL_WAIT_THRESHOLD, so the
+	// pool grows before requests are shed.
+	poolGrowWait = 5 * time.Millisecond
+	// poolSlowLatency is how much slower than its baseline a round trip to
+	// the database must be before the tuner treats it as overloaded. Past
+	// a floor of poolSlowFloor, so sub-millisecond noise doesn't count.
+	poolSlowLatency = 4
+	poolSlowFloor   = 20 * time.Millisecond
+	// poolLatencyWindow is how many intervals the latency baseline, the
+	// fastest recent round trip, covers.
+	poolLatencyWindow = 20
+)
+
+// poolSize is the starting size of a pool bounded by lo and hi.
+func poolSize(lo, hi int) int {
+	return clamp(defaultPoolSize, lo, hi)
+}
+
+func clamp(n, lo, hi int) int {
+	return max(lo, min(n, hi))
+}
+
+// poolTuner sizes the database pool to its load, within DB_POOL_MIN and
+// DB_POOL_MAX. Each interval it looks at how long queries waited for a
+// connection, the most connections in use at once and the latency of a
+// round trip to the database:
+//
+//   - queries waited and the database answers as fast as usual: the pool is
+//     too small, so it grows by a quarter;
+//   - queries waited but the database is slow too: more connections would
+//     only load it further, so the pool stays as it is;
+//   - nobody waited and at most half the pool was in use: it shrinks by one,
+//     slowly, so a short lull doesn't undo the growth.
+//
+// A pool at DB_POOL_MAX that still makes queries wait is saturated; that is
+// logged and shows as db_pool_limited, before poolMonitor starts shedding.
+type poolTuner struct {
+	db       *sql.DB
+	min, max int
+	size     int
+
+	latencies []time.Duration // the last poolLatencyWindow round trips
+	limited   bool            // at max and still waiting
+	slow      bool            // held back by a slow database
+}
+
+func newPoolTuner(db *sql.DB, cfg config) *poolTuner {
+	t := &poolTuner{db: db, min: cfg.DBPoolMin, max: cfg.DBPoolMax, size: poolSize(cfg.DBPoolMin, cfg.DBPoolMax)}
+	metrics.GaugeFunc("db_pool_max_open", "Connections the pool may open, as sized by the tuner.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	metrics.Set("db_pool_min", "Lower bound of the pool size (DB_POOL_MIN).", float64(t.min))
+	metrics.Set("db_pool_max", "Upper bound of the pool size (DB_POOL_MAX).", float64(t.max))
+	metrics.Set("db_pool_limited", "1 while the pool is at DB_POOL_MAX and queries still wait for connections.", 0)
+	return t
+}
+
+// run tunes the pool every interval, sampling connections in use every
+// second in between, until the process exits.
+func (t *poolTuner) run(interval time.Duration) {
+	sample := time.NewTicker(time.Second)
+	defer sample.Stop()
+	tune := time.NewTicker(interval)
+	defer tune.Stop()
+	prev := t.db.Stats()
+	peak := prev.InUse
+	for {
+		select {
+		case <-sample.C:
+			peak = max(peak, t.db.Stats().InUse)
+		case <-tune.C:
+			cur := t.db.Stats()
+			var avgWait time.Duration
+			waits := cur.WaitCount - prev.WaitCount
+			if waits > 0 {
+				avgWait = (cur.WaitDuration - prev.WaitDuration) / time.Duration(waits)
+			}
+			prev = cur
+			t.tune(avgWait, max(peak, cur.InUse))
+			peak = cur.InUse
+		}
+	}
+}
+
+// tune resizes the pool after an interval in which queries waited avgWait
+// on average and at most peak connections were in use.
+func (t *poolTuner) tune(avgWait time.Duration, peak int) {
+	latency, err := t.roundTrip()
+	if err != nil {
+		log.Printf("db pool tuning: %v", err)
+		return
+	}
+	metrics.Set("db_round_trip_seconds", "Latency of a trivial query over a pooled connection, sampled by the pool tuner.",
+		latency.Seconds())
+	baseline := t.observe(latency)
+	slow := latency > poolSlowFloor && latency > poolSlowLatency*baseline
+
+	size := t.size
+	switch {
+	case avgWait >= poolGrowWait && !slow:
+		size = clamp(size+max(1, size/4), t.min, t.max)
+	case avgWait == 0 && peak <= size/2:
+		size = clamp(size-1, t.min, t.max)
+	}
+	if size != t.size {
+		direction := "grow"
+		if size < t.size {
+			direction = "shrink"
+		}
+		metrics.Inc("db_pool_resizes_total", "Pool size changes made by the tuner.", "direction", direction)
+		log.Printf("db pool: %d -> %d connections (avg wait %s, peak in use %d, round trip %s)",
+			t.size, size, avgWait, peak, latency.Round(time.Microsecond))
+		t.size = size
+		t.db.SetMaxOpenConns(size)
+		t.db.SetMaxIdleConns(size)
+	}
+
+	waiting := avgWait >= poolGrowWait
+	if held := waiting && slow; held != t.slow {
+		t.slow = held
+		if held {
+			log.Printf("WARNING: database round trips take %s against a baseline of %s; not growing the pool past %d",
+				latency, baseline, t.size)
+		}
+	}
+	limited := waiting && t.size == t.max
+	if limited != t.limited {
+		t.limited = limited
+		if limited {
+			metrics.Set("db_pool_limited", "1 while the pool is at DB_POOL_MAX and queries still wait for connections.", 1)
+			log.Printf("WARNING: database pool saturated at DB_POOL_MAX (%d connections, avg wait %s); "+
+				"raise DB_POOL_MAX if the database has room", t.max, avgWait)
+		} else {
+			metrics.Set("db_pool_limited", "1 while the pool is at DB_POOL_MAX and queries still wait for connections.", 0)
+			log.Printf("database pool no longer saturated (%d connections)", t.size)
+		}
+	}
+}
+
+// roundTrip times SELECT 1 on a pooled connection, not counting the wait
+// for the connection itself.
+func (t *poolTuner) roundTrip() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := t.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var one int
+	start := time.Now()
+	if err := conn.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// observe records a round trip and returns the baseline: the fastest of
+// the recent ones.
+func (t *poolTuner) observe(latency time.Duration) time.Duration {
+	t.latencies = append(t.latencies, latency)
+	if len(t.latencies) > poolLatencyWindow {
+		t.latencies = t.latencies[1:]
+	}
+	return slices.Min(t.latencies)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	// The runtime image has no zoneinfo; timezones are validated and
+	// applied with the copy embedded in the binary.
+	_ "time/tzdata"
+)
+
+// NotificationPrefs say which notifications a user wants and whether they
+// are also sent by email.
+type NotificationPrefs struct {
+	Email   bool `json:"email"`
+	Reviews bool `json:"reviews"`
+	Replies bool `json:"replies"`
+	Digest  bool `json:"digest"`
+}
+
+type Profile struct {
+	User
+	AvatarURL     string            `json:"avatar_url"`
+	Timezone      string            `json:"timezone"`
+	Notifications NotificationPrefs `json:"notifications"`
+	// FavoriteGenres narrow the weekly digest; empty means every genre.
+	FavoriteGenres []string `json:"favorite_genres"`
+}
+
+const profileColumns = userColumns + `,
+	COALESCE(p.avatar_url, ''), COALESCE(p.timezone, 'UTC'),
+	COALESCE(p.email_notifications, TRUE), COALESCE(p.notify_reviews, TRUE),
+	COALESCE(p.notify_replies, TRUE), COALESCE(p.weekly_digest, FALSE), COALESCE(p.favorite_genres, '{}')`
+
+const selectProfile = `SELECT ` + profileColumns + ` FROM users u
+	LEFT JOIN user_preferences p ON p.user_id = u.id
+	WHERE u.id=$1`
+
+func scanProfile(row rowScanner) (Profile, error) {
+	var p Profile
+	u, err := scanUser(row, &p.AvatarURL, &p.Timezone,
+		&p.Notifications.Email, &p.Notifications.Reviews, &p.Notifications.Replies, &p.Notifications.Digest,
+		pq.Array(&p.FavoriteGenres))
+	p.User = u
+	return p, err
+}
+
+// GET /me
+func getProfile(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := scanProfile(db.QueryRowContext(r.Context(), selectProfile, userFrom(r.Context()).ID))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	}
+}
+
+// profileInput is a PATCH /me body; absent fields are left alone.
+type profileInput struct {
+	Name          *string `json:"name"`
+	AvatarURL     *string `json:"avatar_url"`
+	Timezone      *string `json:"timezone"`
+	Notifications *struct {
+		Email   *bool `json:"email"`
+		Reviews *bool `json:"reviews"`
+		Replies *bool `json:"replies"`
+		Digest  *bool `json:"digest"`
+	} `json:"notifications"`
+	FavoriteGenres *[]string `json:"favorite_genres"`
+}
+
+// apply validates in and merges it into p. It returns a message for the
+// client when a value is invalid.
+func (in profileInput) apply(p *Profile, rd *refData) string {
+	if in.Name != nil {
+		name := strings.TrimSpace(*in.Name)
+		if name == "" || len(name) > 100 {
+			return "name is required (max 100 characters)"
+		}
+		p.Name = name
+	}
+	if in.AvatarURL != nil {
+		avatar := strings.TrimSpace(*in.AvatarURL)
+		if avatar != "" {
+			u, err := url.Parse(avatar)
+			if err != nil || u.Scheme != "https" || u.Host == "" || len(avatar) > 2048 {
+				return "avatar_url must be an https URL (or empty to remove it)"
+			}
+		}
+		p.AvatarURL = avatar
+	}
+	if in.Timezone != nil {
+		// LoadLocation also accepts "Local" and "", which mean nothing to
+		// other clients.
+		tz := strings.TrimSpace(*in.Timezone)
+		if _, err := time.LoadLocation(tz); err != nil || tz == "" || tz == "Local" {
+			return "timezone must be an IANA name such as Europe/Berlin"
+		}
+		p.Timezone = tz
+	}
+	if n := in.Notifications; n != nil {
+		for _, f := range []struct {
+			in  *bool
+			out *bool
+		}{
+			{n.Email, &p.Notifications.Email},
+			{n.Reviews, &p.Notifications.Reviews},
+			{n.Replies, &p.Notifications.Replies},
+			{n.Digest, &p.Notifications.Digest},
+		} {
+			if f.in != nil {
+				*f.out = *f.in
+			}
+		}
+	}
+	if in.FavoriteGenres != nil {
+		genres := cleanLabels(*in.FavoriteGenres)
+		if len(genres) > 20 {
+			return "at most 20 favorite_genres"
+		}
+		if g, ok := rd.unknownGenre(genres); ok {
+			return "unknown genre: " + g
+		}
+		p.FavoriteGenres = genres
+	}
+	return ""
+}
+
+// PATCH /me
+func updateProfile(db *sql.DB, refs *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in profileInput
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		id := userFrom(r.Context()).ID
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := scanProfile(tx.QueryRow(selectProfile+` FOR UPDATE OF u`, id))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		after := before
+		if msg := in.apply(&after, refs); msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+
+		if after.Name != before.Name {
+			_, err = tx.Exec(`UPDATE users SET name=$1 WHERE id=$2`, after.Name, id)
+		}
+		if err == nil {
+			n := after.Notifications
+			_, err = tx.Exec(`
+				INSERT INTO user_preferences
+					(user_id, avatar_url, timezone, email_notifications, notify_reviews, notify_replies, weekly_digest, favorite_genres)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				ON CONFLICT (user_id) DO UPDATE SET
+					avatar_url=EXCLUDED.avatar_url, timezone=EXCLUDED.timezone,
+					email_notifications=EXCLUDED.email_notifications, notify_reviews=EXCLUDED.notify_reviews,
+					notify_replies=EXCLUDED.notify_replies, weekly_digest=EXCLUDED.weekly_digest,
+					favorite_genres=EXCLUDED.favorite_genres, updated_at=now()`,
+				id, after.AvatarURL, after.Timezone, n.Email, n.Reviews, n.Replies, n.Digest, pq.Array(after.FavoriteGenres))
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "user", id, "update", before, after)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, after)
+	}
+}
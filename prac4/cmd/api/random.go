@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// maxSample bounds ?sample= on the movie list.
+const maxSample = 500
+
+// parseSample reads ?sample=N and ?seed= of the movie list. n is 0 when no
+// sample was asked for. It returns a message for the client on bad input.
+func parseSample(q url.Values) (n int, seed string, msg string) {
+	if seed, msg = parseSeed(q); msg != "" {
+		return 0, "", msg
+	}
+	v := q.Get("sample")
+	if v == "" {
+		return 0, seed, ""
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxSample {
+		return 0, "", "sample must be between 1 and " + strconv.Itoa(maxSample)
+	}
+	return n, seed, ""
+}
+
+func parseSeed(q url.Values) (string, string) {
+	seed := q.Get("seed")
+	if len(seed) > 64 {
+		return "", "seed must be at most 64 characters"
+	}
+	return seed, ""
+}
+
+// randomOrder is the ORDER BY of a random pick from movies. With a seed it
+// orders by a hash of id and seed instead of random(), so the same seed
+// picks the same movies for as long as the catalog doesn't change.
+func randomOrder(wc *whereClause, seed string) string {
+	if seed == "" {
+		return "random()"
+	}
+	return "md5(id::text || ':' || " + wc.arg(seed) + ")"
+}
+
+// GET /movies/random
+//
+// One movie picked at random from those matching the filters of GET
+// /movies, e.g. ?genre=Comedy&year_min=2000. ?seed= makes the pick
+// repeatable.
+func randomMovie(db *sql.DB, refs *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var filter whereClause
+		filter.add("tenant_id = ?", tenantFrom(r.Context()))
+		filter.add("deleted_at IS NULL")
+		if msg := movieFilters(r.URL.Query(), refs, &filter); msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+		seed, msg := parseSeed(r.URL.Query())
+		if msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+		query := `SELECT ` + movieColumns + ` FROM movies WHERE ` + filter.String() +
+			` ORDER BY ` + randomOrder(&filter, seed) + ` LIMIT 1`
+		m, err := scanMovie(db.QueryRowContext(r.Context(), query, filter.args...))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no movie matches the filters"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, withLinks(m, movieLinks(r, m)))
+	}
+}
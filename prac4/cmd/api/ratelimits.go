@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RateLimitOverride changes the limits of one user or one personal access
+// token: the monthly request and byte quotas and the comment rate limit. A
+// nil limit keeps the default and 0 lifts it; Exempt lifts every limit.
+type RateLimitOverride struct {
+	ID              int64     `json:"id"`
+	UserID          *int64    `json:"user_id,omitempty"`
+	TokenID         *int64    `json:"token_id,omitempty"`
+	Exempt          bool      `json:"exempt"`
+	MonthlyRequests *int64    `json:"monthly_requests"`
+	MonthlyBytes    *int64    `json:"monthly_bytes"`
+	CommentLimit    *int      `json:"comment_limit"`
+	Note            string    `json:"note"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+const rateLimitColumns = `id, user_id, token_id, exempt, monthly_requests, monthly_bytes, comment_limit, note, updated_at`
+
+func scanRateLimitOverride(row rowScanner) (RateLimitOverride, error) {
+	var o RateLimitOverride
+	err := row.Scan(&o.ID, &o.UserID, &o.TokenID, &o.Exempt, &o.MonthlyRequests, &o.MonthlyBytes, &o.CommentLimit, &o.Note, &o.UpdatedAt)
+	return o, err
+}
+
+// quotaLimits are the limits in force for a caller; zero means unlimited.
+type quotaLimits struct {
+	Requests int64 `json:"requests,omitempty"`
+	Bytes    int64 `json:"bytes,omitempty"`
+	Comments int   `json:"comments,omitempty"`
+}
+
+func (o RateLimitOverride) apply(l quotaLimits) quotaLimits {
+	if o.Exempt {
+		return quotaLimits{}
+	}
+	if o.MonthlyRequests != nil {
+		l.Requests = *o.MonthlyRequests
+	}
+	if o.MonthlyBytes != nil {
+		l.Bytes = *o.MonthlyBytes
+	}
+	if o.CommentLimit != nil {
+		l.Comments = *o.CommentLimit
+	}
+	return l
+}
+
+// rateLimits is the in-memory copy of rate_limit_overrides on top of the
+// configured defaults. Like featureFlags it is reloaded periodically and
+// whenever the table's trigger sends a cache_invalidate notification.
+type rateLimits struct {
+	db       *sql.DB
+	defaults quotaLimits
+
+	mu     sync.RWMutex
+	users  map[int64]RateLimitOverride
+	tokens map[int64]RateLimitOverride
+}
+
+func newRateLimits(db *sql.DB, cfg config) (*rateLimits, error) {
+	rl := &rateLimits{db: db, defaults: quotaLimits{
+		Requests: int64(cfg.MonthlyRequestQuota),
+		Bytes:    int64(cfg.MonthlyByteQuota),
+		Comments: cfg.CommentRateLimit,
+	}}
+	if err := rl.reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+func (rl *rateLimits) reload(ctx context.Context) error {
+	rows, err := rl.db.QueryContext(ctx, `SELECT `+rateLimitColumns+` FROM rate_limit_overrides`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	users, tokens := map[int64]RateLimitOverride{}, map[int64]RateLimitOverride{}
+	for rows.Next() {
+		o, err := scanRateLimitOverride(rows)
+		if err != nil {
+			return err
+		}
+		if o.UserID != nil {
+			users[*o.UserID] = o
+		} else {
+			tokens[*o.TokenID] = o
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	rl.users, rl.tokens = users, tokens
+	rl.mu.Unlock()
+	return nil
+}
+
+// watch keeps the overrides fresh until the process exits; see refData.watch.
+func (rl *rateLimits) watch(dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("rate limit listener: %v", err)
+		}
+	})
+	if err := listener.Listen("cache_invalidate"); err != nil {
+		log.Printf("rate limit listener: %v", err)
+	}
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n != nil && n.Extra != "rate_limit_overrides" {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if err := rl.reload(context.Background()); err != nil {
+			log.Printf("rate limit reload: %v", err)
+		}
+	}
+}
+
+// limitsFor returns the limits of a user, or of one of their personal
+// access tokens when token is not 0. Each limit comes from the token's
+// override if it sets one, else the user's, else the default.
+func (rl *rateLimits) limitsFor(user, token int64) quotaLimits {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	l := rl.defaults
+	if o, ok := rl.users[user]; ok {
+		l = o.apply(l)
+	}
+	if o, ok := rl.tokens[token]; ok && token != 0 {
+		l = o.apply(l)
+	}
+	return l
+}
+
+// setDefaults replaces the configured defaults, for a CONFIG_FILE reload,
+// and returns the previous ones.
+func (rl *rateLimits) setDefaults(l quotaLimits) quotaLimits {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	old := rl.defaults
+	rl.defaults = l
+	return old
+}
+
+// getDefaults returns the defaults in force.
+func (rl *rateLimits) getDefaults() quotaLimits {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.defaults
+}
+
+// forRequest is limitsFor the signed-in user and the token they presented.
+func (rl *rateLimits) forRequest(u *User) quotaLimits {
+	var token int64
+	if u.tokenScopes != nil {
+		token = u.tokenID
+	}
+	return rl.limitsFor(u.ID, token)
+}
+
+// GET /admin/rate-limits
+func adminListRateLimits(rl *rateLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rl.mu.RLock()
+		defaults := rl.defaults
+		out := make([]RateLimitOverride, 0, len(rl.users)+len(rl.tokens))
+		for _, o := range rl.users {
+			out = append(out, o)
+		}
+		for _, o := range rl.tokens {
+			out = append(out, o)
+		}
+		rl.mu.RUnlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+		writeJSON(w, http.StatusOK, map[string]any{"defaults": defaults, "overrides": out})
+	}
+}
+
+// rateLimitTarget resolves {kind}/{id} of an override route to the user or
+// token it is about and the tenant that owns it. Only personal access
+// tokens are metered, so session tokens can't have overrides.
+func rateLimitTarget(w http.ResponseWriter, r *http.Request, tx *sql.Tx) (column string, id, tenant int64, ok bool) {
+	id, ok = pathID(r)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return "", 0, 0, false
+	}
+	var query string
+	switch r.PathValue("kind") {
+	case "users":
+		column, query = "user_id", `SELECT tenant_id FROM users WHERE id=$1`
+	case "tokens":
+		column, query = "token_id", `
+			SELECT u.tenant_id FROM tokens t JOIN users u ON u.id = t.user_id WHERE t.id=$1 AND t.kind='personal'`
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return "", 0, 0, false
+	}
+	err := tx.QueryRowContext(r.Context(), query, id).Scan(&tenant)
+	if err == sql.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": strings.TrimSuffix(r.PathValue("kind"), "s") + " not found"})
+		return "", 0, 0, false
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return "", 0, 0, false
+	}
+	return column, id, tenant, true
+}
+
+// PUT /admin/rate-limits/users/{id}
+// PUT /admin/rate-limits/tokens/{id}
+//
+// Creates or replaces the override of a user or a personal access token.
+func adminPutRateLimit(db *sql.DB, rl *rateLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Exempt          bool   `json:"exempt"`
+			MonthlyRequests *int64 `json:"monthly_requests"`
+			MonthlyBytes    *int64 `json:"monthly_bytes"`
+			CommentLimit    *int   `json:"comment_limit"`
+			Note            string `json:"note"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		if in.MonthlyRequests != nil && *in.MonthlyRequests < 0 || in.MonthlyBytes != nil && *in.MonthlyBytes < 0 ||
+			in.CommentLimit != nil && *in.CommentLimit < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limits can't be negative"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		column, id, tenant, ok := rateLimitTarget(w, r, tx)
+		if !ok {
+			return
+		}
+		var before *RateLimitOverride
+		old, err := scanRateLimitOverride(tx.QueryRowContext(r.Context(), `
+			SELECT `+rateLimitColumns+` FROM rate_limit_overrides WHERE `+column+`=$1 FOR UPDATE`, id))
+		switch {
+		case err == nil:
+			before = &old
+		case err != sql.ErrNoRows:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		o, err := scanRateLimitOverride(tx.QueryRowContext(r.Context(), `
+			INSERT INTO rate_limit_overrides (`+column+`, exempt, monthly_requests, monthly_bytes, comment_limit, note)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (`+column+`) DO UPDATE SET exempt=EXCLUDED.exempt, monthly_requests=EXCLUDED.monthly_requests,
+				monthly_bytes=EXCLUDED.monthly_bytes, comment_limit=EXCLUDED.comment_limit, note=EXCLUDED.note, updated_at=now()
+			RETURNING `+rateLimitColumns,
+			id, in.Exempt, in.MonthlyRequests, in.MonthlyBytes, in.CommentLimit, strings.TrimSpace(in.Note)))
+		if err == nil {
+			action := "update"
+			if before == nil {
+				action = "create"
+			}
+			after := o
+			after.UpdatedAt = time.Time{}
+			if before != nil {
+				before.UpdatedAt = time.Time{}
+			}
+			err = recordAuditIn(r, tx, tenant, "rate_limit_override", o.ID, action, before, after)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err == nil {
+			err = rl.reload(r.Context())
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		code := http.StatusOK
+		if before == nil {
+			code = http.StatusCreated
+		}
+		writeJSON(w, code, o)
+	}
+}
+
+// DELETE /admin/rate-limits/users/{id}
+// DELETE /admin/rate-limits/tokens/{id}
+//
+// Removes the override; the defaults apply again.
+func adminDeleteRateLimit(db *sql.DB, rl *rateLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		column, id, tenant, ok := rateLimitTarget(w, r, tx)
+		if !ok {
+			return
+		}
+		before, err := scanRateLimitOverride(tx.QueryRowContext(r.Context(), `
+			DELETE FROM rate_limit_overrides WHERE `+column+`=$1 RETURNING `+rateLimitColumns, id))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err == nil {
+			before.UpdatedAt = time.Time{}
+			err = recordAuditIn(r, tx, tenant, "rate_limit_override", before.ID, "delete", before, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err == nil {
+			err = rl.reload(r.Context())
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
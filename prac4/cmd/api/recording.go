@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "[redacted]"
+
+// recording is one request/response pair kept by the recorder, with
+// credentials and secrets already redacted.
+type recording struct {
+	ID         int64           `json:"id"`
+	Time       time.Time       `json:"time"`
+	RequestID  string          `json:"request_id"`
+	RemoteIP   string          `json:"remote_ip"`
+	User       string          `json:"user,omitempty"`
+	Method     string          `json:"method"`
+	URI        string          `json:"uri"`
+	Status     int             `json:"status"`
+	DurationMS float64         `json:"duration_ms"`
+	Request    recordedMessage `json:"request"`
+	Response   recordedMessage `json:"response"`
+}
+
+type recordedMessage struct {
+	Headers   http.Header `json:"headers"`
+	Body      any         `json:"body,omitempty"`
+	BodyBytes int64       `json:"body_bytes"`
+}
+
+// recorder keeps the last requests and responses in a ring buffer for
+// GET /admin/recordings, so a client integration problem can be looked at
+// without a packet capture. It is off unless RECORD_REQUESTS is set.
+type recorder struct {
+	mu        sync.Mutex
+	buf       []recording
+	next      int
+	seq       int64
+	bodyLimit int
+	paths     []string
+}
+
+// newRecorder keeps the last size pairs, bodies up to bodyLimit bytes, for
+// paths under one of the comma-separated prefixes (all when empty).
+func newRecorder(size, bodyLimit int, paths string) *recorder {
+	rec := &recorder{buf: make([]recording, 0, size), bodyLimit: bodyLimit}
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			rec.paths = append(rec.paths, p)
+		}
+	}
+	return rec
+}
+
+func (rec *recorder) enabled() bool {
+	return cap(rec.buf) > 0
+}
+
+// records says whether path is recorded. The debug and recording endpoints
+// never are: one would keep profiles and the other its own output.
+func (rec *recorder) records(path string) bool {
+	if strings.HasPrefix(path, "/debug/") || strings.HasPrefix(path, "/admin/recordings") {
+		return false
+	}
+	if len(rec.paths) == 0 {
+		return true
+	}
+	for _, p := range rec.paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rec *recorder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rec.records(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		reqBody := &cappedBuffer{limit: rec.bodyLimit}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		// authenticate names the user on the access record; make sure
+		// there is one when the access log is off.
+		access := accessRecordFrom(r.Context())
+		if access == nil {
+			access = &accessRecord{}
+			r = r.WithContext(context.WithValue(r.Context(), ctxAccessRecord, access))
+		}
+		rw := &recordingWriter{ResponseWriter: w, body: cappedBuffer{limit: rec.bodyLimit}}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+
+		rec.add(recording{
+			Time:       start.UTC(),
+			RequestID:  requestIDFrom(r.Context()),
+			RemoteIP:   clientIPFrom(r),
+			User:       access.user,
+			Method:     r.Method,
+			URI:        redactURI(r.URL),
+			Status:     rw.status,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Request:    recordMessage(r.Header, reqBody),
+			Response:   recordMessage(w.Header(), &rw.body),
+		})
+	})
+}
+
+func (rec *recorder) add(rc recording) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.seq++
+	rc.ID = rec.seq
+	if len(rec.buf) < cap(rec.buf) {
+		rec.buf = append(rec.buf, rc)
+		return
+	}
+	rec.buf[rec.next] = rc
+	rec.next = (rec.next + 1) % len(rec.buf)
+}
+
+// newest returns the recordings newest first.
+func (rec *recorder) newest() []recording {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	out := make([]recording, 0, len(rec.buf))
+	for i := len(rec.buf) - 1; i >= 0; i-- {
+		out = append(out, rec.buf[(rec.next+i)%len(rec.buf)])
+	}
+	return out
+}
+
+func (rec *recorder) clear() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	n := len(rec.buf)
+	rec.buf, rec.next = rec.buf[:0], 0
+	return n
+}
+
+// cappedBuffer keeps the first limit bytes written to it and counts the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+	total int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) truncated() bool {
+	return b.total > int64(b.Len())
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   cappedBuffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// sensitiveName says whether a header, query parameter or JSON field of
+// this name may hold a credential. It errs on the side of redacting.
+func sensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie", "code", "key", "state":
+		return true
+	}
+	for _, s := range []string{"password", "token", "secret", "signature", "api-key", "api_key", "recovery", "otpauth"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func recordMessage(h http.Header, body *cappedBuffer) recordedMessage {
+	headers := h.Clone()
+	for name := range headers {
+		if sensitiveName(name) {
+			headers[name] = []string{redacted}
+		}
+	}
+	return recordedMessage{Headers: headers, Body: recordBody(h.Get("Content-Type"), body), BodyBytes: body.total}
+}
+
+// recordBody keeps a JSON or form body with its sensitive fields redacted,
+// and text as is. A truncated JSON or form body can't be redacted reliably,
+// so like any other body only its size and type are kept.
+func recordBody(contentType string, body *cappedBuffer) any {
+	if body.total == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	isJSON := strings.HasSuffix(mediaType, "json")
+	isForm := mediaType == "application/x-www-form-urlencoded"
+	if !body.truncated() {
+		switch {
+		case isJSON:
+			var v any
+			if err := json.Unmarshal(body.Bytes(), &v); err == nil {
+				return redactJSON(v)
+			}
+		case isForm:
+			if q, err := url.ParseQuery(body.String()); err == nil {
+				return redactValues(q).Encode()
+			}
+		}
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "xml") {
+		s := body.String()
+		if body.truncated() {
+			s += "..."
+		}
+		return s
+	}
+	if mediaType == "" {
+		mediaType = "unknown type"
+	}
+	return fmt.Sprintf("[%d bytes of %s]", body.total, mediaType)
+}
+
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			if sensitiveName(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(val)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactJSON(v[i])
+		}
+	}
+	return v
+}
+
+func redactValues(q url.Values) url.Values {
+	for k := range q {
+		if sensitiveName(k) {
+			q[k] = []string{redacted}
+		}
+	}
+	return q
+}
+
+func redactURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.Path + "?" + redacted
+	}
+	return u.Path + "?" + redactValues(q).Encode()
+}
+
+// GET /admin/recordings?path=&request_id=&min_status=&limit=
+func adminListRecordings(rec *recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !rec.enabled() {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "request recording is off"})
+			return
+		}
+		q := r.URL.Query()
+		minStatus, limit := 0, 50
+		if s := q.Get("min_status"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid min_status"})
+				return
+			}
+			minStatus = n
+		}
+		if s := q.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+				return
+			}
+			limit = n
+		}
+		out := []recording{}
+		for _, rc := range rec.newest() {
+			if len(out) == limit {
+				break
+			}
+			if rc.Status < minStatus ||
+				q.Get("request_id") != "" && rc.RequestID != q.Get("request_id") ||
+				!strings.HasPrefix(rc.URI, q.Get("path")) {
+				continue
+			}
+			out = append(out, rc)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"recordings": out})
+	}
+}
+
+// DELETE /admin/recordings
+func adminClearRecordings(rec *recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !rec.enabled() {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "request recording is off"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"cleared": rec.clear()})
+	}
+}
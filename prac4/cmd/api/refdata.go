@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// refreshInterval is how often reference data is reloaded even without a
+// notification, as a safety net for missed NOTIFYs.
+const refreshInterval = 5 * time.Minute
+
+type Certification struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	MinAge      int    `json:"min_age"`
+}
+
+// refData is an in-memory copy of the small reference tables (genres and
+// certifications). Validation and filtering read from it instead of
+// querying the database on every request; it is reloaded periodically and
+// whenever the tables' triggers send a cache_invalidate notification.
+type refData struct {
+	db *sql.DB
+
+	mu       sync.RWMutex
+	genres   map[string]bool
+	certs    map[string]Certification
+	loadedAt time.Time
+}
+
+func newRefData(db *sql.DB) (*refData, error) {
+	rd := &refData{db: db}
+	if err := rd.reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+func (rd *refData) reload(ctx context.Context) error {
+	genres := map[string]bool{}
+	rows, err := rd.db.QueryContext(ctx, `SELECT name FROM genres`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		genres[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	certs := map[string]Certification{}
+	rows, err = rd.db.QueryContext(ctx, `SELECT code, description, min_age FROM certifications`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c Certification
+		if err := rows.Scan(&c.Code, &c.Description, &c.MinAge); err != nil {
+			rows.Close()
+			return err
+		}
+		certs[c.Code] = c
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rd.mu.Lock()
+	rd.genres, rd.certs, rd.loadedAt = genres, certs, time.Now()
+	rd.mu.Unlock()
+	return nil
+}
+
+// watch keeps the cache fresh until the process exits. A nil notification
+// means the listener reconnected and may have missed events, so it reloads
+// then as well.
+func (rd *refData) watch(dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("reference data listener: %v", err)
+		}
+	})
+	if err := listener.Listen("cache_invalidate"); err != nil {
+		log.Printf("reference data listener: %v", err)
+	}
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n != nil && n.Extra != "genres" && n.Extra != "certifications" {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if err := rd.reload(context.Background()); err != nil {
+			log.Printf("reference data reload: %v", err)
+		}
+	}
+}
+
+func (rd *refData) hasGenre(name string) bool {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	return rd.genres[name]
+}
+
+// unknownGenre returns the first genre that isn't in the reference table.
+func (rd *refData) unknownGenre(names []string) (string, bool) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	for _, g := range names {
+		if !rd.genres[g] {
+			return g, true
+		}
+	}
+	return "", false
+}
+
+func (rd *refData) hasCertification(code string) bool {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	_, ok := rd.certs[code]
+	return ok
+}
+
+func (rd *refData) genreList() []string {
+	rd.mu.RLock()
+	out := make([]string, 0, len(rd.genres))
+	for g := range rd.genres {
+		out = append(out, g)
+	}
+	rd.mu.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+func (rd *refData) certificationList() []Certification {
+	rd.mu.RLock()
+	out := make([]Certification, 0, len(rd.certs))
+	for _, c := range rd.certs {
+		out = append(out, c)
+	}
+	rd.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].MinAge != out[j].MinAge {
+			return out[i].MinAge < out[j].MinAge
+		}
+		return out[i].Code < out[j].Code
+	})
+	return out
+}
+
+// GET /genres
+func listGenres(rd *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, rd.genreList())
+	}
+}
+
+// GET /certifications
+func listCertifications(rd *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, rd.certificationList())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runtimeSettings are the settings that are safe to change without a
+// restart. They live in the optional CONFIG_FILE, e.g.
+//
+//	{"db_pool_wait_threshold": "250ms", "maintenance": {"enabled": true}}
+//
+// A key left out of the file keeps its current value. The quotas and the
+// comment rate limit are the defaults of MONTHLY_REQUEST_QUOTA,
+// MONTHLY_BYTE_QUOTA and COMMENT_RATE_LIMIT; overrides still apply on top.
+type runtimeSettings struct {
+	DBPoolWaitThreshold *string           `json:"db_pool_wait_threshold"`
+	Maintenance         *maintenanceInput `json:"maintenance"`
+	MonthlyRequestQuota *int64            `json:"monthly_request_quota"`
+	MonthlyByteQuota    *int64            `json:"monthly_byte_quota"`
+	CommentRateLimit    *int              `json:"comment_rate_limit"`
+	AccessLogSampleRate *float64          `json:"access_log_sample_rate"`
+}
+
+// reloader applies CONFIG_FILE at startup, on SIGHUP and whenever the file
+// changes on disk. access is nil when the access log is off.
+type reloader struct {
+	path          string
+	pool          *poolMonitor
+	maint         *maintenance
+	limits        *rateLimits
+	access        *accessLogger
+	commentWindow time.Duration
+
+	modTime time.Time
+}
+
+func (rl *reloader) load() error {
+	fi, err := os.Stat(rl.path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(rl.path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var s runtimeSettings
+	if err := dec.Decode(&s); err != nil {
+		return fmt.Errorf("%s: %w", rl.path, err)
+	}
+
+	// Validate everything before applying anything.
+	var threshold time.Duration
+	if s.DBPoolWaitThreshold != nil {
+		threshold, err = time.ParseDuration(*s.DBPoolWaitThreshold)
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("%s: db_pool_wait_threshold must be a duration such as 100ms", rl.path)
+		}
+	}
+	if s.Maintenance != nil && s.Maintenance.RetryAfter < 0 {
+		return fmt.Errorf("%s: maintenance.retry_after must not be negative", rl.path)
+	}
+	if s.MonthlyRequestQuota != nil && *s.MonthlyRequestQuota < 0 ||
+		s.MonthlyByteQuota != nil && *s.MonthlyByteQuota < 0 {
+		return fmt.Errorf("%s: monthly quotas must not be negative", rl.path)
+	}
+	if s.CommentRateLimit != nil && (*s.CommentRateLimit < 0 || *s.CommentRateLimit > 0 && rl.commentWindow <= 0) {
+		return fmt.Errorf("%s: comment_rate_limit must not be negative, and needs COMMENT_RATE_WINDOW", rl.path)
+	}
+	if r := s.AccessLogSampleRate; r != nil && (*r < 0 || *r > 1) {
+		return fmt.Errorf("%s: access_log_sample_rate must be between 0 and 1", rl.path)
+	}
+
+	rl.modTime = fi.ModTime()
+	if s.DBPoolWaitThreshold != nil {
+		if old := time.Duration(rl.pool.threshold.Swap(int64(threshold))); old != threshold {
+			log.Printf("config reload: db_pool_wait_threshold %s -> %s", old, threshold)
+		}
+	}
+	if s.Maintenance != nil {
+		old, next := rl.maint.get(), s.Maintenance.state()
+		if old.Enabled != next.Enabled || old.AllowReads != next.AllowReads ||
+			old.Message != next.Message || old.RetryAfter != next.RetryAfter {
+			log.Printf("config reload: maintenance changed")
+			rl.maint.set(next)
+		}
+	}
+	if s.MonthlyRequestQuota != nil || s.MonthlyByteQuota != nil || s.CommentRateLimit != nil {
+		next := rl.limits.getDefaults()
+		if s.MonthlyRequestQuota != nil {
+			next.Requests = *s.MonthlyRequestQuota
+		}
+		if s.MonthlyByteQuota != nil {
+			next.Bytes = *s.MonthlyByteQuota
+		}
+		if s.CommentRateLimit != nil {
+			next.Comments = *s.CommentRateLimit
+		}
+		if old := rl.limits.setDefaults(next); old != next {
+			log.Printf("config reload: rate limit defaults %+v -> %+v", old, next)
+		}
+	}
+	if s.AccessLogSampleRate != nil && rl.access != nil {
+		if old := rl.access.setRate(*s.AccessLogSampleRate); old != *s.AccessLogSampleRate {
+			log.Printf("config reload: access_log_sample_rate %g -> %g", old, *s.AccessLogSampleRate)
+		}
+	}
+	return nil
+}
+
+// watch reloads on SIGHUP and polls the file's modification time. Errors
+// are logged and the previous settings stay in effect.
+func (rl *reloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-hup:
+		case <-tick.C:
+			fi, err := os.Stat(rl.path)
+			if err != nil || fi.ModTime().Equal(rl.modTime) {
+				continue
+			}
+		}
+		if err := rl.load(); err != nil {
+			log.Printf("config reload failed, keeping current settings: %v", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// errorReport is one server-side failure worth a human's attention.
+type errorReport struct {
+	Err       error
+	Stack     []byte // set for panics
+	RequestID string
+	Route     string
+	Status    int
+}
+
+// errorReporter ships failures to an error tracker. Reports are
+// fire-and-forget; a broken tracker must never fail a request.
+type errorReporter interface {
+	report(r *http.Request, rep errorReport)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) report(*http.Request, errorReport) {}
+
+// sentryReporter sends to Sentry or anything speaking its protocol
+// (GlitchTip, self-hosted Sentry).
+type sentryReporter struct{}
+
+func newErrorReporter(dsn, environment string) (errorReporter, error) {
+	if dsn == "" {
+		return nopReporter{}, nil
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              dsn,
+		Environment:      environment,
+		Release:          build.Version,
+		AttachStacktrace: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sentryReporter{}, nil
+}
+
+func (sentryReporter) report(r *http.Request, rep errorReport) {
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetRequest(r)
+		scope.SetTag("request_id", rep.RequestID)
+		scope.SetTag("route", rep.Route)
+		scope.SetTag("status", fmt.Sprint(rep.Status))
+		if u := userFrom(r.Context()); u != nil {
+			scope.SetUser(sentry.User{ID: fmt.Sprint(u.ID)})
+		}
+		if rep.Stack != nil {
+			scope.SetContext("panic", sentry.Context{"stack": string(rep.Stack)})
+		}
+	})
+	hub.CaptureException(rep.Err)
+}
+
+// flushErrors waits briefly for queued reports, e.g. before exiting.
+func flushErrors() {
+	sentry.Flush(2 * time.Second)
+}
+
+// reportErrors recovers panics into a 500 and reports them, along with every
+// other 5xx response. 503 is left out: it's the expected answer while
+// shedding load and would drown real errors.
+func reportErrors(rep errorReporter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &errorRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+			report := errorReport{RequestID: requestIDFrom(r.Context()), Route: r.Method + " " + r.URL.Path}
+
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				report.Err, report.Stack, report.Status = fmt.Errorf("panic: %v", v), debug.Stack(), http.StatusInternalServerError
+				log.Printf("panic serving %s (request %s): %v\n%s", report.Route, report.RequestID, v, report.Stack)
+				rep.report(r, report)
+				if !rec.wrote {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+				}
+			}()
+
+			next.ServeHTTP(rec, r)
+
+			if rec.status >= 500 && rec.status != http.StatusServiceUnavailable {
+				report.Err, report.Status = rec.err(), rec.status
+				rep.report(r, report)
+			}
+		})
+	}
+}
+
+// errorRecorder keeps the start of 5xx response bodies, which carry the
+// handler's error message.
+type errorRecorder struct {
+	statusRecorder
+	wrote bool
+	body  bytes.Buffer
+}
+
+func (e *errorRecorder) WriteHeader(code int) {
+	e.wrote = true
+	e.statusRecorder.WriteHeader(code)
+}
+
+func (e *errorRecorder) Write(b []byte) (int, error) {
+	e.wrote = true
+	if e.status >= 500 && e.body.Len() < 1024 {
+		e.body.Write(b[:min(len(b), 1024-e.body.Len())])
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+func (e *errorRecorder) err() error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(e.body.Bytes(), &body) == nil && body.Error != "" {
+		return errors.New(body.Error)
+	}
+	return errors.New(http.StatusText(e.status))
+}
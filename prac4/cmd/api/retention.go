@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+)
+
+// retentionBatch bounds how many rows one DELETE removes, so a large
+// backlog is worked off without holding locks for long.
+const retentionBatch = 5000
+
+// retentionPolicy removes the rows of table that match where, whose $1 is
+// the cutoff: now minus keep. A zero keep disables the policy.
+type retentionPolicy struct {
+	name  string
+	table string
+	where string
+	keep  time.Duration
+	// perTenant marks tables that live in tenant schemas.
+	perTenant bool
+	// partitioned marks tables partitioned by month (see partitions.go),
+	// whose expired months are dropped whole before the rest is deleted.
+	partitioned bool
+}
+
+// retentionPolicies are the policies runRetention applies. With an archive
+// configured, deleted movies and the audit log are purged by the archiver
+// instead, once it has copied them.
+func retentionPolicies(cfg config) []retentionPolicy {
+	var archived []retentionPolicy
+	if cfg.ArchiveURL == "" {
+		archived = []retentionPolicy{
+			{"deleted_movies", "movies", `deleted_at < $1`, cfg.RetainDeletedMovies, true, false},
+			{"audit_log", "audit_log", `created_at < $1`, cfg.RetainAuditLog, true, true},
+		}
+	}
+	return append(archived, []retentionPolicy{
+		{"auth_events", "auth_events", `created_at < $1`, cfg.RetainAuthEvents, false, true},
+		{"analytics_events", "analytics_events", `received_at < $1`, cfg.RetainAnalyticsEvents, false, true},
+		{"tokens", "tokens", `(revoked_at < $1 OR expires_at < $1)`, cfg.RetainTokens, false, false},
+	}...)
+}
+
+// runRetention applies the policies every interval. Translations of purged
+// movies go with them (ON DELETE CASCADE), as does the usage of purged
+// tokens.
+func runRetention(db *sql.DB, schemas bool, policies []retentionPolicy, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, p := range policies {
+			if p.keep <= 0 {
+				continue
+			}
+			n, err := p.apply(context.Background(), db, schemas)
+			if n > 0 {
+				metrics.Add("api_retention_deleted_rows_total", "Rows removed by retention policies.", float64(n), "policy", p.name)
+				log.Printf("retention %s: removed %d rows older than %s", p.name, n, p.keep)
+			}
+			if err != nil {
+				log.Printf("retention %s: %v", p.name, err)
+			}
+		}
+	}
+}
+
+// apply deletes the expired rows batch by batch and returns how many went.
+func (p retentionPolicy) apply(ctx context.Context, db *sql.DB, schemas bool) (int64, error) {
+	cutoff := time.Now().Add(-p.keep)
+	var total int64
+	err := forEachTenant(ctx, db, schemas && p.perTenant, func(ctx context.Context) error {
+		n, err := p.purge(ctx, db, cutoff)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+// purge deletes the rows of ctx's tenant that expired by cutoff.
+func (p retentionPolicy) purge(ctx context.Context, db *sql.DB, cutoff time.Time) (int64, error) {
+	if p.partitioned {
+		var dropped int
+		err := db.QueryRowContext(ctx, `SELECT drop_month_partitions($1::regclass, $2)`, p.table, cutoff).Scan(&dropped)
+		if err != nil {
+			return 0, err
+		}
+		if dropped > 0 {
+			log.Printf("retention %s: dropped %d monthly partitions", p.name, dropped)
+		}
+	}
+	// ctids are only unique within a partition, so partitioned tables match
+	// on the partition too.
+	batch := `ctid = ANY(ARRAY(SELECT ctid FROM ` + p.table + ` WHERE ` + p.where + ` LIMIT ` + strconv.Itoa(retentionBatch) + `))`
+	if p.partitioned {
+		batch = `(tableoid, ctid) IN (SELECT tableoid, ctid FROM ` + p.table + ` WHERE ` + p.where + ` LIMIT ` + strconv.Itoa(retentionBatch) + `)`
+	}
+	var total int64
+	for {
+		res, err := db.ExecContext(ctx, `DELETE FROM `+p.table+` WHERE `+batch, cutoff)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < retentionBatch {
+			return total, nil
+		}
+	}
+}
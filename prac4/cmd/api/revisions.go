@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Revision is one change to a movie's own fields, numbered from 1 in the
+// order they were made. Translations and tags have their own history.
+type Revision struct {
+	Revision  int              `json:"revision"`
+	AuditID   int64            `json:"audit_id"`
+	Action    string           `json:"action"`
+	Actor     string           `json:"actor"`
+	RequestID string           `json:"request_id,omitempty"`
+	Changes   []revisionChange `json:"changes"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+type revisionChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// revertedMovie is how a revert shows up in the audit log.
+type revertedMovie struct {
+	Movie
+	RevertedTo int `json:"reverted_to,omitempty"`
+}
+
+const movieRevisionsQuery = `SELECT ` + auditColumns + ` FROM audit_log
+	WHERE tenant_id=$2 AND entity='movie' AND entity_id=$1 ORDER BY id`
+
+func revisionsOf(entries []AuditEntry) []Revision {
+	out := make([]Revision, len(entries))
+	for i, e := range entries {
+		changes := make([]revisionChange, 0, len(e.Changes))
+		for f, c := range e.Changes {
+			changes = append(changes, revisionChange{f, c.From, c.To})
+		}
+		sort.Slice(changes, func(a, b int) bool { return changes[a].Field < changes[b].Field })
+		out[i] = Revision{Revision: i + 1, AuditID: e.ID, Action: e.Action, Actor: e.Actor, RequestID: e.RequestID,
+			Changes: changes, CreatedAt: e.CreatedAt}
+	}
+	return out
+}
+
+// GET /movies/{id}/revisions
+//
+// The movie's revisions, oldest first, each with who made it and the fields
+// it changed. Like the history, this is kept after a movie is deleted.
+// Audit retention drops the oldest revisions, so numbering then starts at
+// the oldest one left.
+func movieRevisions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		entries, err := queryAudit(r.Context(), db, movieRevisionsQuery, id, tenantFrom(r.Context()))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"movie_id": id, "revisions": revisionsOf(entries)})
+	}
+}
+
+// POST /movies/{id}/revisions/{n}/revert
+//
+// Restores the title, year, rating, genres, certification and metadata the
+// movie had right after revision n, by undoing the later revisions on its
+// current state. External IDs, slug and translations are left alone. The
+// revert is itself a new revision. A state that no longer validates, e.g.
+// a genre that has since been deleted, is a 409.
+func revertMovie(db *sql.DB, refs *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		n, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil || n < 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid revision"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		tenant := tenantFrom(r.Context())
+		before, err := scanMovie(tx.QueryRow(`
+			SELECT `+movieColumns+` FROM movies WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL FOR UPDATE`, id, tenant))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		entries, err := queryAudit(r.Context(), tx, movieRevisionsQuery, id, tenant)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if n > len(entries) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such revision"})
+			return
+		}
+
+		state, err := toFieldMap(before)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		for i := len(entries) - 1; i >= n; i-- {
+			for f, c := range entries[i].Changes {
+				state[f] = c.From
+			}
+		}
+		var in movieInput
+		raw, err := json.Marshal(state)
+		if err == nil {
+			err = json.Unmarshal(raw, &in)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "revision " + strconv.Itoa(n) + " can't be restored: " + err.Error()})
+			return
+		}
+		if msg := in.normalize(refs); msg != "" {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "revision " + strconv.Itoa(n) + " can't be restored: " + msg})
+			return
+		}
+
+		m, err := scanMovie(tx.QueryRow(`
+			UPDATE movies
+			SET title=$1, genres=$2, certification=NULLIF($3, ''), year=NULLIF($4, 0), rating=$5, metadata=$8, updated_at=now()
+			WHERE id=$6 AND tenant_id=$7
+			RETURNING `+movieColumns,
+			in.Title, pq.Array(in.Genres), in.Certification, in.Year, in.Rating, id, tenant, []byte(in.Metadata)))
+		if err == nil {
+			err = recordAudit(r, tx, "movie", id, "update", revertedMovie{Movie: before}, revertedMovie{Movie: m, RevertedTo: n})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		countEvent(eventMovieUpdated)
+		writeJSON(w, http.StatusOK, map[string]any{"reverted_to": n, "movie": m})
+	}
+}
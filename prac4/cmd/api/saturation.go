@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Request priority classes used when the database pool is saturated.
+// Critical requests (health checks and writes) are never shed.
+const (
+	priorityCritical = iota
+	priorityNormal
+	priorityLow
+)
+
+var priorityNames = [...]string{"critical", "normal", "low"}
+
+// poolMonitor samples database/sql pool statistics and decides which
+// request classes to shed. Saturation is measured as the average time a
+// query waited for a connection during the last sample interval.
+type poolMonitor struct {
+	db *sql.DB
+
+	// threshold is a time.Duration; zero disables shedding. It can change
+	// at runtime through a config reload.
+	threshold atomic.Int64
+
+	// shedAbove holds the lowest priority class that is still served;
+	// requests with a higher number are rejected.
+	shedAbove atomic.Int32
+}
+
+func newPoolMonitor(db *sql.DB, threshold time.Duration) *poolMonitor {
+	pm := &poolMonitor{db: db}
+	pm.threshold.Store(int64(threshold))
+	pm.shedAbove.Store(priorityLow)
+
+	metrics.GaugeFunc("db_pool_in_use", "Connections currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	metrics.GaugeFunc("db_pool_open", "Open connections.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	metrics.GaugeFunc("db_pool_wait_count", "Total number of connections waited for.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	metrics.Set("db_pool_saturated", "1 while low-priority requests are being shed, 2 when normal ones are too.", 0)
+	return pm
+}
+
+func (pm *poolMonitor) run(interval time.Duration) {
+	prev := pm.db.Stats()
+	for range time.Tick(interval) {
+		cur := pm.db.Stats()
+		var avgWait time.Duration
+		if n := cur.WaitCount - prev.WaitCount; n > 0 {
+			avgWait = (cur.WaitDuration - prev.WaitDuration) / time.Duration(n)
+		}
+		prev = cur
+		metrics.Set("db_pool_wait_seconds_avg", "Average wait for a connection during the last sample.", avgWait.Seconds())
+
+		// Shed low-priority traffic past the threshold and normal traffic
+		// past four times the threshold. Recover only below half of it so
+		// the state doesn't flap from one sample to the next.
+		threshold := time.Duration(pm.threshold.Load())
+		level := pm.shedAbove.Load()
+		next := level
+		switch {
+		case threshold == 0:
+			next = priorityLow
+		case avgWait >= 4*threshold:
+			next = priorityCritical
+		case avgWait >= threshold:
+			next = min(level, priorityNormal)
+		case avgWait < threshold/2:
+			next = priorityLow
+		}
+		if next == level {
+			continue
+		}
+		pm.shedAbove.Store(next)
+		metrics.Set("db_pool_saturated", "1 while low-priority requests are being shed, 2 when normal ones are too.",
+			float64(priorityLow-next))
+		if next < level {
+			log.Printf("ALERT: database pool saturated (avg wait %s, in use %d/%d); shedding %s priority requests",
+				avgWait, cur.InUse, cur.MaxOpenConnections, priorityNames[next+1])
+		} else {
+			log.Printf("database pool recovered (avg wait %s); serving up to %s priority requests",
+				avgWait, priorityNames[next])
+		}
+	}
+}
+
+// requestPriority classifies a request for load shedding.
+func requestPriority(r *http.Request) int {
+	switch {
+	case r.URL.Path == "/health" || r.URL.Path == "/metrics" || r.URL.Path == "/version":
+		return priorityCritical
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		return priorityCritical
+	case strings.HasPrefix(r.URL.Path, "/search/"),
+		strings.HasPrefix(r.URL.Path, "/stats/"),
+		r.URL.Path == "/movies/suggest",
+		r.URL.Path == "/movies/export",
+		r.URL.Path == "/translations/missing",
+		r.URL.Path == "/admin/audit":
+		return priorityLow
+	default:
+		return priorityNormal
+	}
+}
+
+// shed rejects requests whose class is currently being shed with a fast 503.
+func (pm *poolMonitor) shed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := requestPriority(r); int32(p) > pm.shedAbove.Load() {
+			metrics.Inc("db_pool_shed_requests_total", "Requests rejected because the database pool was saturated.",
+				"class", priorityNames[p])
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "service busy, try again shortly"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"practice4/migrations"
+
+	"github.com/lib/pq"
+)
+
+// SCHEMA_CHECK modes.
+const (
+	schemaCheckFail = "fail"
+	schemaCheckWarn = "warn"
+	schemaCheckOff  = "off"
+)
+
+// Kinds of schema drift.
+const (
+	driftUnapplied = "unapplied_migration"
+	driftUnknown   = "unknown_migration"
+	driftChecksum  = "checksum_mismatch"
+	driftMissing   = "missing_relation"
+)
+
+// schemaDrift is one way the live schema differs from what the embedded
+// migrations expect.
+type schemaDrift struct {
+	schema string
+	kind   string
+	name   string
+}
+
+func (d schemaDrift) String() string {
+	switch d.kind {
+	case driftUnapplied:
+		return fmt.Sprintf("%s: migration %s was never applied", d.schema, d.name)
+	case driftUnknown:
+		return fmt.Sprintf("%s: migration %s is applied but not part of this build (a newer release ran?)", d.schema, d.name)
+	case driftChecksum:
+		return fmt.Sprintf("%s: migration %s was applied with different contents", d.schema, d.name)
+	default:
+		return fmt.Sprintf("%s: %s is missing (dropped by hand?)", d.schema, d.name)
+	}
+}
+
+var (
+	sqlCommentRe = regexp.MustCompile(`--[^\n]*`)
+	createdRelRe = regexp.MustCompile(`(?i)\bCREATE\s+(?:UNIQUE\s+)?(?:TABLE|INDEX|MATERIALIZED\s+VIEW)\s+(?:IF\s+NOT\s+EXISTS\s+)?([a-z_][a-z0-9_]*)`)
+	droppedRelRe = regexp.MustCompile(`(?i)\bDROP\s+(?:TABLE|INDEX|MATERIALIZED\s+VIEW)\s+(?:IF\s+EXISTS\s+)?([a-z_][a-z0-9_]*)`)
+)
+
+// expectedRelations reads the tables, indexes and views the migrations in
+// fsys create and don't drop again, so the list follows the migrations
+// without being kept by hand.
+func expectedRelations(fsys fs.FS, pattern string) ([]string, error) {
+	names, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	rels := map[string]bool{}
+	for _, name := range names {
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		src := sqlCommentRe.ReplaceAllString(string(body), "")
+		for _, m := range createdRelRe.FindAllStringSubmatch(src, -1) {
+			if rel := strings.ToLower(m[1]); rel != "on" {
+				rels[rel] = true
+			}
+		}
+		for _, m := range droppedRelRe.FindAllStringSubmatch(src, -1) {
+			delete(rels, strings.ToLower(m[1]))
+		}
+	}
+	out := make([]string, 0, len(rels))
+	for rel := range rels {
+		out = append(out, rel)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// checkSchema compares public, and each tenant schema when schemas is set,
+// with the embedded migrations: every migration applied with the contents
+// it has now, none applied that this build doesn't know, and every
+// relation they create present.
+func checkSchema(ctx context.Context, db *sql.DB, schemas bool) ([]schemaDrift, error) {
+	statuses, err := migrationStatuses(ctx, db, "public", migrations.FS, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	drift, err := checkSchemaAgainst(ctx, db, "public", statuses, migrations.FS, "*.sql")
+	if err != nil || !schemas {
+		return drift, err
+	}
+	ids, err := tenantIDs(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if id == defaultTenantID {
+			continue
+		}
+		statuses, err := tenantMigrationStatuses(ctx, db, id)
+		if err != nil {
+			return nil, err
+		}
+		d, err := checkSchemaAgainst(ctx, db, tenantSchema(id), statuses, migrations.TenantFS, "tenant/*.sql")
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, d...)
+	}
+	return drift, nil
+}
+
+// checkSchemaAgainst turns the migration statuses of schema into drift and
+// adds the relations of fsys missing from it.
+func checkSchemaAgainst(ctx context.Context, db *sql.DB, schema string, statuses []migrationStatus, fsys fs.FS, pattern string) ([]schemaDrift, error) {
+	var drift []schemaDrift
+	for _, m := range statuses {
+		switch m.Status {
+		case migrationPending:
+			drift = append(drift, schemaDrift{schema, driftUnapplied, m.Version})
+		case migrationModified:
+			drift = append(drift, schemaDrift{schema, driftChecksum, m.Version})
+		case migrationUnknown:
+			drift = append(drift, schemaDrift{schema, driftUnknown, m.Version})
+		}
+	}
+
+	rels, err := expectedRelations(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	err = db.QueryRowContext(ctx, `
+		SELECT coalesce(array_agg(r ORDER BY r), '{}') FROM unnest($2::text[]) AS r
+		WHERE to_regclass(quote_ident($1) || '.' || quote_ident(r)) IS NULL`, schema, pq.Array(rels)).Scan(pq.Array(&missing))
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range missing {
+		drift = append(drift, schemaDrift{schema, driftMissing, rel})
+	}
+	return drift, nil
+}
+
+// verifySchema runs checkSchema after the migrations and reports drift as
+// api_schema_drift{kind="..."}. In fail mode any drift but an unknown
+// migration stops the API with the list, rather than letting requests run
+// into "relation does not exist"; unknown migrations come from a newer
+// release and are expected while rolling back, so they only warn. So do
+// pending migrations and their missing relations when pendingOK is set,
+// for deployments that apply migrations through the admin API.
+func verifySchema(db *sql.DB, schemas bool, mode string, pendingOK bool) error {
+	if mode == schemaCheckOff {
+		return nil
+	}
+	drift, err := checkSchema(context.Background(), db, schemas)
+	if err != nil {
+		return fmt.Errorf("schema check: %w", err)
+	}
+	counts := map[string]int{driftUnapplied: 0, driftUnknown: 0, driftChecksum: 0, driftMissing: 0}
+	var fatal []string
+	for _, d := range drift {
+		counts[d.kind]++
+		log.Printf("schema drift: %s", d)
+		if d.kind == driftUnknown || pendingOK && (d.kind == driftUnapplied || d.kind == driftMissing) {
+			continue
+		}
+		fatal = append(fatal, d.String())
+	}
+	for kind, n := range counts {
+		metrics.Set("api_schema_drift", "Differences between the live schema and the migrations, by kind.", float64(n), "kind", kind)
+	}
+	if mode == schemaCheckFail && len(fatal) > 0 {
+		return fmt.Errorf("schema drift (set SCHEMA_CHECK=warn to start anyway):\n  %s", strings.Join(fatal, "\n  "))
+	}
+	return nil
+}
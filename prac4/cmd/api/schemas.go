@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/lib/pq"
+
+	"practice4/migrations"
+)
+
+// Tenant isolation modes (TENANT_ISOLATION). With schema isolation every
+// tenant but the default one keeps its movies, translations, webhooks and
+// audit log in a schema of its own, tenant_<id>; users, tokens and the
+// reference data stay shared in public, as do the default tenant's rows.
+// Queries don't name schemas: schemaConnector points each connection's
+// search_path at the tenant of the context a query runs with. The tenant_id
+// filters stay either way.
+const (
+	isolationRow    = "row"
+	isolationSchema = "schema"
+)
+
+// tenantTables live in tenant schemas, parents first.
+var tenantTables = []string{"movies", "movie_translations", "tags", "movie_tags", "comments", "movie_views", "webhooks", "audit_log"}
+
+func tenantSchema(id int64) string {
+	return "tenant_" + strconv.FormatInt(id, 10)
+}
+
+// tenantSearchPath is the search_path for queries on behalf of the tenant.
+// Without a tenant it is public, where the tenant_id filters match nothing.
+func tenantSearchPath(id int64) string {
+	if id <= defaultTenantID {
+		return "public"
+	}
+	return pq.QuoteIdentifier(tenantSchema(id)) + ", public"
+}
+
+// schemaConnector hands out connections that follow the tenant in the
+// context of each query.
+type schemaConnector struct {
+	driver.Connector
+}
+
+func (c schemaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &schemaConn{Conn: conn}, nil
+}
+
+// schemaConn sets search_path before a statement when the context's tenant
+// differs from the one the session is on. Inside a transaction the path set
+// at BEGIN is kept, since statements of a *sql.Tx often run without the
+// request context.
+type schemaConn struct {
+	driver.Conn
+	path string
+	inTx bool
+}
+
+func (c *schemaConn) follow(ctx context.Context) error {
+	p := tenantSearchPath(tenantFrom(ctx))
+	if c.inTx || p == c.path {
+		return nil
+	}
+	if _, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, `SET search_path TO `+p, nil); err != nil {
+		return err
+	}
+	c.path = p
+	return nil
+}
+
+func (c *schemaConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.follow(ctx); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *schemaConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.follow(ctx); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *schemaConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.follow(ctx); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *schemaConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.follow(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.inTx = true
+	return schemaTx{tx, c}, nil
+}
+
+func (c *schemaConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *schemaConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *schemaConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+type schemaTx struct {
+	driver.Tx
+	conn *schemaConn
+}
+
+func (t schemaTx) Commit() error {
+	t.conn.inTx = false
+	return t.Tx.Commit()
+}
+
+func (t schemaTx) Rollback() error {
+	t.conn.inTx = false
+	return t.Tx.Rollback()
+}
+
+// queryer is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// tenantIDs lists every tenant.
+func tenantIDs(ctx context.Context, q queryer) ([]int64, error) {
+	rows, err := q.QueryContext(ctx, `SELECT id FROM tenants ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// inEachTenant runs fn inside tx once per tenant, with the search_path on
+// that tenant's tables, and restores the request's path afterwards. Without
+// schema isolation the tables are shared and fn runs once.
+func inEachTenant(ctx context.Context, tx *sql.Tx, schemas bool, fn func() error) error {
+	if !schemas {
+		return fn()
+	}
+	ids, err := tenantIDs(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `SET LOCAL search_path TO `+tenantSearchPath(id)); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `SET LOCAL search_path TO `+tenantSearchPath(tenantFrom(ctx)))
+	return err
+}
+
+// forEachTenant runs fn with a context for each tenant, for background work
+// on tenant tables. Without schema isolation fn runs once with ctx.
+func forEachTenant(ctx context.Context, db *sql.DB, schemas bool, fn func(ctx context.Context) error) error {
+	if !schemas {
+		return fn(ctx)
+	}
+	ids, err := tenantIDs(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := fn(context.WithValue(ctx, ctxTenant, tenantScope{id: id})); err != nil {
+			return fmt.Errorf("tenant %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// migrateTenants brings the schema of every tenant up to date at startup.
+func migrateTenants(db *sql.DB) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	ids, err := tenantIDs(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id == defaultTenantID {
+			continue
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := migrateTenant(ctx, tx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateTenant creates the tenant's schema if needed and applies the tenant
+// migrations it hasn't had yet, all inside tx. A tenant created before
+// schema isolation was turned on has its rows moved out of the shared
+// tables when its schema is created.
+func migrateTenant(ctx context.Context, tx *sql.Tx, id int64) error {
+	schema := pq.QuoteIdentifier(tenantSchema(id))
+
+	var fresh bool
+	if err := tx.QueryRowContext(ctx, `SELECT to_regnamespace($1) IS NULL`, schema).Scan(&fresh); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+schema); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `SET LOCAL search_path TO `+tenantSearchPath(id)); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS `+schema+`.schema_migrations (
+			version TEXT PRIMARY KEY,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrations.TenantFS, "tenant/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		version := path.Base(name)
+		var applied bool
+		err := tx.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM `+schema+`.schema_migrations WHERE version=$1)`, version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+		body, err := fs.ReadFile(migrations.TenantFS, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(body)
+		if _, err := tx.ExecContext(ctx, string(body)); err != nil {
+			return fmt.Errorf("tenant migration %s on %s: %w", version, schema, err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO `+schema+`.schema_migrations (version, checksum) VALUES ($1, $2)`,
+			version, hex.EncodeToString(sum[:])); err != nil {
+			return err
+		}
+		log.Printf("Applied tenant migration %s to %s", version, schema)
+	}
+
+	if fresh {
+		if err := moveTenantRows(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `SET LOCAL search_path TO `+tenantSearchPath(tenantFrom(ctx)))
+	return err
+}
+
+// moveTenantRows moves the tenant's rows from the shared tables into its
+// schema. Generated columns are left for the target to compute.
+func moveTenantRows(ctx context.Context, tx *sql.Tx, id int64) error {
+	schema := pq.QuoteIdentifier(tenantSchema(id))
+	var moved int64
+	for _, t := range partitionedTables {
+		if !t.perTenant {
+			continue
+		}
+		if err := backfillPartitions(ctx, tx, schema, t, id); err != nil {
+			return err
+		}
+	}
+	for _, t := range tenantTables {
+		var cols string
+		err := tx.QueryRowContext(ctx, `
+			SELECT string_agg(quote_ident(column_name), ', ' ORDER BY ordinal_position)
+			FROM information_schema.columns
+			WHERE table_schema = 'public' AND table_name = $1 AND is_generated = 'NEVER'`, t).Scan(&cols)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO `+schema+`.`+t+` (`+cols+`)
+			SELECT `+cols+` FROM public.`+t+` WHERE tenant_id = $1`, id)
+		if err != nil {
+			return fmt.Errorf("moving %s of tenant %d: %w", t, id, err)
+		}
+		n, _ := res.RowsAffected()
+		moved += n
+	}
+	for i := len(tenantTables) - 1; i >= 0; i-- {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM public.`+tenantTables[i]+` WHERE tenant_id = $1`, id); err != nil {
+			return err
+		}
+	}
+	if moved > 0 {
+		log.Printf("Moved %d rows of tenant %d into %s", moved, id, schema)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type searchResult struct {
+	Movie   Movie   `json:"movie"`
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// GET /search/movies?q=...&limit=20
+//
+// Full-text search over titles, ranked with ts_rank and highlighted with
+// ts_headline. When the query matches nothing (usually a typo) it falls back
+// to pg_trgm similarity so "intersteler" still finds "Interstellar". The
+// response's "mode" says which of the two produced the results.
+func searchMovies(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "q is required"})
+			return
+		}
+		limit := 20
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > 100 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 100"})
+				return
+			}
+			limit = n
+		}
+
+		mode := "fulltext"
+		results, err := querySearch(r.Context(), db, `
+			SELECT `+movieColumns+`,
+				ts_rank(search, query) AS rank,
+				ts_headline('english', title, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')
+			FROM movies, websearch_to_tsquery('english', $1) AS query
+			WHERE search @@ query AND tenant_id = $3 AND deleted_at IS NULL
+			ORDER BY rank DESC, id
+			LIMIT $2`, q, limit, tenantFrom(r.Context()))
+		if err == nil && len(results) == 0 {
+			mode = "trigram"
+			results, err = querySearch(r.Context(), db, `
+				SELECT `+movieColumns+`, similarity(title, $1) AS rank, title
+				FROM movies
+				WHERE title % $1 AND tenant_id = $3 AND deleted_at IS NULL
+				ORDER BY rank DESC, id
+				LIMIT $2`, q, limit, tenantFrom(r.Context()))
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"query":   q,
+			"mode":    mode,
+			"results": results,
+		})
+	}
+}
+
+func querySearch(ctx context.Context, db *sql.DB, query string, args ...any) ([]searchResult, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []searchResult{}
+	for rows.Next() {
+		var res searchResult
+		m, err := scanMovie(rows, &res.Rank, &res.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		res.Movie = m
+		out = append(out, res)
+	}
+	return out, rows.Err()
+}
+
+// suggestBudget bounds how long a suggestion lookup may take. Suggestions are
+// fired on every keystroke, so a slow answer is worse than no answer.
+const suggestBudget = 150 * time.Millisecond
+
+type suggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+// likeEscaper escapes LIKE wildcards so user input is matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// GET /movies/suggest?q=int&limit=10
+//
+// Returns title completions: prefix matches first, then trigram-similar
+// titles, both served by movies_title_trgm_idx. If the lookup exceeds
+// suggestBudget the response is an empty list with "timed_out": true rather
+// than an error, so search boxes just keep the previous suggestions.
+func suggestMovies(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if len([]rune(q)) < 2 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "q must be at least 2 characters"})
+			return
+		}
+		limit := 10
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > 25 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 25"})
+				return
+			}
+			limit = n
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), suggestBudget)
+		defer cancel()
+
+		out := []suggestion{}
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, title FROM movies
+			WHERE (title ILIKE $1 || '%' OR title % $2) AND tenant_id = $4 AND deleted_at IS NULL
+			ORDER BY title ILIKE $1 || '%' DESC, similarity(title, $2) DESC, title
+			LIMIT $3`, likeEscaper.Replace(q), q, limit, tenantFrom(r.Context()))
+		if err == nil {
+			defer rows.Close()
+			for rows.Next() {
+				var s suggestion
+				if err = rows.Scan(&s.ID, &s.Title); err != nil {
+					break
+				}
+				out = append(out, s)
+			}
+			if err == nil {
+				err = rows.Err()
+			}
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			writeJSON(w, http.StatusOK, map[string]any{"query": q, "suggestions": []suggestion{}, "timed_out": true})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		writeJSON(w, http.StatusOK, map[string]any{"query": q, "suggestions": out})
+	}
+}
+
+type relatedMovie struct {
+	Movie        Movie    `json:"movie"`
+	SharedGenres []string `json:"shared_genres"`
+	Score        int      `json:"score"`
+}
+
+// GET /movies/{id}/related?limit=10
+//
+// "More like this": movies sharing the most genres with the given one.
+// Ties go to the closer release year, then the higher rating. Movies don't
+// record their cast, so genres are all there is to go on.
+func relatedMovies(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		limit := 10
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > 50 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 50"})
+				return
+			}
+			limit = n
+		}
+		ctx := r.Context()
+
+		var (
+			genres []string
+			year   sql.NullInt64
+		)
+		err := db.QueryRowContext(ctx, `
+			SELECT genres, year FROM movies WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL`,
+			id, tenantFrom(ctx)).Scan(pq.Array(&genres), &year)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		out := []relatedMovie{}
+		rows, err := db.QueryContext(ctx, `
+			SELECT `+movieColumns+`, shared FROM (
+				SELECT *, ARRAY(SELECT unnest(genres) INTERSECT SELECT unnest($3::text[]) ORDER BY 1) AS shared
+				FROM movies
+				WHERE tenant_id=$2 AND deleted_at IS NULL AND id<>$1 AND genres && $3
+			) m
+			ORDER BY cardinality(shared) DESC, abs(year - $4::int) NULLS LAST, rating DESC NULLS LAST, id
+			LIMIT $5`, id, tenantFrom(ctx), pq.Array(genres), year, limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var rm relatedMovie
+			m, err := scanMovie(rows, pq.Array(&rm.SharedGenres))
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			rm.Movie, rm.Score = m, len(rm.SharedGenres)
+			out = append(out, rm)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"movie_id": id, "related": out})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchHTTP is the JSON-over-HTTP plumbing both engines share.
+type searchHTTP struct {
+	base   string
+	auth   string // Authorization header value
+	client *http.Client
+}
+
+func newSearchHTTP(base, auth string) searchHTTP {
+	return searchHTTP{base: strings.TrimSuffix(base, "/"), auth: auth, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// do sends body (JSON unless contentType says otherwise) and decodes a 2xx
+// answer into out. Statuses in ok are accepted too.
+func (h searchHTTP) do(ctx context.Context, method, path, contentType string, body []byte, out any, ok ...int) error {
+	req, err := http.NewRequestWithContext(ctx, method, h.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if h.auth != "" {
+		req.Header.Set("Authorization", h.auth)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	accepted := resp.StatusCode/100 == 2
+	for _, code := range ok {
+		accepted = accepted || resp.StatusCode == code
+	}
+	if !accepted {
+		if len(raw) > 300 {
+			raw = raw[:300]
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, raw)
+	}
+	if out == nil || resp.StatusCode/100 != 2 {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// elasticsearchIndex mirrors movies into an Elasticsearch (or OpenSearch)
+// index, created with its mapping on first use.
+type elasticsearchIndex struct {
+	http  searchHTTP
+	index string
+}
+
+func newElasticsearchIndex(url, index, apiKey string) *elasticsearchIndex {
+	auth := ""
+	if apiKey != "" {
+		auth = "ApiKey " + apiKey
+	}
+	return &elasticsearchIndex{http: newSearchHTTP(url, auth), index: index}
+}
+
+func (es *elasticsearchIndex) name() string { return searchElasticsearch }
+
+func (es *elasticsearchIndex) setup(ctx context.Context) error {
+	mapping := map[string]any{"mappings": map[string]any{"properties": map[string]any{
+		"key":           map[string]string{"type": "keyword"},
+		"tenant_id":     map[string]string{"type": "long"},
+		"movie_id":      map[string]string{"type": "long"},
+		"title":         map[string]string{"type": "text"},
+		"titles":        map[string]string{"type": "text"},
+		"tags":          map[string]string{"type": "text"},
+		"genres":        map[string]string{"type": "keyword"},
+		"certification": map[string]string{"type": "keyword"},
+		"year":          map[string]string{"type": "integer"},
+		"rating":        map[string]string{"type": "float"},
+		"updated_at":    map[string]string{"type": "date"},
+	}}}
+	body, _ := json.Marshal(mapping)
+	// 400 is resource_already_exists_exception: the index is there.
+	return es.http.do(ctx, http.MethodPut, "/"+es.index, "", body, nil, http.StatusBadRequest)
+}
+
+func (es *elasticsearchIndex) sync(ctx context.Context, upserts []searchDocument, removals []string) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, d := range upserts {
+		enc.Encode(map[string]any{"index": map[string]string{"_index": es.index, "_id": d.Key}})
+		enc.Encode(d)
+	}
+	for _, key := range removals {
+		enc.Encode(map[string]any{"delete": map[string]string{"_index": es.index, "_id": key}})
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := es.http.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", b.Bytes(), &resp); err != nil {
+		return err
+	}
+	if resp.Errors {
+		for _, item := range resp.Items {
+			for _, res := range item {
+				if len(res.Error) > 0 {
+					return fmt.Errorf("bulk item %d: %s", res.Status, res.Error)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (es *elasticsearchIndex) search(ctx context.Context, q searchQuery) (searchPage, error) {
+	must := []any{map[string]any{"match_all": map[string]any{}}}
+	if q.Text != "" {
+		must = []any{map[string]any{"multi_match": map[string]any{
+			"query": q.Text, "fields": []string{"title^3", "titles^2", "tags"}, "fuzziness": "AUTO",
+		}}}
+	}
+	filter := []any{map[string]any{"term": map[string]any{"tenant_id": q.Tenant}}}
+	if q.Genre != "" {
+		filter = append(filter, map[string]any{"term": map[string]any{"genres": q.Genre}})
+	}
+	if q.Certification != "" {
+		filter = append(filter, map[string]any{"term": map[string]any{"certification": q.Certification}})
+	}
+	if q.YearMin != 0 || q.YearMax != 0 {
+		years := map[string]int{}
+		if q.YearMin != 0 {
+			years["gte"] = q.YearMin
+		}
+		if q.YearMax != 0 {
+			years["lte"] = q.YearMax
+		}
+		filter = append(filter, map[string]any{"range": map[string]any{"year": years}})
+	}
+	aggs := map[string]any{}
+	for _, f := range searchFacets {
+		aggs[f] = map[string]any{"terms": map[string]any{"field": f, "size": 100}}
+	}
+	body, _ := json.Marshal(map[string]any{
+		"from": q.Offset, "size": q.Limit, "_source": []string{"movie_id"}, "track_total_hits": true,
+		"query": map[string]any{"bool": map[string]any{"must": must, "filter": filter}},
+		"aggs":  aggs,
+	})
+
+	var resp struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Source struct {
+					MovieID int64 `json:"movie_id"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+		Aggregations map[string]struct {
+			Buckets []struct {
+				Key      any `json:"key"`
+				DocCount int `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"aggregations"`
+	}
+	if err := es.http.do(ctx, http.MethodPost, "/"+es.index+"/_search", "", body, &resp); err != nil {
+		return searchPage{}, err
+	}
+	page := searchPage{Total: resp.Hits.Total.Value, Facets: map[string]map[string]int{}}
+	for _, h := range resp.Hits.Hits {
+		page.IDs = append(page.IDs, h.Source.MovieID)
+	}
+	for name, agg := range resp.Aggregations {
+		counts := map[string]int{}
+		for _, bucket := range agg.Buckets {
+			counts[fmt.Sprint(bucket.Key)] = bucket.DocCount
+		}
+		page.Facets[name] = counts
+	}
+	return page, nil
+}
+
+// meilisearchIndex mirrors movies into a Meilisearch index. Typo tolerance
+// is Meilisearch's default; setup makes the facets filterable.
+type meilisearchIndex struct {
+	http  searchHTTP
+	index string
+}
+
+func newMeilisearchIndex(url, index, apiKey string) *meilisearchIndex {
+	auth := ""
+	if apiKey != "" {
+		auth = "Bearer " + apiKey
+	}
+	return &meilisearchIndex{http: newSearchHTTP(url, auth), index: index}
+}
+
+func (ms *meilisearchIndex) name() string { return searchMeilisearch }
+
+func (ms *meilisearchIndex) setup(ctx context.Context) error {
+	body, _ := json.Marshal(map[string]any{
+		"searchableAttributes": []string{"title", "titles", "tags"},
+		"filterableAttributes": append([]string{"tenant_id"}, searchFacets...),
+	})
+	return ms.http.do(ctx, http.MethodPatch, "/indexes/"+ms.index+"/settings", "", body, nil)
+}
+
+// Writes are queued as Meilisearch tasks; they are not awaited, so a
+// change shows up in results a moment after it is synced.
+func (ms *meilisearchIndex) sync(ctx context.Context, upserts []searchDocument, removals []string) error {
+	if len(upserts) > 0 {
+		body, _ := json.Marshal(upserts)
+		if err := ms.http.do(ctx, http.MethodPost, "/indexes/"+ms.index+"/documents?primaryKey=key", "", body, nil); err != nil {
+			return err
+		}
+	}
+	if len(removals) > 0 {
+		body, _ := json.Marshal(removals)
+		if err := ms.http.do(ctx, http.MethodPost, "/indexes/"+ms.index+"/documents/delete-batch", "", body, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// meiliString quotes s for a Meilisearch filter expression.
+func meiliString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (ms *meilisearchIndex) search(ctx context.Context, q searchQuery) (searchPage, error) {
+	filter := []string{"tenant_id = " + strconv.FormatInt(q.Tenant, 10)}
+	if q.Genre != "" {
+		filter = append(filter, "genres = "+meiliString(q.Genre))
+	}
+	if q.Certification != "" {
+		filter = append(filter, "certification = "+meiliString(q.Certification))
+	}
+	if q.YearMin != 0 {
+		filter = append(filter, "year >= "+strconv.Itoa(q.YearMin))
+	}
+	if q.YearMax != 0 {
+		filter = append(filter, "year <= "+strconv.Itoa(q.YearMax))
+	}
+	body, _ := json.Marshal(map[string]any{
+		"q": q.Text, "filter": filter, "facets": searchFacets, "limit": q.Limit, "offset": q.Offset,
+		"attributesToRetrieve": []string{"movie_id"},
+	})
+
+	var resp struct {
+		Hits []struct {
+			MovieID int64 `json:"movie_id"`
+		} `json:"hits"`
+		EstimatedTotalHits int                       `json:"estimatedTotalHits"`
+		FacetDistribution  map[string]map[string]int `json:"facetDistribution"`
+	}
+	if err := ms.http.do(ctx, http.MethodPost, "/indexes/"+ms.index+"/search", "", body, &resp); err != nil {
+		return searchPage{}, err
+	}
+	page := searchPage{Total: resp.EstimatedTotalHits, Facets: resp.FacetDistribution}
+	if page.Facets == nil {
+		page.Facets = map[string]map[string]int{}
+	}
+	for _, h := range resp.Hits {
+		page.IDs = append(page.IDs, h.MovieID)
+	}
+	return page, nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SEARCH_ENGINE values.
+const (
+	searchElasticsearch = "elasticsearch"
+	searchMeilisearch   = "meilisearch"
+)
+
+// searchFacets are the document fields GET /search counts results by.
+var searchFacets = []string{"genres", "certification", "year"}
+
+// searchBatch is how many outbox rows one pass of the indexer claims.
+const searchBatch = 100
+
+// searchDocument is a movie as the external index stores it. Key is unique
+// across tenants, which share the index.
+type searchDocument struct {
+	Key           string    `json:"key"`
+	TenantID      int64     `json:"tenant_id"`
+	MovieID       int64     `json:"movie_id"`
+	Title         string    `json:"title"`
+	Titles        []string  `json:"titles"` // translated titles
+	Tags          []string  `json:"tags"`
+	Genres        []string  `json:"genres"`
+	Certification string    `json:"certification,omitempty"`
+	Year          int       `json:"year,omitempty"`
+	Rating        *float64  `json:"rating,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func searchKey(tenant, movieID int64) string {
+	return strconv.FormatInt(tenant, 10) + "-" + strconv.FormatInt(movieID, 10)
+}
+
+type searchQuery struct {
+	Tenant        int64
+	Text          string
+	Genre         string
+	Certification string
+	YearMin       int
+	YearMax       int
+	Limit         int
+	Offset        int
+}
+
+// searchPage is one page of hits, best first, with the facet counts of
+// all of them.
+type searchPage struct {
+	IDs    []int64
+	Total  int
+	Facets map[string]map[string]int
+}
+
+// searchIndex is an external search engine holding a copy of the catalog.
+type searchIndex interface {
+	name() string
+	// setup creates the index or updates its settings; it is safe to
+	// repeat.
+	setup(ctx context.Context) error
+	sync(ctx context.Context, upserts []searchDocument, removals []string) error
+	search(ctx context.Context, q searchQuery) (searchPage, error)
+}
+
+// newSearchIndex is the configured engine, or nil when SEARCH_ENGINE is
+// unset and /search runs on Postgres.
+func newSearchIndex(cfg config) searchIndex {
+	switch cfg.SearchEngine {
+	case searchElasticsearch:
+		return newElasticsearchIndex(cfg.SearchURL, cfg.SearchIndex, cfg.SearchAPIKey)
+	case searchMeilisearch:
+		return newMeilisearchIndex(cfg.SearchURL, cfg.SearchIndex, cfg.SearchAPIKey)
+	}
+	return nil
+}
+
+// queueSearchSync marks a movie for the indexer, in x's transaction so the
+// index only hears of changes that commit.
+func queueSearchSync(ctx context.Context, x execer, tenant, movieID int64) error {
+	_, err := x.ExecContext(ctx, `INSERT INTO search_outbox (tenant_id, movie_id) VALUES ($1, $2)`, tenant, movieID)
+	return err
+}
+
+// runSearchIndexer works through the search outbox, mirroring each queued
+// movie's current state into idx. Without an engine it just empties the
+// outbox; POST /admin/search/reindex fills a new index.
+func runSearchIndexer(db *sql.DB, idx searchIndex) {
+	ctx := context.Background()
+	for idx != nil {
+		err := idx.setup(ctx)
+		if err == nil {
+			break
+		}
+		log.Printf("search indexer: setting up %s: %v", idx.name(), err)
+		time.Sleep(30 * time.Second)
+	}
+	for {
+		n, err := syncSearchIndex(ctx, db, idx)
+		if err != nil {
+			log.Printf("search indexer: %v", err)
+		}
+		if err != nil || n < searchBatch {
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
+
+// syncSearchIndex handles one batch of the outbox and returns its size.
+func syncSearchIndex(ctx context.Context, db *sql.DB, idx searchIndex) (int, error) {
+	// Claim the batch for a minute, as the mailer does.
+	rows, err := db.QueryContext(ctx, `
+		UPDATE search_outbox SET next_attempt_at = now() + interval '1 minute'
+		WHERE id IN (
+			SELECT id FROM search_outbox
+			WHERE next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, tenant_id, movie_id`, searchBatch)
+	if err != nil {
+		return 0, err
+	}
+	type target struct{ tenant, movie int64 }
+	var (
+		ids     []int64
+		targets []target
+		seen    = map[target]bool{}
+	)
+	for rows.Next() {
+		var (
+			id int64
+			t  target
+		)
+		if err := rows.Scan(&id, &t.tenant, &t.movie); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		// A movie edited several times is synced once.
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	var serr error
+	if idx != nil {
+		var (
+			upserts  []searchDocument
+			removals []string
+		)
+		for _, t := range targets {
+			d, ok, err := loadSearchDocument(ctx, db, t.tenant, t.movie)
+			if err != nil {
+				serr = err
+				break
+			}
+			if ok {
+				upserts = append(upserts, d)
+			} else {
+				removals = append(removals, searchKey(t.tenant, t.movie))
+			}
+		}
+		if serr == nil {
+			syncCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			serr = idx.sync(syncCtx, upserts, removals)
+			cancel()
+		}
+	}
+	if serr != nil {
+		// Back off 30s, 1m, 2m, ... up to ten minutes; the index is a copy,
+		// so rows are retried until the engine is back rather than dropped.
+		_, err = db.ExecContext(ctx, `
+			UPDATE search_outbox
+			SET attempts=attempts+1, last_error=$2,
+				next_attempt_at=now() + make_interval(secs => least(30 * power(2, attempts), 600))
+			WHERE id = ANY($1)`, pq.Array(ids), serr.Error())
+		if err != nil {
+			return len(ids), err
+		}
+		return len(ids), serr
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM search_outbox WHERE id = ANY($1)`, pq.Array(ids))
+	return len(ids), err
+}
+
+// loadSearchDocument reads a movie with its tags and translated titles. It
+// reports false for movies that are deleted or gone, which leave the index.
+func loadSearchDocument(ctx context.Context, db *sql.DB, tenant, movieID int64) (searchDocument, bool, error) {
+	// Movies are the tenant's, which in schema mode means its schema.
+	ctx = context.WithValue(ctx, ctxTenant, tenantScope{id: tenant})
+	d := searchDocument{Key: searchKey(tenant, movieID), TenantID: tenant, MovieID: movieID}
+	var (
+		year sql.NullInt64
+		cert sql.NullString
+	)
+	err := db.QueryRowContext(ctx, `
+		SELECT m.title, m.genres, m.certification, m.year, m.rating, m.updated_at,
+			ARRAY(SELECT t.name FROM movie_tags mt JOIN tags t ON t.id = mt.tag_id
+				WHERE mt.movie_id = m.id AND mt.tenant_id = m.tenant_id ORDER BY t.name),
+			ARRAY(SELECT tr.title FROM movie_translations tr
+				WHERE tr.movie_id = m.id AND tr.tenant_id = m.tenant_id AND tr.title IS NOT NULL ORDER BY tr.language)
+		FROM movies m WHERE m.id=$1 AND m.tenant_id=$2 AND m.deleted_at IS NULL`, movieID, tenant).
+		Scan(&d.Title, pq.Array(&d.Genres), &cert, &year, &d.Rating, &d.UpdatedAt, pq.Array(&d.Tags), pq.Array(&d.Titles))
+	if err == sql.ErrNoRows {
+		return searchDocument{}, false, nil
+	}
+	if err != nil {
+		return searchDocument{}, false, err
+	}
+	d.Year, d.Certification = int(year.Int64), cert.String
+	return d, true, nil
+}
+
+// postgresSearch answers a search from the database: full-text matches and
+// trigram-similar titles, ranked by both, with facets counted over every
+// match.
+func postgresSearch(ctx context.Context, db *sql.DB, q searchQuery) (searchPage, error) {
+	var wc whereClause
+	wc.add("tenant_id = ?", q.Tenant)
+	wc.add("deleted_at IS NULL")
+	order := "id"
+	if q.Text != "" {
+		p := wc.arg(q.Text)
+		wc.add("(search @@ websearch_to_tsquery('english', " + p + ") OR title % " + p + ")")
+		order = "ts_rank(search, websearch_to_tsquery('english', " + p + ")) + similarity(title, " + p + ") DESC, id"
+	}
+	if q.Genre != "" {
+		wc.add("? = ANY(genres)", q.Genre)
+	}
+	if q.Certification != "" {
+		wc.add("certification = ?", q.Certification)
+	}
+	if q.YearMin != 0 {
+		wc.add("year >= ?", q.YearMin)
+	}
+	if q.YearMax != 0 {
+		wc.add("year <= ?", q.YearMax)
+	}
+
+	where, args := wc.String(), wc.args
+	page := searchPage{Facets: map[string]map[string]int{}}
+	rows, err := db.QueryContext(ctx, `
+		SELECT id FROM movies WHERE `+where+`
+		ORDER BY `+order+`
+		LIMIT `+wc.arg(q.Limit)+` OFFSET `+wc.arg(q.Offset), wc.args...)
+	if err != nil {
+		return searchPage{}, err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return searchPage{}, err
+		}
+		page.IDs = append(page.IDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return searchPage{}, err
+	}
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM movies WHERE `+where, args...).Scan(&page.Total); err != nil {
+		return searchPage{}, err
+	}
+
+	for _, f := range []struct{ name, expr string }{
+		{"genres", "unnest(genres)"},
+		{"certification", "certification"},
+		{"year", "year::text"},
+	} {
+		rows, err := db.QueryContext(ctx, `
+			SELECT v, count(*) FROM (SELECT `+f.expr+` AS v FROM movies WHERE `+where+`) f
+			WHERE v IS NOT NULL GROUP BY v`, args...)
+		if err != nil {
+			return searchPage{}, err
+		}
+		counts := map[string]int{}
+		for rows.Next() {
+			var (
+				v string
+				n int
+			)
+			if err := rows.Scan(&v, &n); err != nil {
+				rows.Close()
+				return searchPage{}, err
+			}
+			counts[v] = n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return searchPage{}, err
+		}
+		page.Facets[f.name] = counts
+	}
+	return page, nil
+}
+
+// GET /search?q=...&genre=&certification=&year_min=&year_max=&limit=20&offset=0
+//
+// Catalog search with facets. With SEARCH_ENGINE set it asks the external
+// index, which tolerates typos and weighs titles over translated titles and
+// tags; otherwise, or if the engine is unreachable, Postgres answers. The
+// response's "engine" says which did. q may be empty to browse by facet.
+// Hits are read back from the database, so they show the movie as it is
+// now even before the index catches up.
+func searchCatalog(db *sql.DB, refs *refData, idx searchIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		q := searchQuery{
+			Tenant:        tenantFrom(r.Context()),
+			Text:          strings.TrimSpace(v.Get("q")),
+			Genre:         v.Get("genre"),
+			Certification: v.Get("certification"),
+			Limit:         20,
+		}
+		msg := ""
+		if q.Genre != "" && !refs.hasGenre(q.Genre) {
+			msg = unknownGenreMessage(refs, q.Genre)
+		}
+		if q.Certification != "" && !refs.hasCertification(q.Certification) {
+			msg = "unknown certification: " + q.Certification
+		}
+		for _, p := range []struct {
+			name     string
+			dst      *int
+			min, max int
+		}{
+			{"year_min", &q.YearMin, 1, 9999},
+			{"year_max", &q.YearMax, 1, 9999},
+			{"limit", &q.Limit, 1, 100},
+			{"offset", &q.Offset, 0, 10000},
+		} {
+			if s := v.Get(p.name); s != "" && msg == "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < p.min || n > p.max {
+					msg = fmt.Sprintf("%s must be between %d and %d", p.name, p.min, p.max)
+				}
+				*p.dst = n
+			}
+		}
+		if msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+
+		engine := "postgres"
+		var (
+			page searchPage
+			err  error
+		)
+		if idx != nil {
+			ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+			page, err = idx.search(ctx, q)
+			cancel()
+			if err == nil {
+				engine = idx.name()
+			} else {
+				log.Printf("search: %s failed, using postgres: %v", idx.name(), err)
+			}
+		}
+		if engine == "postgres" {
+			page, err = postgresSearch(r.Context(), db, q)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT `+movieColumns+` FROM movies
+			WHERE id = ANY($1) AND tenant_id=$2 AND deleted_at IS NULL`, pq.Array(page.IDs), q.Tenant)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+		found := map[int64]Movie{}
+		for rows.Next() {
+			m, err := scanMovie(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			found[m.ID] = m
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		// Keep the engine's order; hits deleted since they were indexed drop
+		// out.
+		results := []any{}
+		for _, id := range page.IDs {
+			if m, ok := found[id]; ok {
+				results = append(results, withLinks(m, movieLinks(r, m)))
+			}
+		}
+		for _, f := range searchFacets {
+			if page.Facets[f] == nil {
+				page.Facets[f] = map[string]int{}
+			}
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"query":   q.Text,
+			"engine":  engine,
+			"total":   page.Total,
+			"results": results,
+			"facets":  page.Facets,
+		})
+	}
+}
+
+// POST /admin/search/reindex
+//
+// Queues every movie of the tenant for the search indexer, to fill a new
+// index or repair one. Deleted movies are queued too, so they leave it.
+func adminReindexSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := db.ExecContext(r.Context(), `
+			INSERT INTO search_outbox (tenant_id, movie_id)
+			SELECT tenant_id, id FROM movies WHERE tenant_id=$1`, tenantFrom(r.Context()))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		n, _ := res.RowsAffected()
+		writeJSON(w, http.StatusAccepted, map[string]any{"queued": n})
+	}
+}
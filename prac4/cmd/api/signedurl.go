@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signedLinkTTL is how long a signed URL is valid. Fetching the job again
+// gives a fresh one.
+const signedLinkTTL = time.Hour
+
+// urlSignature signs a URL of path valid until expires.
+//
+// Signed URLs let a file be fetched without credentials, by a warehouse
+// loader, a partner or a CDN in front of the API, so bearer tokens never
+// end up in query strings or access logs. Each file has its own key, kept
+// with its job, and the signature covers the path and the expiry: a link
+// opens nothing but that file, and nothing once it expires or the job is
+// deleted.
+func urlSignature(key []byte, path string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedLink is the URL of path signed with key. It is valid for
+// signedLinkTTL, or until until if that is sooner.
+func signedLink(r *http.Request, path string, key []byte, until time.Time) string {
+	expires := time.Now().Add(signedLinkTTL)
+	if until.Before(expires) {
+		expires = until
+	}
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("signature", urlSignature(key, path, expires.Unix()))
+	return linkTo(r, path).Href + "?" + q.Encode()
+}
+
+// signedUntil checks the signature of r against key, and returns when the
+// link expires; ok is false if it's invalid or has expired.
+func signedUntil(r *http.Request, key []byte) (expires time.Time, ok bool) {
+	q := r.URL.Query()
+	unix, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(q.Get("signature")), []byte(urlSignature(key, r.URL.Path, unix))) {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+// serveSigned sets the caching headers of a file served from a signed
+// URL. Shared caches may keep it until the link expires, but no longer,
+// so a CDN can't hand it out past the expiry.
+func serveSigned(w http.ResponseWriter, expires time.Time) {
+	maxAge := int64(time.Until(expires).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(maxAge, 10))
+	w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+}
+
+// signedDownloads are the routes authorized by their URL's signature
+// rather than by credentials, as path prefix and suffix around a job id.
+var signedDownloads = [][2]string{
+	{"/exports/", "/download"},
+	{"/imports/", "/errors"},
+}
+
+// isSignedDownload reports whether path is that of a signed download.
+func isSignedDownload(path string) bool {
+	for _, d := range signedDownloads {
+		rest, ok := strings.CutPrefix(path, d[0])
+		if !ok {
+			continue
+		}
+		if id, ok := strings.CutSuffix(rest, d[1]); ok && id != "" && !strings.Contains(id, "/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signed requests let a partner authenticate with a personal access token
+// without ever sending it: the request carries
+//
+//	X-Signature: keyId=<token id>,ts=<unix seconds>,nonce=<random>,sig=<hex>
+//
+// where sig is HMAC-SHA256, keyed with the token's signing key, over
+//
+//	METHOD \n REQUEST-URI \n ts \n nonce \n hex(SHA-256(body))
+//
+// The signing key is HMAC-SHA256(SIGNING_SECRET, token id), handed out with
+// the token. It is derived rather than stored, and nothing in the database
+// gives it away: a leaked tokens table lets no one sign. The timestamp must
+// be within the window and each nonce is accepted once.
+const signatureHeader = "X-Signature"
+
+// maxSignedBody bounds the body buffered for verification.
+const maxSignedBody = 10 << 20
+
+type requestSigner struct {
+	db     *sql.DB
+	window time.Duration
+	secret []byte
+}
+
+func newRequestSigner(db *sql.DB, cfg config) *requestSigner {
+	return &requestSigner{db: db, window: cfg.SignatureWindow, secret: []byte(cfg.SigningSecret)}
+}
+
+// enabled reports whether SIGNING_SECRET is set.
+func (s *requestSigner) enabled() bool {
+	return len(s.secret) > 0
+}
+
+// key is the signing key of the personal access token tokenID.
+func (s *requestSigner) key(tokenID int64) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("request-signing\n" + strconv.FormatInt(tokenID, 10)))
+	return mac.Sum(nil)
+}
+
+type signatureError struct {
+	status int
+	msg    string
+}
+
+func (e *signatureError) Error() string { return e.msg }
+
+func badSignature(msg string) error {
+	return &signatureError{http.StatusUnauthorized, msg}
+}
+
+// verify checks r's signature and returns the hash of the signing token for
+// authenticate to look up like a bearer token. The body is buffered and put
+// back for the handler.
+func (s *requestSigner) verify(r *http.Request) ([]byte, error) {
+	if !s.enabled() {
+		return nil, badSignature("signed requests are not enabled")
+	}
+	params := map[string]string{}
+	for _, part := range strings.Split(r.Header.Get(signatureHeader), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		params[k] = v
+	}
+	keyID, err := strconv.ParseInt(params["keyId"], 10, 64)
+	if err != nil {
+		return nil, badSignature("signature has no valid keyId")
+	}
+	ts, err := strconv.ParseInt(params["ts"], 10, 64)
+	if err != nil {
+		return nil, badSignature("signature has no valid ts")
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > s.window || d < -s.window {
+		return nil, badSignature("signature timestamp outside the allowed window")
+	}
+	nonce := params["nonce"]
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return nil, badSignature("signature nonce must be 16 to 128 characters")
+	}
+	sig, err := hex.DecodeString(params["sig"])
+	if err != nil || len(sig) == 0 {
+		return nil, badSignature("signature has no valid sig")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil {
+		return nil, badSignature("could not read body")
+	}
+	if len(body) > maxSignedBody {
+		return nil, &signatureError{http.StatusRequestEntityTooLarge, "signed request bodies are limited to 10 MiB"}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var hash []byte
+	err = s.db.QueryRowContext(r.Context(), `SELECT hash FROM tokens WHERE id=$1 AND kind='personal'`, keyID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, badSignature("invalid signature")
+	}
+	if err != nil {
+		return nil, err
+	}
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, s.key(keyID))
+	mac.Write([]byte(strings.Join([]string{r.Method, r.URL.RequestURI(), params["ts"], nonce, hex.EncodeToString(bodySum[:])}, "\n")))
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return nil, badSignature("invalid signature")
+	}
+
+	res, err := s.db.ExecContext(r.Context(), `
+		INSERT INTO signature_nonces (token_id, nonce, expires_at)
+		VALUES ($1, $2, now() + make_interval(secs => $3))
+		ON CONFLICT DO NOTHING`, keyID, nonce, 2*s.window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, badSignature("signature nonce already used")
+	}
+	return hash, nil
+}
+
+// prune forgets nonces that can no longer pass the timestamp check.
+func (s *requestSigner) prune(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := s.db.Exec(`DELETE FROM signature_nonces WHERE expires_at < now()`); err != nil {
+			log.Printf("prune signature nonces: %v", err)
+		}
+	}
+}
+
+func signatureStatus(err error) (int, bool) {
+	var se *signatureError
+	if errors.As(err, &se) {
+		return se.status, true
+	}
+	return 0, false
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type countBy[K any] struct {
+	Key   K   `json:"key"`
+	Count int `json:"count"`
+}
+
+type movieStats struct {
+	Totals struct {
+		Movies        int      `json:"movies"`
+		WithYear      int      `json:"with_year"`
+		WithRating    int      `json:"with_rating"`
+		AverageRating *float64 `json:"average_rating"`
+	} `json:"totals"`
+	ByYear   []countBy[int]    `json:"by_year"`
+	ByGenre  []countBy[string] `json:"by_genre"`
+	ByRating []countBy[string] `json:"by_rating"`
+	Recent   []Movie           `json:"recent"`
+
+	// Freshness covers the aggregates; Recent is always live.
+	Freshness *freshness `json:"freshness"`
+}
+
+// parseTimeParam accepts either a date (2024-01-31) or an RFC 3339 timestamp.
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// GET /stats/movies?from=2024-01-01&to=2024-02-01
+//
+// Aggregates for the admin dashboard. from/to restrict the movies counted by
+// when they were added (to is exclusive). Without a range the aggregates
+// come from the movie_stats view, refreshed every STATS_REFRESH_INTERVAL;
+// with one, or before the view's first refresh, they are computed live.
+// The aggregate queries are independent, so they run concurrently.
+func movieStatsHandler(db *sql.DB, views []matView) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			where = []string{"tenant_id = $1"}
+			args  = []any{tenantFrom(r.Context())}
+		)
+		for _, p := range []struct{ name, cond string }{
+			{"from", "created_at >= $%d"},
+			{"to", "created_at < $%d"},
+		} {
+			v := r.URL.Query().Get(p.name)
+			if v == "" {
+				continue
+			}
+			t, err := parseTimeParam(v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": p.name + " must be a date or RFC 3339 timestamp"})
+				return
+			}
+			args = append(args, t)
+			where = append(where, fmt.Sprintf(p.cond, len(args)))
+		}
+		filter := strings.Join(append(where, "deleted_at IS NULL"), " AND ")
+
+		var st movieStats
+		st.Freshness = liveFreshness
+		if len(args) == 1 {
+			f, err := viewFreshness(r.Context(), db, views, matViewStats)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if f.ComputedAt != nil {
+				st.Freshness = f
+			}
+		}
+		g, ctx := errgroup.WithContext(r.Context())
+		g.SetLimit(includeParallelism)
+
+		if st.Freshness.Source == "materialized" {
+			g.Go(func() error { return materializedStats(ctx, db, args[0], &st) })
+		} else {
+			liveStats(ctx, g, db, filter, args, &st)
+		}
+		g.Go(func() error {
+			rows, err := db.QueryContext(ctx, `
+				SELECT `+movieColumns+` FROM movies
+				WHERE `+filter+`
+				ORDER BY created_at DESC, id DESC LIMIT 5`, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			st.Recent = []Movie{}
+			for rows.Next() {
+				m, err := scanMovie(rows)
+				if err != nil {
+					return err
+				}
+				st.Recent = append(st.Recent, m)
+			}
+			return rows.Err()
+		})
+
+		if err := g.Wait(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// liveStats queues the aggregate queries over the movies matching filter.
+func liveStats(ctx context.Context, g *errgroup.Group, db *sql.DB, filter string, args []any, st *movieStats) {
+	g.Go(func() error {
+		t := &st.Totals
+		return db.QueryRowContext(ctx, `
+			SELECT count(*), count(year), count(rating), avg(rating)::float8
+			FROM movies WHERE `+filter, args...).Scan(&t.Movies, &t.WithYear, &t.WithRating, &t.AverageRating)
+	})
+	g.Go(func() (err error) {
+		st.ByYear, err = queryCounts[int](ctx, db, `
+			SELECT year, count(*) FROM movies
+			WHERE year IS NOT NULL AND `+filter+`
+			GROUP BY year ORDER BY year`, args...)
+		return err
+	})
+	g.Go(func() (err error) {
+		st.ByGenre, err = queryCounts[string](ctx, db, `
+			SELECT g, count(*) FROM movies, unnest(genres) AS g
+			WHERE `+filter+`
+			GROUP BY g ORDER BY count(*) DESC, g`, args...)
+		return err
+	})
+	g.Go(func() error {
+		// One-point buckets; a perfect 10 falls into 9-10.
+		buckets, err := queryCounts[int](ctx, db, `
+			SELECT LEAST(floor(rating), 9)::int AS bucket, count(*) FROM movies
+			WHERE rating IS NOT NULL AND `+filter+`
+			GROUP BY bucket ORDER BY bucket`, args...)
+		st.ByRating = make([]countBy[string], len(buckets))
+		for i, b := range buckets {
+			st.ByRating[i] = countBy[string]{Key: strconv.Itoa(b.Key) + "-" + strconv.Itoa(b.Key+1), Count: b.Count}
+		}
+		return err
+	})
+}
+
+// materializedStats reads the aggregates for tenant from movie_stats. The
+// view holds the same groupings as liveStats, as one row per key, and is
+// read in the same order: years and rating buckets by key, genres by count.
+func materializedStats(ctx context.Context, db *sql.DB, tenant any, st *movieStats) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT dimension, key, value FROM movie_stats WHERE tenant_id = $1
+		ORDER BY dimension, CASE WHEN dimension IN ('year', 'rating') THEN key::int END, value DESC, key`, tenant)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	st.ByYear, st.ByGenre, st.ByRating = []countBy[int]{}, []countBy[string]{}, []countBy[string]{}
+	for rows.Next() {
+		var (
+			dim, key string
+			value    sql.NullFloat64
+		)
+		if err := rows.Scan(&dim, &key, &value); err != nil {
+			return err
+		}
+		n := int(value.Float64)
+		switch dim {
+		case "total":
+			t := &st.Totals
+			switch key {
+			case "movies":
+				t.Movies = n
+			case "with_year":
+				t.WithYear = n
+			case "with_rating":
+				t.WithRating = n
+			case "average_rating":
+				if value.Valid {
+					t.AverageRating = &value.Float64
+				}
+			}
+		case "year":
+			year, _ := strconv.Atoi(key)
+			st.ByYear = append(st.ByYear, countBy[int]{Key: year, Count: n})
+		case "genre":
+			st.ByGenre = append(st.ByGenre, countBy[string]{Key: key, Count: n})
+		case "rating":
+			b, _ := strconv.Atoi(key)
+			st.ByRating = append(st.ByRating, countBy[string]{Key: strconv.Itoa(b) + "-" + strconv.Itoa(b+1), Count: n})
+		}
+	}
+	return rows.Err()
+}
+
+func queryCounts[K any](ctx context.Context, db *sql.DB, query string, args ...any) ([]countBy[K], error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []countBy[K]{}
+	for rows.Next() {
+		var c countBy[K]
+		if err := rows.Scan(&c.Key, &c.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
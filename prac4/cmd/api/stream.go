@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// streamFlushEvery is how many elements are written between flushes.
+const streamFlushEvery = 500
+
+// ndjsonMediaType is newline-delimited JSON: one value per line.
+const ndjsonMediaType = "application/x-ndjson"
+
+// rowFormat is how a stream of rows is laid out: a JSON array, or NDJSON.
+// Every row is encoded on a line of its own either way.
+type rowFormat struct {
+	contentType string
+	ext         string
+	open        string // before the first row
+	sep         string // between rows
+	close       string // after the last row
+}
+
+var (
+	jsonRows   = rowFormat{contentType: "application/json", ext: "json", open: "[", sep: ",", close: "]\n"}
+	ndjsonRows = rowFormat{contentType: ndjsonMediaType, ext: "ndjson"}
+	// parquetRows is written by movieParquet rather than laid out as text.
+	parquetRows = rowFormat{contentType: parquetMediaType, ext: "parquet"}
+)
+
+// exportFormats are the formats of GET /movies/export and export jobs, by
+// name.
+var exportFormats = map[string]rowFormat{"json": jsonRows, "ndjson": ndjsonRows, "parquet": parquetRows}
+
+// streamJSONArray writes rows as a JSON array one element at a time; see
+// streamRows.
+func streamJSONArray[T any](w http.ResponseWriter, r *http.Request, rows *sql.Rows, scan func(rowScanner) (T, error)) {
+	streamRows(w, r, rows, scan, jsonRows)
+}
+
+// streamRows writes rows in format f one at a time, so memory stays flat
+// however many rows there are. The status line is held back until the
+// first row arrives, so a query that fails up front still gets a proper
+// 500; a failure mid-stream aborts the connection, leaving the client with
+// truncated output rather than a silently short list.
+func streamRows[T any](w http.ResponseWriter, r *http.Request, rows *sql.Rows, scan func(rowScanner) (T, error), f rowFormat) {
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	stringIDs := wantsStringIDs(w)
+	n := 0
+	for rows.Next() {
+		v, err := scan(rows)
+		if err != nil {
+			failStream(w, r, n, err)
+			return
+		}
+		if n == 0 {
+			w.Header().Set("Content-Type", f.contentType)
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, f.open)
+		} else {
+			io.WriteString(w, f.sep)
+		}
+		// Encode appends a newline, which keeps large exports diffable.
+		if stringIDs {
+			err = writeStringIDs(w, v)
+		} else {
+			err = enc.Encode(v)
+		}
+		if err != nil {
+			failStream(w, r, n, err)
+			return
+		}
+		if n++; n%streamFlushEvery == 0 {
+			_ = rc.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		failStream(w, r, n, err)
+		return
+	}
+	if n == 0 {
+		w.Header().Set("Content-Type", f.contentType)
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, f.open)
+	}
+	io.WriteString(w, f.close)
+}
+
+func failStream(w http.ResponseWriter, r *http.Request, written int, err error) {
+	if written == 0 {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("stream %s aborted after %d rows (request %s): %v", r.URL.Path, written, requestIDFrom(r.Context()), err)
+	panic(http.ErrAbortHandler)
+}
+
+// spoolRows writes rows to w as exactly the bytes streamRows sends, so a
+// byte range of the spooled copy is that range of the download. It returns
+// how many rows it wrote.
+func spoolRows[T any](w io.Writer, rows *sql.Rows, scan func(rowScanner) (T, error), stringIDs bool, f rowFormat) (int64, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	bw.WriteString(f.open)
+	var n int64
+	for ; rows.Next(); n++ {
+		v, err := scan(rows)
+		if err != nil {
+			return n, err
+		}
+		if n > 0 {
+			bw.WriteString(f.sep)
+		}
+		if stringIDs {
+			err = writeStringIDs(bw, v)
+		} else {
+			err = enc.Encode(v)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	bw.WriteString(f.close)
+	return n, bw.Flush()
+}
+
+// writeExport writes the movies of rows to w in format f and returns how
+// many there were.
+func writeExport(w io.Writer, rows *sql.Rows, f rowFormat, stringIDs bool) (int64, error) {
+	if f == parquetRows {
+		mp := newMovieParquet(w)
+		err := mp.writeRows(rows)
+		return int64(mp.written()), err
+	}
+	return spoolRows(w, rows, func(row rowScanner) (Movie, error) { return scanMovie(row) }, stringIDs, f)
+}
+
+// exportFilter is the WHERE clause selecting the movies of ctx's tenant
+// that q's filters match, or a message for the client.
+func exportFilter(ctx context.Context, q url.Values, refs *refData) (whereClause, string) {
+	var filter whereClause
+	filter.add("tenant_id = ?", tenantFrom(ctx))
+	filter.add("deleted_at IS NULL")
+	return filter, movieFilters(q, refs, &filter)
+}
+
+// GET /movies/export
+//
+// Every movie as a download, streamed: a JSON array, with format=ndjson one
+// movie per line, or with format=parquet a Parquet file (see movieParquet).
+// It takes the filters of GET /movies. The ETag and Last-Modified cover
+// every exported movie, so an interrupted download can resume with Range
+// and If-Range: a range request is answered from a copy spooled to a
+// temporary file, with 206 and Content-Range, or with the whole export if
+// it changed since.
+func exportMovies(db *sql.DB, refs *refData) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		name := r.URL.Query().Get("format")
+		if name == "" {
+			name = "json"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be json, ndjson or parquet"})
+			return
+		}
+		filter, msg := exportFilter(ctx, r.URL.Query(), refs)
+		if msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+
+		// The validators and the rows come from one snapshot, so they agree.
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		var sum string
+		var modified time.Time
+		err = tx.QueryRowContext(ctx, `
+			SELECT coalesce(md5(string_agg(ROW(`+movieColumns+`)::text, ',' ORDER BY id)), ''), coalesce(max(updated_at), 'epoch')
+			FROM movies WHERE `+filter.String(), filter.args...).Scan(&sum, &modified)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		rows, err := tx.QueryContext(ctx, `
+			SELECT `+movieColumns+` FROM movies WHERE `+filter.String()+` ORDER BY id`, filter.args...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		stringIDs := wantsStringIDs(w)
+		ids := jsonIDsNumber
+		if stringIDs {
+			ids = jsonIDsString
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="movies.`+format.ext+`"`)
+		w.Header().Set("ETag", `"`+sum+"-"+format.ext+"-"+ids+`"`)
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+		scan := func(row rowScanner) (Movie, error) { return scanMovie(row) }
+		if r.Header.Get("Range") == "" {
+			if format == parquetRows {
+				streamMovieParquet(w, r, rows)
+			} else {
+				streamRows(w, r, rows, scan, format)
+			}
+			return
+		}
+
+		f, err := os.CreateTemp("", "movies-export-*."+format.ext)
+		if err == nil {
+			defer os.Remove(f.Name())
+			defer f.Close()
+			_, err = writeExport(f, rows, format, stringIDs)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", format.contentType)
+		http.ServeContent(w, r, "", modified, f)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Bounds of free-form tags: the length of one and how many one request adds.
+const (
+	maxTagLength  = 50
+	maxTagsPerAdd = 20
+)
+
+// TagCount is one entry of the tag cloud.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// tagsAudit is what the audit log records when tags are added or removed.
+type tagsAudit struct {
+	Tags []string `json:"tags"`
+}
+
+// normalizeTag lower-cases a tag and collapses its whitespace, so "Cult
+// Classic " and "cult classic" are the same tag.
+func normalizeTag(s string) (string, bool) {
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+	n := len([]rune(s))
+	return s, n > 0 && n <= maxTagLength
+}
+
+func queryMovieTags(ctx context.Context, db *sql.DB, movieID int64) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.name FROM movie_tags mt JOIN tags t ON t.id = mt.tag_id
+		WHERE mt.movie_id=$1 AND mt.tenant_id=$2 ORDER BY t.name`, movieID, tenantFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
+
+// GET /movies/{id}/tags
+func listMovieTags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		exists, err := movieExists(r.Context(), db, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		tags, err := queryMovieTags(r.Context(), db, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"movie_id": id, "tags": tags})
+	}
+}
+
+// POST /movies/{id}/tags with {"tags": ["cult classic", "space"]}
+//
+// Attaches tags to the movie, creating those the tenant doesn't have yet.
+// Tags the movie already carries are ignored. The response lists all of the
+// movie's tags; only the new ones are audited.
+func addMovieTags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		var in struct {
+			Tags []string `json:"tags"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		names := []string{}
+		seen := make(map[string]bool, len(in.Tags))
+		for _, t := range in.Tags {
+			name, ok := normalizeTag(t)
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "tags must be 1 to " + strconv.Itoa(maxTagLength) + " characters"})
+				return
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 || len(names) > maxTagsPerAdd {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "tags must list 1 to " + strconv.Itoa(maxTagsPerAdd) + " tags"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		tenant := tenantFrom(r.Context())
+		var exists bool
+		if err := tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM movies WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL)`, id, tenant).Scan(&exists); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO tags (tenant_id, name) SELECT $1, unnest($2::text[])
+			ON CONFLICT (tenant_id, name) DO NOTHING`, tenant, pq.Array(names))
+		var added []string
+		if err == nil {
+			err = tx.QueryRow(`
+				WITH added AS (
+					INSERT INTO movie_tags (tenant_id, movie_id, tag_id)
+					SELECT $1, $2, id FROM tags WHERE tenant_id=$1 AND name = ANY($3)
+					ON CONFLICT DO NOTHING
+					RETURNING tag_id
+				)
+				SELECT coalesce(array_agg(t.name ORDER BY t.name), '{}') FROM added JOIN tags t ON t.id = added.tag_id`,
+				tenant, id, pq.Array(names)).Scan(pq.Array(&added))
+		}
+		if err == nil && len(added) > 0 {
+			err = recordAudit(r, tx, "tag", id, "create", nil, tagsAudit{added})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		tags, err := queryMovieTags(r.Context(), db, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"movie_id": id, "tags": tags, "added": added})
+	}
+}
+
+// DELETE /movies/{id}/tags/{tag}
+//
+// Detaches one tag from the movie. The tag itself stays; the cloud only
+// counts tags that are in use.
+func removeMovieTag(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		name, ok := normalizeTag(r.PathValue("tag"))
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid tag"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec(`
+			DELETE FROM movie_tags mt USING tags t
+			WHERE t.id = mt.tag_id AND mt.movie_id=$1 AND mt.tenant_id=$2 AND t.name=$3`, id, tenantFrom(r.Context()), name)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		err = recordAudit(r, tx, "tag", id, "delete", tagsAudit{[]string{name}}, nil)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /tags?prefix=cu&limit=100
+//
+// The tag cloud: tags by the number of live movies carrying them, most used
+// first. Unused tags are left out. Movies with a tag are listed by GET
+// /movies?tag=.
+func tagCloud(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > 500 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 500"})
+				return
+			}
+			limit = n
+		}
+		prefix := strings.ToLower(strings.Join(strings.Fields(r.URL.Query().Get("prefix")), " "))
+
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT t.name, count(*) FROM tags t
+			JOIN movie_tags mt ON mt.tag_id = t.id
+			JOIN movies m ON m.id = mt.movie_id AND m.deleted_at IS NULL
+			WHERE t.tenant_id=$1 AND t.name LIKE $2 || '%'
+			GROUP BY t.name
+			ORDER BY count(*) DESC, t.name
+			LIMIT $3`, tenantFrom(r.Context()), likeEscaper.Replace(prefix), limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []TagCount{}
+		for rows.Next() {
+			var t TagCount
+			if err := rows.Scan(&t.Tag, &t.Count); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			out = append(out, t)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
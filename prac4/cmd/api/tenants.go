@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Every request runs for exactly one tenant: the signed-in user's, or for
+// anonymous requests the one named by X-Tenant-ID (by slug), falling back to
+// the configured default. Anonymous requests can only read it; see
+// bindUserTenant. Queries on tenant-owned tables filter on
+// tenantFrom(ctx); with no tenant in the context that is 0, which matches
+// nothing.
+const tenantHeader = "X-Tenant-ID"
+
+// defaultTenantID is the tenant created by the migration. Its admins are
+// operators: they manage tenants and the shared reference data.
+const defaultTenantID = 1
+
+var tenantSlugRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+type Tenant struct {
+	ID        int64     `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// tenantScope is what the request context carries: the tenant, and whether
+// the client asked for it explicitly.
+type tenantScope struct {
+	id       int64
+	explicit bool
+}
+
+func tenantFrom(ctx context.Context) int64 {
+	s, _ := ctx.Value(ctxTenant).(tenantScope)
+	return s.id
+}
+
+// tenantDirectory resolves slugs to tenant IDs. Tenants are never renamed
+// or removed, so lookups are cached for good.
+type tenantDirectory struct {
+	db          *sql.DB
+	defaultSlug string
+
+	mu  sync.RWMutex
+	ids map[string]int64
+}
+
+func newTenantDirectory(db *sql.DB, defaultSlug string) *tenantDirectory {
+	return &tenantDirectory{db: db, defaultSlug: defaultSlug, ids: map[string]int64{}}
+}
+
+// lookup returns sql.ErrNoRows for an unknown slug.
+func (td *tenantDirectory) lookup(ctx context.Context, slug string) (int64, error) {
+	td.mu.RLock()
+	id, ok := td.ids[slug]
+	td.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+	if err := td.db.QueryRowContext(ctx, `SELECT id FROM tenants WHERE slug=$1`, slug).Scan(&id); err != nil {
+		return 0, err
+	}
+	td.mu.Lock()
+	td.ids[slug] = id
+	td.mu.Unlock()
+	return id, nil
+}
+
+// resolve puts the tenant named by X-Tenant-ID, or the default one, into the
+// request context. It runs before authenticate so users created during
+// external sign-in land in it.
+func (td *tenantDirectory) resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", tenantHeader)
+		slug := strings.TrimSpace(r.Header.Get(tenantHeader))
+		scope := tenantScope{explicit: slug != ""}
+		if slug == "" {
+			slug = td.defaultSlug
+		}
+		if !tenantSlugRe.MatchString(slug) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid " + tenantHeader})
+			return
+		}
+		id, err := td.lookup(r.Context(), slug)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown tenant: " + slug})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		scope.id = id
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxTenant, scope)))
+	})
+}
+
+// anonymousInTenant reports whether an anonymous r may run in the tenant it
+// named: reads do, and of writes only those anonymous clients make: signing
+// up or in, unsubscribing and sending analytics events.
+func anonymousInTenant(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	switch r.URL.Path {
+	case "/users", "/tokens/authentication", "/auth/two-factor", "/unsubscribe/digest", "/events":
+		return true
+	}
+	return false
+}
+
+// bindUserTenant switches authenticated requests to the user's tenant.
+// Naming a different one in X-Tenant-ID is refused rather than ignored, so
+// a client can't believe it is writing to one tenant while writing to
+// another. Anonymous requests keep the tenant they named only to read it;
+// any other write needs a user, who can only write to their own tenant.
+func bindUserTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := userFrom(r.Context())
+		if u == nil {
+			if !anonymousInTenant(r) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope, _ := r.Context().Value(ctxTenant).(tenantScope)
+		if scope.explicit && scope.id != u.TenantID {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "your account belongs to another tenant"})
+			return
+		}
+		scope.id = u.TenantID
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxTenant, scope)))
+	})
+}
+
+// isOperator reports whether u administers the whole deployment rather than
+// one tenant.
+func (u *User) isOperator() bool {
+	return u.isAdmin() && u.TenantID == defaultTenantID
+}
+
+// requireOperator guards admin routes that affect every tenant.
+func requireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !userFrom(r.Context()).isOperator() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "only admins of the default tenant can do this"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// GET /admin/tenants
+func adminListTenants(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), `SELECT id, slug, name, created_at FROM tenants ORDER BY id`)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []Tenant{}
+		for rows.Next() {
+			var t Tenant
+			if err := rows.Scan(&t.ID, &t.Slug, &t.Name, &t.CreatedAt); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			out = append(out, t)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// POST /admin/tenants creates a tenant together with its first admin, who
+// should change the initial password with PUT /me/password. With schema
+// isolation the tenant's schema is set up in the same transaction.
+func adminCreateTenant(db *sql.DB, schemas bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Slug  string `json:"slug"`
+			Name  string `json:"name"`
+			Admin struct {
+				Email    string `json:"email"`
+				Name     string `json:"name"`
+				Password string `json:"password"`
+			} `json:"admin"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		in.Slug = strings.ToLower(strings.TrimSpace(in.Slug))
+		in.Name = strings.TrimSpace(in.Name)
+		if !tenantSlugRe.MatchString(in.Slug) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "slug must be lowercase letters, digits and dashes (max 63)"})
+			return
+		}
+		if in.Name == "" {
+			in.Name = in.Slug
+		}
+		email := strings.ToLower(strings.TrimSpace(in.Admin.Email))
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "admin.email must be a valid email"})
+			return
+		}
+		if len(in.Admin.Password) < 8 || len(in.Admin.Password) > 72 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "admin.password must be 8 to 72 bytes long"})
+			return
+		}
+		adminName := strings.TrimSpace(in.Admin.Name)
+		if adminName == "" {
+			adminName, _, _ = strings.Cut(email, "@")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(in.Admin.Password), 12)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		t := Tenant{Slug: in.Slug, Name: in.Name}
+		err = tx.QueryRow(`INSERT INTO tenants (slug, name) VALUES ($1, $2) RETURNING id, created_at`,
+			in.Slug, in.Name).Scan(&t.ID, &t.CreatedAt)
+		if isUniqueViolation(err) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "a tenant with this slug already exists"})
+			return
+		}
+		var adminID int64
+		if err == nil {
+			err = tx.QueryRow(`
+				INSERT INTO users (tenant_id, email, name, password_hash, role) VALUES ($1, $2, $3, $4, 'admin')
+				RETURNING id`, t.ID, email, adminName, hash).Scan(&adminID)
+			if isUniqueViolation(err) {
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "a user with this email already exists"})
+				return
+			}
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "tenant", t.ID, "create", nil, map[string]any{"tenant": t, "admin_id": adminID})
+		}
+		if err == nil && schemas {
+			err = migrateTenant(r.Context(), tx, t.ID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		countEvent(eventUserRegistered)
+		writeJSON(w, http.StatusCreated, map[string]any{"tenant": t, "admin_id": adminID})
+	}
+}
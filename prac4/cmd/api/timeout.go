@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// longRoutes are path prefixes of routes allowed to run past the normal
+// handler budget, such as bulk operations touching many rows.
+var longRoutes = []string{
+	"/admin/genres/rename",
+	"/movies/export",
+	"/movies/import",
+	"/imports",
+	"/admin/matviews/",
+}
+
+// longPosts are routes whose POST runs long while their reads don't:
+// applying migrations, which holds the migration lock whatever the client
+// does, and starting an archive run.
+var longPosts = []string{
+	"/admin/migrations/apply",
+	"/admin/archive/runs",
+}
+
+// isLongRoute also covers the unpaginated movie list, which is streamed and
+// must not be buffered by http.TimeoutHandler, and signed downloads.
+func isLongRoute(r *http.Request) bool {
+	if r.URL.Path == "/movies" && r.Method == http.MethodGet && !r.URL.Query().Has("limit") && !r.URL.Query().Has("cursor") {
+		return true
+	}
+	if isSignedDownload(r.URL.Path) {
+		return true
+	}
+	if r.Method == http.MethodPost && slices.Contains(longPosts, r.URL.Path) {
+		return true
+	}
+	for _, p := range longRoutes {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeouts bounds how long a handler may run. Normal routes go through
+// http.TimeoutHandler and get a 503 JSON error when they overrun. Long routes
+// get a context deadline instead, and their connection read/write deadlines
+// are pushed out past the server-wide ReadTimeout/WriteTimeout, so they can
+// stream large bodies.
+func timeouts(normal, long time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		body := `{"error":"request timed out"}` + "\n"
+		limited := http.TimeoutHandler(next, normal, body)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isLongRoute(r) {
+				if normal == 0 {
+					next.ServeHTTP(w, r)
+					return
+				}
+				// Only used when the timeout fires; a handler's own headers
+				// replace it otherwise.
+				w.Header().Set("Content-Type", "application/json")
+				limited.ServeHTTP(w, r)
+				return
+			}
+
+			if long == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			deadline := time.Now().Add(long)
+			rc := http.NewResponseController(w)
+			_ = rc.SetReadDeadline(deadline)
+			_ = rc.SetWriteDeadline(deadline)
+			ctx, cancel := context.WithDeadline(r.Context(), deadline)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Scopes a personal access token can be limited to.
+var tokenScopes = map[string]bool{
+	"movies:read":  true,
+	"movies:write": true,
+	"webhooks":     true,
+	roleAdmin:      true,
+}
+
+// personalTokenPrefix makes leaked tokens easy to recognise for secret
+// scanners.
+const personalTokenPrefix = "pat_"
+
+type PersonalToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+const personalTokenColumns = `id, name, scopes, expires_at, last_used_at, created_at`
+
+func scanPersonalToken(row rowScanner) (PersonalToken, error) {
+	var t PersonalToken
+	err := row.Scan(&t.ID, &t.Name, pq.Array(&t.Scopes), &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt)
+	return t, err
+}
+
+// POST /me/tokens
+//
+// Creates a personal access token for integrations. The plaintext token is
+// only in this response; the database keeps its SHA-256 hash. With signed
+// requests enabled the response also has the token's signing_key.
+func createPersonalToken(db *sql.DB, signer *requestSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expires_in_days"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		in.Name = strings.TrimSpace(in.Name)
+		if in.Name == "" || len(in.Name) > 100 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required (max 100 characters)"})
+			return
+		}
+		in.Scopes = cleanLabels(in.Scopes)
+		if len(in.Scopes) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "at least one scope is required"})
+			return
+		}
+		for _, s := range in.Scopes {
+			if !tokenScopes[s] {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown scope: " + s})
+				return
+			}
+		}
+		if in.ExpiresInDays < 0 || in.ExpiresInDays > 366 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expires_in_days must be between 0 (never) and 366"})
+			return
+		}
+
+		u := userFrom(r.Context())
+		if u.tokenScopes != nil {
+			// Tokens can't mint other tokens; that needs a real sign-in.
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "personal access tokens cannot create tokens"})
+			return
+		}
+		var expires *time.Time
+		if in.ExpiresInDays > 0 {
+			t := time.Now().AddDate(0, 0, in.ExpiresInDays)
+			expires = &t
+		}
+
+		token := personalTokenPrefix + randomToken(32)
+		pt, err := scanPersonalToken(db.QueryRowContext(r.Context(), `
+			INSERT INTO tokens (hash, user_id, kind, name, scopes, expires_at)
+			VALUES ($1, $2, 'personal', $3, $4, $5)
+			RETURNING `+personalTokenColumns,
+			hashToken(token), u.ID, in.Name, pq.Array(in.Scopes), expires))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		logAuthEvent(r, db, u.ID, authTokenCreated, map[string]any{"token_id": pt.ID, "name": pt.Name, "scopes": pt.Scopes})
+		out := struct {
+			PersonalToken
+			Token      string `json:"token"`
+			SigningKey string `json:"signing_key,omitempty"`
+		}{PersonalToken: pt, Token: token}
+		if signer.enabled() {
+			out.SigningKey = hex.EncodeToString(signer.key(pt.ID))
+		}
+		writeJSON(w, http.StatusCreated, out)
+	}
+}
+
+// GET /me/tokens/{id}/signing-key gives the signing key of one of the
+// caller's personal access tokens again. Like creating tokens it needs a
+// real sign-in, so a token can't be used to learn its own key.
+func personalTokenSigningKey(db *sql.DB, signer *requestSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		u := userFrom(r.Context())
+		if u.tokenScopes != nil {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "personal access tokens cannot read signing keys"})
+			return
+		}
+		if !signer.enabled() {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "signed requests are not enabled"})
+			return
+		}
+		var exists bool
+		err := db.QueryRowContext(r.Context(), `
+			SELECT EXISTS (SELECT 1 FROM tokens
+			WHERE id=$1 AND user_id=$2 AND kind='personal' AND revoked_at IS NULL)`, id, u.ID).Scan(&exists)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"id": id, "signing_key": hex.EncodeToString(signer.key(id))})
+	}
+}
+
+// GET /me/tokens lists the caller's personal access tokens (never the
+// secrets themselves).
+func listPersonalTokens(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT `+personalTokenColumns+` FROM tokens
+			WHERE user_id=$1 AND kind='personal' AND revoked_at IS NULL
+			ORDER BY id`, userFrom(r.Context()).ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []PersonalToken{}
+		for rows.Next() {
+			t, err := scanPersonalToken(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			out = append(out, t)
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// DELETE /me/tokens/{id}
+func revokePersonalToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		res, err := db.ExecContext(r.Context(), `
+			UPDATE tokens SET revoked_at=now()
+			WHERE id=$1 AND user_id=$2 AND kind='personal' AND revoked_at IS NULL`, id, userFrom(r.Context()).ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		aff, _ := res.RowsAffected()
+		if aff == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		logAuthEvent(r, db, userFrom(r.Context()).ID, authTokenRevoked, map[string]any{"token_id": id})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST /tokens/revoke
+//
+// Revokes one of the caller's tokens, given as {"token": "..."}, or the
+// presented token when the body is empty. Like RFC 7009, a token that is
+// unknown or not the caller's is not an error, so the endpoint can't be
+// used to probe for valid tokens.
+func revokeToken(db *sql.DB, jwts *jwtIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Token string `json:"token"`
+		}
+		if err := readJSON(r, &in); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		u := userFrom(r.Context())
+		hash := u.tokenHash
+		if in.Token != "" {
+			if u.tokenScopes != nil {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "personal access tokens can only revoke themselves"})
+				return
+			}
+			hash = jwts.storedHash(in.Token)
+		}
+		n, err := revokeTokens(r, db, `hash=$1 AND user_id=$2`, hash, u.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if n > 0 {
+			logAuthEvent(r, db, u.ID, authTokenRevoked, map[string]any{"presented": in.Token == ""})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST /logout revokes the presented token.
+func logout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := userFrom(r.Context())
+		if _, err := revokeTokens(r, db, `hash=$1`, u.tokenHash); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		logAuthEvent(r, db, u.ID, authLogout, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST /admin/users/{id}/tokens/revoke revokes every session and personal
+// token of a user, e.g. after their password leaked. The account stays
+// active; they can sign in again.
+func adminRevokeUserTokens(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id=$1 AND tenant_id=$2)`, id, tenantFrom(r.Context())).Scan(&exists); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		res, err := tx.Exec(`UPDATE tokens SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL`, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		n, _ := res.RowsAffected()
+		err = recordAudit(r, tx, "user", id, "update", nil, map[string]int64{"revoked_tokens": n})
+		if err == nil {
+			err = recordAuthEvent(r, tx, id, authTokenRevoked, map[string]any{"all": true, "count": n, "by": userFrom(r.Context()).ID})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"revoked": n})
+	}
+}
+
+// revokeTokens marks the tokens matching where as revoked and returns how
+// many there were.
+func revokeTokens(r *http.Request, db *sql.DB, where string, args ...any) (int64, error) {
+	res, err := db.ExecContext(r.Context(), `UPDATE tokens SET revoked_at=now() WHERE revoked_at IS NULL AND `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TOTP (RFC 6238) with the parameters every authenticator app supports:
+// SHA-1, six digits, 30-second steps. Codes one step either side of now are
+// accepted to allow for clock drift.
+const (
+	totpIssuer        = "Movies API"
+	totpPeriod        = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1_000_000)
+}
+
+// totpMatch returns the time step code is valid for, or 0.
+func totpMatch(secret []byte, code string, now time.Time) int64 {
+	step := now.Unix() / totpPeriod
+	for _, s := range []int64{step, step - 1, step + 1} {
+		if hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) {
+			return s
+		}
+	}
+	return 0
+}
+
+// checkSecondFactor verifies a TOTP or recovery code for a user who has
+// two-factor authentication. Used codes are burnt in the same statement
+// that checks them, so concurrent requests can't both use one.
+func checkSecondFactor(ctx context.Context, db *sql.DB, userID int64, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) == totpDigits {
+		var secret []byte
+		err := db.QueryRowContext(ctx, `
+			SELECT secret FROM user_totp WHERE user_id=$1 AND confirmed_at IS NOT NULL`, userID).Scan(&secret)
+		if err != nil {
+			return false, err
+		}
+		step := totpMatch(secret, code, time.Now())
+		if step == 0 {
+			return false, nil
+		}
+		res, err := db.ExecContext(ctx, `
+			UPDATE user_totp SET last_step=$2 WHERE user_id=$1 AND last_step < $2`, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE user_recovery_codes SET used_at=now()
+		WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`, userID, recoveryCodeHash(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// recoveryCodeHash is the stored hash of a recovery code. The dash shown
+// in the middle is only for reading, so codes match with or without it.
+func recoveryCodeHash(code string) []byte {
+	return hashToken(strings.ToLower(strings.ReplaceAll(code, "-", "")))
+}
+
+// newRecoveryCodes replaces a user's recovery codes and returns the new
+// ones in plain text, for showing once.
+func newRecoveryCodes(tx *sql.Tx, userID int64) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		t := randomToken(5)
+		codes[i] = t[:5] + "-" + t[5:]
+		hashes[i] = recoveryCodeHash(codes[i])
+	}
+	_, err := tx.Exec(`
+		INSERT INTO user_recovery_codes (user_id, code_hash)
+		SELECT $1, unnest($2::bytea[])`, userID, pq.Array(hashes))
+	return codes, err
+}
+
+// sessionOnly keeps personal access tokens away from two-factor settings.
+func sessionOnly(w http.ResponseWriter, u *User) bool {
+	if u.tokenScopes != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "personal access tokens cannot change two-factor settings"})
+		return false
+	}
+	return true
+}
+
+// POST /me/2fa/totp
+//
+// Starts enrolling an authenticator: returns the secret and an otpauth:// URI
+// to show as a QR code. Nothing is enforced until POST /me/2fa/totp/confirm.
+func enrollTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := userFrom(r.Context())
+		if !sessionOnly(w, u) {
+			return
+		}
+		if u.TwoFactor {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "two-factor authentication is already enabled"})
+			return
+		}
+		secret := make([]byte, 20)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+		_, err := db.ExecContext(r.Context(), `
+			INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET secret=EXCLUDED.secret, last_step=0, created_at=now()`,
+			u.ID, secret)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		encoded := totpEncoding.EncodeToString(secret)
+		q := url.Values{"secret": {encoded}, "issuer": {totpIssuer}}
+		uri := "otpauth://totp/" + url.PathEscape(totpIssuer+":"+u.Email) + "?" + q.Encode()
+		writeJSON(w, http.StatusCreated, map[string]string{"secret": encoded, "otpauth_uri": uri})
+	}
+}
+
+// POST /me/2fa/totp/confirm turns two-factor authentication on with a first
+// code and returns the recovery codes.
+func confirmTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Code string `json:"code"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		u := userFrom(r.Context())
+		if !sessionOnly(w, u) {
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		var (
+			secret    []byte
+			confirmed sql.NullTime
+		)
+		err = tx.QueryRow(`SELECT secret, confirmed_at FROM user_totp WHERE user_id=$1 FOR UPDATE`, u.ID).Scan(&secret, &confirmed)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "start enrollment with POST /me/2fa/totp first"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if confirmed.Valid {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "two-factor authentication is already enabled"})
+			return
+		}
+		step := totpMatch(secret, strings.TrimSpace(in.Code), time.Now())
+		if step == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid code"})
+			return
+		}
+		_, err = tx.Exec(`UPDATE user_totp SET confirmed_at=now(), last_step=$2 WHERE user_id=$1`, u.ID, step)
+		var codes []string
+		if err == nil {
+			codes, err = newRecoveryCodes(tx, u.ID)
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "user", u.ID, "update", map[string]bool{"two_factor": false}, map[string]bool{"two_factor": true})
+		}
+		if err == nil {
+			err = recordAuthEvent(r, tx, u.ID, authTwoFactorEnabled, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+	}
+}
+
+// POST /me/2fa/recovery-codes replaces the recovery codes; it takes a
+// current code so a stolen session can't mint new ones.
+func regenerateRecoveryCodes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := secondFactorRequest(w, r, db)
+		if !ok {
+			return
+		}
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		codes, err := newRecoveryCodes(tx, u.ID)
+		if err == nil {
+			err = recordAuthEvent(r, tx, u.ID, authRecoveryCodes, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+	}
+}
+
+// DELETE /me/2fa/totp turns two-factor authentication off, given a current
+// code. Users for whom it is required can't.
+func disableTOTP(db *sql.DB, adminsRequired bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := secondFactorRequest(w, r, db)
+		if !ok {
+			return
+		}
+		if twoFactorRequired(u, adminsRequired) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "two-factor authentication is required for your account"})
+			return
+		}
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		err = resetTwoFactor(tx, u.ID)
+		if err == nil {
+			err = recordAudit(r, tx, "user", u.ID, "update", map[string]bool{"two_factor": true}, map[string]bool{"two_factor": false})
+		}
+		if err == nil {
+			err = recordAuthEvent(r, tx, u.ID, authTwoFactorDisabled, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// secondFactorRequest reads {"code": "..."} and checks it for the caller.
+func secondFactorRequest(w http.ResponseWriter, r *http.Request, db *sql.DB) (*User, bool) {
+	var in struct {
+		Code string `json:"code"`
+	}
+	if err := readJSON(r, &in); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+		return nil, false
+	}
+	u := userFrom(r.Context())
+	if !sessionOnly(w, u) {
+		return nil, false
+	}
+	if !u.TwoFactor {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "two-factor authentication is not enabled"})
+		return nil, false
+	}
+	ok, err := checkSecondFactor(r.Context(), db, u.ID, in.Code)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid code"})
+		return nil, false
+	}
+	return u, true
+}
+
+// resetTwoFactor removes a user's authenticator and recovery codes.
+func resetTwoFactor(tx *sql.Tx, userID int64) error {
+	if _, err := tx.Exec(`DELETE FROM user_totp WHERE user_id=$1`, userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id=$1`, userID)
+	return err
+}
+
+func twoFactorRequired(u *User, adminsRequired bool) bool {
+	return u.RequireTwoFactor || (adminsRequired && u.isAdmin())
+}
+
+// requireTwoFactor holds users who must use two-factor authentication but
+// haven't set it up to the enrollment endpoints until they do. Services
+// authenticated by client certificate can't enroll and are let through.
+func requireTwoFactor(adminsRequired bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u := userFrom(r.Context())
+			if u != nil && !u.TwoFactor && u.certName == "" && twoFactorRequired(u, adminsRequired) &&
+				!strings.HasPrefix(r.URL.Path, "/me/2fa/") && r.URL.Path != "/me" && r.URL.Path != "/logout" {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "set up two-factor authentication at /me/2fa/totp first"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PUT /admin/users/{id}/require-2fa
+func adminRequireTwoFactor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Required bool `json:"required"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		updateUser(w, r, db, func(tx *sql.Tx, id int64) error {
+			_, err := tx.Exec(`UPDATE users SET require_2fa=$1 WHERE id=$2`, in.Required, id)
+			return err
+		})
+	}
+}
+
+// DELETE /admin/users/{id}/2fa resets two-factor authentication for a user
+// who lost both their authenticator and recovery codes.
+func adminResetTwoFactor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updateUser(w, r, db, func(tx *sql.Tx, id int64) error {
+			if err := resetTwoFactor(tx, id); err != nil {
+				return err
+			}
+			return recordAuthEvent(r, tx, id, authTwoFactorDisabled, map[string]any{"by": userFrom(r.Context()).ID})
+		})
+	}
+}
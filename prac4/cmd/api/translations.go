@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Translation statuses. Machine translations are imported automatically and
+// still need a human pass; reviewed ones have been checked by an editor.
+const (
+	translationMachine  = "machine"
+	translationReviewed = "reviewed"
+)
+
+// languageRe accepts simple BCP 47 tags such as "en", "fr" or "pt-BR".
+var languageRe = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+type Translation struct {
+	MovieID     int64     `json:"movie_id"`
+	Language    string    `json:"language"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// translationAudit is what the audit log records for a translation; the
+// timestamp is left out so re-saving identical text isn't logged as a change.
+type translationAudit struct {
+	Language    string `json:"language"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+}
+
+// normalizeLanguage lower-cases the language subtag and upper-cases the
+// region, so "PT-br" and "pt-BR" refer to the same row.
+func normalizeLanguage(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	lang, region, found := strings.Cut(s, "-")
+	s = strings.ToLower(lang)
+	if found {
+		s += "-" + strings.ToUpper(region)
+	}
+	return s, languageRe.MatchString(s)
+}
+
+func pathID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+func movieExists(ctx context.Context, db *sql.DB, id int64) (bool, error) {
+	var ok bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM movies WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL)`, id, tenantFrom(ctx)).Scan(&ok)
+	return ok, err
+}
+
+func queryTranslations(ctx context.Context, db *sql.DB, movieID int64) ([]Translation, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT movie_id, language, coalesce(title, ''), description, status, updated_at
+		FROM movie_translations WHERE movie_id=$1 AND tenant_id=$2 ORDER BY language`, movieID, tenantFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Translation{}
+	for rows.Next() {
+		var t Translation
+		if err := rows.Scan(&t.MovieID, &t.Language, &t.Title, &t.Description, &t.Status, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// GET /movies/{id}/translations
+func listTranslations(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		exists, err := movieExists(r.Context(), db, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		out, err := queryTranslations(r.Context(), db, id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// PUT /movies/{id}/translations/{lang}
+//
+// Creates or replaces the description, and optionally the title, for one
+// language. Status defaults to "machine" so automated importers don't have
+// to send it.
+func putTranslation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		lang, ok := normalizeLanguage(r.PathValue("lang"))
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid language"})
+			return
+		}
+
+		var in struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+			Status      string `json:"status"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		in.Title = cleanTitle(in.Title)
+		if utf8.RuneCountInString(in.Title) > maxTitleLength {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("title is longer than %d characters", maxTitleLength)})
+			return
+		}
+		in.Description = strings.TrimSpace(in.Description)
+		if in.Description == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "description is required"})
+			return
+		}
+		if in.Status == "" {
+			in.Status = translationMachine
+		}
+		if in.Status != translationMachine && in.Status != translationReviewed {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "status must be machine or reviewed"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		tenant := tenantFrom(r.Context())
+		var exists bool
+		if err := tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM movies WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL)`, id, tenant).Scan(&exists); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		var before *translationAudit
+		var old translationAudit
+		err = tx.QueryRow(`
+			SELECT language, coalesce(title, ''), description, status FROM movie_translations
+			WHERE movie_id=$1 AND language=$2 AND tenant_id=$3 FOR UPDATE`, id, lang, tenant).Scan(&old.Language, &old.Title, &old.Description, &old.Status)
+		switch {
+		case err == nil:
+			before = &old
+		case err != sql.ErrNoRows:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		t := Translation{MovieID: id, Language: lang, Title: in.Title, Description: in.Description, Status: in.Status}
+		err = tx.QueryRow(`
+			INSERT INTO movie_translations (tenant_id, movie_id, language, title, description, status)
+			VALUES ($5, $1, $2, NULLIF($6, ''), $3, $4)
+			ON CONFLICT (movie_id, language)
+			DO UPDATE SET title=EXCLUDED.title, description=EXCLUDED.description, status=EXCLUDED.status, updated_at=now()
+			RETURNING updated_at`,
+			id, lang, in.Description, in.Status, tenant, in.Title).Scan(&t.UpdatedAt)
+		created := before == nil
+		if err == nil {
+			action := "update"
+			if created {
+				action = "create"
+			}
+			err = recordAudit(r, tx, "translation", id, action, before, translationAudit{lang, in.Title, in.Description, in.Status})
+		}
+		if err == nil {
+			err = commitUnlessDryRun(w, r, tx)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if !isDryRun(r) {
+			countEvent(eventTranslationSaved)
+		}
+		code := http.StatusOK
+		if created {
+			code = http.StatusCreated
+		}
+		writeJSON(w, code, t)
+	}
+}
+
+// DELETE /movies/{id}/translations/{lang}
+func deleteTranslation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		lang, ok := normalizeLanguage(r.PathValue("lang"))
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid language"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		var before translationAudit
+		err = tx.QueryRow(`
+			DELETE FROM movie_translations WHERE movie_id=$1 AND language=$2 AND tenant_id=$3
+			RETURNING language, coalesce(title, ''), description, status`, id, lang, tenantFrom(r.Context())).Scan(&before.Language, &before.Title, &before.Description, &before.Status)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "translation", id, "delete", before, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type missingTranslations struct {
+	Language string  `json:"language"`
+	Missing  int     `json:"missing"`
+	MovieIDs []int64 `json:"movie_ids"`
+}
+
+// GET /translations/missing?languages=fr,de&status=reviewed
+//
+// Reports, per language, which movies have no description yet. Without
+// ?languages= every language that appears in the catalog is checked. With
+// status=reviewed, machine translations also count as missing.
+func missingTranslationsReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := tenantFrom(r.Context())
+		var langs []string
+		if raw := strings.TrimSpace(r.URL.Query().Get("languages")); raw != "" {
+			for _, s := range strings.Split(raw, ",") {
+				lang, ok := normalizeLanguage(s)
+				if !ok {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid language: " + strings.TrimSpace(s)})
+					return
+				}
+				langs = append(langs, lang)
+			}
+		} else {
+			rows, err := db.QueryContext(r.Context(), `SELECT DISTINCT language FROM movie_translations WHERE tenant_id=$1 ORDER BY language`, tenant)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			for rows.Next() {
+				var lang string
+				if err := rows.Scan(&lang); err != nil {
+					rows.Close()
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+					return
+				}
+				langs = append(langs, lang)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+
+		statuses := []string{translationMachine, translationReviewed}
+		switch r.URL.Query().Get("status") {
+		case "":
+		case translationReviewed:
+			statuses = []string{translationReviewed}
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "status must be reviewed"})
+			return
+		}
+
+		out := []missingTranslations{}
+		for _, lang := range langs {
+			rows, err := db.QueryContext(r.Context(), `
+				SELECT m.id FROM movies m
+				WHERE m.tenant_id = $3 AND m.deleted_at IS NULL AND NOT EXISTS (
+					SELECT 1 FROM movie_translations t
+					WHERE t.tenant_id = m.tenant_id AND t.movie_id = m.id AND t.language = $1 AND t.status = ANY($2)
+				)
+				ORDER BY m.id`, lang, pq.Array(statuses), tenant)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			report := missingTranslations{Language: lang, MovieIDs: []int64{}}
+			for rows.Next() {
+				var id int64
+				if err := rows.Scan(&id); err != nil {
+					rows.Close()
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+					return
+				}
+				report.MovieIDs = append(report.MovieIDs, id)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			report.Missing = len(report.MovieIDs)
+			out = append(out, report)
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
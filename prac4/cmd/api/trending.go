@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+type trendingMovie struct {
+	Movie Movie   `json:"movie"`
+	Score float64 `json:"score"`
+}
+
+// GET /movies/trending?limit=20
+//
+// The movies with the highest trending score: recent views and approved
+// comments, weighted by age (see migration 0032). Scores come from the
+// movie_trending view, refreshed every TRENDING_REFRESH_INTERVAL, and
+// freshness says how old they are; movies with no recent activity aren't
+// listed. It takes the filters of GET /movies.
+func movieTrending(db *sql.DB, refs *refData, views []matView) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := 20
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > 100 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 100"})
+				return
+			}
+			limit = n
+		}
+		var filter whereClause
+		filter.add("tenant_id = ?", tenantFrom(r.Context()))
+		filter.add("deleted_at IS NULL")
+		if msg := movieFilters(r.URL.Query(), refs, &filter); msg != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+			return
+		}
+
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT `+movieColumns+`, t.score
+			FROM movies JOIN movie_trending t ON t.movie_id = movies.id
+			WHERE `+filter.String()+`
+			ORDER BY t.score DESC, id
+			LIMIT `+filter.arg(limit), filter.args...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+		out := []trendingMovie{}
+		for rows.Next() {
+			var tm trendingMovie
+			tm.Movie, err = scanMovie(rows, &tm.Score)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			out = append(out, tm)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		fresh, err := viewFreshness(r.Context(), db, views, matViewTrending)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Add("Vary", tenantHeader)
+		writeJSON(w, http.StatusOK, map[string]any{"movies": out, "freshness": fresh})
+	}
+}
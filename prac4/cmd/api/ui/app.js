@@ -0,0 +1,144 @@
+// Minimal admin client for the movies API. The token from /tokens/authentication
+// is kept in sessionStorage and sent as a bearer token on every call.
+const $ = (sel) => document.querySelector(sel);
+let movies = [];
+
+function token() { return sessionStorage.getItem("token"); }
+
+async function api(method, path, body) {
+  const headers = { "Accept": "application/json" };
+  if (token()) headers["Authorization"] = "Bearer " + token();
+  if (body !== undefined) headers["Content-Type"] = "application/json";
+  const res = await fetch(path, { method, headers, body: body === undefined ? undefined : JSON.stringify(body) });
+  if (res.status === 401) { sessionStorage.removeItem("token"); show("login"); }
+  if (res.status === 204) return null;
+  const data = res.headers.get("Content-Type")?.includes("json") ? await res.json() : await res.text();
+  if (!res.ok) throw new Error((data && data.error) || res.statusText);
+  return data;
+}
+
+function say(text, ok) {
+  $("#message").textContent = text;
+  $("#message").className = ok ? "ok" : "";
+}
+
+function show(view) {
+  for (const id of ["login", "movies", "status"]) $("#" + id).hidden = id !== view;
+  $("#logout").hidden = !token();
+  if (view === "movies") loadMovies();
+  if (view === "status") loadStatus();
+}
+
+async function loadMovies() {
+  try {
+    movies = (await api("GET", "/movies")) || [];
+    renderMovies();
+  } catch (e) { say(e.message); }
+}
+
+function renderMovies() {
+  const q = $("#filter").value.toLowerCase();
+  const rows = $("#movie-rows");
+  rows.replaceChildren();
+  for (const m of movies.filter((m) => m.title.toLowerCase().includes(q))) {
+    const tr = document.createElement("tr");
+    for (const v of [m.id, m.title, m.year ?? "", m.rating ?? "", (m.genres || []).join(", "), m.certification ?? ""]) {
+      const td = document.createElement("td");
+      td.textContent = v;
+      tr.append(td);
+    }
+    const actions = document.createElement("td");
+    const edit = document.createElement("button");
+    edit.textContent = "Edit";
+    edit.onclick = () => fillForm(m);
+    const del = document.createElement("button");
+    del.textContent = "Delete";
+    del.onclick = () => deleteMovie(m);
+    actions.append(edit, del);
+    tr.append(actions);
+    rows.append(tr);
+  }
+}
+
+function fillForm(m) {
+  const f = $("#movie-form");
+  f.id.value = m.id;
+  f.title.value = m.title;
+  f.year.value = m.year ?? "";
+  f.rating.value = m.rating ?? "";
+  f.genres.value = (m.genres || []).join(", ");
+  f.certification.value = m.certification ?? "";
+}
+
+async function saveMovie(ev) {
+  ev.preventDefault();
+  const f = ev.target;
+  const body = {
+    title: f.title.value,
+    year: f.year.value ? Number(f.year.value) : 0,
+    rating: f.rating.value ? Number(f.rating.value) : null,
+    genres: f.genres.value.split(",").map((g) => g.trim()).filter(Boolean),
+    certification: f.certification.value,
+  };
+  try {
+    if (f.id.value) await api("PUT", "/movies/" + f.id.value, body);
+    else await api("POST", "/movies", body);
+    f.reset();
+    say("Saved", true);
+    loadMovies();
+  } catch (e) { say(e.message); }
+}
+
+async function deleteMovie(m) {
+  if (!confirm(`Delete "${m.title}"?`)) return;
+  try {
+    await api("DELETE", "/movies/" + m.id);
+    say("Deleted", true);
+    loadMovies();
+  } catch (e) { say(e.message); }
+}
+
+async function loadStatus() {
+  try {
+    const s = await api("GET", "/admin/summary");
+    const dl = $("#status-list");
+    dl.replaceChildren();
+    const add = (k, v) => {
+      const dt = document.createElement("dt"); dt.textContent = k;
+      const dd = document.createElement("dd"); dd.textContent = v;
+      dl.append(dt, dd);
+    };
+    add("Health", s.health);
+    for (const [k, v] of Object.entries(s.counts)) add(k, v);
+    for (const [k, v] of Object.entries(s.db_pool)) add("db pool " + k, v);
+    for (const [k, v] of Object.entries(s.metrics)) add(k, v);
+  } catch (e) { say(e.message); }
+}
+
+async function loadCertifications() {
+  const sel = $("#movie-form").certification;
+  for (const c of await api("GET", "/certifications")) {
+    const o = document.createElement("option");
+    o.value = c.code;
+    o.textContent = c.code;
+    sel.append(o);
+  }
+}
+
+$("#login-form").onsubmit = async (ev) => {
+  ev.preventDefault();
+  try {
+    const res = await api("POST", "/tokens/authentication", { email: ev.target.email.value, password: ev.target.password.value });
+    sessionStorage.setItem("token", res.token);
+    say("", true);
+    show("movies");
+  } catch (e) { say(e.message); }
+};
+$("#logout").onclick = () => { sessionStorage.removeItem("token"); show("login"); };
+$("#movie-form").onsubmit = saveMovie;
+$("#filter").oninput = renderMovies;
+$("#refresh-status").onclick = loadStatus;
+for (const b of document.querySelectorAll("nav [data-view]")) b.onclick = () => show(token() ? b.dataset.view : "login");
+
+loadCertifications().catch(() => {});
+show(token() ? "movies" : "login");
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// usageMeter counts requests and bytes per personal access token and adds
+// them to hourly rows in token_usage on every flush. Month-to-date totals
+// are cached per token for the quota check and reloaded from the table
+// after each flush, so traffic through other instances counts too. The
+// quotas are the defaults unless an override in limits changes them.
+type usageMeter struct {
+	db     *sql.DB
+	limits *rateLimits
+
+	mu      sync.Mutex
+	month   time.Time // start of the month totals are for
+	pending map[usageKey]usageCount
+	totals  map[int64]usageCount // month to date, pending included
+}
+
+type usageKey struct {
+	token int64
+	hour  time.Time
+}
+
+type usageCount struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+func (c usageCount) add(o usageCount) usageCount {
+	return usageCount{c.Requests + o.Requests, c.BytesIn + o.BytesIn, c.BytesOut + o.BytesOut}
+}
+
+func newUsageMeter(db *sql.DB, limits *rateLimits) *usageMeter {
+	return &usageMeter{
+		db:      db,
+		limits:  limits,
+		month:   monthStart(time.Now()),
+		pending: map[usageKey]usageCount{},
+		totals:  map[int64]usageCount{},
+	}
+}
+
+// monthStart returns the start of t's month in UTC; quotas reset then.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// rollover drops the cached totals once a new month starts. Call with mu
+// held.
+func (m *usageMeter) rollover(now time.Time) {
+	if month := monthStart(now); !month.Equal(m.month) {
+		m.month = month
+		m.totals = map[int64]usageCount{}
+	}
+}
+
+// total returns the token's usage this month, loading it on first use.
+func (m *usageMeter) total(ctx context.Context, token int64) (usageCount, error) {
+	m.mu.Lock()
+	m.rollover(time.Now())
+	c, ok := m.totals[token]
+	month := m.month
+	m.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	err := m.db.QueryRowContext(ctx, `
+		SELECT COALESCE(sum(requests), 0), COALESCE(sum(bytes_in), 0), COALESCE(sum(bytes_out), 0)
+		FROM token_usage WHERE token_id=$1 AND hour >= $2`, token, month).Scan(&c.Requests, &c.BytesIn, &c.BytesOut)
+	if err != nil {
+		return usageCount{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.totals[token]; ok {
+		return cur, nil
+	}
+	m.totals[token] = c
+	return c, nil
+}
+
+func (m *usageMeter) record(token int64, c usageCount) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollover(now)
+	k := usageKey{token, now.UTC().Truncate(time.Hour)}
+	m.pending[k] = m.pending[k].add(c)
+	if t, ok := m.totals[token]; ok {
+		m.totals[token] = t.add(c)
+	}
+}
+
+// exceeded names the quota of l that c is over, or returns "".
+func exceeded(c usageCount, l quotaLimits) string {
+	switch {
+	case l.Requests > 0 && c.Requests >= l.Requests:
+		return "request"
+	case l.Bytes > 0 && c.BytesIn+c.BytesOut >= l.Bytes:
+		return "byte"
+	}
+	return ""
+}
+
+// middleware meters requests made with personal access tokens and rejects
+// them with 429 once a monthly quota is used up. GET /me/usage stays
+// reachable so clients can see why.
+func (m *usageMeter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := userFrom(r.Context())
+		if u == nil || u.tokenScopes == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c, err := m.total(r.Context(), u.tokenID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if quota := exceeded(c, m.limits.forRequest(u)); quota != "" && r.URL.Path != "/me/usage" {
+			metrics.Inc("api_quota_exceeded_total", "Requests rejected because a token's monthly quota was used up.", "quota", quota)
+			w.Header().Set("Retry-After", retryAfter(time.Until(monthStart(time.Now()).AddDate(0, 1, 0))))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "monthly " + quota + " quota exceeded"})
+			return
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		uw := &usageWriter{ResponseWriter: w}
+		next.ServeHTTP(uw, r)
+		m.record(u.tokenID, usageCount{1, body.n, uw.n})
+	})
+}
+
+// run flushes the counts every interval.
+func (m *usageMeter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.flush()
+	}
+}
+
+func (m *usageMeter) flush() {
+	m.mu.Lock()
+	batch := m.pending
+	m.pending = map[usageKey]usageCount{}
+	tokens := make([]int64, 0, len(m.totals))
+	for t := range m.totals {
+		tokens = append(tokens, t)
+	}
+	month := m.month
+	m.mu.Unlock()
+
+	for k, c := range batch {
+		_, err := m.db.Exec(`
+			INSERT INTO token_usage (token_id, hour, requests, bytes_in, bytes_out) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (token_id, hour) DO UPDATE SET
+				requests = token_usage.requests + EXCLUDED.requests,
+				bytes_in = token_usage.bytes_in + EXCLUDED.bytes_in,
+				bytes_out = token_usage.bytes_out + EXCLUDED.bytes_out`,
+			k.token, k.hour, c.Requests, c.BytesIn, c.BytesOut)
+		if err == nil {
+			continue
+		}
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			// The token is gone; nothing to bill.
+			continue
+		}
+		log.Printf("usage flush: %v", err)
+		m.mu.Lock()
+		m.pending[k] = m.pending[k].add(c)
+		m.mu.Unlock()
+	}
+
+	if len(tokens) == 0 {
+		return
+	}
+	rows, err := m.db.Query(`
+		SELECT token_id, sum(requests), sum(bytes_in), sum(bytes_out) FROM token_usage
+		WHERE token_id = ANY($1) AND hour >= $2 GROUP BY token_id`, pq.Array(tokens), month)
+	if err != nil {
+		log.Printf("usage refresh: %v", err)
+		return
+	}
+	defer rows.Close()
+	fresh := map[int64]usageCount{}
+	for rows.Next() {
+		var (
+			t int64
+			c usageCount
+		)
+		if err := rows.Scan(&t, &c.Requests, &c.BytesIn, &c.BytesOut); err != nil {
+			log.Printf("usage refresh: %v", err)
+			return
+		}
+		fresh[t] = c
+	}
+	if rows.Err() != nil {
+		return
+	}
+
+	// Requests recorded since the batch was taken are in the new pending
+	// map but not yet in the table.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.month.Equal(month) {
+		return
+	}
+	for t, c := range fresh {
+		for k, p := range m.pending {
+			if k.token == t {
+				c = c.add(p)
+			}
+		}
+		m.totals[t] = c
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type usageWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (u *usageWriter) Write(b []byte) (int, error) {
+	n, err := u.ResponseWriter.Write(b)
+	u.n += int64(n)
+	return n, err
+}
+
+func (u *usageWriter) Unwrap() http.ResponseWriter {
+	return u.ResponseWriter
+}
+
+type tokenUsage struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	usageCount
+	Quotas quotaLimits   `json:"quotas"`
+	Hours  []hourlyUsage `json:"hours,omitempty"`
+}
+
+type hourlyUsage struct {
+	Hour time.Time `json:"hour"`
+	usageCount
+}
+
+// GET /me/usage?hourly=true
+//
+// Returns this month's usage of the caller's personal access tokens (just
+// the presented one when called with a token) and the quotas that apply:
+// the user's, and each token's, which differ when an admin set an override
+// for it. hourly adds the hourly breakdown. Counts lag by up to a minute.
+func myUsage(db *sql.DB, m *usageMeter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hourly, _ := strconv.ParseBool(r.URL.Query().Get("hourly"))
+		u := userFrom(r.Context())
+		month := monthStart(time.Now())
+
+		var tokenID any
+		if u.tokenScopes != nil {
+			tokenID = u.tokenID
+		}
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT t.id, t.name, g.hour, g.requests, g.bytes_in, g.bytes_out
+			FROM tokens t LEFT JOIN token_usage g ON g.token_id = t.id AND g.hour >= $2
+			WHERE t.user_id=$1 AND t.kind='personal' AND ($3::bigint IS NULL OR t.id=$3)
+				AND (t.revoked_at IS NULL OR g.token_id IS NOT NULL)
+			ORDER BY t.id, g.hour`, u.ID, month, tokenID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []tokenUsage{}
+		for rows.Next() {
+			var (
+				id   int64
+				name string
+				hour sql.NullTime
+				c    struct{ requests, in, out sql.NullInt64 }
+			)
+			if err := rows.Scan(&id, &name, &hour, &c.requests, &c.in, &c.out); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if len(out) == 0 || out[len(out)-1].ID != id {
+				out = append(out, tokenUsage{ID: id, Name: name, Quotas: m.limits.limitsFor(u.ID, id)})
+			}
+			if !hour.Valid {
+				continue
+			}
+			h := hourlyUsage{hour.Time, usageCount{c.requests.Int64, c.in.Int64, c.out.Int64}}
+			t := &out[len(out)-1]
+			t.usageCount = t.usageCount.add(h.usageCount)
+			if hourly {
+				t.Hours = append(t.Hours, h)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"period_start": month,
+			"period_end":   month.AddDate(0, 1, 0),
+			"quotas":       m.limits.limitsFor(u.ID, 0),
+			"tokens":       out,
+		})
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+
+	tokenPersonal = "personal"
+
+	tokenTTL = 24 * time.Hour
+)
+
+type User struct {
+	ID          int64     `json:"id"`
+	UUID        string    `json:"uuid"`
+	TenantID    int64     `json:"tenant_id"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Role        string    `json:"role"`
+	Active      bool      `json:"active"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// TwoFactor is set once a TOTP authenticator is confirmed;
+	// RequireTwoFactor makes enrolling one mandatory for this user.
+	TwoFactor        bool `json:"two_factor"`
+	RequireTwoFactor bool `json:"require_two_factor"`
+
+	// Set by authenticate: the scopes of the personal access token used for
+	// the request, or nil for a session token, which has full access.
+	tokenScopes []string
+	// tokenHash identifies the presented token, for logout; tokenID is its
+	// row, for usage metering.
+	tokenHash []byte
+	tokenID   int64
+	// certName is the client certificate name the request authenticated
+	// with, if any.
+	certName string
+}
+
+const userColumns = `u.id, u.uuid, u.tenant_id, u.email, u.name, u.role, u.active, u.created_at,
+	ARRAY(SELECT permission FROM user_permissions p WHERE p.user_id = u.id ORDER BY permission),
+	EXISTS (SELECT 1 FROM user_totp o WHERE o.user_id = u.id AND o.confirmed_at IS NOT NULL), u.require_2fa`
+
+func scanUser(row rowScanner, extra ...any) (User, error) {
+	var u User
+	dest := append([]any{&u.ID, &u.UUID, &u.TenantID, &u.Email, &u.Name, &u.Role, &u.Active, &u.CreatedAt, pq.Array(&u.Permissions),
+		&u.TwoFactor, &u.RequireTwoFactor}, extra...)
+	err := row.Scan(dest...)
+	return u, err
+}
+
+func (u *User) isAdmin() bool {
+	return u != nil && u.Role == roleAdmin
+}
+
+// hasScope reports whether the token used for the request grants scope.
+func (u *User) hasScope(scope string) bool {
+	if u.tokenScopes == nil {
+		return true
+	}
+	for _, s := range u.tokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// POST /users
+func registerUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Email    string `json:"email"`
+			Name     string `json:"name"`
+			Password string `json:"password"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		in.Email = strings.ToLower(strings.TrimSpace(in.Email))
+		in.Name = strings.TrimSpace(in.Name)
+		if addr, err := mail.ParseAddress(in.Email); err != nil || addr.Address != in.Email {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "a valid email is required"})
+			return
+		}
+		if in.Name == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required"})
+			return
+		}
+		if len(in.Password) < 8 || len(in.Password) > 72 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "password must be 8 to 72 bytes long"})
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(in.Password), 12)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		var id int64
+		err = db.QueryRowContext(r.Context(), `
+			INSERT INTO users (tenant_id, email, name, password_hash) VALUES ($1, $2, $3, $4) RETURNING id`,
+			tenantFrom(r.Context()), in.Email, in.Name, hash).Scan(&id)
+		if isUniqueViolation(err) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "a user with this email already exists"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		u, err := scanUser(db.QueryRowContext(r.Context(), `SELECT `+userColumns+` FROM users u WHERE u.id=$1`, id))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		countEvent(eventUserRegistered)
+		writeJSON(w, http.StatusCreated, u)
+	}
+}
+
+// signInAccount is what signing in needs to know about an account.
+type signInAccount struct {
+	id        int64
+	tenant    int64
+	email     string
+	hash      []byte
+	active    bool
+	deleting  bool
+	twoFactor bool
+}
+
+// findSignInAccount loads the account whose column is v, returning
+// sql.ErrNoRows if there is none.
+func findSignInAccount(ctx context.Context, db *sql.DB, column string, v any) (signInAccount, error) {
+	var a signInAccount
+	err := db.QueryRowContext(ctx, `
+		SELECT id, tenant_id, email, password_hash, active, deletion_requested_at IS NOT NULL AND erased_at IS NULL,
+			EXISTS (SELECT 1 FROM user_totp o WHERE o.user_id = users.id AND o.confirmed_at IS NOT NULL)
+		FROM users WHERE `+column+`=$1`, v).Scan(&a.id, &a.tenant, &a.email, &a.hash, &a.active, &a.deleting, &a.twoFactor)
+	return a, err
+}
+
+// canSignIn reports whether the account may be signed in to. An account
+// awaiting deletion is inactive, but signing in to it is how its owner
+// takes the request back.
+func (a signInAccount) canSignIn() bool {
+	return a.active || a.deleting
+}
+
+// finishSignIn runs what every way of signing in shares once the account
+// is known: the second factor if the account has one, clearing failed
+// attempts and taking back a pending deletion. A missing or wrong code is
+// answered 401 with two_factor_required, plus extra (such as the ticket of
+// an external sign-in). It returns false once it has written a response.
+func finishSignIn(w http.ResponseWriter, r *http.Request, db *sql.DB, guard *loginGuard, acct signInAccount, otp string, extra map[string]any) bool {
+	if acct.twoFactor {
+		fail := func(msg string) {
+			body := map[string]any{"error": msg, "two_factor_required": true}
+			for k, v := range extra {
+				body[k] = v
+			}
+			writeJSON(w, http.StatusUnauthorized, body)
+		}
+		if otp == "" {
+			fail("two-factor code required")
+			return false
+		}
+		ok, err := checkSecondFactor(r.Context(), db, acct.id, otp)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return false
+		}
+		if !ok {
+			guard.fail(r, acct.email, acct.id, "two_factor")
+			fail("invalid two-factor code")
+			return false
+		}
+	}
+
+	guard.succeed(r, acct.email)
+	if acct.deleting {
+		if err := cancelAccountDeletion(r, db, acct.id, acct.tenant); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return false
+		}
+	}
+	return true
+}
+
+// POST /tokens/authentication exchanges email and password for a bearer
+// token. Only the token's hash is stored. Users with two-factor
+// authentication also send "otp": a current TOTP or an unused recovery code.
+// Repeated failures are throttled by guard.
+func createAuthToken(db *sql.DB, guard *loginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+			OTP      string `json:"otp"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		email := strings.ToLower(strings.TrimSpace(in.Email))
+		if !guard.check(w, r, email) {
+			return
+		}
+
+		acct, err := findSignInAccount(r.Context(), db, "email", email)
+		if err != nil && err != sql.ErrNoRows {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if err == sql.ErrNoRows || !acct.canSignIn() || bcrypt.CompareHashAndPassword(acct.hash, []byte(in.Password)) != nil {
+			guard.fail(r, email, acct.id, "password")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid credentials"})
+			return
+		}
+		if !finishSignIn(w, r, db, guard, acct, in.OTP, nil) {
+			return
+		}
+
+		token := randomToken(32)
+		expires := time.Now().Add(tokenTTL)
+		_, err = db.ExecContext(r.Context(), `
+			INSERT INTO tokens (hash, user_id, expires_at) VALUES ($1, $2, $3)`, hashToken(token), acct.id, expires)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		logAuthEvent(r, db, acct.id, authLogin, map[string]any{"method": "password", "two_factor": acct.twoFactor})
+		writeJSON(w, http.StatusCreated, map[string]any{"token": token, "expires_at": expires})
+	}
+}
+
+// PUT /me/password changes the caller's password. The caller's other
+// sessions are signed out; personal access tokens keep working. Accounts
+// created through external sign-in have no password yet and can set one
+// without current_password.
+func changePassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		u := userFrom(r.Context())
+		if u.tokenScopes != nil {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "personal access tokens cannot change the password"})
+			return
+		}
+		if len(in.NewPassword) < 8 || len(in.NewPassword) > 72 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "password must be 8 to 72 bytes long"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		var hash []byte
+		if err := tx.QueryRow(`SELECT password_hash FROM users WHERE id=$1 FOR UPDATE`, u.ID).Scan(&hash); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if len(hash) > 0 && bcrypt.CompareHashAndPassword(hash, []byte(in.CurrentPassword)) != nil {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "current password is incorrect"})
+			return
+		}
+		hash, err = bcrypt.GenerateFromPassword([]byte(in.NewPassword), 12)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE users SET password_hash=$1 WHERE id=$2`, hash, u.ID)
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+				UPDATE tokens SET revoked_at=now()
+				WHERE user_id=$1 AND kind='session' AND hash<>$2 AND revoked_at IS NULL`, u.ID, u.tokenHash)
+		}
+		if err == nil {
+			err = recordAuthEvent(r, tx, u.ID, authPasswordChanged, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// authenticate resolves "Authorization: Bearer <token>" to the user and
+// stores it in the request context. Requests without the header continue
+// anonymously if the access mode allows, else they get a 401; a header with
+// a bad, expired, revoked or deactivated token is a 401 so clients notice
+// instead of silently losing their privileges.
+//
+// Tokens are opaque session tokens, personal access tokens, or JWTs from
+// jwts, which are looked up by their ID instead. RS256 tokens from an
+// external identity provider are checked by ext, and requests signed with
+// a personal access token (X-Signature) by signer. Requests with neither
+// fall back to a verified client certificate mapped in certs.
+func authenticate(db *sql.DB, jwts *jwtIssuer, ext *externalJWTs, signer *requestSigner, certs clientCerts, mode string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Authorization, "+signatureHeader)
+			header := r.Header.Get("Authorization")
+			signed := header == "" && r.Header.Get(signatureHeader) != ""
+			serve := func(u User) {
+				if rec := accessRecordFrom(r.Context()); rec != nil {
+					rec.user = strconv.FormatInt(u.ID, 10)
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxUser, &u)))
+			}
+			if header == "" && !signed {
+				if !certs.presented(r) {
+					if !anonymousAllowed(mode, r) {
+						w.Header().Set("WWW-Authenticate", "Bearer")
+						writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+						return
+					}
+					next.ServeHTTP(w, r)
+					return
+				}
+				u, err := certs.user(r, db)
+				if err == errUnknownCertificate {
+					writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+					return
+				}
+				if err != nil {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+					return
+				}
+				serve(u)
+				return
+			}
+
+			var hash []byte
+			if signed {
+				var err error
+				hash, err = signer.verify(r)
+				if status, ok := signatureStatus(err); ok {
+					writeJSON(w, status, map[string]string{"error": err.Error()})
+					return
+				}
+				if err != nil {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+					return
+				}
+			} else {
+				token, ok := strings.CutPrefix(header, "Bearer ")
+				if !ok || token == "" {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid authorization header"})
+					return
+				}
+				if ext.handles(token) {
+					u, err := ext.user(r, db, token)
+					if err == errInvalidToken || err == errLinkRequired {
+						w.Header().Set("WWW-Authenticate", "Bearer")
+						writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+						return
+					}
+					if err != nil {
+						writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+						return
+					}
+					serve(u)
+					return
+				}
+				hash = jwts.storedHash(token)
+			}
+
+			var (
+				tokenID  int64
+				kind     string
+				scopes   []string
+				lastUsed sql.NullTime
+			)
+			u, err := scanUser(db.QueryRowContext(r.Context(), `
+				SELECT `+userColumns+`, t.id, t.kind, t.scopes, t.last_used_at FROM users u
+				JOIN tokens t ON t.user_id = u.id
+				WHERE t.hash = $1 AND (t.expires_at IS NULL OR t.expires_at > now())
+					AND t.revoked_at IS NULL AND u.active`, hash),
+				&tokenID, &kind, pq.Array(&scopes), &lastUsed)
+			if err == sql.ErrNoRows {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": errInvalidToken.Error()})
+				return
+			}
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			u.tokenHash, u.tokenID = hash, tokenID
+			if kind == tokenPersonal {
+				u.tokenScopes = scopes
+				if s := requestAction(r); s != "" && !u.hasScope(s) {
+					writeJSON(w, http.StatusForbidden, map[string]string{"error": "token lacks the " + s + " scope"})
+					return
+				}
+				// Track usage for the token list, at most once a minute.
+				if !lastUsed.Valid || time.Since(lastUsed.Time) > time.Minute {
+					_, _ = db.ExecContext(r.Context(), `UPDATE tokens SET last_used_at=now() WHERE hash=$1`, hash)
+				}
+			}
+			serve(u)
+		})
+	}
+}
+
+func userFrom(ctx context.Context) *User {
+	u, _ := ctx.Value(ctxUser).(*User)
+	return u
+}
+
+// requireUser rejects anonymous requests with 401.
+func requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userFrom(r.Context()) == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// trendingDays is how many days back ?sort=trending counts views.
+const trendingDays = 7
+
+// trendingOrder is the ORDER BY of ?sort=trending: views in the last
+// trendingDays, most first.
+func trendingOrder(wc *whereClause) string {
+	since := time.Now().UTC().AddDate(0, 0, -trendingDays).Format(time.DateOnly)
+	return `(SELECT coalesce(sum(v.views), 0) FROM movie_views v
+		WHERE v.movie_id = movies.id AND v.tenant_id = movies.tenant_id AND v.day > ` + wc.arg(since) + `::date) DESC, id`
+}
+
+// viewCounter counts fetches of movie details in memory and adds them to
+// the movie's views and its daily bucket in movie_views on every flush, so
+// a popular movie costs a write per flush rather than one per read.
+// Responses show the views as of the last flush.
+type viewCounter struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	pending map[viewKey]int64
+}
+
+type viewKey struct {
+	tenant, movie int64
+	day           string // UTC date, as movie_views buckets by
+}
+
+func newViewCounter(db *sql.DB) *viewCounter {
+	return &viewCounter{db: db, pending: map[viewKey]int64{}}
+}
+
+func (c *viewCounter) record(tenant, movie int64) {
+	k := viewKey{tenant, movie, time.Now().UTC().Format(time.DateOnly)}
+	c.mu.Lock()
+	c.pending[k]++
+	c.mu.Unlock()
+}
+
+// run flushes the counts every interval.
+func (c *viewCounter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.flush()
+	}
+}
+
+func (c *viewCounter) flush() {
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = map[viewKey]int64{}
+	c.mu.Unlock()
+
+	for k, n := range batch {
+		// The movie is the tenant's, which in schema mode means its schema.
+		ctx := context.WithValue(context.Background(), ctxTenant, tenantScope{id: k.tenant})
+		_, err := c.db.ExecContext(ctx, `
+			WITH bucket AS (
+				INSERT INTO movie_views (tenant_id, movie_id, day, views) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (movie_id, day) DO UPDATE SET views = movie_views.views + EXCLUDED.views
+			)
+			UPDATE movies SET views = views + $4 WHERE id=$2 AND tenant_id=$1`,
+			k.tenant, k.movie, k.day, n)
+		if err == nil {
+			continue
+		}
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			// The movie was purged since; nothing to count.
+			continue
+		}
+		log.Printf("view flush: %v", err)
+		c.mu.Lock()
+		c.pending[k] += n
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Webhook subscriptions start out pending and only become active once the
+// subscriber has echoed the challenge token back. Verification state lives in
+// the table, so a restart simply resumes where the previous process stopped.
+const (
+	webhookPending = "pending"
+	webhookActive  = "active"
+	webhookFailed  = "failed"
+
+	webhookMaxAttempts = 6
+)
+
+type Webhook struct {
+	ID             int64      `json:"id"`
+	URL            string     `json:"url"`
+	Events         []string   `json:"events"`
+	Status         string     `json:"status"`
+	VerifyAttempts int        `json:"verify_attempts"`
+	NextVerifyAt   *time.Time `json:"next_verify_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ActivatedAt    *time.Time `json:"activated_at,omitempty"`
+}
+
+const webhookColumns = `id, url, events, status, verify_attempts, next_verify_at, last_error, created_at, activated_at`
+
+func scanWebhook(row rowScanner, extra ...any) (Webhook, error) {
+	var (
+		wh   Webhook
+		next time.Time
+	)
+	dest := append([]any{&wh.ID, &wh.URL, pq.Array(&wh.Events), &wh.Status, &wh.VerifyAttempts,
+		&next, &wh.LastError, &wh.CreatedAt, &wh.ActivatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return Webhook{}, err
+	}
+	if wh.Status == webhookPending {
+		wh.NextVerifyAt = &next
+	}
+	return wh, nil
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// POST /webhooks
+//
+// Registering the same URL twice is idempotent: the existing subscription is
+// returned (with its events updated) instead of creating a duplicate, and the
+// verification already in progress keeps its challenge token.
+func createWebhook(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+		if err := readJSON(r, &in); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalidJSON(err)})
+			return
+		}
+		u, err := url.Parse(strings.TrimSpace(in.URL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "url must be an absolute http(s) url"})
+			return
+		}
+		if err := checkWebhookHost(r.Context(), u.Hostname()); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		tenant := tenantFrom(r.Context())
+		var before *Webhook
+		old, err := scanWebhook(tx.QueryRow(`
+			SELECT `+webhookColumns+` FROM webhooks WHERE url=$1 AND tenant_id=$2 FOR UPDATE`, u.String(), tenant))
+		switch {
+		case err == nil:
+			before = &old
+		case err != sql.ErrNoRows:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		var created bool
+		wh, err := scanWebhook(tx.QueryRow(`
+			INSERT INTO webhooks (tenant_id, url, events, challenge) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (tenant_id, url) DO UPDATE SET events=EXCLUDED.events
+			RETURNING `+webhookColumns+`, (xmax = 0)`,
+			tenant, u.String(), pq.Array(cleanLabels(in.Events)), randomToken(16)), &created)
+		if err == nil {
+			action := "update"
+			if created {
+				action = "create"
+			}
+			err = recordAudit(r, tx, "webhook", wh.ID, action, before, wh)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		// 202: the subscription exists but won't receive anything until the
+		// handshake succeeds.
+		code := http.StatusOK
+		if created {
+			code = http.StatusAccepted
+		}
+		writeJSON(w, code, wh)
+	}
+}
+
+// GET /webhooks
+func listWebhooks(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), `SELECT `+webhookColumns+` FROM webhooks WHERE tenant_id=$1 ORDER BY id`, tenantFrom(r.Context()))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		out := []Webhook{}
+		for rows.Next() {
+			wh, err := scanWebhook(rows)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			out = append(out, wh)
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// GET /webhooks/{id}
+func getWebhook(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		wh, err := scanWebhook(db.QueryRowContext(r.Context(), `
+			SELECT `+webhookColumns+` FROM webhooks WHERE id=$1 AND tenant_id=$2`, id, tenantFrom(r.Context())))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, wh)
+	}
+}
+
+// POST /webhooks/{id}/verify restarts the handshake for a failed
+// subscription, e.g. after the subscriber fixed their endpoint.
+func reverifyWebhook(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := scanWebhook(tx.QueryRow(`
+			SELECT `+webhookColumns+` FROM webhooks WHERE id=$1 AND tenant_id=$2 AND status <> 'active' FOR UPDATE`,
+			id, tenantFrom(r.Context())))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "webhook not found or already active"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		wh, err := scanWebhook(tx.QueryRow(`
+			UPDATE webhooks
+			SET status='pending', verify_attempts=0, next_verify_at=now(), last_error=''
+			WHERE id=$1
+			RETURNING `+webhookColumns, id))
+		if err == nil {
+			err = recordAudit(r, tx, "webhook", id, "update", before, wh)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, wh)
+	}
+}
+
+// DELETE /webhooks/{id}
+func deleteWebhook(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := scanWebhook(tx.QueryRow(`
+			DELETE FROM webhooks WHERE id=$1 AND tenant_id=$2 RETURNING `+webhookColumns, id, tenantFrom(r.Context())))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err == nil {
+			err = recordAudit(r, tx, "webhook", id, "delete", before, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// nonPublicPrefixes are the ranges isPublicIP refuses on top of what netip
+// classifies: shared address space (carrier-grade NAT), "this network",
+// IETF protocol assignments, documentation, benchmarking and reserved.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// isPublicIP reports whether ip is an internet address a webhook may be
+// sent to: not loopback, private (RFC 1918, unique local), link-local
+// (which includes cloud metadata at 169.254.169.254), multicast or any of
+// nonPublicPrefixes.
+func isPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+var errPrivateWebhook = errors.New("url must point at a public address")
+
+// checkWebhookHost resolves host and refuses it unless every address is
+// public, so a bad subscription fails when it is made. The delivery client
+// checks again on every connection, since DNS can change in between.
+func checkWebhookHost(ctx context.Context, host string) error {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !isPublicIP(ip) {
+			return errPrivateWebhook
+		}
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("url host %s does not resolve", host)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return errPrivateWebhook
+		}
+	}
+	return nil
+}
+
+// webhookClient is the client that calls subscribers. Subscriber URLs come
+// from API clients, so it only connects to public addresses: the check
+// runs on the address actually dialed, after DNS resolution, for the first
+// request and every redirect alike. Proxies from the environment are not
+// used, since they would dial on its behalf.
+func webhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || !isPublicIP(ap.Addr()) {
+				return fmt.Errorf("refusing to connect to %s: %w", address, errPrivateWebhook)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 5 * time.Second},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("redirect to a non-http(s) url")
+			}
+			return nil
+		},
+	}
+}
+
+// runWebhookVerifier polls for pending subscriptions and performs the
+// challenge handshake. Rows are claimed with SKIP LOCKED and leased by pushing
+// next_verify_at forward, so several replicas can run it side by side and a
+// crash mid-attempt only delays that subscription by the lease. With
+// schema isolation it goes through every tenant's subscriptions in turn.
+func runWebhookVerifier(db *sql.DB, schemas bool) {
+	client := webhookClient()
+	for {
+		err := forEachTenant(context.Background(), db, schemas, func(ctx context.Context) error {
+			return verifyPendingWebhooks(ctx, db, client)
+		})
+		if err != nil {
+			log.Printf("webhook verifier: %v", err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func verifyPendingWebhooks(ctx context.Context, db *sql.DB, client *http.Client) error {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE webhooks SET next_verify_at = now() + interval '1 minute'
+		WHERE id IN (
+			SELECT id FROM webhooks
+			WHERE status = 'pending' AND next_verify_at <= now()
+			ORDER BY next_verify_at
+			LIMIT 10
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, url, challenge, verify_attempts`)
+	if err != nil {
+		return err
+	}
+	type claim struct {
+		id        int64
+		url       string
+		challenge string
+		attempts  int
+	}
+	var claims []claim
+	for rows.Next() {
+		var c claim
+		if err := rows.Scan(&c.id, &c.url, &c.challenge, &c.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		claims = append(claims, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range claims {
+		herr := sendChallenge(client, c.url, c.challenge)
+		if herr == nil {
+			_, err = db.ExecContext(ctx, `
+				UPDATE webhooks
+				SET status='active', activated_at=now(), verify_attempts=verify_attempts+1, last_error=''
+				WHERE id=$1 AND status='pending'`, c.id)
+			countEvent(eventWebhookVerified)
+			log.Printf("webhook %d verified", c.id)
+		} else if c.attempts+1 >= webhookMaxAttempts {
+			_, err = db.ExecContext(ctx, `
+				UPDATE webhooks SET status='failed', verify_attempts=verify_attempts+1, last_error=$2
+				WHERE id=$1 AND status='pending'`, c.id, herr.Error())
+			countEvent(eventWebhookDeadLettered)
+			log.Printf("webhook %d verification failed permanently: %v", c.id, herr)
+		} else {
+			// Exponential backoff: 5s, 10s, 20s, ... between attempts.
+			delay := (5 * time.Second) << c.attempts
+			_, err = db.ExecContext(ctx, `
+				UPDATE webhooks
+				SET verify_attempts=verify_attempts+1, last_error=$2, next_verify_at=now() + $3 * interval '1 second'
+				WHERE id=$1 AND status='pending'`, c.id, herr.Error(), delay.Seconds())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendChallenge POSTs the challenge token to the subscriber, which must answer
+// 2xx with either {"challenge": "<token>"} or the bare token as the body.
+func sendChallenge(client *http.Client, target, challenge string) error {
+	body, _ := json.Marshal(map[string]string{"type": "webhook.verification", "challenge": challenge})
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("subscriber returned %s", resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	var echo struct {
+		Challenge string `json:"challenge"`
+	}
+	if json.Unmarshal(raw, &echo) == nil && echo.Challenge == challenge {
+		return nil
+	}
+	if strings.TrimSpace(string(raw)) == challenge {
+		return nil
+	}
+	return fmt.Errorf("subscriber did not echo the challenge")
+}
@@ -0,0 +1,583 @@
+// Command moviectl lists, creates, updates, deletes, imports and exports
+// movies from the terminal, through the practice4/client package. Servers
+// and credentials are kept as named profiles; see `moviectl profile`.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"practice4/client"
+)
+
+const usageText = `usage: moviectl [-profile name] [-server url] [-token token] [-o table|json] <command> [args]
+
+commands:
+  list    [filters] [-limit n] [-cursor c] [-all]   list movies
+  get     <id>                                      show a movie
+  create  [movie flags] [-f file.json]              add a movie
+  update  <id> [movie flags] [-f file.json]         change a movie; fields not given are kept
+  delete  <id>                                      soft-delete a movie
+  import  <file.json|->                             bulk-load a JSON array of movies
+  export  [filters] [-f file.json]                  write every matching movie as a JSON array
+  login   -email addr [-otp code]                   sign in and save the token to the profile
+  profile list|show|set|use|delete                  manage server profiles
+
+Run "moviectl <command> -h" for its flags. MOVIECTL_PROFILE, MOVIECTL_SERVER and
+MOVIECTL_TOKEN override the profile; MOVIECTL_CONFIG moves the config file.
+`
+
+type app struct {
+	ctx      context.Context
+	c        *client.Client
+	out      io.Writer
+	json     bool
+	profiles *profiles
+	profile  string
+	server   string
+}
+
+var commands = map[string]func(*app, []string) error{
+	"list":    listCommand,
+	"get":     getCommand,
+	"create":  createCommand,
+	"update":  updateCommand,
+	"delete":  deleteCommand,
+	"import":  importCommand,
+	"export":  exportCommand,
+	"login":   loginCommand,
+	"profile": profileCommand,
+}
+
+func main() {
+	global := flag.NewFlagSet("moviectl", flag.ExitOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usageText) }
+	profileName := global.String("profile", "", "profile to use (default the current one)")
+	server := global.String("server", os.Getenv("MOVIECTL_SERVER"), "API base URL, overriding the profile")
+	token := global.String("token", os.Getenv("MOVIECTL_TOKEN"), "bearer token, overriding the profile")
+	output := global.String("o", "table", "output format: table or json")
+	global.Parse(os.Args[1:])
+	args := global.Args()
+	if len(args) == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "moviectl: unknown command %q\n\n%s", args[0], usageText)
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fatal(errors.New("-o must be table or json"))
+	}
+
+	profs, err := loadProfiles()
+	if err != nil {
+		fatal(err)
+	}
+	name, prof, err := profs.resolve(*profileName)
+	if err != nil && args[0] != "profile" {
+		fatal(err)
+	}
+	if *server != "" {
+		prof.Server = *server
+	}
+	if *token != "" {
+		prof.Token = *token
+	}
+	opts := []client.Option{client.WithUserAgent("moviectl")}
+	if prof.Token != "" {
+		opts = append(opts, client.WithToken(prof.Token))
+	}
+	if prof.Tenant != "" {
+		opts = append(opts, client.WithTenant(prof.Tenant))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	a := &app{
+		ctx:      ctx,
+		c:        client.New(prof.Server, opts...),
+		out:      os.Stdout,
+		json:     *output == "json",
+		profiles: profs,
+		profile:  name,
+		server:   prof.Server,
+	}
+	if err := cmd(a, args[1:]); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "moviectl:", err)
+	os.Exit(1)
+}
+
+// filterFlags adds the listing filters to fs.
+func filterFlags(fs *flag.FlagSet) func() (client.ListMoviesOptions, error) {
+	genre := fs.String("genre", "", "only movies with this genre")
+	genres := fs.String("genres", "", "comma-separated genres; movies with any of them")
+	all := fs.Bool("all-genres", false, "with -genres, movies with all of them")
+	tag := fs.String("tag", "", "only movies with this tag")
+	cert := fs.String("certification", "", "only movies with this certification")
+	yearMin := fs.Int("year-min", 0, "earliest year")
+	yearMax := fs.Int("year-max", 0, "latest year")
+	ratingMin := fs.Float64("rating-min", 0, "lowest rating")
+	ratingMax := fs.Float64("rating-max", 10, "highest rating")
+	since := fs.String("created-after", "", "only movies added after this RFC 3339 time")
+	return func() (client.ListMoviesOptions, error) {
+		o := client.ListMoviesOptions{Genre: *genre, GenresMatchAll: *all, Tag: *tag, Certification: *cert,
+			YearMin: *yearMin, YearMax: *yearMax}
+		if *genres != "" {
+			o.Genres = strings.Split(*genres, ",")
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "rating-min":
+				o.RatingMin = ratingMin
+			case "rating-max":
+				o.RatingMax = ratingMax
+			}
+		})
+		if *since != "" {
+			t, err := time.Parse(time.RFC3339, *since)
+			if err != nil {
+				return o, errors.New("-created-after must be an RFC 3339 time")
+			}
+			o.CreatedAfter = t
+		}
+		return o, nil
+	}
+}
+
+func listCommand(a *app, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	filters := filterFlags(fs)
+	limit := fs.Int("limit", 20, "page size, 1 to 500")
+	cursor := fs.String("cursor", "", "cursor of the page to show, from a previous list")
+	all := fs.Bool("all", false, "list every matching movie, following the pages")
+	fs.Parse(args)
+	opts, err := filters()
+	if err != nil {
+		return err
+	}
+	opts.Limit, opts.Cursor = *limit, *cursor
+
+	if *all {
+		var movies []client.Movie
+		it := a.c.Movies(opts)
+		for it.Next(a.ctx) {
+			movies = append(movies, it.Movie())
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		return a.printMovies(movies)
+	}
+	page, err := a.c.ListMovies(a.ctx, opts)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(map[string]any{"movies": page.Movies, "next_cursor": page.NextCursor})
+	}
+	if err := a.printMovies(page.Movies); err != nil {
+		return err
+	}
+	if page.NextCursor != "" {
+		fmt.Fprintf(os.Stderr, "more: moviectl list -cursor %s\n", page.NextCursor)
+	}
+	return nil
+}
+
+func getCommand(a *app, args []string) error {
+	id, err := movieID(args)
+	if err != nil {
+		return err
+	}
+	m, err := a.c.GetMovie(a.ctx, id)
+	if err != nil {
+		return err
+	}
+	return a.printMovie(m)
+}
+
+// movieFlags adds the fields of a movie to fs. The returned function applies
+// the ones given on the command line to in, after -f if that was given too.
+func movieFlags(fs *flag.FlagSet) func(in *client.MovieInput) error {
+	file := fs.String("f", "", "JSON file with the movie, in the API's create format; - reads stdin")
+	title := fs.String("title", "", "title")
+	year := fs.Int("year", 0, "release year")
+	rating := fs.Float64("rating", 0, "rating, 0 to 10")
+	genres := fs.String("genres", "", "comma-separated genres")
+	cert := fs.String("certification", "", "certification, e.g. PG-13")
+	metadata := fs.String("metadata", "", "metadata as a JSON object")
+	imdb := fs.String("imdb", "", "IMDb ID (create only)")
+	tmdb := fs.Int64("tmdb", 0, "TMDb ID (create only)")
+	return func(in *client.MovieInput) error {
+		if *file != "" {
+			raw, err := readFile(*file)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(raw, in); err != nil {
+				return fmt.Errorf("%s: %w", *file, err)
+			}
+		}
+		var err error
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "title":
+				in.Title = *title
+			case "year":
+				in.Year = *year
+			case "rating":
+				in.Rating = rating
+			case "genres":
+				in.Genres = nil
+				if *genres != "" {
+					in.Genres = strings.Split(*genres, ",")
+				}
+			case "certification":
+				in.Certification = *cert
+			case "metadata":
+				if !json.Valid([]byte(*metadata)) {
+					err = errors.New("-metadata must be JSON")
+				}
+				in.Metadata = json.RawMessage(*metadata)
+			case "imdb", "tmdb":
+				if in.ExternalIDs == nil {
+					in.ExternalIDs = &client.ExternalIDs{}
+				}
+				in.ExternalIDs.IMDbID, in.ExternalIDs.TMDbID = *imdb, *tmdb
+			}
+		})
+		return err
+	}
+}
+
+func createCommand(a *app, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	apply := movieFlags(fs)
+	fs.Parse(args)
+	var in client.MovieInput
+	if err := apply(&in); err != nil {
+		return err
+	}
+	m, err := a.c.CreateMovie(a.ctx, in)
+	if err != nil {
+		return err
+	}
+	return a.printMovie(m)
+}
+
+func updateCommand(a *app, args []string) error {
+	id, err := movieID(args)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	apply := movieFlags(fs)
+	fs.Parse(args[1:])
+
+	// An update replaces the whole movie, so start from what it is now.
+	cur, err := a.c.GetMovie(a.ctx, id)
+	if err != nil {
+		return err
+	}
+	in := client.MovieInput{Title: cur.Title, Year: cur.Year, Rating: cur.Rating, Genres: cur.Genres,
+		Certification: cur.Certification, Metadata: cur.Metadata}
+	if err := apply(&in); err != nil {
+		return err
+	}
+	if in.ExternalIDs != nil {
+		return errors.New("external IDs can't be changed by an update")
+	}
+	m, err := a.c.UpdateMovie(a.ctx, id, in)
+	if err != nil {
+		return err
+	}
+	return a.printMovie(m)
+}
+
+func deleteCommand(a *app, args []string) error {
+	id, err := movieID(args)
+	if err != nil {
+		return err
+	}
+	if err := a.c.DeleteMovie(a.ctx, id); err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(map[string]any{"deleted": id})
+	}
+	fmt.Fprintf(a.out, "deleted movie %d\n", id)
+	return nil
+}
+
+func importCommand(a *app, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: moviectl import <file.json|->")
+	}
+	r := io.Reader(os.Stdin)
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	sum, err := a.c.ImportMoviesFrom(a.ctx, r)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(sum)
+	}
+	fmt.Fprintf(a.out, "%d received, %d imported, %d skipped as duplicates in %.1fs\n",
+		sum.Received, sum.Imported, sum.SkippedDuplicates, sum.Seconds)
+	return nil
+}
+
+func exportCommand(a *app, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	filters := filterFlags(fs)
+	file := fs.String("f", "-", "file to write; - is stdout")
+	fs.Parse(args)
+	opts, err := filters()
+	if err != nil {
+		return err
+	}
+	if *file == "-" {
+		return a.c.ExportMovies(a.ctx, opts, a.out)
+	}
+	// Write next to the target and rename, so a failed export doesn't
+	// leave half a file behind.
+	tmp := *file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = a.c.ExportMovies(a.ctx, opts, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, *file)
+}
+
+func loginCommand(a *app, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	email := fs.String("email", "", "account email")
+	otp := fs.String("otp", "", "current two-factor code, if the account has two-factor authentication")
+	fs.Parse(args)
+	if *email == "" {
+		return errors.New("login needs -email")
+	}
+	password := os.Getenv("MOVIECTL_PASSWORD")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	tok, err := a.c.Login(a.ctx, *email, password, *otp)
+	if errors.Is(err, client.ErrTwoFactorRequired) {
+		return errors.New("the account has two-factor authentication; pass the current code with -otp")
+	}
+	if err != nil {
+		return err
+	}
+
+	name := a.profile
+	if name == "" {
+		name = "default"
+	}
+	prof := a.profiles.Profiles[name]
+	prof.Server, prof.Token = a.server, tok.Token
+	a.profiles.Profiles[name] = prof
+	if a.profiles.Current == "" {
+		a.profiles.Current = name
+	}
+	if err := a.profiles.save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "signed in; token saved to profile %q, valid until %s\n", name, tok.ExpiresAt.Local().Format(time.DateTime))
+	return nil
+}
+
+func profileCommand(a *app, args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	p := a.profiles
+	switch args[0] {
+	case "list":
+		if a.json {
+			return a.printJSON(map[string]any{"current": p.Current, "profiles": p.names()})
+		}
+		tw := tabwriter.NewWriter(a.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tNAME\tSERVER\tTENANT\tTOKEN")
+		for _, name := range p.names() {
+			prof := p.Profiles[name]
+			mark := ""
+			if name == p.Current {
+				mark = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\n", mark, name, prof.Server, prof.Tenant, prof.Token != "")
+		}
+		return tw.Flush()
+	case "set":
+		fs := flag.NewFlagSet("profile set", flag.ExitOnError)
+		server := fs.String("server", "", "API base URL")
+		token := fs.String("token", "", "bearer token, e.g. a personal access token")
+		tenant := fs.String("tenant", "", "tenant slug for anonymous requests")
+		if len(args) < 2 {
+			return errors.New("usage: moviectl profile set <name> [-server url] [-token token] [-tenant slug]")
+		}
+		fs.Parse(args[2:])
+		name := args[1]
+		prof, ok := p.Profiles[name]
+		if !ok {
+			prof.Server = "http://localhost:8080"
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "server":
+				prof.Server = *server
+			case "token":
+				prof.Token = *token
+			case "tenant":
+				prof.Tenant = *tenant
+			}
+		})
+		p.Profiles[name] = prof
+		if p.Current == "" {
+			p.Current = name
+		}
+		return p.save()
+	case "use", "delete", "show":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: moviectl profile %s <name>", args[0])
+		}
+		name := args[1]
+		prof, ok := p.Profiles[name]
+		if !ok {
+			return fmt.Errorf("no profile %q", name)
+		}
+		switch args[0] {
+		case "show":
+			if prof.Token != "" {
+				prof.Token = "(set)"
+			}
+			return a.printJSON(prof)
+		case "use":
+			p.Current = name
+		case "delete":
+			delete(p.Profiles, name)
+			if p.Current == name {
+				p.Current = ""
+			}
+		}
+		return p.save()
+	}
+	return fmt.Errorf("unknown profile command %q", args[0])
+}
+
+func movieID(args []string) (int64, error) {
+	if len(args) == 0 {
+		return 0, errors.New("missing movie id")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid movie id %q", args[0])
+	}
+	return id, nil
+}
+
+func readFile(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+func (a *app) printJSON(v any) error {
+	enc := json.NewEncoder(a.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (a *app) printMovies(movies []client.Movie) error {
+	if a.json {
+		if movies == nil {
+			movies = []client.Movie{}
+		}
+		return a.printJSON(movies)
+	}
+	tw := tabwriter.NewWriter(a.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tYEAR\tRATING\tGENRES")
+	for _, m := range movies {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", m.ID, m.Title, yearString(m.Year), ratingString(m.Rating), strings.Join(m.Genres, ", "))
+	}
+	return tw.Flush()
+}
+
+func (a *app) printMovie(m *client.Movie) error {
+	if a.json {
+		return a.printJSON(m)
+	}
+	tw := tabwriter.NewWriter(a.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "id\t%d\n", m.ID)
+	fmt.Fprintf(tw, "uuid\t%s\n", m.UUID)
+	fmt.Fprintf(tw, "title\t%s\n", m.Title)
+	fmt.Fprintf(tw, "year\t%s\n", yearString(m.Year))
+	fmt.Fprintf(tw, "rating\t%s\n", ratingString(m.Rating))
+	fmt.Fprintf(tw, "genres\t%s\n", strings.Join(m.Genres, ", "))
+	fmt.Fprintf(tw, "certification\t%s\n", m.Certification)
+	if m.ExternalIDs != nil {
+		if m.ExternalIDs.IMDbID != "" {
+			fmt.Fprintf(tw, "imdb\t%s\n", m.ExternalIDs.IMDbID)
+		}
+		if m.ExternalIDs.TMDbID != 0 {
+			fmt.Fprintf(tw, "tmdb\t%d\n", m.ExternalIDs.TMDbID)
+		}
+	}
+	if len(m.Metadata) > 0 && string(m.Metadata) != "{}" {
+		fmt.Fprintf(tw, "metadata\t%s\n", m.Metadata)
+	}
+	fmt.Fprintf(tw, "updated\t%s\n", m.UpdatedAt.Local().Format(time.DateTime))
+	return tw.Flush()
+}
+
+func yearString(y int) string {
+	if y == 0 {
+		return "-"
+	}
+	return strconv.Itoa(y)
+}
+
+func ratingString(r *float64) string {
+	if r == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(*r, 'f', 1, 64)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// profile is one server and the credentials to use with it.
+type profile struct {
+	Server string `json:"server"`
+	Token  string `json:"token,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// profiles is the config file, by default ~/.config/moviectl/config.json.
+// It holds tokens, so it is written readable by the owner only.
+type profiles struct {
+	Current  string             `json:"current"`
+	Profiles map[string]profile `json:"profiles"`
+
+	path string
+}
+
+func configPath() (string, error) {
+	if p := os.Getenv("MOVIECTL_CONFIG"); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "moviectl", "config.json"), nil
+}
+
+func loadProfiles() (*profiles, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	p := &profiles{Profiles: map[string]profile{}, path: path}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if p.Profiles == nil {
+		p.Profiles = map[string]profile{}
+	}
+	return p, nil
+}
+
+func (p *profiles) save() error {
+	raw, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0o700); err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, append(raw, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// resolve picks the profile to use: name, else MOVIECTL_PROFILE, else the
+// current one. Having no profile at all is fine, for a local server.
+func (p *profiles) resolve(name string) (string, profile, error) {
+	if name == "" {
+		name = os.Getenv("MOVIECTL_PROFILE")
+	}
+	if name == "" {
+		name = p.Current
+	}
+	if name == "" {
+		return "", profile{Server: "http://localhost:8080"}, nil
+	}
+	prof, ok := p.Profiles[name]
+	if !ok {
+		return "", profile{}, fmt.Errorf("no profile %q in %s", name, p.path)
+	}
+	return name, prof, nil
+}
+
+func (p *profiles) names() []string {
+	names := make([]string, 0, len(p.Profiles))
+	for name := range p.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,225 @@
+// Package mailer renders the API's emails from embedded templates and sends
+// them over SMTP. Callers queue emails rather than sending them inline; see
+// the email outbox in cmd/api.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Message is one rendered email. Text and HTML are alternatives of the same
+// content; HTML may be empty. Unsubscribe, when set, is the one-click
+// unsubscribe URL (RFC 8058) mail clients offer next to the sender.
+type Message struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Unsubscribe string
+}
+
+// Sender delivers messages.
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Every template file defines "subject", "text" and "content" (the body of
+// the HTML version, framed by layout.tmpl), and optionally "unsubscribe",
+// the URL for Message.Unsubscribe. Names are the file names without .tmpl.
+//
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+type template struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var templates = mustParse()
+
+func mustParse() map[string]template {
+	files, err := templateFS.ReadDir("templates")
+	if err != nil {
+		panic(err)
+	}
+	out := map[string]template{}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".tmpl")
+		if name == "layout" {
+			continue
+		}
+		file := path.Join("templates", f.Name())
+		out[name] = template{
+			text: texttemplate.Must(texttemplate.New(name).Option("missingkey=error").ParseFS(templateFS, file)),
+			html: htmltemplate.Must(htmltemplate.New(name).Option("missingkey=error").ParseFS(templateFS, "templates/layout.tmpl", file)),
+		}
+	}
+	return out
+}
+
+// Templates lists the template names.
+func Templates() []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render fills the template name with data and addresses it to to.
+func Render(name, to string, data any) (Message, error) {
+	t, ok := templates[name]
+	if !ok {
+		return Message{}, fmt.Errorf("mailer: no template %q", name)
+	}
+	m := Message{To: to}
+	var b bytes.Buffer
+	if err := t.text.ExecuteTemplate(&b, "subject", data); err != nil {
+		return Message{}, err
+	}
+	// The subject is a header; line breaks would start new ones.
+	m.Subject = strings.Join(strings.Fields(b.String()), " ")
+	b.Reset()
+	if err := t.text.ExecuteTemplate(&b, "text", data); err != nil {
+		return Message{}, err
+	}
+	m.Text = b.String()
+	b.Reset()
+	if err := t.html.ExecuteTemplate(&b, "layout", data); err != nil {
+		return Message{}, err
+	}
+	m.HTML = b.String()
+	if t.text.Lookup("unsubscribe") != nil {
+		b.Reset()
+		if err := t.text.ExecuteTemplate(&b, "unsubscribe", data); err != nil {
+			return Message{}, err
+		}
+		m.Unsubscribe = strings.TrimSpace(b.String())
+	}
+	return m, nil
+}
+
+// SMTP sends through a mail server, upgrading to TLS when the server offers
+// STARTTLS and authenticating with PLAIN when a username is set.
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	if strings.ContainsAny(m.To+s.From+m.Unsubscribe, "\r\n") {
+		return fmt.Errorf("mailer: invalid address")
+	}
+	body, err := encode(s.From, m)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// encode builds the RFC 5322 message: multipart/alternative with the text
+// and HTML parts, quoted-printable.
+func encode(from string, m Message) ([]byte, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\n", from, m.To, mime.QEncoding.Encode("utf-8", m.Subject))
+	if m.Unsubscribe != "" {
+		fmt.Fprintf(&b, "List-Unsubscribe: <%s>\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n", m.Unsubscribe)
+	}
+	parts := []struct{ contentType, body string }{{"text/plain", m.Text}}
+	if m.HTML != "" {
+		parts = append(parts, struct{ contentType, body string }{"text/html", m.HTML})
+	}
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, p := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Log stands in when no mail server is configured, so development setups
+// see what would have been sent. It logs the subject, not the recipient.
+type Log struct{}
+
+func (Log) Send(_ context.Context, m Message) error {
+	log.Printf("email not sent (no SMTP server configured): %s", m.Subject)
+	return nil
+}
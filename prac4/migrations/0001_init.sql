@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS movies (
+  id SERIAL PRIMARY KEY,
+  title TEXT NOT NULL,
+  genres TEXT[] NOT NULL DEFAULT '{}',
+  imdb_id TEXT UNIQUE,
+  tmdb_id BIGINT UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS movies_genres_idx ON movies USING GIN (genres);
+
+CREATE TABLE IF NOT EXISTS movie_translations (
+  movie_id INTEGER NOT NULL REFERENCES movies(id) ON DELETE CASCADE,
+  language TEXT NOT NULL,
+  description TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'machine' CHECK (status IN ('machine', 'reviewed')),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (movie_id, language)
+);
+
+-- optional seed data (can remove if you want empty DB)
+INSERT INTO movies (title)
+SELECT 'Sample Movie'
+WHERE NOT EXISTS (SELECT 1 FROM movies);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+  id BIGSERIAL PRIMARY KEY,
+  url TEXT NOT NULL UNIQUE,
+  events TEXT[] NOT NULL DEFAULT '{}',
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'active', 'failed')),
+  challenge TEXT NOT NULL,
+  verify_attempts INTEGER NOT NULL DEFAULT 0,
+  next_verify_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  activated_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_pending_idx ON webhooks (next_verify_at) WHERE status = 'pending';
@@ -0,0 +1,47 @@
+CREATE TABLE IF NOT EXISTS genres (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE
+);
+
+INSERT INTO genres (name)
+SELECT DISTINCT unnest(genres) FROM movies
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO genres (name) VALUES
+  ('Action'), ('Adventure'), ('Animation'), ('Comedy'), ('Crime'), ('Documentary'),
+  ('Drama'), ('Family'), ('Fantasy'), ('Horror'), ('Mystery'), ('Romance'),
+  ('Science Fiction'), ('Thriller'), ('War'), ('Western')
+ON CONFLICT (name) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS certifications (
+  code TEXT PRIMARY KEY,
+  description TEXT NOT NULL,
+  min_age INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO certifications (code, description, min_age) VALUES
+  ('G', 'General audiences', 0),
+  ('PG', 'Parental guidance suggested', 0),
+  ('PG-13', 'Parents strongly cautioned', 13),
+  ('R', 'Restricted', 17),
+  ('NC-17', 'Adults only', 18)
+ON CONFLICT (code) DO NOTHING;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS certification TEXT REFERENCES certifications(code);
+
+-- The API keeps these tables in memory; tell it whenever they change, no
+-- matter who made the change.
+CREATE OR REPLACE FUNCTION notify_reference_change() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify('cache_invalidate', TG_TABLE_NAME);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS genres_notify ON genres;
+CREATE TRIGGER genres_notify AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON genres
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_reference_change();
+
+DROP TRIGGER IF EXISTS certifications_notify ON certifications;
+CREATE TRIGGER certifications_notify AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON certifications
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_reference_change();
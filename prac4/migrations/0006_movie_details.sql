@@ -0,0 +1,8 @@
+ALTER TABLE movies
+  ADD COLUMN IF NOT EXISTS year INTEGER CHECK (year BETWEEN 1888 AND 2100),
+  ADD COLUMN IF NOT EXISTS rating NUMERIC(3, 1) CHECK (rating BETWEEN 0 AND 10),
+  ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS movies_created_at_idx ON movies (created_at);
+CREATE INDEX IF NOT EXISTS movies_year_idx ON movies (year);
@@ -0,0 +1,7 @@
+ALTER TABLE tokens
+  ADD COLUMN IF NOT EXISTS id BIGSERIAL UNIQUE,
+  ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'session' CHECK (kind IN ('session', 'personal')),
+  ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{}',
+  ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMPTZ,
+  ALTER COLUMN expires_at DROP NOT NULL;
@@ -0,0 +1,12 @@
+-- Profile settings and notification preferences. Users without a row get
+-- the defaults.
+CREATE TABLE IF NOT EXISTS user_preferences (
+  user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  avatar_url TEXT NOT NULL DEFAULT '',
+  timezone TEXT NOT NULL DEFAULT 'UTC',
+  email_notifications BOOLEAN NOT NULL DEFAULT TRUE,
+  notify_reviews BOOLEAN NOT NULL DEFAULT TRUE,
+  notify_replies BOOLEAN NOT NULL DEFAULT TRUE,
+  weekly_digest BOOLEAN NOT NULL DEFAULT FALSE,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
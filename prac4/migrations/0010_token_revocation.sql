@@ -0,0 +1,3 @@
+-- Revoked tokens stay on record until they expire, so admins can see when
+-- and which tokens were cut off.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ;
@@ -0,0 +1,20 @@
+-- TOTP two-factor authentication. An enrollment counts once confirmed with
+-- a first code; last_step is the newest time step used, so a code can't be
+-- replayed.
+CREATE TABLE IF NOT EXISTS user_totp (
+  user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  secret BYTEA NOT NULL,
+  confirmed_at TIMESTAMPTZ,
+  last_step BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- One-time codes for when the authenticator is lost; only hashes are kept.
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash BYTEA NOT NULL,
+  used_at TIMESTAMPTZ,
+  PRIMARY KEY (user_id, code_hash)
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS require_2fa BOOLEAN NOT NULL DEFAULT FALSE;
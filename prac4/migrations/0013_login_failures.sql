@@ -0,0 +1,8 @@
+-- Recent failed sign-ins, keyed by "account:<email>" or "ip:<address>".
+-- Rows older than the lockout window are ignored and pruned.
+CREATE TABLE IF NOT EXISTS login_failures (
+  key TEXT PRIMARY KEY,
+  failures INT NOT NULL,
+  last_failure_at TIMESTAMPTZ NOT NULL,
+  locked_until TIMESTAMPTZ
+);
@@ -0,0 +1,14 @@
+-- Security-relevant account activity: sign-ins, password and 2FA changes,
+-- tokens and permissions. user_id is NULL for attempts on unknown accounts.
+CREATE TABLE IF NOT EXISTS auth_events (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+  type TEXT NOT NULL,
+  ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  details JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS auth_events_user_idx ON auth_events (user_id, id);
+CREATE INDEX IF NOT EXISTS auth_events_type_idx ON auth_events (type, id);
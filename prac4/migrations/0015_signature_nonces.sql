@@ -0,0 +1,8 @@
+-- Nonces of signed requests seen within the signature window, so a captured
+-- request can't be replayed.
+CREATE TABLE IF NOT EXISTS signature_nonces (
+  token_id BIGINT NOT NULL,
+  nonce TEXT NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (token_id, nonce)
+);
@@ -0,0 +1,10 @@
+-- Requests and bytes per personal access token, one row per hour, for
+-- monthly quotas and GET /me/usage.
+CREATE TABLE IF NOT EXISTS token_usage (
+  token_id BIGINT NOT NULL REFERENCES tokens(id) ON DELETE CASCADE,
+  hour TIMESTAMPTZ NOT NULL,
+  requests BIGINT NOT NULL DEFAULT 0,
+  bytes_in BIGINT NOT NULL DEFAULT 0,
+  bytes_out BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (token_id, hour)
+);
@@ -0,0 +1,45 @@
+-- Tenants partition the data: movies, translations, webhooks, users and
+-- audit entries belong to exactly one. Everything that existed before is
+-- the default tenant's. tenant_id has no default, so a write that doesn't
+-- say which tenant it is for fails instead of landing in one.
+CREATE TABLE IF NOT EXISTS tenants (
+  id BIGSERIAL PRIMARY KEY,
+  slug TEXT NOT NULL UNIQUE,
+  name TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO tenants (id, slug, name) VALUES (1, 'default', 'Default') ON CONFLICT (id) DO NOTHING;
+SELECT setval('tenants_id_seq', (SELECT max(id) FROM tenants));
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS tenant_id BIGINT NOT NULL DEFAULT 1 REFERENCES tenants(id);
+ALTER TABLE movies ALTER COLUMN tenant_id DROP DEFAULT;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_tenant_id_id_key ON movies (tenant_id, id);
+
+-- External IDs are unique per tenant: two customers may carry the same title.
+DROP INDEX IF EXISTS movies_imdb_id_key;
+DROP INDEX IF EXISTS movies_tmdb_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_imdb_id_key ON movies (tenant_id, imdb_id) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_tmdb_id_key ON movies (tenant_id, tmdb_id) WHERE deleted_at IS NULL;
+
+-- Translations reference their movie together with its tenant, so one
+-- can't be attached to another tenant's movie.
+ALTER TABLE movie_translations ADD COLUMN IF NOT EXISTS tenant_id BIGINT;
+UPDATE movie_translations t SET tenant_id = m.tenant_id FROM movies m WHERE m.id = t.movie_id AND t.tenant_id IS NULL;
+ALTER TABLE movie_translations ALTER COLUMN tenant_id SET NOT NULL;
+ALTER TABLE movie_translations DROP CONSTRAINT IF EXISTS movie_translations_movie_id_fkey;
+ALTER TABLE movie_translations ADD CONSTRAINT movie_translations_movie_id_fkey
+  FOREIGN KEY (tenant_id, movie_id) REFERENCES movies (tenant_id, id) ON DELETE CASCADE;
+
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS tenant_id BIGINT NOT NULL DEFAULT 1 REFERENCES tenants(id);
+ALTER TABLE webhooks ALTER COLUMN tenant_id DROP DEFAULT;
+ALTER TABLE webhooks DROP CONSTRAINT IF EXISTS webhooks_url_key;
+CREATE UNIQUE INDEX IF NOT EXISTS webhooks_tenant_url_key ON webhooks (tenant_id, url);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id BIGINT NOT NULL DEFAULT 1 REFERENCES tenants(id);
+ALTER TABLE users ALTER COLUMN tenant_id DROP DEFAULT;
+CREATE INDEX IF NOT EXISTS users_tenant_id_idx ON users (tenant_id);
+
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS tenant_id BIGINT NOT NULL DEFAULT 1 REFERENCES tenants(id);
+ALTER TABLE audit_log ALTER COLUMN tenant_id DROP DEFAULT;
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON audit_log (tenant_id, id);
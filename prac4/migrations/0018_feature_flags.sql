@@ -0,0 +1,16 @@
+-- Feature flags set at runtime. A row overrides the FEATURE_FLAGS default
+-- of the same name. The API caches the table, so its changes are announced
+-- like those to the reference data.
+CREATE TABLE IF NOT EXISTS feature_flags (
+  id BIGSERIAL PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  description TEXT NOT NULL DEFAULT '',
+  enabled BOOLEAN NOT NULL DEFAULT false,
+  percentage INT NOT NULL DEFAULT 0 CHECK (percentage BETWEEN 0 AND 100),
+  tenants BIGINT[] NOT NULL DEFAULT '{}',
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+DROP TRIGGER IF EXISTS feature_flags_notify ON feature_flags;
+CREATE TRIGGER feature_flags_notify AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON feature_flags
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_reference_change();
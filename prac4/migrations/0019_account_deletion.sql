@@ -0,0 +1,8 @@
+-- DELETE /me deactivates the account and sets deletion_requested_at; once
+-- the grace period is over the eraser strips the personal data and sets
+-- erased_at. The row itself stays so references to the user keep working.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_requested_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS erased_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS users_deletion_idx ON users (deletion_requested_at)
+  WHERE deletion_requested_at IS NOT NULL AND erased_at IS NULL;
@@ -0,0 +1,23 @@
+-- Free-form tags users attach to movies, next to the curated genres. Names
+-- are stored normalized (lower case, single spaces), so "Cult  Classic" and
+-- "cult classic" are one tag. A tag belongs to one tenant, and movie_tags
+-- references both sides together with it.
+CREATE TABLE IF NOT EXISTS tags (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL REFERENCES tenants(id),
+  name TEXT NOT NULL CHECK (name <> '' AND name = lower(name)),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  UNIQUE (tenant_id, name)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS tags_tenant_id_id_key ON tags (tenant_id, id);
+
+CREATE TABLE IF NOT EXISTS movie_tags (
+  tenant_id BIGINT NOT NULL,
+  movie_id INTEGER NOT NULL,
+  tag_id BIGINT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (movie_id, tag_id),
+  FOREIGN KEY (tenant_id, movie_id) REFERENCES movies (tenant_id, id) ON DELETE CASCADE,
+  FOREIGN KEY (tenant_id, tag_id) REFERENCES tags (tenant_id, id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS movie_tags_tag_idx ON movie_tags (tag_id);
@@ -0,0 +1,7 @@
+-- Extensible attributes (distributor, original language, awards, ...) that
+-- don't deserve a column each. Always an object, so containment filters
+-- work without NULL checks; jsonb_path_ops keeps the index small and serves
+-- @>, the only operator the API uses on it.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'
+  CHECK (jsonb_typeof(metadata) = 'object');
+CREATE INDEX IF NOT EXISTS movies_metadata_idx ON movies USING GIN (metadata jsonb_path_ops);
@@ -0,0 +1,3 @@
+-- A translation may carry the title used in its market. NULL means the
+-- original title is used there too.
+ALTER TABLE movie_translations ADD COLUMN IF NOT EXISTS title TEXT;
@@ -0,0 +1,21 @@
+-- UUIDv7 public ids for movies and users, next to the serial ids that stay
+-- the primary and foreign keys. Version 7 UUIDs start with the creation time
+-- in milliseconds, so they index well, and end in random bits, so they
+-- can't be guessed. Postgres 18 has uuidv7(); this is the same layout for
+-- the versions before it.
+CREATE OR REPLACE FUNCTION uuid_v7() RETURNS uuid AS $$
+  SELECT encode(
+    set_bit(set_bit(
+      overlay(uuid_send(gen_random_uuid())
+        placing substring(int8send(floor(extract(epoch FROM clock_timestamp()) * 1000)::bigint) FROM 3)
+        FROM 1 FOR 6),
+      52, 1), 53, 1),
+    'hex')::uuid
+$$ LANGUAGE sql VOLATILE;
+
+-- The volatile default gives every existing row its own UUID.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS uuid UUID NOT NULL DEFAULT uuid_v7();
+CREATE UNIQUE INDEX IF NOT EXISTS movies_uuid_key ON movies (uuid);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS uuid UUID NOT NULL DEFAULT uuid_v7();
+CREATE UNIQUE INDEX IF NOT EXISTS users_uuid_key ON users (uuid);
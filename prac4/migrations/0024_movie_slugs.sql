@@ -0,0 +1,44 @@
+-- Human-friendly movie URLs. A movie gets its slug when it is created,
+-- from its title, and keeps it when the title changes so links stay valid.
+-- Slugs are unique per tenant, deleted movies included, so an old URL never
+-- leads to a different movie; clashes get -2, -3, ... The trigger covers
+-- every way movies are inserted, COPY included.
+CREATE OR REPLACE FUNCTION movie_slug_base(title TEXT) RETURNS TEXT AS $$
+  SELECT coalesce(nullif(left(trim(BOTH '-' FROM regexp_replace(
+    translate(lower(title), 'àáâãäåāçćčďèéêëēěìíîïīłñńňòóôõöøōřśšťùúûüūůýÿžźż', 'aaaaaaacccdeeeeeeiiiiilnnnooooooorsstuuuuuuyyzzz'),
+    '[^a-z0-9]+', '-', 'g')), 80), ''), 'movie')
+$$ LANGUAGE sql IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION movies_set_slug() RETURNS trigger AS $$
+DECLARE
+  base TEXT := movie_slug_base(NEW.title);
+  n INTEGER := 1;
+BEGIN
+  IF NEW.slug IS NOT NULL THEN
+    RETURN NEW;
+  END IF;
+  NEW.slug := base;
+  WHILE EXISTS (SELECT 1 FROM movies WHERE tenant_id = NEW.tenant_id AND slug = NEW.slug) LOOP
+    n := n + 1;
+    NEW.slug := base || '-' || n;
+  END LOOP;
+  RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS slug TEXT;
+
+-- Existing movies, oldest first so they get the unsuffixed slugs.
+UPDATE movies m SET slug = s.slug
+FROM (
+  SELECT id, movie_slug_base(title) || CASE WHEN k > 1 THEN '-' || k ELSE '' END AS slug
+  FROM (SELECT id, title, row_number() OVER (PARTITION BY tenant_id, movie_slug_base(title) ORDER BY id) AS k FROM movies) n
+) s
+WHERE s.id = m.id AND m.slug IS NULL;
+
+ALTER TABLE movies ALTER COLUMN slug SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_slug_key ON movies (tenant_id, slug);
+
+DROP TRIGGER IF EXISTS movies_set_slug ON movies;
+CREATE TRIGGER movies_set_slug BEFORE INSERT ON movies
+  FOR EACH ROW EXECUTE FUNCTION movies_set_slug();
@@ -0,0 +1,21 @@
+-- Comments on movies, threaded through parent_id. New comments wait in
+-- pending until a moderator approves or rejects them; only approved ones
+-- are shown. They belong to the movie's tenant and go with the movie.
+CREATE TABLE IF NOT EXISTS comments (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  movie_id INTEGER NOT NULL,
+  parent_id BIGINT REFERENCES comments(id) ON DELETE CASCADE,
+  user_id BIGINT NOT NULL REFERENCES users(id),
+  body TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+  moderation_note TEXT NOT NULL DEFAULT '',
+  moderated_by BIGINT REFERENCES users(id),
+  moderated_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  FOREIGN KEY (tenant_id, movie_id) REFERENCES movies (tenant_id, id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS comments_movie_idx ON comments (movie_id, id) WHERE status = 'approved';
+CREATE INDEX IF NOT EXISTS comments_queue_idx ON comments (tenant_id, id) WHERE status = 'pending';
+-- Rate limits count a user's recent comments.
+CREATE INDEX IF NOT EXISTS comments_user_idx ON comments (user_id, created_at);
@@ -0,0 +1,22 @@
+-- Per-user inbox. Notifications belong to the recipient, who lives in
+-- public, so they stay there in schema-per-tenant mode too. Emails for them
+-- are queued through email_status and delivered in the background.
+CREATE TABLE IF NOT EXISTS notifications (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  kind TEXT NOT NULL,
+  subject_type TEXT NOT NULL,
+  subject_id BIGINT NOT NULL,
+  actor_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+  message TEXT NOT NULL,
+  read_at TIMESTAMPTZ,
+  email_status TEXT NOT NULL DEFAULT 'none' CHECK (email_status IN ('none', 'pending', 'sent', 'failed')),
+  email_attempts INTEGER NOT NULL DEFAULT 0,
+  email_error TEXT NOT NULL DEFAULT '',
+  next_email_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, id);
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
+CREATE INDEX IF NOT EXISTS notifications_email_idx ON notifications (next_email_at) WHERE email_status = 'pending';
@@ -0,0 +1,32 @@
+-- Outgoing email queue, for every kind of email. Rows hold the template
+-- and its data; the background sender renders and delivers them, retrying
+-- with backoff. Notification emails move here from their own columns.
+CREATE TABLE IF NOT EXISTS email_outbox (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+  to_address TEXT NOT NULL,
+  template TEXT NOT NULL,
+  data JSONB NOT NULL DEFAULT '{}',
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'failed')),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT NOT NULL DEFAULT '',
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  sent_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS email_outbox_due_idx ON email_outbox (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS email_outbox_tenant_idx ON email_outbox (tenant_id, status);
+
+INSERT INTO email_outbox (tenant_id, user_id, to_address, template, data, attempts, last_error, next_attempt_at)
+SELECT n.tenant_id, n.user_id, u.email, 'notification', jsonb_build_object('Name', u.name, 'Message', n.message),
+  n.email_attempts, n.email_error, n.next_email_at
+FROM notifications n JOIN users u ON u.id = n.user_id
+WHERE n.email_status = 'pending' AND u.active AND u.erased_at IS NULL;
+
+DROP INDEX IF EXISTS notifications_email_idx;
+ALTER TABLE notifications
+  DROP COLUMN IF EXISTS email_status,
+  DROP COLUMN IF EXISTS email_attempts,
+  DROP COLUMN IF EXISTS email_error,
+  DROP COLUMN IF EXISTS next_email_at;
@@ -0,0 +1,7 @@
+-- Weekly digest: the genres a user wants it narrowed to, when they last got
+-- one, and the token of their unsubscribe link.
+ALTER TABLE user_preferences
+  ADD COLUMN IF NOT EXISTS favorite_genres TEXT[] NOT NULL DEFAULT '{}',
+  ADD COLUMN IF NOT EXISTS last_digest_at TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS unsubscribe_token TEXT UNIQUE;
+CREATE INDEX IF NOT EXISTS user_preferences_digest_idx ON user_preferences (last_digest_at) WHERE weekly_digest;
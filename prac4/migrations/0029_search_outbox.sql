@@ -0,0 +1,14 @@
+-- Movies waiting to be mirrored into the external search index. Every
+-- audited change to a movie, its tags or translations adds a row in the
+-- same transaction; the indexer syncs the movie's current state and
+-- removes the row. It serves all tenants, so it stays in public.
+CREATE TABLE IF NOT EXISTS search_outbox (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  movie_id BIGINT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT NOT NULL DEFAULT '',
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS search_outbox_due_idx ON search_outbox (next_attempt_at);
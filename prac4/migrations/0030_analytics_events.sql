@@ -0,0 +1,17 @@
+-- Client-side analytics events from POST /events. Append-only: rows are
+-- never updated, and sample_rate records the EVENT_SAMPLE_RATE they were
+-- kept at, so counts can be scaled back up (sum(1 / sample_rate)). Like the
+-- usage tables it serves all tenants, so it stays in public.
+CREATE TABLE IF NOT EXISTS analytics_events (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  user_id BIGINT,
+  type TEXT NOT NULL,
+  movie_id BIGINT,
+  properties JSONB NOT NULL DEFAULT '{}',
+  sample_rate DOUBLE PRECISION NOT NULL DEFAULT 1,
+  occurred_at TIMESTAMPTZ NOT NULL,
+  received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS analytics_events_type_idx ON analytics_events (tenant_id, type, occurred_at);
+CREATE INDEX IF NOT EXISTS analytics_events_movie_idx ON analytics_events (tenant_id, movie_id, occurred_at) WHERE movie_id IS NOT NULL;
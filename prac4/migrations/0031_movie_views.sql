@@ -0,0 +1,15 @@
+-- View counts of movie detail pages. The API counts in memory and adds its
+-- counts here on every flush: to the movie's running total, and to a daily
+-- bucket that the trending sort sums over the last days. Buckets belong to
+-- the movie's tenant and go with the movie.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS views BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS movie_views (
+  tenant_id BIGINT NOT NULL,
+  movie_id INTEGER NOT NULL,
+  day DATE NOT NULL,
+  views BIGINT NOT NULL,
+  PRIMARY KEY (movie_id, day),
+  FOREIGN KEY (tenant_id, movie_id) REFERENCES movies (tenant_id, id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS movie_views_day_idx ON movie_views (tenant_id, day);
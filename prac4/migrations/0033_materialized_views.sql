@@ -0,0 +1,36 @@
+-- When each materialized view was last refreshed, per schema: public, and
+-- every tenant schema in schema-per-tenant mode, which has its own copies of
+-- the views. Responses built from a view report its age from here.
+CREATE TABLE IF NOT EXISTS matview_refreshes (
+  name TEXT NOT NULL,
+  schema_name TEXT NOT NULL,
+  refreshed_at TIMESTAMPTZ NOT NULL,
+  duration_ms INTEGER NOT NULL,
+  PRIMARY KEY (name, schema_name)
+);
+
+-- The aggregates of GET /stats/movies when no date range is asked for, one
+-- row per tenant, dimension and key. Totals are keyed by their field name.
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_stats AS
+SELECT tenant_id, 'total' AS dimension, 'movies' AS key, count(*)::float8 AS value
+  FROM movies WHERE deleted_at IS NULL GROUP BY tenant_id
+UNION ALL
+SELECT tenant_id, 'total', 'with_year', count(year)::float8
+  FROM movies WHERE deleted_at IS NULL GROUP BY tenant_id
+UNION ALL
+SELECT tenant_id, 'total', 'with_rating', count(rating)::float8
+  FROM movies WHERE deleted_at IS NULL GROUP BY tenant_id
+UNION ALL
+SELECT tenant_id, 'total', 'average_rating', avg(rating)::float8
+  FROM movies WHERE deleted_at IS NULL GROUP BY tenant_id
+UNION ALL
+SELECT tenant_id, 'year', year::text, count(*)::float8
+  FROM movies WHERE deleted_at IS NULL AND year IS NOT NULL GROUP BY tenant_id, year
+UNION ALL
+SELECT tenant_id, 'genre', g, count(*)::float8
+  FROM movies, unnest(genres) AS g WHERE deleted_at IS NULL GROUP BY tenant_id, g
+UNION ALL
+SELECT tenant_id, 'rating', LEAST(floor(rating), 9)::int::text, count(*)::float8
+  FROM movies WHERE deleted_at IS NULL AND rating IS NOT NULL GROUP BY tenant_id, LEAST(floor(rating), 9)::int;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movie_stats_key_idx ON movie_stats (tenant_id, dimension, key);
@@ -0,0 +1,122 @@
+-- The append-only log tables are partitioned by month, so retention can drop
+-- a whole month at once instead of deleting it row by row, and queries on
+-- recent rows only touch recent partitions. Partitions are named
+-- <table>_YYYY_MM and cover calendar months in UTC; the API creates upcoming
+-- ones ahead of time (see partitions.go).
+
+-- create_month_partition adds the partition of parent for the month of day,
+-- unless it exists. It reports whether it created one.
+CREATE OR REPLACE FUNCTION create_month_partition(parent regclass, day date) RETURNS boolean AS $$
+DECLARE
+  rel record;
+  start date := date_trunc('month', day)::date;
+BEGIN
+  SELECT c.relname, n.nspname INTO rel
+  FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.oid = parent;
+  IF to_regclass(format('%I.%I', rel.nspname, rel.relname || '_' || to_char(start, 'YYYY_MM'))) IS NOT NULL THEN
+    RETURN false;
+  END IF;
+  EXECUTE format('CREATE TABLE %I.%I PARTITION OF %I.%I FOR VALUES FROM (%L) TO (%L)',
+    rel.nspname, rel.relname || '_' || to_char(start, 'YYYY_MM'), rel.nspname, rel.relname,
+    to_char(start, 'YYYY-MM-DD') || ' 00:00:00+00',
+    to_char(start + interval '1 month', 'YYYY-MM-DD') || ' 00:00:00+00');
+  RETURN true;
+EXCEPTION WHEN duplicate_table THEN
+  -- Another instance created it meanwhile.
+  RETURN false;
+END
+$$ LANGUAGE plpgsql;
+
+-- drop_month_partitions drops the partitions of parent whose month ended
+-- before cutoff and returns how many went.
+CREATE OR REPLACE FUNCTION drop_month_partitions(parent regclass, cutoff timestamptz) RETURNS integer AS $$
+DECLARE
+  part record;
+  dropped integer := 0;
+BEGIN
+  FOR part IN
+    SELECT c.relname, n.nspname FROM pg_inherits i
+    JOIN pg_class c ON c.oid = i.inhrelid JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE i.inhparent = parent AND c.relname ~ '_\d{4}_\d{2}$'
+      AND (to_date(right(c.relname, 7), 'YYYY_MM') + interval '1 month') AT TIME ZONE 'UTC' <= cutoff
+  LOOP
+    EXECUTE format('DROP TABLE %I.%I', part.nspname, part.relname);
+    dropped := dropped + 1;
+  END LOOP;
+  RETURN dropped;
+END
+$$ LANGUAGE plpgsql;
+
+-- partition_by_month turns tbl into a table partitioned by month on col,
+-- with partitions from its oldest row through two months ahead, and moves
+-- its rows over. The primary key becomes (id, col), as a partitioned table's
+-- keys must include the partition column. Indexes and foreign keys are left
+-- to the caller. It is a no-op on a table that is already partitioned and
+-- reports whether it converted.
+CREATE OR REPLACE FUNCTION partition_by_month(tbl regclass, col text) RETURNS boolean AS $$
+DECLARE
+  rel record;
+  legacy text;
+  pkey text;
+  seq text;
+  oldest timestamptz;
+  m date;
+BEGIN
+  SELECT c.relname, c.relkind, n.nspname INTO rel
+  FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.oid = tbl;
+  IF rel.relkind = 'p' THEN
+    RETURN false;
+  END IF;
+  legacy := rel.relname || '_unpartitioned';
+  seq := pg_get_serial_sequence(format('%I.%I', rel.nspname, rel.relname), 'id');
+  SELECT conname INTO pkey FROM pg_constraint WHERE conrelid = tbl AND contype = 'p';
+
+  EXECUTE format('ALTER TABLE %I.%I RENAME TO %I', rel.nspname, rel.relname, legacy);
+  IF pkey IS NOT NULL THEN
+    EXECUTE format('ALTER TABLE %I.%I RENAME CONSTRAINT %I TO %I', rel.nspname, legacy, pkey, legacy || '_pkey');
+  END IF;
+  EXECUTE format('CREATE TABLE %I.%I (LIKE %I.%I INCLUDING DEFAULTS INCLUDING CONSTRAINTS, '
+    'CONSTRAINT %I PRIMARY KEY (id, %I)) PARTITION BY RANGE (%I)',
+    rel.nspname, rel.relname, rel.nspname, legacy, rel.relname || '_pkey', col, col);
+  -- Keep the id sequence when the old table goes.
+  IF seq IS NOT NULL THEN
+    EXECUTE format('ALTER SEQUENCE %s OWNED BY %I.%I.id', seq, rel.nspname, rel.relname);
+  END IF;
+
+  EXECUTE format('SELECT min(%I) FROM %I.%I', col, rel.nspname, legacy) INTO oldest;
+  m := date_trunc('month', coalesce(oldest, now()) AT TIME ZONE 'UTC')::date;
+  WHILE m <= date_trunc('month', now() AT TIME ZONE 'UTC') + interval '2 months' LOOP
+    PERFORM create_month_partition(format('%I.%I', rel.nspname, rel.relname)::regclass, m);
+    m := m + interval '1 month';
+  END LOOP;
+
+  EXECUTE format('INSERT INTO %I.%I SELECT * FROM %I.%I', rel.nspname, rel.relname, rel.nspname, legacy);
+  EXECUTE format('DROP TABLE %I.%I', rel.nspname, legacy);
+  RETURN true;
+END
+$$ LANGUAGE plpgsql;
+
+-- This rewrites each table once. Analytics events go by received_at, the
+-- server's clock, as occurred_at comes from clients.
+DO $$
+BEGIN
+  IF partition_by_month('audit_log', 'created_at') THEN
+    ALTER TABLE audit_log ADD CONSTRAINT audit_log_tenant_id_fkey FOREIGN KEY (tenant_id) REFERENCES tenants(id);
+  END IF;
+  IF partition_by_month('auth_events', 'created_at') THEN
+    ALTER TABLE auth_events ADD CONSTRAINT auth_events_user_id_fkey
+      FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+  END IF;
+  PERFORM partition_by_month('analytics_events', 'received_at');
+END
+$$;
+
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity, entity_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON audit_log (tenant_id, id);
+
+CREATE INDEX IF NOT EXISTS auth_events_user_idx ON auth_events (user_id, id);
+CREATE INDEX IF NOT EXISTS auth_events_type_idx ON auth_events (type, id);
+
+CREATE INDEX IF NOT EXISTS analytics_events_type_idx ON analytics_events (tenant_id, type, occurred_at);
+CREATE INDEX IF NOT EXISTS analytics_events_movie_idx ON analytics_events (tenant_id, movie_id, occurred_at) WHERE movie_id IS NOT NULL;
@@ -0,0 +1,17 @@
+-- Runs of the archiver, which copies expired soft-deleted movies and audit
+-- partitions to cold storage before purging them. A run covers every
+-- tenant, so the table stays in public. At most one runs at a time.
+CREATE TABLE IF NOT EXISTS archive_runs (
+  id BIGSERIAL PRIMARY KEY,
+  trigger TEXT NOT NULL CHECK (trigger IN ('schedule', 'manual')),
+  status TEXT NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed')),
+  movies BIGINT NOT NULL DEFAULT 0,
+  audit_rows BIGINT NOT NULL DEFAULT 0,
+  objects JSONB NOT NULL DEFAULT '[]',
+  error TEXT NOT NULL DEFAULT '',
+  started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  finished_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS archive_runs_running_key ON archive_runs ((true)) WHERE status = 'running';
+CREATE INDEX IF NOT EXISTS archive_runs_started_idx ON archive_runs (started_at DESC);
@@ -0,0 +1,21 @@
+-- Exceptions to the default rate limits for one user or one personal access
+-- token, such as a partner integration. A NULL limit keeps the default and 0
+-- lifts it; exempt lifts all of them. The API caches the table, so its
+-- changes are announced like those to the reference data.
+CREATE TABLE IF NOT EXISTS rate_limit_overrides (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+  token_id BIGINT UNIQUE REFERENCES tokens(id) ON DELETE CASCADE,
+  exempt BOOLEAN NOT NULL DEFAULT false,
+  monthly_requests BIGINT CHECK (monthly_requests >= 0),
+  monthly_bytes BIGINT CHECK (monthly_bytes >= 0),
+  comment_limit INT CHECK (comment_limit >= 0),
+  note TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  CHECK ((user_id IS NULL) <> (token_id IS NULL))
+);
+
+DROP TRIGGER IF EXISTS rate_limit_overrides_notify ON rate_limit_overrides;
+CREATE TRIGGER rate_limit_overrides_notify AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON rate_limit_overrides
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_reference_change();
@@ -0,0 +1,14 @@
+-- Titles are stored in one form now (see cleanTitle): NFC, without control
+-- characters, with single spaces. Bring the existing ones in line so they
+-- compare, sort and search like new ones. Titles that would end up empty
+-- are left alone.
+CREATE OR REPLACE FUNCTION clean_title(t TEXT) RETURNS TEXT AS $$
+  SELECT btrim(regexp_replace(
+    regexp_replace(
+      regexp_replace(normalize(t, NFC), '[\t\n\u000b\f\r\u0085]', ' ', 'g'),
+      '[\u0001-\u0008\u000e-\u001f\u007f-\u0084\u0086-\u009f]', '', 'g'),
+    '[\s\u00a0\u1680\u2000-\u200a\u2028\u2029\u202f\u205f\u3000]+', ' ', 'g'))
+$$ LANGUAGE sql IMMUTABLE;
+
+UPDATE movies SET title = clean_title(title) WHERE title <> clean_title(title) AND clean_title(title) <> '';
+UPDATE movie_translations SET title = clean_title(title) WHERE title <> clean_title(title) AND clean_title(title) <> '';
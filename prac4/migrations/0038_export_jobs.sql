@@ -0,0 +1,27 @@
+-- Exports run in the background for catalogs too large to download in one
+-- request. The finished file lives in EXPORT_DIR until expires_at, and is
+-- fetched with a URL signed with download_key. A running job's worker
+-- touches heartbeat_at while it works; once that stops the job is queued
+-- again.
+CREATE TABLE IF NOT EXISTS export_jobs (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL REFERENCES tenants(id),
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  format TEXT NOT NULL CHECK (format IN ('json', 'ndjson', 'parquet')),
+  filters JSONB NOT NULL DEFAULT '{}',
+  string_ids BOOLEAN NOT NULL DEFAULT false,
+  status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'succeeded', 'failed')),
+  movies BIGINT NOT NULL DEFAULT 0,
+  bytes BIGINT NOT NULL DEFAULT 0,
+  error TEXT NOT NULL DEFAULT '',
+  download_key BYTEA NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  started_at TIMESTAMPTZ,
+  heartbeat_at TIMESTAMPTZ,
+  finished_at TIMESTAMPTZ,
+  expires_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS export_jobs_queued_idx ON export_jobs (id) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS export_jobs_user_idx ON export_jobs (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS export_jobs_expires_idx ON export_jobs (expires_at);
@@ -0,0 +1,29 @@
+-- Imports can run in the background too: POST /imports stores the upload in
+-- IMPORT_DIR and a worker loads it, skipping invalid rows. The counts are
+-- updated as it goes; the rows it skipped are listed in a report file next to
+-- the upload until expires_at. Like export jobs, a running job whose
+-- heartbeat_at stops moving is queued again.
+CREATE TABLE IF NOT EXISTS import_jobs (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL REFERENCES tenants(id),
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  request_id TEXT NOT NULL DEFAULT '',
+  format TEXT NOT NULL CHECK (format IN ('json', 'ndjson')),
+  bytes BIGINT NOT NULL DEFAULT 0,
+  status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'succeeded', 'failed')),
+  processed BIGINT NOT NULL DEFAULT 0,
+  imported BIGINT NOT NULL DEFAULT 0,
+  skipped_duplicates BIGINT NOT NULL DEFAULT 0,
+  failed BIGINT NOT NULL DEFAULT 0,
+  errors JSONB NOT NULL DEFAULT '[]',
+  error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  started_at TIMESTAMPTZ,
+  heartbeat_at TIMESTAMPTZ,
+  finished_at TIMESTAMPTZ,
+  expires_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS import_jobs_queued_idx ON import_jobs (id) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS import_jobs_user_idx ON import_jobs (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS import_jobs_expires_idx ON import_jobs (expires_at);
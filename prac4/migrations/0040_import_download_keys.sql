@@ -0,0 +1,7 @@
+-- Import error reports are fetched with signed URLs like export files, so
+-- they can be handed on without the owner's credentials. Jobs from before
+-- get a random key of their own.
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS download_key BYTEA;
+UPDATE import_jobs SET download_key = uuid_send(gen_random_uuid()) || uuid_send(gen_random_uuid())
+WHERE download_key IS NULL;
+ALTER TABLE import_jobs ALTER COLUMN download_key SET NOT NULL;
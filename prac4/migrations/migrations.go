@@ -0,0 +1,18 @@
+// Package migrations embeds the SQL schema migrations so the API binary can
+// apply them at startup. Files are applied in lexical order; never edit a
+// file once it has shipped, add a new one instead.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
+
+// TenantFS holds the migrations applied to every tenant schema when tenants
+// are isolated by schema. A change to a tenant-owned table needs a file in
+// both sets. Tenant schemas start as copies of the public tables, so write
+// tenant migrations to be no-ops on a table that already has the change
+// (ADD COLUMN IF NOT EXISTS and the like).
+//
+//go:embed tenant/*.sql
+var TenantFS embed.FS
@@ -0,0 +1,13 @@
+-- The tables a tenant owns, in its own schema. They copy the shared tables
+-- in public as they are when the schema is created (columns, defaults,
+-- checks and indexes; ids come from the same sequences, so they stay unique
+-- across tenants). public keeps the default tenant's rows.
+CREATE TABLE IF NOT EXISTS movies (LIKE public.movies INCLUDING ALL);
+
+CREATE TABLE IF NOT EXISTS movie_translations (LIKE public.movie_translations INCLUDING ALL);
+ALTER TABLE movie_translations ADD CONSTRAINT movie_translations_movie_id_fkey
+  FOREIGN KEY (tenant_id, movie_id) REFERENCES movies (tenant_id, id) ON DELETE CASCADE;
+
+CREATE TABLE IF NOT EXISTS webhooks (LIKE public.webhooks INCLUDING ALL);
+
+CREATE TABLE IF NOT EXISTS audit_log (LIKE public.audit_log INCLUDING ALL);
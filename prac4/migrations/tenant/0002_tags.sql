@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS tags (LIKE public.tags INCLUDING ALL);
+
+CREATE TABLE IF NOT EXISTS movie_tags (LIKE public.movie_tags INCLUDING ALL);
+ALTER TABLE movie_tags ADD CONSTRAINT movie_tags_tenant_id_movie_id_fkey
+  FOREIGN KEY (tenant_id, movie_id) REFERENCES movies (tenant_id, id) ON DELETE CASCADE;
+ALTER TABLE movie_tags ADD CONSTRAINT movie_tags_tenant_id_tag_id_fkey
+  FOREIGN KEY (tenant_id, tag_id) REFERENCES tags (tenant_id, id) ON DELETE CASCADE;
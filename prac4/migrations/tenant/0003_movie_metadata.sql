@@ -0,0 +1,3 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'
+  CHECK (jsonb_typeof(metadata) = 'object');
+CREATE INDEX IF NOT EXISTS movies_metadata_idx ON movies USING GIN (metadata jsonb_path_ops);
@@ -0,0 +1 @@
+ALTER TABLE movie_translations ADD COLUMN IF NOT EXISTS title TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS uuid UUID NOT NULL DEFAULT public.uuid_v7();
+CREATE UNIQUE INDEX IF NOT EXISTS movies_uuid_key ON movies (uuid);
@@ -0,0 +1,16 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS slug TEXT;
+
+UPDATE movies m SET slug = s.slug
+FROM (
+  SELECT id, movie_slug_base(title) || CASE WHEN k > 1 THEN '-' || k ELSE '' END AS slug
+  FROM (SELECT id, title, row_number() OVER (PARTITION BY tenant_id, movie_slug_base(title) ORDER BY id) AS k FROM movies) n
+) s
+WHERE s.id = m.id AND m.slug IS NULL;
+
+ALTER TABLE movies ALTER COLUMN slug SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_slug_key ON movies (tenant_id, slug);
+
+-- LIKE doesn't copy triggers.
+DROP TRIGGER IF EXISTS movies_set_slug ON movies;
+CREATE TRIGGER movies_set_slug BEFORE INSERT ON movies
+  FOR EACH ROW EXECUTE FUNCTION movies_set_slug();
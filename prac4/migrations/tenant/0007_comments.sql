@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS comments (LIKE public.comments INCLUDING ALL);
+ALTER TABLE comments ADD CONSTRAINT comments_parent_id_fkey
+  FOREIGN KEY (parent_id) REFERENCES comments (id) ON DELETE CASCADE;
+ALTER TABLE comments ADD CONSTRAINT comments_user_id_fkey
+  FOREIGN KEY (user_id) REFERENCES public.users (id);
+ALTER TABLE comments ADD CONSTRAINT comments_moderated_by_fkey
+  FOREIGN KEY (moderated_by) REFERENCES public.users (id);
+ALTER TABLE comments ADD CONSTRAINT comments_tenant_id_movie_id_fkey
+  FOREIGN KEY (tenant_id, movie_id) REFERENCES movies (tenant_id, id) ON DELETE CASCADE;
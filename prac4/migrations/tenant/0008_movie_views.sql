@@ -0,0 +1,4 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS views BIGINT NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS movie_views (LIKE public.movie_views INCLUDING ALL);
+ALTER TABLE movie_views ADD CONSTRAINT movie_views_tenant_id_movie_id_fkey
+  FOREIGN KEY (tenant_id, movie_id) REFERENCES movies (tenant_id, id) ON DELETE CASCADE;
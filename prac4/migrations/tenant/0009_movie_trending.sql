@@ -0,0 +1,15 @@
+-- Same as the public view, over the tenant's tables.
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_trending AS
+SELECT e.movie_id, sum(e.score)::float8 AS score, now() AS computed_at
+FROM (
+  SELECT movie_id, views * power(0.5, (current_date - day) / 3.0) AS score
+  FROM movie_views WHERE day > current_date - 30
+  UNION ALL
+  SELECT movie_id, 5 * power(0.5, extract(epoch FROM now() - created_at) / 259200)
+  FROM comments WHERE status = 'approved' AND created_at > now() - interval '30 days'
+) e
+JOIN movies m ON m.id = e.movie_id AND m.deleted_at IS NULL
+GROUP BY e.movie_id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movie_trending_movie_idx ON movie_trending (movie_id);
+CREATE INDEX IF NOT EXISTS movie_trending_score_idx ON movie_trending (score DESC);
@@ -0,0 +1,24 @@
+-- Same as the public view, over the tenant's tables.
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_stats AS
+SELECT tenant_id, 'total' AS dimension, 'movies' AS key, count(*)::float8 AS value
+  FROM movies WHERE deleted_at IS NULL GROUP BY tenant_id
+UNION ALL
+SELECT tenant_id, 'total', 'with_year', count(year)::float8
+  FROM movies WHERE deleted_at IS NULL GROUP BY tenant_id
+UNION ALL
+SELECT tenant_id, 'total', 'with_rating', count(rating)::float8
+  FROM movies WHERE deleted_at IS NULL GROUP BY tenant_id
+UNION ALL
+SELECT tenant_id, 'total', 'average_rating', avg(rating)::float8
+  FROM movies WHERE deleted_at IS NULL GROUP BY tenant_id
+UNION ALL
+SELECT tenant_id, 'year', year::text, count(*)::float8
+  FROM movies WHERE deleted_at IS NULL AND year IS NOT NULL GROUP BY tenant_id, year
+UNION ALL
+SELECT tenant_id, 'genre', g, count(*)::float8
+  FROM movies, unnest(genres) AS g WHERE deleted_at IS NULL GROUP BY tenant_id, g
+UNION ALL
+SELECT tenant_id, 'rating', LEAST(floor(rating), 9)::int::text, count(*)::float8
+  FROM movies WHERE deleted_at IS NULL AND rating IS NOT NULL GROUP BY tenant_id, LEAST(floor(rating), 9)::int;
+
+CREATE UNIQUE INDEX IF NOT EXISTS movie_stats_key_idx ON movie_stats (tenant_id, dimension, key);
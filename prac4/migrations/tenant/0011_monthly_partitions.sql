@@ -0,0 +1,7 @@
+-- The tenant's audit log is partitioned by month like the public one; see
+-- migration 0034 for the functions.
+SELECT partition_by_month('audit_log', 'created_at');
+
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity, entity_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_tenant_idx ON audit_log (tenant_id, id);
@@ -0,0 +1,3 @@
+-- Clean up the tenant's titles like migration 0037 does the shared ones.
+UPDATE movies SET title = clean_title(title) WHERE title <> clean_title(title) AND clean_title(title) <> '';
+UPDATE movie_translations SET title = clean_title(title) WHERE title <> clean_title(title) AND clean_title(title) <> '';
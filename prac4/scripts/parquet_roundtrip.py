@@ -0,0 +1,170 @@
+#!/usr/bin/env python3
+"""Round-trip check of the Parquet movie export against a reference reader.
+
+The API writes Parquet by hand (cmd/api/parquet.go), so this reads an export
+back with pyarrow and compares it, movie by movie, with the NDJSON export of
+the same catalog. It insists on the cases a hand-written writer gets wrong:
+null values in every optional column, empty genre lists and more than one
+row group. Run it after changing parquet.go, against a scratch database:
+
+    pip install pyarrow
+    docker compose up -d
+    TOKEN=... scripts/parquet_roundtrip.py --seed 10001
+
+--seed imports that many movies covering those cases first (it needs a token
+allowed to import); without it the catalog must already cover them. Exits 1
+with the differences found, 0 when the export reads back the same.
+"""
+
+import argparse
+import io
+import json
+import math
+import os
+import random
+import sys
+import urllib.request
+
+import pyarrow as pa
+import pyarrow.parquet as pq
+
+# parquetRowGroupRows in cmd/api/parquet.go.
+ROW_GROUP_ROWS = 10000
+
+COLUMNS = [
+    "id", "uuid", "slug", "title", "year", "rating", "genres", "certification",
+    "imdb_id", "tmdb_id", "metadata", "views", "created_at", "updated_at",
+]
+# Optional columns that can hold nulls; metadata is optional too, but the
+# database never leaves it null.
+OPTIONAL = ["year", "rating", "certification", "imdb_id", "tmdb_id"]
+
+
+def request(args, path, body=None, content_type=None):
+    req = urllib.request.Request(args.url.rstrip("/") + path, data=body)
+    if args.token:
+        req.add_header("Authorization", "Bearer " + args.token)
+    if args.tenant:
+        req.add_header("X-Tenant-ID", args.tenant)
+    if content_type:
+        req.add_header("Content-Type", content_type)
+    with urllib.request.urlopen(req) as resp:
+        return resp.read()
+
+
+def seed_movies(n):
+    """Movies that cycle through every null, an empty and a long genre list."""
+    run = random.randrange(10**6)
+    for i in range(n):
+        m = {"title": "parquet check %d-%d" % (run, i), "genres": []}
+        if i % 3 == 1:
+            m.update(year=1990 + i % 30, rating=round(i % 100 / 10, 1),
+                     genres=["Crime", "Drama", "Thriller"][: 1 + i // 3 % 3],
+                     certification="R", metadata={"awards": [], "cut": "director's"},
+                     external_ids={"imdb_id": "tt%06d%07d" % (run, i), "tmdb_id": 9 * 10**12 + run * 10**6 + i})
+        elif i % 3 == 2:
+            m.update(year=2001, genres=["Drama"], external_ids={"tmdb_id": 8 * 10**12 + run * 10**6 + i})
+        yield m
+
+
+def micros(ts):
+    """RFC 3339 from the JSON export as Unix microseconds, as Go's UnixMicro."""
+    date, _, clock = ts.partition("T")
+    offset = 0
+    if clock.endswith("Z"):
+        clock = clock[:-1]
+    else:
+        sign = 1 if "+" in clock else -1
+        clock, _, tz = clock.replace("-", "+").partition("+")
+        h, m = tz.split(":")
+        offset = sign * (int(h) * 3600 + int(m) * 60)
+    whole, _, frac = clock.partition(".")
+    y, mo, d = (int(x) for x in date.split("-"))
+    hh, mm, ss = (int(x) for x in whole.split(":"))
+    # Days since the epoch, from the civil date (proleptic Gregorian).
+    y -= mo <= 2
+    era = y // 400
+    yoe = y - era * 400
+    doy = (153 * (mo + (-3 if mo > 2 else 9)) + 2) // 5 + d - 1
+    days = era * 146097 + yoe * 365 + yoe // 4 - yoe // 100 + doy - 719468
+    seconds = days * 86400 + hh * 3600 + mm * 60 + ss - offset
+    return seconds * 10**6 + int((frac + "000000")[:6])
+
+
+def expected(m):
+    ext = m.get("external_ids") or {}
+    return {
+        "id": m["id"], "uuid": m["uuid"], "slug": m["slug"], "title": m["title"],
+        "year": m.get("year"), "rating": m.get("rating"), "genres": m.get("genres") or [],
+        "certification": m.get("certification"), "imdb_id": ext.get("imdb_id"),
+        "tmdb_id": ext.get("tmdb_id"), "metadata": m.get("metadata"), "views": m["views"],
+        "created_at": micros(m["created_at"]), "updated_at": micros(m["updated_at"]),
+    }
+
+
+def main():
+    p = argparse.ArgumentParser(description=__doc__.split("\n")[0])
+    p.add_argument("--url", default="http://localhost:8080")
+    p.add_argument("--token", default=os.environ.get("TOKEN", ""))
+    p.add_argument("--tenant", default="", help="X-Tenant-ID to run in")
+    p.add_argument("--seed", type=int, default=0, metavar="N", help="import N edge-case movies first")
+    args = p.parse_args()
+
+    if args.seed:
+        body = "".join(json.dumps(m) + "\n" for m in seed_movies(args.seed)).encode()
+        print("seeded:", request(args, "/movies/import", body, "application/x-ndjson").decode().strip())
+
+    want = {}
+    for line in request(args, "/movies/export?format=ndjson").splitlines():
+        if line.strip():
+            m = json.loads(line)
+            want[m["id"]] = expected(m)
+
+    f = pq.ParquetFile(io.BytesIO(request(args, "/movies/export?format=parquet")))
+    table = f.read()
+    problems = []
+    if table.column_names != COLUMNS:
+        problems.append("columns %s, want %s" % (table.column_names, COLUMNS))
+    if table.num_rows != len(want):
+        problems.append("%d rows, the NDJSON export has %d" % (table.num_rows, len(want)))
+    groups = max(1, math.ceil(table.num_rows / ROW_GROUP_ROWS))
+    if f.metadata.num_row_groups != groups:
+        problems.append("%d row groups, want %d" % (f.metadata.num_row_groups, groups))
+
+    for name in ("created_at", "updated_at"):
+        i = table.column_names.index(name)
+        table = table.set_column(i, name, table.column(name).cast(pa.int64()))
+    nulls = dict.fromkeys(OPTIONAL, 0)
+    empty_lists = 0
+    for got in table.to_pylist():
+        if got["metadata"] is not None:
+            got["metadata"] = json.loads(got["metadata"])
+        for name in OPTIONAL:
+            nulls[name] += got[name] is None
+        empty_lists += got["genres"] == []
+        w = want.get(got["id"])
+        if w is None:
+            problems.append("movie %s is not in the NDJSON export" % got["id"])
+        elif got != w:
+            diff = {k: (got.get(k), w[k]) for k in w if got.get(k) != w[k]}
+            problems.append("movie %s differs (parquet, ndjson): %s" % (got["id"], diff))
+        if len(problems) > 20:
+            break
+
+    missing = [name for name, n in nulls.items() if n == 0]
+    if missing:
+        problems.append("no nulls in %s to check; use --seed" % ", ".join(missing))
+    if empty_lists == 0:
+        problems.append("no empty genre lists to check; use --seed")
+    if f.metadata.num_row_groups < 2:
+        problems.append("only one row group to check; use --seed %d" % (ROW_GROUP_ROWS + 1))
+
+    print("%d movies in %d row groups, %d empty genre lists, nulls: %s" % (
+        table.num_rows, f.metadata.num_row_groups, empty_lists, nulls))
+    for msg in problems:
+        print("FAIL:", msg)
+    sys.exit(1 if problems else 0)
+
+
+if __name__ == "__main__":
+    main()